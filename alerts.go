@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// For those without Alertmanager, the exporter can evaluate simple alerts itself,
+// configured by a YAML file given with -alerts:
+//
+//	- name: heater_high
+//	  plug: Heater        # MAC, alias or name from the devices file
+//	  power_above: 2000   # W
+//	  for: 5m
+//	- name: fridge_missing
+//	  plug: Fridge
+//	  unseen_for: 15m
+//
+// Alerts are shown on /alerts, and exported as alert_active.
+// They are based on the readings from scrapes (and -poll_interval and -remote_write),
+// so the exporter must be getting scraped for them to be useful.
+
+// alertInterval is how often alerts are evaluated.
+const alertInterval = 15 * time.Second
+
+var alertActiveDesc = prometheus.NewDesc("alert_active",
+	"Whether an alert from -alerts is firing",
+	[]string{"alert", "plug"}, nil)
+
+// alertRule is an alert. Exactly one of PowerAbove, PowerBelow and UnseenFor is set.
+type alertRule struct {
+	Name       string        `yaml:"name"`
+	Plug       string        `yaml:"plug"`
+	PowerAbove *float64      `yaml:"power_above"` // W
+	PowerBelow *float64      `yaml:"power_below"` // W
+	UnseenFor  time.Duration `yaml:"unseen_for"`
+	For        time.Duration `yaml:"for"` // how long the condition must hold for the alert to fire
+}
+
+func loadAlerts(path string) ([]alertRule, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []alertRule
+	if err := yaml.UnmarshalStrict(raw, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for _, r := range rules {
+		if r.Name == "" || r.Plug == "" {
+			return nil, fmt.Errorf("alert needs name and plug")
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate alert %q", r.Name)
+		}
+		names[r.Name] = true
+		n := 0
+		for _, set := range []bool{r.PowerAbove != nil, r.PowerBelow != nil, r.UnseenFor > 0} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return nil, fmt.Errorf("alert %q needs exactly one of power_above, power_below and unseen_for", r.Name)
+		}
+	}
+	return rules, nil
+}
+
+// alerter evaluates alerts, and implements prometheus.Collector.
+type alerter struct {
+	dc    *dataCollector
+	rules []alertRule
+	start time.Time
+
+	mu     sync.Mutex
+	states []alertState // parallel to rules
+}
+
+type alertState struct {
+	mac     tpplug.MAC // once the plug is known
+	pending time.Time  // when the condition started to hold; zero if it doesn't
+	firing  bool
+	value   float64 // power (W), or how long unseen (s)
+}
+
+func newAlerter(dc *dataCollector, rules []alertRule) *alerter {
+	return &alerter{
+		dc:     dc,
+		rules:  rules,
+		start:  time.Now(),
+		states: make([]alertState, len(rules)),
+	}
+}
+
+// run evaluates the alerts every interval, forever.
+func (al *alerter) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		al.eval(now)
+	}
+}
+
+func (al *alerter) eval(now time.Time) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	for i, r := range al.rules {
+		st := &al.states[i]
+		if st.mac == "" {
+			st.mac = al.dc.findMAC(r.Plug)
+		}
+		var cond bool
+		if r.UnseenFor > 0 {
+			seen := al.dc.lastSeen(st.mac)
+			if seen.IsZero() {
+				seen = al.start
+			}
+			cond = now.Sub(seen) >= r.UnseenFor
+			st.value = now.Sub(seen).Seconds()
+		} else if rd, ok := al.dc.latest(st.mac); ok && now.Sub(rd.Time) <= *history {
+			st.value = rd.Power / 1000
+			cond = r.PowerAbove != nil && st.value > *r.PowerAbove || r.PowerBelow != nil && st.value < *r.PowerBelow
+		}
+
+		if !cond {
+			if st.firing {
+				log.Printf("Alert %q resolved", r.Name)
+			}
+			st.pending, st.firing = time.Time{}, false
+			continue
+		}
+		if st.pending.IsZero() {
+			st.pending = now
+		}
+		if !st.firing && now.Sub(st.pending) >= r.For {
+			st.firing = true
+			log.Printf("Alert %q firing for %q (value %.1f)", r.Name, r.Plug, st.value)
+		}
+	}
+}
+
+func (al *alerter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- alertActiveDesc
+}
+
+func (al *alerter) Collect(ch chan<- prometheus.Metric) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	for i, r := range al.rules {
+		var v float64
+		if al.states[i].firing {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(alertActiveDesc, prometheus.GaugeValue, v, r.Name, r.Plug)
+	}
+}
+
+// ServeHTTP serves the state of every alert as JSON.
+func (al *alerter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type alert struct {
+		Name  string     `json:"name"`
+		Plug  string     `json:"plug"`
+		MAC   tpplug.MAC `json:"mac,omitempty"`
+		State string     `json:"state"`           // "inactive", "pending" or "firing"
+		Since *time.Time `json:"since,omitempty"` // when the condition started to hold
+		Value float64    `json:"value"`           // power (W), or seconds unseen
+	}
+	alerts := []alert{}
+	al.mu.Lock()
+	for i, r := range al.rules {
+		st := al.states[i]
+		a := alert{Name: r.Name, Plug: r.Plug, MAC: st.mac, State: "inactive", Value: st.value}
+		if !st.pending.IsZero() {
+			a.State = "pending"
+			since := st.pending
+			a.Since = &since
+		}
+		if st.firing {
+			a.State = "firing"
+		}
+		alerts = append(alerts, a)
+	}
+	al.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(alerts)
+}
+
+// findMAC returns the MAC of a known plug with the given MAC, alias or name,
+// or "" if there isn't one.
+func (dc *dataCollector) findMAC(plug string) tpplug.MAC {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	want := tpplug.CanonicalMAC(plug)
+	for mac, info := range dc.prev {
+		if mac == want || info.State.System.Info.Alias == plug || dc.devices.Name(info.State) == plug {
+			return mac
+		}
+	}
+	return ""
+}
+
+// lastSeen returns when a plug last responded, or the zero time if it hasn't.
+func (dc *dataCollector) lastSeen(mac tpplug.MAC) time.Time {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	var seen time.Time
+	if info, ok := dc.prev[mac]; ok {
+		seen = info.Seen
+	}
+	if ph, ok := dc.hist[mac]; ok && ph.n > 0 {
+		if t := ph.readings[(ph.n-1)%recentReadings].Time; t.After(seen) {
+			seen = t
+		}
+	}
+	return seen
+}
+
+// latest returns the most recent power reading of a plug.
+func (dc *dataCollector) latest(mac tpplug.MAC) (reading, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	ph, ok := dc.hist[mac]
+	if !ok || ph.n == 0 {
+		return reading{}, false
+	}
+	return ph.readings[(ph.n-1)%recentReadings], true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// /api/plugs serves the plugs seen by the most recent scan as JSON, for scripts.
+// With -control, POSTing to /api/plugs/<mac>/on (or off, or toggle) switches
+// a plug's relay, and the front page has buttons that do so. The response is
+// the plug as in /api/plugs, or with a form value redirect=<path>, a redirect there.
+
+var control = flag.Bool("control", false, "allow switching plugs from the front page and /api/plugs")
+
+// apiPlug is a plug as served by /api/plugs.
+type apiPlug struct {
+	MAC     tpplug.MAC `json:"mac"`
+	Addr    string     `json:"addr"` // IP:port
+	Name    string     `json:"name"`
+	Alias   string     `json:"alias"`
+	Model   string     `json:"model"`
+	On      bool       `json:"on"`
+	Power   float64    `json:"power_w"`
+	Seen    time.Time  `json:"seen"`
+	Ignored bool       `json:"ignored,omitempty"`
+}
+
+func (dc *dataCollector) apiPlugOf(info macInfo) apiPlug {
+	si := info.State.System.Info
+	return apiPlug{
+		MAC:     si.MAC,
+		Addr:    info.Addr.String(),
+		Name:    dc.devices.Name(info.State),
+		Alias:   si.Alias,
+		Model:   si.Model,
+		On:      si.RelayState == 1,
+		Power:   float64(info.State.EnergyMeter.Realtime.Power) / 1000,
+		Seen:    info.Seen,
+		Ignored: dc.ignore[si.MAC],
+	}
+}
+
+func (dc *dataCollector) serveAPIPlugs(w http.ResponseWriter, r *http.Request) {
+	if rest := strings.TrimPrefix(r.URL.Path, "/api/plugs"); rest != "" {
+		dc.serveAPISwitch(w, r, strings.TrimPrefix(rest, "/"))
+		return
+	}
+	dc.mu.Lock()
+	ps := []apiPlug{} // so JSON is [] rather than null
+	for _, info := range dc.prev {
+		ps = append(ps, dc.apiPlugOf(info))
+	}
+	dc.mu.Unlock()
+	sort.Slice(ps, func(i, j int) bool { return ps[i].MAC < ps[j].MAC })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ps)
+}
+
+// serveAPISwitch serves /api/plugs/<mac>/<how>, given the part after /api/plugs/.
+func (dc *dataCollector) serveAPISwitch(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	mac, how := tpplug.CanonicalMAC(parts[0]), parts[1]
+	if how != "on" && how != "off" && how != "toggle" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !*control {
+		http.Error(w, "switching plugs is disabled; see -control", http.StatusForbidden)
+		return
+	}
+	redirect := r.PostFormValue("redirect")
+	if redirect != "" && (!strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//")) {
+		http.Error(w, "redirect must be a path", http.StatusBadRequest)
+		return
+	}
+
+	// As in solarctrl, there's no XSRF check; the threat model isn't worth the effort.
+
+	dc.mu.Lock()
+	info, ok := dc.prev[mac]
+	dc.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *scanTime)
+	defer cancel()
+	state, err := setRelay(ctx, info, how)
+	if err != nil {
+		log.Printf("Switching %s %s: %v", mac, how, err)
+		http.Error(w, fmt.Sprintf("switching %s %s: %v", mac, how, err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Switched %s (%s) %s", mac, dc.devices.Name(state), how)
+
+	// Others may still be reading dc.prev, so it's replaced rather than changed.
+	dc.mu.Lock()
+	if cur, ok := dc.prev[mac]; ok {
+		cur.State.System.Info.RelayState = state.System.Info.RelayState
+		prev := make(map[tpplug.MAC]macInfo, len(dc.prev))
+		for m, mi := range dc.prev {
+			prev[m] = mi
+		}
+		prev[mac] = cur
+		dc.prev = prev
+		info = cur
+	}
+	dc.mu.Unlock()
+
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dc.apiPlugOf(info))
+}
+
+// setRelay switches a plug on or off, or toggles it, and returns its state afterwards.
+func setRelay(ctx context.Context, info macInfo, how string) (tpplug.State, error) {
+	var err error
+	switch how {
+	case "on":
+		err = tpplug.SetRelayState(ctx, info.Addr, 1)
+	case "off":
+		err = tpplug.SetRelayState(ctx, info.Addr, 0)
+	case "toggle":
+		var state tpplug.State
+		if state, err = tpplug.QuerySysinfoOnly(ctx, info.Addr); err == nil {
+			err = tpplug.SetRelayState(ctx, info.Addr, 1-state.System.Info.RelayState)
+		}
+	}
+	if err != nil {
+		return tpplug.State{}, err
+	}
+	return tpplug.QuerySysinfoOnly(ctx, info.Addr)
+}
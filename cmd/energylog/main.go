@@ -0,0 +1,218 @@
+/*
+energylog records the power use of TP-Link smart plugs into SQLite,
+for long-term per-appliance history without running Prometheus.
+
+	energylog [flags] run
+	energylog [flags] query [-mac <mac>] [-since 24h] [-by hour|day|total]
+
+"run" (the default) discovers plugs every -interval and records their readings.
+Raw readings are kept for -raw_retention, and downsampled into hourly
+averages that are kept for -hourly_retention. If -http is set, it also serves
+the same data as "query" as JSON at /api/energy?mac=&since=&by=.
+
+"query" prints energy use from the database.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	dbPath          = flag.String("db", "energylog.db", "SQLite database `file`")
+	interval        = flag.Duration("interval", 1*time.Minute, "how often to record readings")
+	scanTime        = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	rawRetention    = flag.Duration("raw_retention", 7*24*time.Hour, "how long to keep raw readings (0 = forever)")
+	hourlyRetention = flag.Duration("hourly_retention", 0, "how long to keep hourly averages (0 = forever)")
+	httpAddr        = flag.String("http", "", "if set, serve the query API on this `address`")
+	devicesFile     = flag.String("devices", "", "devices `file` giving canonical names to record (default $"+tpplug.DevicesEnv+")")
+)
+
+func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n\tenergylog [flags] run\n\tenergylog [flags] query [-mac <mac>] [-since 24h] [-by hour|day|total]\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	st, err := openStore(*dbPath, *interval)
+	if err != nil {
+		log.Fatalf("Opening database %s: %v", *dbPath, err)
+	}
+	defer st.Close()
+
+	cmd := "run"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+	}
+	switch cmd {
+	case "run":
+		err = run(st)
+	case "query":
+		err = query(st, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(st *store) error {
+	devices, err := tpplug.LoadDevices(*devicesFile)
+	if err != nil {
+		return fmt.Errorf("loading devices: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if *httpAddr != "" {
+		http.HandleFunc("/api/energy", func(w http.ResponseWriter, r *http.Request) {
+			serveEnergy(st, w, r)
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, nil))
+		}()
+	}
+
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	for {
+		if err := recordOnce(st, devices); err != nil {
+			log.Printf("Recording readings: %v", err)
+		}
+		if err := st.downsample(time.Now(), *rawRetention, *hourlyRetention); err != nil {
+			log.Printf("Downsampling: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func recordOnce(st *store, devices *tpplug.Devices) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var rs []reading
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		if info.MAC == "" {
+			continue
+		}
+		rs = append(rs, reading{
+			Time:  now,
+			MAC:   info.MAC.String(),
+			Alias: devices.Name(dr.State),
+			Power: dr.State.EnergyMeter.Realtime.Power,
+			On:    info.RelayState == 1,
+		})
+	}
+	return st.record(rs)
+}
+
+type queryOpts struct {
+	mac   string
+	since time.Duration
+	by    string
+}
+
+func (qo queryOpts) check() error {
+	switch qo.by {
+	case "hour", "day", "total":
+		return nil
+	}
+	return fmt.Errorf("bad -by %q (want hour, day or total)", qo.by)
+}
+
+func (qo queryOpts) run(st *store) ([]bucket, error) {
+	bs, err := st.energy(time.Now().Add(-qo.since), tpplug.CanonicalMAC(qo.mac).String())
+	if err != nil {
+		return nil, err
+	}
+	return rollup(bs, qo.by, time.Local), nil
+}
+
+func query(st *store, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	var qo queryOpts
+	fs.StringVar(&qo.mac, "mac", "", "only show this `MAC`")
+	fs.DurationVar(&qo.since, "since", 24*time.Hour, "how far back to show")
+	fs.StringVar(&qo.by, "by", "day", "period to total over: hour, day or total")
+	fs.Parse(args)
+	if err := qo.check(); err != nil {
+		return err
+	}
+	bs, err := qo.run(st)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if qo.by == "total" {
+		fmt.Fprintln(tw, "MAC\tALIAS\tAVG POWER\tENERGY\t")
+	} else {
+		fmt.Fprintln(tw, "PERIOD\tMAC\tALIAS\tAVG POWER\tENERGY\t")
+	}
+	for _, b := range bs {
+		if qo.by == "hour" {
+			fmt.Fprintf(tw, "%s\t", b.Hour.Format("2006-01-02 15:04"))
+		} else if qo.by == "day" {
+			fmt.Fprintf(tw, "%s\t", b.Hour.Format("2006-01-02"))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f W\t%.3f kWh\t\n", b.MAC, b.Alias, b.AvgPower, b.Energy/1000)
+	}
+	return tw.Flush()
+}
+
+func serveEnergy(st *store, w http.ResponseWriter, r *http.Request) {
+	qo := queryOpts{mac: r.FormValue("mac"), since: 24 * time.Hour, by: "day"}
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if qo.since, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if by := r.FormValue("by"); by != "" {
+		qo.by = by
+	}
+	if err := qo.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bs, err := qo.run(st)
+	if err != nil {
+		log.Printf("Querying energy: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bs == nil {
+		bs = []bucket{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(bs)
+}
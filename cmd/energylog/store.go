@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS readings (
+	ts       INTEGER NOT NULL, -- Unix seconds
+	mac      TEXT NOT NULL,
+	alias    TEXT NOT NULL,
+	power_mw INTEGER NOT NULL,
+	relay    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS readings_ts ON readings (ts);
+
+-- hourly holds downsampled readings for completed hours.
+CREATE TABLE IF NOT EXISTS hourly (
+	hour         INTEGER NOT NULL, -- Unix seconds at the start of the hour
+	mac          TEXT NOT NULL,
+	alias        TEXT NOT NULL,
+	avg_power_mw REAL NOT NULL,
+	samples      INTEGER NOT NULL,
+	energy_wh    REAL NOT NULL,
+	PRIMARY KEY (hour, mac)
+);
+`
+
+// store is the SQLite database of readings.
+type store struct {
+	db       *sql.DB
+	interval time.Duration // expected gap between readings
+}
+
+func openStore(path string, interval time.Duration) (*store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports one writer; serialise access rather than fight over locks.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	return &store{db: db, interval: interval}, nil
+}
+
+func (s *store) Close() error { return s.db.Close() }
+
+type reading struct {
+	Time  time.Time
+	MAC   string
+	Alias string
+	Power int // mW
+	On    bool
+}
+
+func (s *store) record(rs []reading) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range rs {
+		relay := 0
+		if r.On {
+			relay = 1
+		}
+		if _, err := tx.Exec(`INSERT INTO readings (ts, mac, alias, power_mw, relay) VALUES (?, ?, ?, ?, ?)`,
+			r.Time.Unix(), r.MAC, r.Alias, r.Power, relay); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// bucket is the aggregate of readings for one plug over one hour.
+type bucket struct {
+	Hour     time.Time `json:"hour"`
+	MAC      string    `json:"mac"`
+	Alias    string    `json:"alias"`
+	AvgPower float64   `json:"avg_power_w"`
+	Samples  int       `json:"samples"`
+	Energy   float64   `json:"energy_wh"`
+}
+
+// aggregate buckets raw readings in [from, to) by hour and plug.
+// Energy is the average power over the hour, scaled down if the hour was only partly sampled.
+func (s *store) aggregate(from, to time.Time) ([]bucket, error) {
+	rows, err := s.db.Query(`
+		SELECT (ts / 3600) * 3600 AS hour, mac, MAX(alias), AVG(power_mw), COUNT(*)
+		FROM readings WHERE ts >= ? AND ts < ?
+		GROUP BY hour, mac`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bs []bucket
+	for rows.Next() {
+		var b bucket
+		var hour int64
+		var avgMW float64
+		if err := rows.Scan(&hour, &b.MAC, &b.Alias, &avgMW, &b.Samples); err != nil {
+			return nil, err
+		}
+		b.Hour = time.Unix(hour, 0)
+		b.AvgPower = avgMW / 1000
+		coverage := float64(time.Duration(b.Samples)*s.interval) / float64(time.Hour)
+		if coverage > 1 {
+			coverage = 1
+		}
+		b.Energy = b.AvgPower * coverage
+		bs = append(bs, b)
+	}
+	return bs, rows.Err()
+}
+
+// downsample aggregates completed hours into the hourly table,
+// and deletes raw readings older than rawRetention and hourly data older than hourlyRetention.
+// A zero retention keeps data forever.
+func (s *store) downsample(now time.Time, rawRetention, hourlyRetention time.Duration) error {
+	var last sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(hour) FROM hourly`).Scan(&last); err != nil {
+		return err
+	}
+	var from time.Time // the zero time is before any reading
+	if last.Valid {
+		from = time.Unix(last.Int64, 0).Add(time.Hour)
+	}
+	bs, err := s.aggregate(from, now.Truncate(time.Hour))
+	if err != nil {
+		return fmt.Errorf("aggregating: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, b := range bs {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO hourly (hour, mac, alias, avg_power_mw, samples, energy_wh) VALUES (?, ?, ?, ?, ?, ?)`,
+			b.Hour.Unix(), b.MAC, b.Alias, b.AvgPower*1000, b.Samples, b.Energy); err != nil {
+			return err
+		}
+	}
+	if rawRetention > 0 {
+		// Never delete readings that haven't been aggregated yet.
+		cut := now.Add(-rawRetention)
+		if t := now.Truncate(time.Hour); cut.After(t) {
+			cut = t
+		}
+		if _, err := tx.Exec(`DELETE FROM readings WHERE ts < ?`, cut.Unix()); err != nil {
+			return err
+		}
+	}
+	if hourlyRetention > 0 {
+		if _, err := tx.Exec(`DELETE FROM hourly WHERE hour < ?`, now.Add(-hourlyRetention).Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// energy returns hourly buckets since the given time, optionally for a single plug,
+// including the hour in progress.
+func (s *store) energy(since time.Time, mac string) ([]bucket, error) {
+	rows, err := s.db.Query(`
+		SELECT hour, mac, alias, avg_power_mw, samples, energy_wh
+		FROM hourly WHERE hour >= ? AND (? = '' OR mac = ?)`, since.Truncate(time.Hour).Unix(), mac, mac)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bs []bucket
+	done := make(map[string]bool) // hour/mac of buckets already aggregated
+	var last time.Time
+	for rows.Next() {
+		var b bucket
+		var hour int64
+		var avgMW float64
+		if err := rows.Scan(&hour, &b.MAC, &b.Alias, &avgMW, &b.Samples, &b.Energy); err != nil {
+			return nil, err
+		}
+		b.Hour = time.Unix(hour, 0)
+		b.AvgPower = avgMW / 1000
+		bs = append(bs, b)
+		done[fmt.Sprint(hour, b.MAC)] = true
+		if b.Hour.After(last) {
+			last = b.Hour
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Anything not yet downsampled comes straight from the raw readings.
+	from := since.Truncate(time.Hour)
+	if !last.IsZero() && last.After(from) {
+		from = last
+	}
+	raw, err := s.aggregate(from, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range raw {
+		if done[fmt.Sprint(b.Hour.Unix(), b.MAC)] || (mac != "" && b.MAC != mac) {
+			continue
+		}
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if !bs[i].Hour.Equal(bs[j].Hour) {
+			return bs[i].Hour.Before(bs[j].Hour)
+		}
+		return bs[i].MAC < bs[j].MAC
+	})
+	return bs, nil
+}
+
+// rollup combines hourly buckets into coarser periods per plug.
+// by is "hour", "day" or "total".
+func rollup(bs []bucket, by string, loc *time.Location) []bucket {
+	if by == "hour" {
+		return bs
+	}
+	type key struct {
+		t   time.Time
+		mac string
+	}
+	var keys []key
+	agg := make(map[key]*bucket)
+	for _, b := range bs {
+		var t time.Time
+		if by == "day" {
+			y, m, d := b.Hour.In(loc).Date()
+			t = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		}
+		k := key{t, b.MAC}
+		a, ok := agg[k]
+		if !ok {
+			a = &bucket{Hour: t, MAC: b.MAC}
+			agg[k] = a
+			keys = append(keys, k)
+		}
+		a.Alias = b.Alias
+		a.AvgPower = (a.AvgPower*float64(a.Samples) + b.AvgPower*float64(b.Samples)) / float64(a.Samples+b.Samples)
+		a.Samples += b.Samples
+		a.Energy += b.Energy
+	}
+	var out []bucket
+	for _, k := range keys {
+		out = append(out, *agg[k])
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+/*
+fakeplug emulates one or more TP-Link HS110 smart plugs,
+for demoing and testing the exporter and solarctrl without hardware.
+
+It answers discovery broadcasts on the discovery port (9999 by default),
+and each emulated plug answers unicast queries on its own UDP port.
+Discovery replies come from each plug's port, so discovering clients
+learn the right address to query.
+
+Plugs are described by a YAML file given with -config:
+
+	plugs:
+	  - alias: Heater
+	    mac: 50:C7:BF:00:00:01
+	    port: 10001
+	    power: 2000     # W drawn when on
+	    curve: sine     # constant, sine or random
+	    period: 1h      # for sine
+	    off: false      # if true, the relay starts off
+	    stuck: false    # if true, attempts to switch the relay fail
+	    drop: 0.1       # fraction of queries to ignore
+	    drift: 90s      # how far the plug's clock is ahead of ours
+
+Without -config, -n plugs are emulated with default settings.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile    = flag.String("config", "", "YAML `file` describing the plugs to emulate")
+	numPlugs      = flag.Int("n", 3, "number of default plugs to emulate, if -config is not set")
+	discoveryAddr = flag.String("discovery_addr", ":9999", "UDP `address` to answer discovery on")
+	basePort      = flag.Int("base_port", 10001, "first UDP port for plugs without a configured port")
+	vFlag         = flag.Bool("v", false, "log every request")
+)
+
+type Config struct {
+	Plugs []PlugConfig
+}
+
+type PlugConfig struct {
+	Alias string
+	MAC   string
+	Model string
+	Port  int
+
+	Power  float64       // W when on
+	Curve  string        // "constant", "sine" or "random"
+	Period time.Duration // for "sine"
+
+	Off   bool // initial relay state
+	Stuck bool
+	Drop  float64
+	Drift time.Duration
+}
+
+func main() {
+	flag.Parse()
+
+	var config Config
+	if *configFile != "" {
+		raw, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			log.Fatalf("Reading config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+			log.Fatalf("Parsing config file %s: %v", *configFile, err)
+		}
+	} else {
+		for i := 0; i < *numPlugs; i++ {
+			config.Plugs = append(config.Plugs, PlugConfig{
+				Alias: fmt.Sprintf("Fake plug %d", i+1),
+				Power: float64(100 * (i + 1)),
+				Curve: "random",
+			})
+		}
+	}
+	if len(config.Plugs) == 0 {
+		log.Fatal("No plugs to emulate")
+	}
+
+	var plugs []*plug
+	for i, pc := range config.Plugs {
+		p, err := newPlug(i, pc)
+		if err != nil {
+			log.Fatalf("Plug %d: %v", i, err)
+		}
+		laddr := &net.UDPAddr{Port: p.cfg.Port}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			log.Fatalf("Listening for plug %q: %v", p.cfg.Alias, err)
+		}
+		p.conn = conn
+		plugs = append(plugs, p)
+		log.Printf("Emulating %q (%s) on UDP port %d", p.cfg.Alias, p.cfg.MAC, p.cfg.Port)
+		go p.serve()
+	}
+
+	daddr, err := net.ResolveUDPAddr("udp", *discoveryAddr)
+	if err != nil {
+		log.Fatalf("Bad -discovery_addr: %v", err)
+	}
+	dconn, err := net.ListenUDP("udp", daddr)
+	if err != nil {
+		log.Fatalf("Listening for discovery: %v", err)
+	}
+	log.Printf("Answering discovery on %v", dconn.LocalAddr())
+	var scratch [4 << 10]byte
+	for {
+		n, raddr, err := dconn.ReadFromUDP(scratch[:])
+		if err != nil {
+			log.Fatalf("Reading discovery message: %v", err)
+		}
+		req := append([]byte(nil), scratch[:n]...)
+		tpplug.Decrypt(req)
+		if *vFlag {
+			log.Printf("Discovery from %v: %s", raddr, req)
+		}
+		if !readOnly(req) {
+			// This socket stands for every plug, so don't let it change them all.
+			log.Printf("Ignoring non-query discovery message from %v", raddr)
+			continue
+		}
+		// Each plug replies from its own socket, so the client learns its port.
+		for _, p := range plugs {
+			p.respond(raddr, req)
+		}
+	}
+}
+
+// readOnly reports whether a request only invokes get_ methods.
+func readOnly(req []byte) bool {
+	var modules map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(req, &modules); err != nil {
+		return false
+	}
+	for _, methods := range modules {
+		for method := range methods {
+			if !strings.HasPrefix(method, "get_") {
+				return false
+			}
+		}
+	}
+	return true
+}
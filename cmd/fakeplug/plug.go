@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+const voltage = 240.0 // V, nominal
+
+// plug is an emulated plug.
+type plug struct {
+	cfg  PlugConfig
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	on        bool
+	onSince   time.Time
+	energyWh  float64   // total energy used
+	lastTick  time.Time // when energyWh was last updated
+	countdown *countdownRule
+	schedule  bool // whether the (empty) schedule is enabled
+	lat, lon  int  // in 1e-4 degrees, as reported
+	ledOff    bool
+	tzIndex   int
+}
+
+type countdownRule struct {
+	Delay int       `json:"delay"`
+	Act   int       `json:"act"`
+	Name  string    `json:"name"`
+	due   time.Time // when it fires
+	timer *time.Timer
+}
+
+func newPlug(i int, pc PlugConfig) (*plug, error) {
+	if pc.Alias == "" {
+		pc.Alias = fmt.Sprintf("Fake plug %d", i+1)
+	}
+	if pc.MAC == "" {
+		pc.MAC = fmt.Sprintf("50:C7:BF:FA:CE:%02X", i+1)
+	}
+	if pc.Model == "" {
+		pc.Model = "HS110(AU)"
+	}
+	if pc.Port == 0 {
+		pc.Port = *basePort + i
+	}
+	switch pc.Curve {
+	case "":
+		pc.Curve = "constant"
+	case "constant", "sine", "random":
+	default:
+		return nil, fmt.Errorf("unknown curve %q", pc.Curve)
+	}
+	if pc.Period <= 0 {
+		pc.Period = time.Hour
+	}
+	p := &plug{cfg: pc, lastTick: time.Now()}
+	if !pc.Off {
+		p.on, p.onSince = true, time.Now()
+	}
+	return p, nil
+}
+
+func (p *plug) serve() {
+	var scratch [4 << 10]byte
+	for {
+		n, raddr, err := p.conn.ReadFromUDP(scratch[:])
+		if err != nil {
+			log.Printf("Plug %q: reading message: %v", p.cfg.Alias, err)
+			return
+		}
+		req := append([]byte(nil), scratch[:n]...)
+		tpplug.Decrypt(req)
+		if *vFlag {
+			log.Printf("Plug %q: request from %v: %s", p.cfg.Alias, raddr, req)
+		}
+		p.respond(raddr, req)
+	}
+}
+
+// respond handles a request, and sends the response to raddr.
+func (p *plug) respond(raddr *net.UDPAddr, req []byte) {
+	if p.cfg.Drop > 0 && rand.Float64() < p.cfg.Drop {
+		return
+	}
+	resp, err := p.handle(req)
+	if err != nil {
+		// Real plugs ignore garbage.
+		log.Printf("Plug %q: bad request from %v: %v", p.cfg.Alias, raddr, err)
+		return
+	}
+	tpplug.Encrypt(resp)
+	if _, err := p.conn.WriteToUDP(resp, raddr); err != nil {
+		log.Printf("Plug %q: sending response to %v: %v", p.cfg.Alias, raddr, err)
+	}
+}
+
+// handle computes the response to a request.
+// Like real plugs, unknown modules and methods get error responses rather than failing the request.
+func (p *plug) handle(req []byte) ([]byte, error) {
+	var modules map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(req, &modules); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tick(time.Now())
+
+	resp := make(map[string]map[string]interface{})
+	for mod, methods := range modules {
+		out := make(map[string]interface{})
+		resp[mod] = out
+		for method, arg := range methods {
+			h, ok := handlers[mod]
+			if !ok {
+				resp[mod] = map[string]interface{}{"err_code": -1, "err_msg": "module not support"}
+				break
+			}
+			out[method] = h(p, method, arg)
+		}
+	}
+	return json.Marshal(resp)
+}
+
+type handler func(p *plug, method string, arg json.RawMessage) interface{}
+
+var handlers = map[string]handler{
+	"system":     (*plug).system,
+	"emeter":     (*plug).emeter,
+	"count_down": (*plug).countDown,
+	"time":       (*plug).clock,
+	"schedule":   (*plug).scheduleModule,
+}
+
+func errResult(code int, msg string) map[string]interface{} {
+	return map[string]interface{}{"err_code": code, "err_msg": msg}
+}
+
+var (
+	okResult           = map[string]interface{}{"err_code": 0}
+	memberNotSupported = errResult(-2, "member not support")
+	invalidArgument    = errResult(-3, "invalid argument")
+	relayStuck         = errResult(-10, "relay failure")
+)
+
+func (p *plug) system(method string, arg json.RawMessage) interface{} {
+	switch method {
+	case "get_sysinfo":
+		onTime := 0
+		if p.on {
+			onTime = int(time.Since(p.onSince) / time.Second)
+		}
+		return map[string]interface{}{
+			"sw_ver":      "1.0.0 Build 000000 Rel.000000",
+			"hw_ver":      "2.0",
+			"type":        "IOT.SMARTPLUGSWITCH",
+			"model":       p.cfg.Model,
+			"mac":         p.cfg.MAC,
+			"dev_name":    "Smart Wi-Fi Plug With Energy Monitoring",
+			"alias":       p.cfg.Alias,
+			"relay_state": boolInt(p.on),
+			"on_time":     onTime,
+			"active_mode": p.activeMode(),
+			"feature":     "TIM:ENE",
+			"updating":    0,
+			"rssi":        -50,
+			"led_off":     boolInt(p.ledOff),
+			"latitude_i":  p.lat,
+			"longitude_i": p.lon,
+			"err_code":    0,
+		}
+	case "set_relay_state":
+		var a struct {
+			State *int `json:"state"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.State == nil {
+			return invalidArgument
+		}
+		if p.cfg.Stuck {
+			return relayStuck
+		}
+		p.setRelay(*a.State == 1)
+		return okResult
+	case "set_dev_alias":
+		var a struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Alias == "" {
+			return invalidArgument
+		}
+		p.cfg.Alias = a.Alias
+		return okResult
+	case "set_dev_location":
+		var a struct {
+			Lat *int `json:"latitude_i"`
+			Lon *int `json:"longitude_i"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Lat == nil || a.Lon == nil {
+			return invalidArgument
+		}
+		p.lat, p.lon = *a.Lat, *a.Lon
+		return okResult
+	case "set_led_off":
+		var a struct {
+			Off *int `json:"off"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Off == nil {
+			return invalidArgument
+		}
+		p.ledOff = *a.Off == 1
+		return okResult
+	}
+	return memberNotSupported
+}
+
+func (p *plug) emeter(method string, arg json.RawMessage) interface{} {
+	switch method {
+	case "get_realtime":
+		w := p.power(time.Now())
+		v := voltage + rand.Float64()*4 - 2
+		return map[string]interface{}{
+			"voltage_mv": int(v * 1000),
+			"current_ma": int(w / v * 1000),
+			"power_mw":   int(w * 1000),
+			"total_wh":   int(p.energyWh),
+			"err_code":   0,
+		}
+	}
+	return memberNotSupported
+}
+
+func (p *plug) clock(method string, arg json.RawMessage) interface{} {
+	switch method {
+	case "get_time":
+		t := time.Now().Add(p.cfg.Drift)
+		return map[string]interface{}{
+			"year":     t.Year(),
+			"month":    int(t.Month()),
+			"mday":     t.Day(),
+			"hour":     t.Hour(),
+			"min":      t.Minute(),
+			"sec":      t.Second(),
+			"err_code": 0,
+		}
+	case "set_time":
+		var a struct {
+			Year, Month, MDay, Hour, Min, Sec int
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Year == 0 {
+			return invalidArgument
+		}
+		t := time.Date(a.Year, time.Month(a.Month), a.MDay, a.Hour, a.Min, a.Sec, 0, time.Local)
+		p.cfg.Drift = time.Until(t).Round(time.Second)
+		return okResult
+	case "get_timezone":
+		return map[string]interface{}{"index": p.tzIndex, "err_code": 0}
+	case "set_timezone":
+		var a struct {
+			Index *int
+			Year  int
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Index == nil || a.Year == 0 {
+			return invalidArgument
+		}
+		p.tzIndex = *a.Index
+		return okResult
+	}
+	return memberNotSupported
+}
+
+// activeMode reports what the plug's timers are doing. p.mu must be held.
+func (p *plug) activeMode() string {
+	switch {
+	case p.countdown != nil:
+		return "count_down"
+	case p.schedule:
+		return "schedule"
+	}
+	return "none"
+}
+
+// scheduleModule emulates a schedule with no rules; only its overall enable flag matters.
+func (p *plug) scheduleModule(method string, arg json.RawMessage) interface{} {
+	switch method {
+	case "get_rules":
+		return map[string]interface{}{"rule_list": []interface{}{}, "enable": boolInt(p.schedule), "version": 2, "err_code": 0}
+	case "set_overall_enable":
+		var a struct {
+			Enable *int `json:"enable"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Enable == nil {
+			return invalidArgument
+		}
+		p.schedule = *a.Enable == 1
+		return okResult
+	}
+	return memberNotSupported
+}
+
+func (p *plug) countDown(method string, arg json.RawMessage) interface{} {
+	switch method {
+	case "get_rules":
+		rules := []interface{}{}
+		if cd := p.countdown; cd != nil {
+			rules = append(rules, map[string]interface{}{
+				"id":     "FAKE0",
+				"name":   cd.Name,
+				"enable": 1,
+				"delay":  cd.Delay,
+				"act":    cd.Act,
+				"remain": int(time.Until(cd.due) / time.Second),
+			})
+		}
+		return map[string]interface{}{"rule_list": rules, "err_code": 0}
+	case "delete_all_rules":
+		if p.countdown != nil {
+			p.countdown.timer.Stop()
+			p.countdown = nil
+		}
+		return okResult
+	case "add_rule":
+		if p.countdown != nil {
+			return errResult(-10, "table is full")
+		}
+		var cd countdownRule
+		if err := json.Unmarshal(arg, &cd); err != nil || cd.Delay <= 0 {
+			return invalidArgument
+		}
+		d := time.Duration(cd.Delay) * time.Second
+		cd.due = time.Now().Add(d)
+		cd.timer = time.AfterFunc(d, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.tick(time.Now())
+			if !p.cfg.Stuck {
+				p.setRelay(cd.Act == 1)
+			}
+			p.countdown = nil
+		})
+		p.countdown = &cd
+		return map[string]interface{}{"id": "FAKE0", "err_code": 0}
+	}
+	return memberNotSupported
+}
+
+// setRelay switches the relay. p.mu must be held.
+func (p *plug) setRelay(on bool) {
+	if on && !p.on {
+		p.onSince = time.Now()
+	}
+	p.on = on
+	if *vFlag {
+		log.Printf("Plug %q: relay now %s", p.cfg.Alias, map[bool]string{true: "on", false: "off"}[on])
+	}
+}
+
+// power returns the current draw in W. p.mu must be held.
+func (p *plug) power(now time.Time) float64 {
+	if !p.on {
+		return 0
+	}
+	switch p.cfg.Curve {
+	case "sine":
+		phase := float64(now.UnixNano()%int64(p.cfg.Period)) / float64(p.cfg.Period)
+		return p.cfg.Power * (0.5 + 0.5*math.Sin(2*math.Pi*phase))
+	case "random":
+		return p.cfg.Power * (0.9 + 0.2*rand.Float64())
+	}
+	return p.cfg.Power
+}
+
+// tick accumulates energy use up to now. p.mu must be held.
+func (p *plug) tick(now time.Time) {
+	p.energyWh += p.power(now) * now.Sub(p.lastTick).Hours()
+	p.lastTick = now
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
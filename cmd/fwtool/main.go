@@ -0,0 +1,232 @@
+/*
+fwtool audits, and optionally updates, the firmware of TP-Link smart plugs.
+
+	fwtool [flags] report
+	fwtool [flags] update [-yes] [<target> ...]
+
+"report" (the default) lists every discovered plug with its model and
+hardware and firmware versions. With -manifest, it also says whether each
+plug runs the expected firmware, and exits with status 1 if any does not.
+
+"update" downloads and flashes the manifest's firmware onto outdated plugs
+(or just the given targets, by MAC or name). Without -yes it only says what
+it would do. Flashing takes a plug offline for a minute or two.
+
+The manifest is a YAML list of expected versions:
+
+	# One entry per model, or per model and hardware version.
+	- model: HS110(AU)
+	  hw_ver: "2.0"       # optional; otherwise matches any hardware version
+	  sw_ver: 1.5.10 Build 191125 Rel.135247
+	  url: http://fileserver.local/hs110v2_1.5.10.bin    # optional; needed for update
+
+Note that plugs fetch the firmware URL themselves, so it must be
+reachable from them (plain HTTP on the local network works best).
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	manifestFile = flag.String("manifest", "", "manifest `file` of expected firmware versions")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names (default $"+tpplug.DevicesEnv+")")
+	discoverTime = flag.Duration("t", 2*time.Second, "how long to wait for discovery")
+	timeout      = flag.Duration("timeout", 3*time.Second, "how long to wait for a plug to respond")
+)
+
+// ManifestEntry is the expected firmware for a model (and optionally hardware version).
+type ManifestEntry struct {
+	Model string
+	HWVer string `yaml:"hw_ver"`
+	SWVer string `yaml:"sw_ver"`
+	URL   string
+}
+
+type manifest []ManifestEntry
+
+// lookup returns the entry for a plug. Entries with a matching hw_ver beat those without.
+func (m manifest) lookup(model, hwVer string) (ManifestEntry, bool) {
+	var best ManifestEntry
+	found := false
+	for _, e := range m {
+		if e.Model != model || (e.HWVer != "" && e.HWVer != hwVer) {
+			continue
+		}
+		if !found || (best.HWVer == "" && e.HWVer != "") {
+			best, found = e, true
+		}
+	}
+	return best, found
+}
+
+// sysinfo is the part of get_sysinfo that matters here.
+type sysinfo struct {
+	MAC      tpplug.MAC `json:"mac"`
+	Alias    string     `json:"alias"`
+	Model    string     `json:"model"`
+	HWVer    string     `json:"hw_ver"`
+	SWVer    string     `json:"sw_ver"`
+	Updating int        `json:"updating"`
+}
+
+// plug is a plug found on the network.
+type plug struct {
+	addr *net.UDPAddr
+	name string
+	info sysinfo
+	err  error
+
+	want    ManifestEntry
+	known   bool // whether want is set
+	current bool // whether it runs the expected firmware
+}
+
+func (p *plug) status() string {
+	switch {
+	case p.err != nil:
+		return "error: " + p.err.Error()
+	case p.info.Updating != 0:
+		return "updating"
+	case !p.known:
+		return "not in manifest"
+	case p.current:
+		return "ok"
+	}
+	return "outdated (want " + p.want.SWVer + ")"
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("fwtool: ")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n\tfwtool [flags] report\n\tfwtool [flags] update [-yes] [<target> ...]\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var m manifest
+	if *manifestFile != "" {
+		raw, err := ioutil.ReadFile(*manifestFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := yaml.UnmarshalStrict(raw, &m); err != nil {
+			log.Fatalf("Parsing manifest %s: %v", *manifestFile, err)
+		}
+		for i, e := range m {
+			if e.Model == "" || e.SWVer == "" {
+				log.Fatalf("Manifest entry %d: model and sw_ver are required", i+1)
+			}
+		}
+	}
+	devices, err := tpplug.LoadDevices(*devicesFile)
+	if err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+
+	cmd := "report"
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+	}
+	switch cmd {
+	case "report":
+		if flag.NArg() > 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		ps, err := sweep(m, devices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !report(ps, m != nil) {
+			os.Exit(1)
+		}
+	case "update":
+		if m == nil {
+			log.Fatal("update needs -manifest")
+		}
+		if err := update(m, devices, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// sweep discovers plugs and fetches their firmware details.
+func sweep(m manifest, devices *tpplug.Devices) ([]*plug, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering plugs: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	ps := make([]*plug, len(drs))
+	for i, dr := range drs {
+		dr := dr
+		p := &plug{addr: dr.Addr, name: devices.Name(dr.State)}
+		ps[i] = p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.info, p.err = getSysinfo(p.addr)
+			if p.err != nil {
+				// Fall back to what discovery said.
+				info := dr.State.System.Info
+				p.info.MAC, p.info.Alias, p.info.Model = info.MAC, info.Alias, info.Model
+				return
+			}
+			p.want, p.known = m.lookup(p.info.Model, p.info.HWVer)
+			p.current = p.known && p.info.SWVer == p.want.SWVer
+		}()
+	}
+	wg.Wait()
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+	return ps, nil
+}
+
+// report prints the sweep results, and reports whether all plugs are up to date.
+func report(ps []*plug, withManifest bool) bool {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "NAME\tMAC\tIP\tMODEL\tHW\tFIRMWARE\t")
+	if withManifest {
+		fmt.Fprint(tw, "STATUS\t")
+	}
+	fmt.Fprintln(tw)
+	allOK := true
+	for _, p := range ps {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t", p.name, p.info.MAC, p.addr.IP, p.info.Model, p.info.HWVer, p.info.SWVer)
+		if withManifest {
+			fmt.Fprintf(tw, "%s\t", p.status())
+			allOK = allOK && p.current
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return allOK
+}
+
+// matches reports whether a plug is named by a command-line target.
+func (p *plug) matches(target string) bool {
+	return p.info.MAC == tpplug.CanonicalMAC(target) || p.name == target || p.info.Alias == target
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+type errResp struct {
+	ErrCode int    `json:"err_code"`
+	ErrMsg  string `json:"err_msg,omitempty"`
+}
+
+func (er errResp) Err() error {
+	if er.ErrCode == 0 {
+		return nil
+	}
+	return fmt.Errorf("error code %d (%s)", er.ErrCode, er.ErrMsg)
+}
+
+func op(addr *net.UDPAddr, req, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return tpplug.RawJSONOp(ctx, addr, req, resp)
+}
+
+func getSysinfo(addr *net.UDPAddr) (sysinfo, error) {
+	var resp struct {
+		System struct {
+			GetSysinfo struct {
+				errResp
+				sysinfo
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	req := map[string]interface{}{"system": map[string]interface{}{"get_sysinfo": struct{}{}}}
+	if err := op(addr, req, &resp); err != nil {
+		return sysinfo{}, err
+	}
+	gs := resp.System.GetSysinfo
+	return gs.sysinfo, gs.Err()
+}
+
+// systemOp runs a single method of the "system" module that returns nothing but an error code.
+func systemOp(addr *net.UDPAddr, method string, arg interface{}) error {
+	var resp struct {
+		System map[string]errResp `json:"system"`
+	}
+	req := map[string]interface{}{"system": map[string]interface{}{method: arg}}
+	if err := op(addr, req, &resp); err != nil {
+		return err
+	}
+	er, ok := resp.System[method]
+	if !ok {
+		return fmt.Errorf("no response to %s", method)
+	}
+	return er.Err()
+}
+
+type downloadState struct {
+	errResp
+	Status     int `json:"status"`
+	Ratio      int `json:"ratio"`       // percent downloaded
+	RebootTime int `json:"reboot_time"` // seconds
+	FlashTime  int `json:"flash_time"`  // seconds
+}
+
+func getDownloadState(addr *net.UDPAddr) (downloadState, error) {
+	var resp struct {
+		System struct {
+			DownloadState downloadState `json:"get_download_state"`
+		} `json:"system"`
+	}
+	req := map[string]interface{}{"system": map[string]interface{}{"get_download_state": struct{}{}}}
+	if err := op(addr, req, &resp); err != nil {
+		return downloadState{}, err
+	}
+	ds := resp.System.DownloadState
+	return ds, ds.Err()
+}
+
+func update(m manifest, devices *tpplug.Devices, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "really update; otherwise just say what would be done")
+	wait := fs.Duration("wait", 5*time.Minute, "how long to wait for each plug to download, flash and reboot")
+	fs.Parse(args)
+
+	ps, err := sweep(m, devices)
+	if err != nil {
+		return err
+	}
+
+	// Pick the plugs to update.
+	var todo []*plug
+	if fs.NArg() == 0 {
+		for _, p := range ps {
+			if p.err == nil && p.known && !p.current {
+				todo = append(todo, p)
+			}
+		}
+	}
+	for _, target := range fs.Args() {
+		found := false
+		for _, p := range ps {
+			if p.matches(target) {
+				found = true
+				todo = append(todo, p)
+			}
+		}
+		if !found {
+			return fmt.Errorf("no plug found matching %q", target)
+		}
+	}
+
+	var failed int
+	for _, p := range todo {
+		switch {
+		case p.err != nil:
+			log.Printf("%s: skipping: %v", p.name, p.err)
+			continue
+		case !p.known:
+			log.Printf("%s: skipping: %s (hw %s) is not in the manifest", p.name, p.info.Model, p.info.HWVer)
+			continue
+		case p.current:
+			log.Printf("%s: already running %s", p.name, p.info.SWVer)
+			continue
+		case p.want.URL == "":
+			log.Printf("%s: skipping: manifest has no URL for %s", p.name, p.info.Model)
+			continue
+		}
+		if !*yes {
+			fmt.Printf("%s: would update %s -> %s from %s\n", p.name, p.info.SWVer, p.want.SWVer, p.want.URL)
+			continue
+		}
+		if err := flash(p, *wait); err != nil {
+			log.Printf("%s: update failed: %v", p.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: now running %s\n", p.name, p.want.SWVer)
+	}
+	if !*yes && len(todo) > 0 {
+		fmt.Println("Run with -yes to update.")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d updates failed", failed, len(todo))
+	}
+	return nil
+}
+
+// flash downloads and flashes the wanted firmware onto a plug,
+// and waits for it to come back running that firmware.
+func flash(p *plug, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+
+	fmt.Printf("%s: downloading %s\n", p.name, p.want.URL)
+	if err := systemOp(p.addr, "download_firmware", map[string]string{"url": p.want.URL}); err != nil {
+		return fmt.Errorf("starting download: %w", err)
+	}
+	lastRatio := -1
+	for {
+		if time.Now().After(deadline) {
+			return errors.New("timed out downloading")
+		}
+		time.Sleep(2 * time.Second)
+		ds, err := getDownloadState(p.addr)
+		if err != nil {
+			return fmt.Errorf("checking download: %w", err)
+		}
+		if ds.Ratio != lastRatio {
+			fmt.Printf("%s: downloaded %d%%\n", p.name, ds.Ratio)
+			lastRatio = ds.Ratio
+		}
+		if ds.Ratio >= 100 {
+			break
+		}
+	}
+
+	fmt.Printf("%s: flashing; the plug will reboot\n", p.name)
+	if err := systemOp(p.addr, "flash_firmware", struct{}{}); err != nil {
+		return fmt.Errorf("flashing: %w", err)
+	}
+	// Wait for the plug to come back. It'll be unreachable for a while,
+	// so errors are expected until then.
+	var lastErr error
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		info, err := getSysinfo(p.addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if info.Updating != 0 {
+			continue
+		}
+		if info.SWVer != p.want.SWVer {
+			return fmt.Errorf("plug came back running %q, not %q", info.SWVer, p.want.SWVer)
+		}
+		return nil
+	}
+	return fmt.Errorf("timed out waiting for plug to come back (last error: %v)", lastErr)
+}
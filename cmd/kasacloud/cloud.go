@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// cloudClient talks to the Kasa cloud API.
+// It is a JSON-RPC-ish protocol: every call is a POST of {"method":..., "params":...},
+// answered with {"error_code":..., "msg":..., "result":...}.
+type cloudClient struct {
+	url   string // base URL
+	token string // set by login
+}
+
+// cloudDevice is an entry in getDeviceList.
+type cloudDevice struct {
+	DeviceID   string `json:"deviceId"`
+	Alias      string `json:"alias"`
+	Model      string `json:"deviceModel"`
+	HWVer      string `json:"deviceHwVer"`
+	FWVer      string `json:"fwVer"`
+	MAC        string `json:"deviceMac"` // no separators
+	Status     int    `json:"status"`    // 1 if online
+	DeviceType string `json:"deviceType"`
+}
+
+func (c *cloudClient) call(ctx context.Context, method string, params, result interface{}) error {
+	req := map[string]interface{}{"method": method}
+	if params != nil {
+		req["params"] = params
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	u := c.url
+	if c.token != "" {
+		u += "?token=" + url.QueryEscape(c.token)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s response: %w", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %s", method, resp.Status)
+	}
+	var cr struct {
+		ErrorCode int             `json:"error_code"`
+		Msg       string          `json:"msg"`
+		Result    json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &cr); err != nil {
+		return fmt.Errorf("decoding %s response: %w", method, err)
+	}
+	if cr.ErrorCode != 0 {
+		return fmt.Errorf("%s: error code %d (%s)", method, cr.ErrorCode, cr.Msg)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(cr.Result, result); err != nil {
+		return fmt.Errorf("decoding %s result: %w", method, err)
+	}
+	return nil
+}
+
+func (c *cloudClient) login(ctx context.Context, user, password string) error {
+	var res struct {
+		Token string `json:"token"`
+	}
+	err := c.call(ctx, "login", map[string]string{
+		"appType":       "Kasa_Android",
+		"cloudUserName": user,
+		"cloudPassword": password,
+		"terminalUUID":  newUUID(),
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if res.Token == "" {
+		return fmt.Errorf("login: no token returned")
+	}
+	c.token = res.Token
+	return nil
+}
+
+func (c *cloudClient) devices(ctx context.Context) ([]cloudDevice, error) {
+	var res struct {
+		DeviceList []cloudDevice `json:"deviceList"`
+	}
+	if err := c.call(ctx, "getDeviceList", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.DeviceList, nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0F | 0x40
+	b[8] = b[8]&0x3F | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
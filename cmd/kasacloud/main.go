@@ -0,0 +1,152 @@
+/*
+kasacloud lists the devices registered to a Kasa cloud account,
+and cross-references them against the plugs discovered on the local network.
+
+	KASA_PASSWORD=... kasacloud -user me@example.com
+
+For each device it shows the model, alias, firmware, whether the cloud
+says it is online, and its local IP address if it was discovered.
+Devices bound to the account but not seen locally (on another network,
+or just unreachable), and local plugs not bound to the account, are
+listed afterwards, and make kasacloud exit with status 1.
+
+The password is read from $KASA_PASSWORD, or from the file given by -password_file.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	user         = flag.String("user", os.Getenv("KASA_USERNAME"), "Kasa account `email` (default $KASA_USERNAME)")
+	passwordFile = flag.String("password_file", "", "`file` containing the Kasa account password (default $KASA_PASSWORD)")
+	cloudURL     = flag.String("url", "https://wap.tplinkcloud.com", "Kasa cloud API `URL`")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names (default $"+tpplug.DevicesEnv+")")
+	discoverTime = flag.Duration("t", 2*time.Second, "how long to wait for discovery")
+	timeout      = flag.Duration("timeout", 30*time.Second, "how long to wait for the cloud")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("kasacloud: ")
+	flag.Parse()
+	if flag.NArg() > 0 || *user == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	password := os.Getenv("KASA_PASSWORD")
+	if *passwordFile != "" {
+		raw, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		password = strings.TrimSpace(string(raw))
+	}
+	if password == "" {
+		log.Fatal("No password; set $KASA_PASSWORD or use -password_file")
+	}
+	devices, err := tpplug.LoadDevices(*devicesFile)
+	if err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+
+	// Do the cloud and local lookups concurrently; discovery is mostly waiting.
+	type localResult struct {
+		drs []tpplug.DiscoveryResponse
+		err error
+	}
+	localc := make(chan localResult, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+		defer cancel()
+		drs, err := tpplug.Discover(ctx)
+		localc <- localResult{drs, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	cc := &cloudClient{url: *cloudURL}
+	if err := cc.login(ctx, *user, password); err != nil {
+		log.Fatalf("Logging in: %v", err)
+	}
+	cds, err := cc.devices(ctx)
+	if err != nil {
+		log.Fatalf("Listing devices: %v", err)
+	}
+	local := <-localc
+	if local.err != nil {
+		log.Fatalf("Discovering plugs: %v", local.err)
+	}
+
+	if !report(cds, local.drs, devices) {
+		os.Exit(1)
+	}
+}
+
+// report prints the inventory, and reports whether the cloud and local views agree.
+func report(cds []cloudDevice, drs []tpplug.DiscoveryResponse, devices *tpplug.Devices) bool {
+	localByMAC := make(map[tpplug.MAC]tpplug.DiscoveryResponse)
+	for _, dr := range drs {
+		localByMAC[dr.State.System.Info.MAC] = dr
+	}
+	sort.Slice(cds, func(i, j int) bool { return cds[i].Alias < cds[j].Alias })
+
+	var invisible []cloudDevice
+	inCloud := make(map[tpplug.MAC]bool)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tALIAS\tMODEL\tMAC\tFIRMWARE\tCLOUD\tLOCAL IP\t")
+	for _, cd := range cds {
+		mac := tpplug.CanonicalMAC(cd.MAC)
+		inCloud[mac] = true
+		name := cd.Alias
+		if d, ok := devices.Lookup(mac); ok && d.Name != "" {
+			name = d.Name
+		}
+		online := "offline"
+		if cd.Status == 1 {
+			online = "online"
+		}
+		ip := "-"
+		if dr, ok := localByMAC[mac]; ok {
+			ip = dr.Addr.IP.String()
+		} else {
+			invisible = append(invisible, cd)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, cd.Alias, cd.Model, mac, cd.FWVer, online, ip)
+	}
+	tw.Flush()
+
+	var localOnly []tpplug.DiscoveryResponse
+	for _, dr := range drs {
+		if !inCloud[dr.State.System.Info.MAC] {
+			localOnly = append(localOnly, dr)
+		}
+	}
+
+	if len(invisible) > 0 {
+		fmt.Printf("\n%d cloud-bound devices not visible locally:\n", len(invisible))
+		for _, cd := range invisible {
+			fmt.Printf("\t%s (%s, %s)\n", cd.Alias, cd.Model, tpplug.CanonicalMAC(cd.MAC))
+		}
+	}
+	if len(localOnly) > 0 {
+		fmt.Printf("\n%d local plugs not bound to this account:\n", len(localOnly))
+		for _, dr := range localOnly {
+			info := dr.State.System.Info
+			fmt.Printf("\t%s (%s, %s, %v)\n", devices.Name(dr.State), info.Model, info.MAC, dr.Addr.IP)
+		}
+	}
+	return len(invisible) == 0 && len(localOnly) == 0
+}
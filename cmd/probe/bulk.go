@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxCIDRHosts limits how large a CIDR range may be expanded.
+const maxCIDRHosts = 1 << 16
+
+type target struct {
+	addr     *net.UDPAddr
+	fromCIDR bool // plenty of addresses in a range are expected not to respond
+}
+
+// expandTargets parses target arguments, expanding CIDR ranges into their host addresses.
+func expandTargets(args []string, defPort int) ([]target, error) {
+	var ts []target
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			addr, err := parseTarget(arg, defPort)
+			if err != nil {
+				return nil, err
+			}
+			ts = append(ts, target{addr: addr})
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("CIDR range %q is not IPv4", arg)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if n := 1 << uint(bits-ones); n > maxCIDRHosts {
+			return nil, fmt.Errorf("CIDR range %q has %d addresses, more than the limit of %d", arg, n, maxCIDRHosts)
+		}
+		for ip := ip4.Mask(ipnet.Mask); ipnet.Contains(ip); ip = nextIP(ip) {
+			if bits-ones >= 2 && (ip.Equal(ipnet.IP) || isBroadcast(ip, ipnet)) {
+				// Skip network and broadcast addresses.
+				continue
+			}
+			ts = append(ts, target{
+				addr:     &net.UDPAddr{IP: ip, Port: defPort},
+				fromCIDR: true,
+			})
+		}
+	}
+	return ts, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func isBroadcast(ip net.IP, ipnet *net.IPNet) bool {
+	for i := range ip {
+		if ip[i]|ipnet.Mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// probeAll queries every target concurrently, and prints the results in target order,
+// followed by a summary of failures. It returns the exit code.
+func probeAll(ts []target, reqs [][]byte) int {
+	type result struct {
+		out bytes.Buffer
+		err error
+	}
+	results := make([]result, len(ts))
+	sem := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	for i, t := range ts {
+		i, t := i, t
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i].err = probeTarget(&results[i].out, t.addr, reqs)
+		}()
+	}
+	wg.Wait()
+
+	var failed, silent int
+	code := exitOK
+	for i, t := range ts {
+		r := &results[i]
+		if r.err != nil {
+			var neterr net.Error
+			if t.fromCIDR && errors.As(r.err, &neterr) && neterr.Timeout() {
+				silent++
+				continue
+			}
+			failed++
+			log.Printf("%v: %v", t.addr, r.err)
+			if c := exitCode(r.err); c > code {
+				code = c
+			}
+		}
+		if r.out.Len() == 0 {
+			continue
+		}
+		if *output == formatRaw && !*pretty {
+			// Raw JSON is a line per response, so keep the address on the same line.
+			for _, line := range bytes.Split(bytes.TrimSuffix(r.out.Bytes(), []byte("\n")), []byte("\n")) {
+				fmt.Printf("%v\t%s\n", t.addr, line)
+			}
+			continue
+		}
+		fmt.Printf("== %v ==\n", t.addr)
+		r.out.WriteTo(os.Stdout)
+	}
+	ok := len(ts) - failed - silent
+	if ok == 0 && code == exitOK {
+		code = exitNetwork
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d targets responded", ok, len(ts))
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, ", %d failed", failed)
+	}
+	if silent > 0 {
+		fmt.Fprintf(os.Stderr, ", %d did not respond", silent)
+	}
+	fmt.Fprintln(os.Stderr)
+	return code
+}
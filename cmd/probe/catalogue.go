@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The catalogue is a list of known queries, so common ones needn't be typed
+// out as JSON. An entry is given as a query argument by name, optionally with @,
+// followed by any parameters as name=value:
+//
+//	probe 192.168.1.20 daystat year=2024 month=5
+//
+// probe -list shows them all.
+
+type catalogueEntry struct {
+	name   string
+	desc   string
+	query  string // JSON, with $param placeholders
+	params []catalogueParam
+}
+
+type catalogueParam struct {
+	name string
+	str  bool          // a JSON string, rather than an integer
+	def  func() string // nil if required
+}
+
+func fixed(s string) func() string { return func() string { return s } }
+
+var catalogue = []catalogueEntry{
+	{name: "sysinfo", desc: "system information", query: `{"system":{"get_sysinfo":null}}`},
+	{name: "realtime", desc: "energy meter readings", query: `{"emeter":{"get_realtime":{}}}`},
+	{
+		name: "daystat", desc: "daily energy use for a month",
+		query: `{"emeter":{"get_daystat":{"year":$year,"month":$month}}}`,
+		params: []catalogueParam{
+			{name: "year", def: func() string { return strconv.Itoa(time.Now().Year()) }},
+			{name: "month", def: func() string { return strconv.Itoa(int(time.Now().Month())) }},
+		},
+	},
+	{
+		name: "monthstat", desc: "monthly energy use for a year",
+		query: `{"emeter":{"get_monthstat":{"year":$year}}}`,
+		params: []catalogueParam{
+			{name: "year", def: func() string { return strconv.Itoa(time.Now().Year()) }},
+		},
+	},
+	{
+		name: "relay", desc: "switch the relay (1 = on, 0 = off)",
+		query:  `{"system":{"set_relay_state":{"state":$state}}}`,
+		params: []catalogueParam{{name: "state"}},
+	},
+	{name: "on", desc: "switch the relay on", query: `{"system":{"set_relay_state":{"state":1}}}`},
+	{name: "off", desc: "switch the relay off", query: `{"system":{"set_relay_state":{"state":0}}}`},
+	{
+		name: "led", desc: "turn the status LED off (1) or on (0)",
+		query:  `{"system":{"set_led_off":{"off":$off}}}`,
+		params: []catalogueParam{{name: "off", def: fixed("1")}},
+	},
+	{
+		name: "alias", desc: "set the alias",
+		query:  `{"system":{"set_dev_alias":{"alias":$alias}}}`,
+		params: []catalogueParam{{name: "alias", str: true}},
+	},
+	{
+		name: "reboot", desc: "reboot after a delay in seconds",
+		query:  `{"system":{"reboot":{"delay":$delay}}}`,
+		params: []catalogueParam{{name: "delay", def: fixed("1")}},
+	},
+	{name: "schedule", desc: "schedule rules", query: `{"schedule":{"get_rules":null}}`},
+	{name: "countdown", desc: "countdown rules", query: `{"count_down":{"get_rules":null}}`},
+	{name: "countdown_clear", desc: "delete countdown rules", query: `{"count_down":{"delete_all_rules":null}}`},
+	{name: "light", desc: "a bulb's light state", query: `{"smartlife.iot.smartbulb.lightingservice":{"get_light_state":null}}`},
+	{name: "time", desc: "the plug's clock", query: `{"time":{"get_time":null}}`},
+	{name: "timezone", desc: "the plug's timezone index", query: `{"time":{"get_timezone":null}}`},
+	{name: "cloud", desc: "cloud connection status", query: `{"cnCloud":{"get_info":null}}`},
+	{name: "wifi_scan", desc: "scan for Wi-Fi networks", query: `{"netif":{"get_scaninfo":{"refresh":1}}}`},
+}
+
+func lookupCatalogue(name string) (catalogueEntry, bool) {
+	for _, ce := range catalogue {
+		if ce.name == name {
+			return ce, true
+		}
+	}
+	return catalogueEntry{}, false
+}
+
+// isParam reports whether a command line argument is a parameter of a catalogue entry.
+func isParam(arg string) bool {
+	return strings.Contains(arg, "=") && !isQuery(arg) && !strings.HasPrefix(arg, "@")
+}
+
+// catalogueQuery builds the query for the named catalogue entry with the given name=value parameters.
+func catalogueQuery(name string, args []string) ([]byte, error) {
+	ce, ok := lookupCatalogue(name)
+	if !ok {
+		return nil, fmt.Errorf("no command @%s in the catalogue; see -list", name)
+	}
+	given := make(map[string]string)
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		given[arg[:i]] = arg[i+1:]
+	}
+	var repl []string
+	for _, p := range ce.params {
+		v, ok := given[p.name]
+		delete(given, p.name)
+		if !ok {
+			if p.def == nil {
+				return nil, fmt.Errorf("@%s needs %s=", name, p.name)
+			}
+			v = p.def()
+		}
+		var enc []byte
+		if p.str {
+			enc, _ = json.Marshal(v)
+		} else {
+			if _, err := strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("@%s: %s must be an integer, not %q", name, p.name, v)
+			}
+			enc = []byte(v)
+		}
+		repl = append(repl, "$"+p.name, string(enc))
+	}
+	for k := range given {
+		return nil, fmt.Errorf("@%s has no parameter %q", name, k)
+	}
+	return []byte(strings.NewReplacer(repl...).Replace(ce.query)), nil
+}
+
+// listCatalogue writes the catalogue.
+func listCatalogue(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMMAND\tDESCRIPTION\tQUERY")
+	entries := append([]catalogueEntry(nil), catalogue...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	for _, ce := range entries {
+		usage := "@" + ce.name
+		for _, p := range ce.params {
+			switch {
+			case p.def == nil:
+				usage += " " + p.name + "=<value>"
+			default:
+				usage += " [" + p.name + "=" + p.def() + "]"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", usage, ce.desc, ce.query)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var debugMu sync.Mutex // serialises dumps from concurrent probes
+
+// wire returns the bytes of a message as sent on the wire.
+// The encryption is deterministic, so this is exactly what was sent or received.
+func wire(msg []byte) []byte {
+	enc := append([]byte(nil), msg...)
+	tpplug.Encrypt(enc)
+	if *useTCP {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(enc)))
+		enc = append(hdr[:], enc...)
+	}
+	return enc
+}
+
+// dumpExchange writes a hex dump of the request and response (if any) to stderr,
+// alongside their decrypted JSON.
+func dumpExchange(addr *net.UDPAddr, req, resp []byte, err error) {
+	var buf bytes.Buffer
+	proto := "udp"
+	if *useTCP {
+		proto = "tcp"
+	}
+	fmt.Fprintf(&buf, "=== %s %v: request (%d bytes)\n%s", proto, addr, len(req), req)
+	fmt.Fprintf(&buf, "\n%s", hex.Dump(wire(req)))
+	if err != nil {
+		fmt.Fprintf(&buf, "=== %s %v: error: %v\n", proto, addr, err)
+	} else {
+		fmt.Fprintf(&buf, "=== %s %v: response (%d bytes)\n%s", proto, addr, len(resp), resp)
+		fmt.Fprintf(&buf, "\n%s", hex.Dump(wire(resp)))
+	}
+
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	buf.WriteTo(os.Stderr)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats for decoded responses.
+const (
+	formatRaw   = "raw"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+	formatTable = "table"
+)
+
+// decoded is the known fields of a response, converted to natural units.
+type decoded struct {
+	IP    string     `json:"ip,omitempty" yaml:"ip,omitempty"` // only for discovery
+	MAC   tpplug.MAC `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Alias string     `json:"alias,omitempty" yaml:"alias,omitempty"`
+	Model string     `json:"model,omitempty" yaml:"model,omitempty"`
+	Kind  string     `json:"kind,omitempty" yaml:"kind,omitempty"`   // see tpplug.DeviceKind
+	Relay string     `json:"relay,omitempty" yaml:"relay,omitempty"` // "on" or "off"
+
+	Voltage *float64 `json:"voltage_v,omitempty" yaml:"voltage_v,omitempty"`
+	Current *float64 `json:"current_a,omitempty" yaml:"current_a,omitempty"`
+	Power   *float64 `json:"power_w,omitempty" yaml:"power_w,omitempty"`
+}
+
+func decodeState(state tpplug.State) decoded {
+	info := state.System.Info
+	d := decoded{
+		MAC:   info.MAC,
+		Alias: info.Alias,
+		Model: info.Model,
+		Kind:  string(state.Kind()),
+	}
+	if info.Model != "" {
+		// relay_state is omitted when off, so only trust it in a sysinfo response.
+		d.Relay = "off"
+		if info.RelayState == 1 {
+			d.Relay = "on"
+		}
+	}
+	rt := state.EnergyMeter.Realtime
+	if rt.Voltage != 0 || rt.Current != 0 || rt.Power != 0 {
+		v, i, p := float64(rt.Voltage)/1000, float64(rt.Current)/1000, float64(rt.Power)/1000
+		d.Voltage, d.Current, d.Power = &v, &i, &p
+	}
+	return d
+}
+
+// writeDecoded writes v, which is a decoded or []decoded, in the given format.
+func writeDecoded(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case formatYAML:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case formatTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		switch v := v.(type) {
+		case decoded:
+			writeFields(tw, v)
+		case []decoded:
+			fmt.Fprintln(tw, "MAC\tIP\tALIAS\tMODEL\tRELAY\tPOWER\t")
+			for _, d := range v {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n", d.MAC, d.IP, d.Alias, d.Model, d.Relay, units(d.Power, "%.1f W"))
+			}
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func writeFields(w io.Writer, d decoded) {
+	field := func(name, val string) {
+		if val != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, val)
+		}
+	}
+	field("ip", d.IP)
+	field("model", d.Model)
+	field("kind", d.Kind)
+	field("mac", d.MAC.String())
+	field("alias", d.Alias)
+	field("relay", d.Relay)
+	field("voltage", units(d.Voltage, "%.1f V"))
+	field("current", units(d.Current, "%.3f A"))
+	field("power", units(d.Power, "%.1f W"))
+}
+
+func units(v *float64, format string) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf(format, *v)
+}
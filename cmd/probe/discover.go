@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+func runDiscover(wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	var (
+		tds     []tpplug.TapoDevice
+		tapoErr error
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		if *tapo {
+			tds, tapoErr = tpplug.DiscoverTapo(ctx)
+		}
+	}()
+	drs, err := tpplug.DiscoverWithOptions(ctx, tpplug.DiscoverOptions{IPv6: *discoverIPv6})
+	<-done
+	if err != nil {
+		return err
+	}
+	if tapoErr != nil {
+		return fmt.Errorf("discovering Tapo devices: %w", tapoErr)
+	}
+	ds := []decoded{} // write [] rather than null if there are none
+	for _, dr := range drs {
+		d := decodeState(dr.State)
+		d.IP = dr.Addr.IP.String()
+		ds = append(ds, d)
+	}
+	for _, td := range tds {
+		ds = append(ds, decoded{
+			IP:    td.IP.String(),
+			MAC:   td.MAC,
+			Model: td.Model,
+			Kind:  string(td.Kind()),
+		})
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Alias < ds[j].Alias })
+
+	format := *output
+	if format == formatRaw {
+		format = formatTable
+	}
+	return writeDecoded(os.Stdout, format, ds)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Exit codes. 2 is avoided since the flag package uses it for bad flags.
+const (
+	exitOK      = 0
+	exitUsage   = 1 // also for failures not covered below
+	exitNetwork = 3 // no response, or a network error
+	exitDevice  = 4 // the device reported an error
+	exitDecode  = 5 // the response could not be decoded
+)
+
+// deviceError is a non-zero err_code somewhere in a response.
+type deviceError struct {
+	Path string // e.g. "system.set_relay_state"
+	Code int
+	Msg  string
+}
+
+func (de *deviceError) Error() string {
+	return fmt.Sprintf("%s: error code %d (%s)", de.Path, de.Code, de.Msg)
+}
+
+// decodeError is a response that isn't the expected JSON.
+type decodeError struct{ err error }
+
+func (de *decodeError) Error() string { return "decoding response: " + de.err.Error() }
+func (de *decodeError) Unwrap() error { return de.err }
+
+// checkResponse reports a decodeError if the response isn't JSON,
+// or a deviceError for the first non-zero err_code in it.
+func checkResponse(raw []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return &decodeError{err}
+	}
+	return findErrCode(nil, v)
+}
+
+func findErrCode(path []string, v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if code, ok := m["err_code"].(float64); ok && code != 0 {
+		msg, _ := m["err_msg"].(string)
+		return &deviceError{Path: strings.Join(path, "."), Code: int(code), Msg: msg}
+	}
+	// Walk in a stable order so the same error is always reported.
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := findErrCode(append(path, k), m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitCode returns the exit code for an error from probing.
+func exitCode(err error) int {
+	var devErr *deviceError
+	var decErr *decodeError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &devErr):
+		return exitDevice
+	case errors.As(err, &decErr):
+		return exitDecode
+	case errors.As(err, &netErr):
+		return exitNetwork
+	}
+	return exitUsage
+}
@@ -1,16 +1,66 @@
 /*
 probe queries a specific plug for its state,
 and writes it to standard output in its raw JSON format.
+
+With -pretty, the JSON is indented. With -o, the response is instead
+decoded into the known fields, shown in natural units as JSON, YAML or a table,
+and any fields that tpplug.State doesn't have are listed on standard error
+(unless -q is given), as a guide to what new firmware has.
+
+Multiple targets may be given, including CIDR ranges (e.g. 192.168.1.0/24),
+in which case they are queried concurrently and each result is labelled
+with its address.
+
+Several queries may be given, and are sent in turn over one socket to each target,
+stopping at the first that fails. For instance, to replace a plug's countdown rule:
+
+	probe 192.168.1.20 '{"count_down":{"delete_all_rules":null}}' \
+		'{"count_down":{"add_rule":{"enable":1,"delay":60,"act":0,"name":"off"}}}' \
+		'{"count_down":{"get_rules":null}}'
+
+Common queries are in a built-in catalogue, listed by -list, and may be given
+by name instead of as JSON, followed by any parameters. The name may have an @
+before it, and needs one if it could be taken for a target:
+
+	probe 192.168.1.20 sysinfo
+	probe 192.168.1.20 on
+	probe 192.168.1.20 @daystat year=2024 month=5
+
+With -i, queries are instead read from standard input, one per line, and sent
+to the one target as they are read, with history; see repl.go.
+
+Queries may instead be read from files with -f (use "-" for standard input),
+which may be repeated, in which case all arguments are targets.
+
+With -discover, it instead broadcasts a query and lists all responding plugs.
+With -tapo as well, it also lists Tapo devices, which use a different protocol.
+With -ipv6, it also discovers over IPv6. Targets may be IPv6 addresses,
+including link-local ones with a zone, such as fe80::1%eth0 or [fe80::1%eth0]:9999.
+
+With -record, each request and its response (decrypted) are appended to a file,
+one JSON object per line with the time, target and how long it took.
+With -replay, the requests in such a file are sent again in order, to the
+targets recorded or else to each target given, noting responses that differ.
+
+The exit code is 0 on success, 3 if a target didn't respond or had a network error,
+4 if the device reported an error (a non-zero err_code), 5 if the response
+couldn't be decoded, and 1 for anything else. With multiple targets,
+the highest code of any target is used, ignoring addresses in CIDR ranges
+that didn't respond.
 */
 package main
 
 import (
-	"context"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dsymonds/tpplug/tpplug"
@@ -18,7 +68,17 @@ import (
 
 const usage = `
 Usage:
-	probe [options] <ip> <query>
+	probe [options] <target>... <query>...
+	probe [options] <target>... @<command> [<param>=<value>...]...
+	probe [options] -f <file> [-f <file>...] <target>...
+	probe [options] -i <target>
+	probe [options] -discover
+	probe [options] -replay <file> [<target>...]
+	probe -list
+
+A target is <ip>[:port] (IPv6 ones in brackets if with a port), or a CIDR range like 192.168.1.0/24.
+Queries are the trailing arguments that are JSON objects, or commands from -list
+(optionally prefixed with @), such as sysinfo, on or off.
 
 Example queries:
 	{"system":{"get_sysinfo":null}}
@@ -29,35 +89,261 @@ Example queries:
 	{"count_down":{"get_rules":null}}
 `
 
+var (
+	pretty   = flag.Bool("pretty", false, "indent the JSON response")
+	decode   = flag.Bool("decode", false, "shorthand for -o table")
+	output   = flag.String("o", formatRaw, "output `format`: raw, json, yaml or table; all but raw decode into known fields")
+	quiet    = flag.Bool("q", false, "when decoding, don't report response fields that aren't known")
+	port     = flag.Int("port", 9999, "`port` to query, if not given with the address")
+	useTCP   = flag.Bool("tcp", false, "query over TCP instead of UDP")
+	debug    = flag.Bool("debug", false, "hex dump the encrypted request and response to stderr")
+	timeout  = flag.Duration("timeout", 3*time.Second, "how long to wait for each response")
+	retries  = flag.Int("retries", 0, "how many more times to try a target that doesn't respond")
+	reqFiles stringList
+
+	parallel = flag.Int("parallel", 64, "maximum `number` of targets to query at once")
+
+	discover     = flag.Bool("discover", false, "discover plugs instead of querying one")
+	discoverTime = flag.Duration("t", 5*time.Second, "how long to wait for discovery responses")
+	tapo         = flag.Bool("tapo", false, "with -discover, also discover Tapo devices (which can't be queried)")
+	discoverIPv6 = flag.Bool("ipv6", false, "with -discover, also discover over IPv6 by link-local multicast")
+
+	list = flag.Bool("list", false, "list the catalogue of known commands, which may be given as queries by name")
+
+	interactive = flag.Bool("i", false, "read queries from standard input, one per line, sending each to the one target")
+	historyFile = flag.String("history", defaultHistoryFile(), "`file` to keep the history of -i in; empty for none")
+
+	record = flag.String("record", "", "append each request and response to this `file`, as JSON lines")
+	replay = flag.String("replay", "", "send the requests recorded in this `file` again, to their targets or to those given")
+)
+
+func init() {
+	flag.Var(&reqFiles, "f", "read a query from this `file` (\"-\" for stdin) instead of the command line; may be repeated")
+}
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (sl *stringList) String() string { return strings.Join(*sl, ",") }
+func (sl *stringList) Set(s string) error {
+	*sl = append(*sl, s)
+	return nil
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprint(flag.CommandLine.Output(), usage)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	if flag.NArg() != 2 {
+	switch *output {
+	case formatRaw, formatJSON, formatYAML, formatTable:
+	default:
+		log.Fatalf("Unknown output format %q", *output)
+	}
+	if *decode {
+		*output = formatTable
+	}
+	if *list {
+		if err := listCatalogue(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := openRecord(); err != nil {
+		log.Fatal(err)
+	}
+	if *replay != "" {
+		os.Exit(runReplay(os.Stdout, *replay, flag.Args()))
+	}
+	if *discover {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := runDiscover(*discoverTime); err != nil {
+			log.Fatalf("Discovering: %v", err)
+		}
+		return
+	}
+	if *interactive {
+		if flag.NArg() != 1 || len(reqFiles) > 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		addr, err := parseTarget(flag.Arg(0), *port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runInteractive(os.Stdin, os.Stdout, addr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	targets := flag.Args()
+	var reqs [][]byte
+	if len(reqFiles) > 0 {
+		for _, name := range reqFiles {
+			req, err := readRequest(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			reqs = append(reqs, req)
+		}
+	} else {
+		var err error
+		if targets, reqs, err = splitQueries(targets); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(targets) == 0 || len(reqs) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	ipStr := flag.Arg(0) // TODO: take port too?
-	req := []byte(flag.Arg(1))
+	if len(targets) == 1 && !strings.Contains(targets[0], "/") {
+		addr, err := parseTarget(targets[0], *port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := probeTarget(os.Stdout, addr, reqs); err != nil {
+			log.Printf("Probing %v: %v", addr, err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	ts, err := expandTargets(targets, *port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(probeAll(ts, reqs))
+}
 
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		log.Fatalf("Bad IP %q", ipStr)
+// splitQueries splits command line arguments into the targets and the trailing queries,
+// expanding catalogue commands.
+func splitQueries(args []string) (targets []string, reqs [][]byte, err error) {
+	n := len(args)
+	for n > 1 {
+		if isQuery(args[n-1]) {
+			reqs = append([][]byte{[]byte(args[n-1])}, reqs...)
+			n--
+			continue
+		}
+		j := n - 1
+		for j > 0 && isParam(args[j]) {
+			j--
+		}
+		if j == 0 || !isCommand(args[j]) {
+			break
+		}
+		req, err := catalogueQuery(strings.TrimPrefix(args[j], "@"), args[j+1:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		reqs = append([][]byte{req}, reqs...)
+		n = j
 	}
-	addr := &net.UDPAddr{
-		IP:   ip,
-		Port: 9999,
+	if len(reqs) == 0 && n >= 2 {
+		// Not JSON, but let the plug be the judge of that.
+		n--
+		reqs = [][]byte{[]byte(args[n])}
 	}
+	return args[:n], reqs, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// isQuery reports whether a command line argument is a query rather than a target.
+func isQuery(arg string) bool {
+	return strings.HasPrefix(strings.TrimSpace(arg), "{")
+}
 
-	raw, err := tpplug.RawOp(ctx, addr, req)
+// isCommand reports whether a command line argument names a catalogue entry.
+// Without an @, it mustn't also be a target.
+func isCommand(arg string) bool {
+	if strings.HasPrefix(arg, "@") {
+		return true
+	}
+	if _, ok := lookupCatalogue(arg); !ok {
+		return false
+	}
+	_, err := parseTarget(arg, *port)
+	return err != nil
+}
+
+// readRequest reads a query from the named file, or standard input if it is "-".
+// It is compacted to keep the datagram small.
+func readRequest(name string) ([]byte, error) {
+	var raw []byte
+	var err error
+	if name == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(name)
+	}
 	if err != nil {
-		log.Fatalf("Probing %v: %v", addr, err)
+		return nil, fmt.Errorf("reading query: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return nil, fmt.Errorf("query in %s is not valid JSON: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// probeTarget sends each request to addr in turn over one socket,
+// and writes the responses to w. It stops at the first that fails.
+func probeTarget(w io.Writer, addr *net.UDPAddr, reqs [][]byte) error {
+	s := &session{addr: addr}
+	defer s.close()
+	for i, req := range reqs {
+		raw, err := s.probe(req)
+		if err == nil {
+			err = checkResponse(raw)
+			if rerr := render(w, addr, raw); rerr != nil && err == nil {
+				err = rerr
+			}
+			if len(reqs) > 1 && *output == formatRaw && !*pretty {
+				// Keep each raw response on its own line.
+				io.WriteString(w, "\n")
+			}
+		}
+		if err != nil {
+			if len(reqs) > 1 {
+				err = fmt.Errorf("query %d: %w", i+1, err)
+			}
+			return err
+		}
 	}
-	os.Stdout.Write(raw)
+	return nil
+}
+
+// render writes a response from addr according to the output flags.
+func render(w io.Writer, addr *net.UDPAddr, raw []byte) error {
+	if *output != formatRaw {
+		var state tpplug.State
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return &decodeError{err}
+		}
+		if unknown := unknownFields(raw); len(unknown) > 0 && !*quiet {
+			log.Printf("%v: not decoded: %s", addr, strings.Join(unknown, ", "))
+		}
+		return writeDecoded(w, *output, decodeState(state))
+	}
+	if *pretty {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, raw, "", "  "); err != nil {
+			return fmt.Errorf("indenting response: %w", err)
+		}
+		buf.WriteByte('\n')
+		_, err := buf.WriteTo(w)
+		return err
+	}
+	_, err := w.Write(raw)
+	return err
+}
+
+// parseTarget parses an IP address (IPv6 ones optionally with a zone),
+// optionally with a port. If there's no port, defPort is used.
+func parseTarget(s string, defPort int) (*net.UDPAddr, error) {
+	return tpplug.ParseAddr(s, defPort)
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -record, every exchange is appended to a file as a line of JSON,
+// decrypted and timestamped, to attach to a bug report.
+// With -replay, the requests in such a file are sent again.
+
+// exchange is one recorded request and its outcome.
+type exchange struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"` // ip:port
+	Proto    string    `json:"proto"`  // "udp" or "tcp"
+	Request  string    `json:"request"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Elapsed  string    `json:"elapsed"` // e.g. "12.3ms"
+}
+
+var (
+	recordMu  sync.Mutex // serialises records from concurrent probes
+	recordOut *os.File   // nil unless -record is set
+)
+
+// openRecord opens the -record file, if set.
+func openRecord() error {
+	if *record == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening record file: %w", err)
+	}
+	recordOut = f
+	return nil
+}
+
+// recordExchange appends an exchange to the -record file.
+// Each is written in full as it happens, so nothing is lost on exit.
+func recordExchange(addr *net.UDPAddr, start time.Time, req, resp []byte, err error) {
+	if recordOut == nil {
+		return
+	}
+	ex := exchange{
+		Time:     start,
+		Target:   addr.String(),
+		Proto:    "udp",
+		Request:  string(req),
+		Response: string(resp),
+		Elapsed:  time.Since(start).String(),
+	}
+	if *useTCP {
+		ex.Proto = "tcp"
+	}
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	line, jerr := json.Marshal(ex)
+	if jerr != nil {
+		log.Printf("Recording exchange: %v", jerr)
+		return
+	}
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if _, werr := recordOut.Write(append(line, '\n')); werr != nil {
+		log.Printf("Recording exchange: %v", werr)
+	}
+}
+
+func readRecording(name string) ([]exchange, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exs []exchange
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ex exchange
+		if err := json.Unmarshal(sc.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		exs = append(exs, ex)
+	}
+	return exs, sc.Err()
+}
+
+// runReplay sends the requests recorded in a file again, in order,
+// to their recorded targets, or else to each of targets.
+// It writes the responses to w, and notes any that differ from the recording.
+// It returns the exit code.
+func runReplay(w io.Writer, name string, targets []string) int {
+	exs, err := readRecording(name)
+	if err != nil {
+		log.Printf("Reading recording: %v", err)
+		return exitUsage
+	}
+	var override []*net.UDPAddr
+	for _, t := range targets {
+		addr, err := parseTarget(t, *port)
+		if err != nil {
+			log.Print(err)
+			return exitUsage
+		}
+		override = append(override, addr)
+	}
+
+	sessions := make(map[string]*session) // keyed by address
+	defer func() {
+		for _, s := range sessions {
+			s.close()
+		}
+	}()
+	code := exitOK
+	for i, ex := range exs {
+		addrs := override
+		if len(addrs) == 0 {
+			addr, err := parseTarget(ex.Target, *port)
+			if err != nil {
+				log.Printf("Exchange %d: %v", i+1, err)
+				return exitUsage
+			}
+			addrs = []*net.UDPAddr{addr}
+		}
+		for _, addr := range addrs {
+			s, ok := sessions[addr.String()]
+			if !ok {
+				s = &session{addr: addr}
+				sessions[addr.String()] = s
+			}
+			raw, err := s.probe([]byte(ex.Request))
+			if err == nil {
+				err = checkResponse(raw)
+				if rerr := render(w, addr, raw); rerr != nil && err == nil {
+					err = rerr
+				}
+				if *output == formatRaw && !*pretty {
+					io.WriteString(w, "\n")
+				}
+				if len(override) == 0 && ex.Response != "" && string(raw) != ex.Response {
+					log.Printf("%v: exchange %d: response differs from recording", addr, i+1)
+				}
+			}
+			if err != nil {
+				log.Printf("%v: exchange %d: %v", addr, i+1, err)
+				if c := exitCode(err); c > code {
+					code = c
+				}
+			}
+		}
+	}
+	return code
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// With -i, probe reads queries from standard input, one per line, and sends
+// each to the one target as soon as it is read, over one socket:
+//
+//	$ probe -i 192.168.1.20
+//	probe> sysinfo
+//	probe> daystat month=5
+//	probe> {"system":{"set_relay_state":{"state":0}}}
+//	probe> !!
+//
+// A line is a JSON query, or a command from the catalogue (with or without @)
+// and its parameters. "history" lists earlier lines, and !<n> or !! sends one again.
+// Lines are kept in the -history file, so they can be recalled in later runs too.
+
+// maxHistory is how many lines of history are kept.
+const maxHistory = 1000
+
+const replHelp = `Enter a JSON query, or a command from the catalogue and its parameters:
+	sysinfo
+	daystat year=2024 month=5
+	alias alias=Living room
+Other commands:
+	history     list earlier lines
+	!<n>, !!    send line n, or the last line, again
+	list        list the catalogue
+	quit        stop (as does end of input)
+`
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".probe_history")
+}
+
+// runInteractive sends queries read from in to addr, writing responses to w,
+// until in ends or a line says to quit.
+func runInteractive(in io.Reader, w io.Writer, addr *net.UDPAddr) error {
+	hist := loadHistory(*historyFile)
+	var hf *os.File
+	if *historyFile != "" {
+		var err error
+		if hf, err = os.OpenFile(*historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			log.Printf("Not keeping history: %v", err)
+		} else {
+			defer hf.Close()
+		}
+	}
+
+	s := &session{addr: addr}
+	defer s.close()
+	prompt := isTerminal(os.Stdin)
+	sc := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(os.Stderr, "probe> ")
+		}
+		if !sc.Scan() {
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+			continue
+		case line == "quit" || line == "exit":
+			return nil
+		case line == "help":
+			fmt.Fprint(w, replHelp)
+			continue
+		case line == "list":
+			if err := listCatalogue(w); err != nil {
+				return err
+			}
+			continue
+		case line == "history":
+			for i, h := range hist {
+				fmt.Fprintf(w, "%5d  %s\n", i+1, h)
+			}
+			continue
+		case strings.HasPrefix(line, "!"):
+			h, err := recall(hist, line[1:])
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			line = h
+			fmt.Fprintln(os.Stderr, line)
+		}
+		hist = append(hist, line)
+		if hf != nil {
+			fmt.Fprintln(hf, line)
+		}
+
+		req, err := parseLine(line)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		raw, err := s.probe(req)
+		if err == nil {
+			err = checkResponse(raw)
+			if rerr := render(w, addr, raw); rerr != nil && err == nil {
+				err = rerr
+			}
+			if *output == formatRaw && !*pretty {
+				io.WriteString(w, "\n")
+			}
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	if prompt {
+		fmt.Fprintln(os.Stderr)
+	}
+	return sc.Err()
+}
+
+// parseLine turns a line of interactive input into a query.
+// Parameters of a command are separated by spaces, though a parameter's value
+// may have spaces in it too, since anything without = continues the one before.
+func parseLine(line string) ([]byte, error) {
+	if isQuery(line) {
+		return []byte(line), nil
+	}
+	fields := strings.Fields(line)
+	var params []string
+	for _, f := range fields[1:] {
+		if strings.Contains(f, "=") || len(params) == 0 {
+			params = append(params, f)
+			continue
+		}
+		params[len(params)-1] += " " + f
+	}
+	for _, p := range params {
+		if !strings.Contains(p, "=") {
+			return nil, fmt.Errorf("parameter %q should be name=value", p)
+		}
+	}
+	return catalogueQuery(strings.TrimPrefix(fields[0], "@"), params)
+}
+
+// recall finds the line of history that follows a !: a number, or another ! for the last.
+func recall(hist []string, ref string) (string, error) {
+	if ref == "!" {
+		if len(hist) == 0 {
+			return "", fmt.Errorf("no history")
+		}
+		return hist[len(hist)-1], nil
+	}
+	n, err := strconv.Atoi(ref)
+	if err != nil || n < 1 || n > len(hist) {
+		return "", fmt.Errorf("no line %q in history", ref)
+	}
+	return hist[n-1], nil
+}
+
+// loadHistory reads the last maxHistory lines from the named file, if it exists.
+func loadHistory(name string) []string {
+	if name == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Reading history: %v", err)
+		}
+		return nil
+	}
+	var hist []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			hist = append(hist, line)
+		}
+	}
+	if len(hist) > maxHistory {
+		hist = hist[len(hist)-maxHistory:]
+	}
+	return hist
+}
+
+// isTerminal reports whether f looks like a terminal, so is worth prompting.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
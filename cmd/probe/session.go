@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// maxUDPResponse is the largest UDP datagram.
+const maxUDPResponse = 1 << 16
+
+// session talks to a plug over a single socket, reused for each query,
+// so a sequence of queries looks to the plug like one client.
+type session struct {
+	addr *net.UDPAddr
+	conn net.Conn // nil until needed, and after a network error
+}
+
+func (s *session) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// probe sends a request, retrying on network errors up to *retries times.
+// A network error may leave a late response in flight, or a TCP stream out of step,
+// so each retry is on a fresh socket.
+func (s *session) probe(req []byte) (resp []byte, err error) {
+	for try := 0; ; try++ {
+		resp, err = s.probeOnce(req)
+		var neterr net.Error
+		if err != nil && errors.As(err, &neterr) {
+			s.close()
+		}
+		if err == nil || !errors.As(err, &neterr) || try >= *retries {
+			return resp, err
+		}
+	}
+}
+
+func (s *session) probeOnce(req []byte) (resp []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if *debug {
+		defer func() { dumpExchange(s.addr, req, resp, err) }()
+	}
+	if recordOut != nil {
+		start := time.Now()
+		defer func() { recordExchange(s.addr, start, req, resp, err) }()
+	}
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(dl)
+	}
+	if *useTCP {
+		return tcpExchange(s.conn, req)
+	}
+	return s.udpExchange(req)
+}
+
+func (s *session) dial(ctx context.Context) error {
+	var d net.Dialer
+	var err error
+	if *useTCP {
+		s.conn, err = d.DialContext(ctx, "tcp", (&net.TCPAddr{IP: s.addr.IP, Port: s.addr.Port}).String())
+	} else {
+		// Not a connected socket, since replies to a broadcast come from elsewhere.
+		network := "udp4"
+		if s.addr.IP.To4() == nil {
+			network = "udp6"
+		}
+		s.conn, err = net.ListenUDP(network, &net.UDPAddr{})
+	}
+	return err
+}
+
+// udpExchange sends a request as a datagram, and waits for the response,
+// ignoring anything that arrives from elsewhere (unless addr is a broadcast or multicast address).
+func (s *session) udpExchange(req []byte) ([]byte, error) {
+	conn := s.conn.(*net.UDPConn)
+	msg := append([]byte(nil), req...)
+	tpplug.Encrypt(msg)
+	if _, err := conn.WriteToUDP(msg, s.addr); err != nil {
+		return nil, fmt.Errorf("sending message: %w", err)
+	}
+	buf := make([]byte, maxUDPResponse)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("reading message: %w", err)
+		}
+		if !s.addr.IP.Equal(net.IPv4bcast) && !s.addr.IP.IsMulticast() && (!raddr.IP.Equal(s.addr.IP) || raddr.Port != s.addr.Port) {
+			continue
+		}
+		resp := buf[:n]
+		tpplug.Decrypt(resp)
+		return resp, nil
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// maxTCPResponse bounds the response length accepted over TCP.
+const maxTCPResponse = 1 << 20
+
+// tcpExchange sends a request over a TCP connection to a plug, and reads the response.
+// The TCP framing is the same XOR encryption, preceded by a 4 byte big-endian length.
+// Some newer firmware no longer answers on UDP.
+func tcpExchange(conn net.Conn, req []byte) ([]byte, error) {
+	msg := make([]byte, 4+len(req))
+	binary.BigEndian.PutUint32(msg, uint32(len(req)))
+	copy(msg[4:], req)
+	tpplug.Encrypt(msg[4:])
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("sending message: %w", err)
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading message length: %w", err)
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxTCPResponse {
+		return nil, fmt.Errorf("response length %d too large", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	tpplug.Decrypt(resp)
+	return resp, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// When decoding, probe reports the fields of a response that tpplug.State
+// doesn't have, which shows what new firmware has that might be worth adding.
+
+// unknownFields returns the dotted paths of the fields in a response
+// that aren't decoded into tpplug.State, in order. Error codes are
+// handled separately, so aren't included.
+func unknownFields(raw []byte) []string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil // reported elsewhere
+	}
+	return unknownIn(nil, v, reflect.TypeOf(tpplug.State{}))
+}
+
+func unknownIn(path []string, v interface{}, t reflect.Type) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var unknown []string
+	for _, k := range keys {
+		if k == "err_code" || k == "err_msg" {
+			continue
+		}
+		p := append(append([]string(nil), path...), k)
+		f, ok := jsonField(t, k)
+		if !ok {
+			unknown = append(unknown, strings.Join(p, "."))
+			continue
+		}
+		unknown = append(unknown, unknownIn(p, m[k], f.Type)...)
+	}
+	return unknown
+}
+
+// jsonField finds the field of a struct type that encoding/json would decode key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// device is a connection to a single plug.
+type device struct {
+	addr *net.UDPAddr
+}
+
+func (d device) alias() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	state, err := tpplug.QuerySysinfoOnly(ctx, d.addr)
+	if err != nil {
+		return "", err
+	}
+	return state.System.Info.Alias, nil
+}
+
+func (d device) setAlias(alias string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return tpplug.SetAlias(ctx, d.addr, alias)
+}
+
+func (d device) schedule() ([]tpplug.ScheduleRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return tpplug.ScheduleRules(ctx, d.addr)
+}
+
+func (d device) addSchedule(r tpplug.ScheduleRule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	_, err := tpplug.AddScheduleRule(ctx, d.addr, r)
+	return err
+}
+
+func (d device) deleteSchedule(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return tpplug.DeleteScheduleRule(ctx, d.addr, id)
+}
+
+func (d device) countdown() ([]tpplug.CountdownRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return tpplug.CountdownRules(ctx, d.addr)
+}
+
+// setCountdown replaces any countdown rule with r, or just removes it if r is nil.
+// There is only one countdown rule permitted at a time.
+func (d device) setCountdown(r *tpplug.CountdownRule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := tpplug.DeleteCountdowns(ctx, d.addr); err != nil || r == nil {
+		return err
+	}
+	_, err := tpplug.AddCountdown(ctx, d.addr, *r)
+	return err
+}
+
+// discoverAll finds the addresses of plugs on the network, keyed by MAC.
+func discoverAll() (map[tpplug.MAC]*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[tpplug.MAC]*net.UDPAddr)
+	for _, dr := range drs {
+		addrs[dr.State.System.Info.MAC] = dr.Addr
+	}
+	return addrs, nil
+}
+
+func minutesOfDay(t time.Time) int { return t.Hour()*60 + t.Minute() }
@@ -0,0 +1,233 @@
+/*
+schedsync reconciles TP-Link smart plugs with a declarative description
+of their aliases, weekly schedules and countdown rules.
+
+	schedsync [flags] diff|apply|report
+
+"diff" (the default) shows the changes needed, and exits with status 1 if there are any.
+"apply" makes them. "report" summarises which plugs are in sync.
+Errors cause an exit status of 2.
+
+The config file looks like
+
+	plugs:
+	  "50:C7:BF:00:00:01":
+	    ip: 192.168.1.20        # optional; otherwise found by discovery
+	    alias: Heater
+	    schedule:               # if present, replaces all schedule rules
+	      - name: morning
+	        days: [mon, tue, wed, thu, fri]   # empty means every day
+	        time: "06:30"
+	        action: on
+	      - name: evening
+	        time: "22:00"
+	        action: off
+	        enabled: false
+	    countdown:              # if present, the only countdown rule
+	      delay: 2h             # zero means no countdown rule
+	      action: off
+
+Plugs, and parts of a plug, that aren't mentioned are left alone.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile   = flag.String("f", "schedules.yaml", "config `file`")
+	discoverTime = flag.Duration("t", 2*time.Second, "how long to wait for discovery")
+	timeout      = flag.Duration("timeout", 3*time.Second, "how long to wait for a plug to respond")
+)
+
+type Config struct {
+	Plugs map[string]PlugSpec // keyed by MAC
+}
+
+type PlugSpec struct {
+	IP        string
+	Alias     string
+	Schedule  *[]RuleSpec
+	Countdown *CountdownSpec
+}
+
+type RuleSpec struct {
+	Name    string
+	Days    []string // "mon", "tue", etc.
+	Time    string   // "15:04"
+	Action  action
+	Enabled *bool // default true
+}
+
+type CountdownSpec struct {
+	Delay  time.Duration
+	Action action
+}
+
+// action is a relay action, written as on/off (which YAML also treats as booleans).
+type action bool
+
+func (a *action) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*a = action(v)
+		return nil
+	case string:
+		switch strings.ToLower(v) {
+		case "on":
+			*a = true
+			return nil
+		case "off":
+			*a = false
+			return nil
+		}
+	}
+	return fmt.Errorf("bad action %v (want on or off)", v)
+}
+
+func (a action) int() int {
+	if a {
+		return 1
+	}
+	return 0
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("schedsync: ")
+	flag.Parse()
+	mode := "diff"
+	if flag.NArg() > 0 {
+		mode = flag.Arg(0)
+	}
+	if flag.NArg() > 1 || (mode != "diff" && mode != "apply" && mode != "report") {
+		fmt.Fprintln(os.Stderr, "usage: schedsync [flags] diff|apply|report")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	raw, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		fatal(err)
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		fatalf("parsing config file %s: %v", *configFile, err)
+	}
+	desired := make(map[tpplug.MAC]desiredPlug)
+	for mac, ps := range config.Plugs {
+		nmac, err := tpplug.ParseMAC(mac)
+		if err != nil {
+			fatalf("plug %s: %v", mac, err)
+		}
+		dp, err := ps.resolve()
+		if err != nil {
+			fatalf("plug %s: %v", mac, err)
+		}
+		dp.mac = mac
+		desired[nmac] = dp
+	}
+
+	var discovered map[tpplug.MAC]*net.UDPAddr
+	for _, dp := range desired {
+		if dp.ip == nil {
+			if discovered, err = discoverAll(); err != nil {
+				fatalf("discovering plugs: %v", err)
+			}
+			break
+		}
+	}
+
+	var macs []tpplug.MAC
+	for mac := range desired {
+		macs = append(macs, mac)
+	}
+	sort.Slice(macs, func(i, j int) bool { return macs[i] < macs[j] })
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	var drift, failed bool
+	for _, nmac := range macs {
+		dp := desired[nmac]
+		addr := discovered[nmac]
+		if dp.ip != nil {
+			addr = &net.UDPAddr{IP: dp.ip, Port: 9999}
+		}
+		if addr == nil {
+			failed = true
+			if mode == "report" {
+				fmt.Fprintf(tw, "%s\t\tnot found\t\n", dp.mac)
+			} else {
+				log.Printf("%s: not found by discovery", dp.mac)
+			}
+			continue
+		}
+		changes, alias, err := plan(device{addr}, dp)
+		if err != nil {
+			failed = true
+			if mode == "report" {
+				fmt.Fprintf(tw, "%s\t%s\terror: %v\t\n", dp.mac, alias, err)
+			} else {
+				log.Printf("%s: %v", dp.mac, err)
+			}
+			continue
+		}
+		drift = drift || len(changes) > 0
+		switch mode {
+		case "report":
+			status := "in sync"
+			if len(changes) > 0 {
+				status = fmt.Sprintf("%d change(s) needed", len(changes))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t\n", dp.mac, alias, status)
+		case "diff":
+			for _, c := range changes {
+				fmt.Printf("%s (%s): %s\n", dp.mac, alias, c.desc)
+			}
+		case "apply":
+			for _, c := range changes {
+				if err := c.apply(); err != nil {
+					failed = true
+					log.Printf("%s (%s): %s: %v", dp.mac, alias, c.desc, err)
+					continue
+				}
+				fmt.Printf("%s (%s): %s: done\n", dp.mac, alias, c.desc)
+			}
+		}
+	}
+	tw.Flush()
+
+	switch {
+	case failed:
+		os.Exit(2)
+	case drift && mode == "diff":
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(2)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fatal(fmt.Errorf(format, args...))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// desiredPlug is a validated PlugSpec, in device terms.
+type desiredPlug struct {
+	mac       string
+	ip        net.IP
+	alias     string
+	schedule  []tpplug.ScheduleRule  // nil if not managed
+	countdown **tpplug.CountdownRule // nil if not managed; *countdown is nil for no rule
+}
+
+func (ps PlugSpec) resolve() (desiredPlug, error) {
+	dp := desiredPlug{alias: ps.Alias}
+	if ps.IP != "" {
+		if dp.ip = net.ParseIP(ps.IP); dp.ip == nil {
+			return dp, fmt.Errorf("bad IP %q", ps.IP)
+		}
+	}
+	if ps.Schedule != nil {
+		dp.schedule = []tpplug.ScheduleRule{}
+		for _, rs := range *ps.Schedule {
+			r, err := rs.resolve()
+			if err != nil {
+				return dp, fmt.Errorf("schedule rule %q: %w", rs.Name, err)
+			}
+			dp.schedule = append(dp.schedule, r)
+		}
+	}
+	if cs := ps.Countdown; cs != nil {
+		var cr *tpplug.CountdownRule
+		if cs.Delay < 0 {
+			return dp, fmt.Errorf("negative countdown delay %v", cs.Delay)
+		} else if cs.Delay > 0 {
+			if cs.Delay < time.Second {
+				return dp, fmt.Errorf("countdown delay %v too short", cs.Delay)
+			}
+			cr = &tpplug.CountdownRule{Name: "schedsync", Enable: 1, Delay: int(cs.Delay / time.Second), Act: cs.Action.int()}
+		}
+		dp.countdown = &cr
+	}
+	return dp, nil
+}
+
+func (rs RuleSpec) resolve() (tpplug.ScheduleRule, error) {
+	t, err := time.Parse("15:04", rs.Time)
+	if err != nil {
+		return tpplug.ScheduleRule{}, fmt.Errorf("bad time %q (want HH:MM)", rs.Time)
+	}
+	r := tpplug.ScheduleRule{
+		Name:     rs.Name,
+		Enable:   1,
+		WDay:     make([]int, 7),
+		SMin:     minutesOfDay(t),
+		SAct:     rs.Action.int(),
+		EtimeOpt: -1,
+		EAct:     -1,
+		Repeat:   1,
+	}
+	if rs.Enabled != nil && !*rs.Enabled {
+		r.Enable = 0
+	}
+	if len(rs.Days) == 0 {
+		for i := range r.WDay {
+			r.WDay[i] = 1
+		}
+	}
+	for _, d := range rs.Days {
+		i := indexOf(weekdays, strings.ToLower(d))
+		if i < 0 {
+			return tpplug.ScheduleRule{}, fmt.Errorf("bad day %q", d)
+		}
+		r.WDay[i] = 1
+	}
+	return r, nil
+}
+
+func indexOf(ss []string, s string) int {
+	for i, x := range ss {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// ruleKey identifies a schedule rule by everything schedsync manages.
+func ruleKey(r tpplug.ScheduleRule) string {
+	return fmt.Sprintf("%s|%v|%d|%d|%d|%d|%d", r.Name, r.WDay, r.StimeOpt, r.SMin, r.SAct, r.Enable, r.Repeat)
+}
+
+func describeRule(r tpplug.ScheduleRule) string {
+	var days []string
+	for i, on := range r.WDay {
+		if on == 1 && i < len(weekdays) {
+			days = append(days, weekdays[i])
+		}
+	}
+	at := fmt.Sprintf("%02d:%02d", r.SMin/60, r.SMin%60)
+	if r.StimeOpt != 0 {
+		at = "sunrise/sunset"
+	}
+	desc := fmt.Sprintf("%q %s at %s turn %s", r.Name, strings.Join(days, ","), at, onOff(r.SAct == 1))
+	if r.Enable != 1 {
+		desc += " (disabled)"
+	}
+	return desc
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+type change struct {
+	desc  string
+	apply func() error
+}
+
+// plan works out the changes needed to bring the device in line with dp.
+// It also returns the device's current alias.
+func plan(d device, dp desiredPlug) ([]change, string, error) {
+	alias, err := d.alias()
+	if err != nil {
+		return nil, "", err
+	}
+	var changes []change
+	if dp.alias != "" && dp.alias != alias {
+		changes = append(changes, change{
+			desc:  fmt.Sprintf("rename %q to %q", alias, dp.alias),
+			apply: func() error { return d.setAlias(dp.alias) },
+		})
+	}
+
+	if dp.schedule != nil {
+		current, err := d.schedule()
+		if err != nil {
+			return nil, alias, fmt.Errorf("getting schedule: %w", err)
+		}
+		want := make(map[string]int) // rule key => count
+		for _, r := range dp.schedule {
+			want[ruleKey(r)]++
+		}
+		for _, r := range current {
+			r := r
+			if k := ruleKey(r); want[k] > 0 {
+				want[k]--
+				continue
+			}
+			changes = append(changes, change{
+				desc:  "delete schedule rule " + describeRule(r),
+				apply: func() error { return d.deleteSchedule(r.ID) },
+			})
+		}
+		for _, r := range dp.schedule {
+			r := r
+			if k := ruleKey(r); want[k] > 0 {
+				want[k]--
+				changes = append(changes, change{
+					desc:  "add schedule rule " + describeRule(r),
+					apply: func() error { return d.addSchedule(r) },
+				})
+			}
+		}
+	}
+
+	if dp.countdown != nil {
+		current, err := d.countdown()
+		if err != nil {
+			return nil, alias, fmt.Errorf("getting countdown rules: %w", err)
+		}
+		cr := *dp.countdown
+		inSync := len(current) == 0 && cr == nil
+		if len(current) == 1 && cr != nil {
+			c := current[0]
+			inSync = c.Enable == cr.Enable && c.Delay == cr.Delay && c.Act == cr.Act
+		}
+		if !inSync {
+			desc := "remove countdown rule"
+			if cr != nil {
+				desc = fmt.Sprintf("set countdown rule: turn %s after %v", onOff(cr.Act == 1), time.Duration(cr.Delay)*time.Second)
+			}
+			changes = append(changes, change{
+				desc:  desc,
+				apply: func() error { return d.setCountdown(cr) },
+			})
+		}
+	}
+	return changes, alias, nil
+}
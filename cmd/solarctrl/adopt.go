@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// AdoptConfig enables adopting newly discovered plugs from the web UI,
+// so adding a smart plug doesn't mean hand-editing YAML.
+// Discovery runs every Interval (default 10m), and TP-Link plugs that aren't
+// already discretionary plugs (by MAC, alias, name or IP) are listed with an
+// "adopt" button. Adopting one appends an entry to File, a YAML list of extra
+// discretionary plugs in the same form as discretionary_plugs, which is read
+// along with the config file at startup:
+//
+//	adopt:
+//	  file: /var/lib/solarctrl/adopted.yaml
+//	  template:
+//	    turn_on: true
+//	    turn_off: true
+//	    min_run: 30m
+//	  ignore: ["50:C7:BF:00:00:09"]  # never offer these
+//
+// Each entry is the template with the plug's name and MAC, and the consumption
+// given when adopting it, which defaults to the template's, or else to what
+// the plug was drawing when it was found. Adopted plugs take effect when
+// solarctrl is restarted.
+type AdoptConfig struct {
+	File     string
+	Interval time.Duration
+	Template yaml.MapSlice
+	Ignore   []string // MACs
+
+	tmpl   TPPlugConfig // Template, decoded
+	ignore map[tpplug.MAC]bool
+}
+
+func (ac *AdoptConfig) check() error {
+	if ac.File == "" {
+		return fmt.Errorf("adopt needs a file")
+	}
+	if ac.Interval <= 0 {
+		ac.Interval = 10 * time.Minute
+	}
+	raw, err := yaml.Marshal(ac.Template)
+	if err != nil {
+		return fmt.Errorf("adopt: encoding template: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(raw, &ac.tmpl); err != nil {
+		return fmt.Errorf("adopt: bad template: %w", err)
+	}
+	ac.ignore = make(map[tpplug.MAC]bool)
+	for _, s := range ac.Ignore {
+		mac, err := tpplug.ParseMAC(s)
+		if err != nil {
+			return fmt.Errorf("adopt: ignore: %w", err)
+		}
+		ac.ignore[mac] = true
+	}
+	return nil
+}
+
+// loadAdopted adds the plugs adopted so far to the discretionary plugs.
+func (c *Config) loadAdopted() error {
+	if c.Adopt == nil || c.Adopt.File == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(c.Adopt.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var tps []TPPlugConfig
+	if err := yaml.UnmarshalStrict(raw, &tps); err != nil {
+		return fmt.Errorf("parsing %s: %w", c.Adopt.File, err)
+	}
+	c.DiscretionaryPlugs = append(c.DiscretionaryPlugs, tps...)
+	return nil
+}
+
+// adoptCandidate is a discovered plug that could be adopted.
+type adoptCandidate struct {
+	MAC         tpplug.MAC
+	Name        string // canonical name, which becomes its alias
+	Addr        string
+	Model       string
+	Power       Power // as found
+	Consumption Power // suggested; zero if there's no good guess
+	Adopted     bool  // awaiting a restart
+}
+
+// adoptConfig returns the adopt config, which is nil if adoption isn't configured.
+// Editing the config may change it, but can't set or remove it.
+func (s *server) adoptConfig() *AdoptConfig {
+	cfg, _ := s.current()
+	return cfg.Adopt
+}
+
+func (s *server) adoptLoop(ctx context.Context) {
+	for {
+		if err := s.scanForAdoption(ctx); err != nil {
+			logger.Warn("Discovering plugs to adopt", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.adoptConfig().Interval):
+		}
+	}
+}
+
+// scanForAdoption runs discovery, and updates the plugs that could be adopted.
+func (s *server) scanForAdoption(ctx context.Context) error {
+	ac := s.adoptConfig()
+	dctx, cancel := context.WithTimeout(ctx, *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(dctx)
+	if err != nil {
+		return err
+	}
+	devices := s.resolver.devices
+	var cands []adoptCandidate
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		if info.MAC == "" || ac.ignore[info.MAC] || dr.Kind == tpplug.KindBulb || s.isDiscretionary(dr) {
+			continue
+		}
+		c := adoptCandidate{
+			MAC:         info.MAC,
+			Name:        devices.Name(dr.State),
+			Addr:        dr.Addr.String(),
+			Model:       info.Model,
+			Power:       Power(dr.State.EnergyMeter.Realtime.Power / 1000),
+			Consumption: ac.tmpl.Consumption,
+		}
+		if c.Consumption == 0 {
+			c.Consumption = c.Power
+		}
+		cands = append(cands, c)
+	}
+	sort.Slice(cands, func(i, j int) bool { return cands[i].Name < cands[j].Name })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range cands {
+		cands[i].Adopted = s.adopted[c.MAC]
+	}
+	s.candidates = cands
+	return nil
+}
+
+// isDiscretionary reports whether a discovered plug is already configured.
+func (s *server) isDiscretionary(dr tpplug.DiscoveryResponse) bool {
+	info := dr.State.System.Info
+	name := s.resolver.devices.Name(dr.State)
+	_, dps := s.current()
+	for _, dp := range dps {
+		cfg := dp.cfg
+		if cfg.MAC != "" && tpplug.CanonicalMAC(cfg.MAC) == info.MAC {
+			return true
+		}
+		if cfg.Alias == info.Alias || cfg.Alias == name {
+			return true
+		}
+		if ip := net.ParseIP(cfg.IP); ip != nil && ip.Equal(dr.Addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) serveAdopt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	ac := s.adoptConfig()
+	if ac == nil {
+		http.Error(w, "adoption not configured", http.StatusNotFound)
+		return
+	}
+	mac, err := tpplug.ParseMAC(r.PostFormValue("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	consumption, err := strconv.Atoi(r.PostFormValue("consumption"))
+	if err != nil || consumption <= 0 {
+		http.Error(w, "consumption must be a positive number of Watts", http.StatusBadRequest)
+		return
+	}
+
+	// As with /pause, there's no XSRF check.
+
+	s.mu.Lock()
+	var cand *adoptCandidate
+	for i := range s.candidates {
+		if s.candidates[i].MAC == mac {
+			cand = &s.candidates[i]
+		}
+	}
+	if cand == nil || cand.Adopted {
+		s.mu.Unlock()
+		http.Error(w, "no such plug to adopt", http.StatusNotFound)
+		return
+	}
+	name := cand.Name
+	s.mu.Unlock()
+
+	s.adoptMu.Lock()
+	err = appendAdopted(ac, name, mac, Power(consumption))
+	s.adoptMu.Unlock()
+	if err != nil {
+		logger.Error("Adopting plug", "plug", name, "mac", mac, "err", err)
+		http.Error(w, "adopting plug: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Adopted plug; restart to take control of it", "plug", name, "mac", mac, "consumption", Power(consumption))
+
+	s.mu.Lock()
+	s.adopted[mac] = true
+	for i := range s.candidates {
+		if s.candidates[i].MAC == mac {
+			s.candidates[i].Adopted = true
+		}
+	}
+	s.mu.Unlock()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// appendAdopted adds an entry for a plug to the adopted plugs file.
+// Like the state file, it is written to a temporary file and renamed.
+func appendAdopted(ac *AdoptConfig, name string, mac tpplug.MAC, consumption Power) error {
+	var entries []yaml.MapSlice
+	raw, err := ioutil.ReadFile(ac.File)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("parsing %s: %w", ac.File, err)
+	}
+	entry := yaml.MapSlice{
+		{Key: "alias", Value: name},
+		{Key: "mac", Value: mac.String()},
+		{Key: "consumption", Value: int(consumption)},
+	}
+	for _, item := range ac.Template {
+		switch item.Key {
+		case "alias", "mac", "ip", "consumption":
+		default:
+			entry = append(entry, item)
+		}
+	}
+	raw, err = yaml.Marshal(append(entries, entry))
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(ac.File), ".solarctrl-adopted-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), ac.File)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With -audit_log, every relay action (or attempt) is appended to a file, one JSON
+// object per line, with why it was taken and the spare solar at the time.
+// The file is only ever appended to, so it may be rotated underneath solarctrl.
+// /audit serves it, optionally filtered by plug, reason and age
+// (/audit?plug=heater&reason=spare_solar&since=24h), as JSON, or as CSV with format=csv.
+//
+// The reasons are
+//
+//	spare_solar, not_enough_solar  following the solar
+//	min_runtime                    meeting a minimum daily runtime
+//	cheap_import                   importing is cheap
+//	unoccupied                     nobody is home
+//	peak_cap                       shedding under a peak demand cap
+//	force_on                       forced on by the webhook
+//	manual                         switched by hand, with /on or /off, or over MQTT
+//	safe_state                     put in its safe state at shutdown
+
+var auditLogFile = flag.String("audit_log", "", "if set, `filename` to append a record of every relay action to")
+
+// auditRecent is how many recent actions are kept in memory, for the front page.
+const auditRecent = 20
+
+// reason is why a load is switched.
+type reason struct {
+	code  string // for the audit log; see above
+	text  string // for people
+	spare Power  // for the load, when it was decided
+}
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Plug   string    `json:"plug"`   // load name: the plug alias, or group name
+	Action string    `json:"action"` // "on" or "off"
+	Reason string    `json:"reason"`
+	Detail string    `json:"detail"`
+	Solar  Power     `json:"solar_w"`
+	Spare  Power     `json:"spare_w"`
+	DryRun bool      `json:"dry_run,omitempty"`
+	Error  string    `json:"error,omitempty"` // if it failed
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	recent []auditEntry // newest last
+}
+
+// loadRecent reads the most recent entries from -audit_log, if it exists.
+func (al *auditLog) loadRecent() error {
+	if *auditLogFile == "" {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	err := readAudit(func(e auditEntry) {
+		al.recent = append(al.recent, e)
+		if len(al.recent) > auditRecent {
+			al.recent = al.recent[1:]
+		}
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// record appends an entry to the audit log.
+func (al *auditLog) record(e auditEntry) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.recent = append(al.recent, e)
+	if len(al.recent) > auditRecent {
+		al.recent = al.recent[1:]
+	}
+	if *auditLogFile == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		logger.Error("Writing audit log", "err", err)
+	}
+}
+
+// latest returns the most recent entries, newest first.
+func (al *auditLog) latest() []auditEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	es := make([]auditEntry, len(al.recent))
+	for i, e := range al.recent {
+		es[len(es)-1-i] = e
+	}
+	return es
+}
+
+// readAudit calls f with each entry in the audit log file, oldest first.
+// Lines that can't be parsed, such as one cut short by a crash, are skipped.
+func readAudit(f func(auditEntry)) error {
+	file, err := os.Open(*auditLogFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			f(e)
+		}
+	}
+	return sc.Err()
+}
+
+func (s *server) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if *auditLogFile == "" {
+		http.NotFound(w, r)
+		return
+	}
+	plug, why := r.FormValue("plug"), r.FormValue("reason")
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	entries := []auditEntry{}
+	err := readAudit(func(e auditEntry) {
+		if (plug == "" || e.Plug == plug) && (why == "" || e.Reason == why) && !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "reading audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="solarctrl-audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "plug", "action", "reason", "detail", "solar_w", "spare_w", "dry_run", "error"})
+		for _, e := range entries {
+			cw.Write([]string{
+				e.Time.Format(time.RFC3339), e.Plug, e.Action, e.Reason, e.Detail,
+				strconv.Itoa(int(e.Solar)), strconv.Itoa(int(e.Spare)), strconv.FormatBool(e.DryRun), e.Error,
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q (want json or csv)", r.FormValue("format")), http.StatusBadRequest)
+	}
+}
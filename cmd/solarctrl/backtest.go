@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/api/prometheus/v1"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// backtest replays a historical time range from Prometheus,
+// simulating the decisions evaluate would have made under the given config.
+//
+// Discretionary plugs are assumed to draw exactly their configured consumption while on,
+// and their historical draw is ignored since it reflects whatever actually controlled them.
+// As in evaluate, plugs are left alone outside their allowed windows.
+func backtest(ctx context.Context, config Config, promAPI promclient.API, args []string) error {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	fromFlag := fs.String("from", "24h", "start of range (RFC3339 `time`, or a duration before now)")
+	toFlag := fs.String("to", "0s", "end of range (RFC3339 `time`, or a duration before now)")
+	step := fs.Duration("step", time.Minute, "simulated evaluation `period`")
+	fs.Parse(args)
+
+	now := time.Now()
+	from, err := parseBacktestTime(*fromFlag, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseBacktestTime(*toFlag, now)
+	if err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("empty range [%v, %v]", from, to)
+	}
+	if *step <= 0 {
+		return fmt.Errorf("step %v not positive", *step)
+	}
+	r := promclient.Range{Start: from, End: to, Step: *step}
+	n := int(to.Sub(from) / *step) + 1
+
+	discNames := make(map[string]bool)
+	for _, tp := range config.DiscretionaryPlugs {
+		discNames[tp.Alias] = true
+	}
+
+	// Fetch solar production and non-discretionary plug use, bucketed per step.
+	solar := make([]Power, n)
+	solarOK := make([]bool, n)
+	m, err := queryRangeMatrix(ctx, promAPI, solarQuery, r)
+	if err != nil {
+		return fmt.Errorf("querying solar power: %w", err)
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("solar query yielded %d series, want 1", len(m))
+	}
+	for _, sp := range m[0].Values {
+		if i := stepIndex(sp.Timestamp, from, *step, n); i >= 0 {
+			solar[i] = Power(sp.Value)
+			solarOK[i] = true
+		}
+	}
+	other := make([]Power, n)
+	m, err = queryRangeMatrix(ctx, promAPI, plugQuery, r)
+	if err != nil {
+		return fmt.Errorf("querying plug power: %w", err)
+	}
+	for _, ss := range m {
+		if discNames[string(ss.Metric["name"])] {
+			continue
+		}
+		for _, sp := range ss.Values {
+			if i := stepIndex(sp.Timestamp, from, *step, n); i >= 0 {
+				other[i] += Power(sp.Value)
+			}
+		}
+	}
+
+	// Simulate.
+	type simPlug struct {
+		cfg        TPPlugConfig
+		on         bool
+		lastToggle time.Time
+		toggles    int
+		onFor      time.Duration
+		shortFor   int // evaluations in a row short of spare solar
+	}
+	// Priority rules depend on how things were at the time, which can't be
+	// replayed, so plugs are taken in order of their configured priority.
+	byAlias := make(map[string]*simPlug)
+	prio := make(map[string]int)
+	var aliases []string
+	for _, tp := range config.DiscretionaryPlugs {
+		byAlias[tp.Alias] = &simPlug{cfg: tp}
+		prio[tp.Alias] = tp.Priority
+		aliases = append(aliases, tp.Alias)
+	}
+	orderLoads(aliases, prio)
+	var sims []*simPlug
+	for _, alias := range aliases {
+		sims = append(sims, byAlias[alias])
+	}
+
+	var surplusWh, capturedWh, importWh float64
+	var skipped int
+	for i := 0; i < n; i++ {
+		if !solarOK[i] {
+			skipped++
+			continue
+		}
+		t := from.Add(time.Duration(i) * *step)
+		avail := solar[i] - config.BaselineConsumption - other[i]
+		spare := avail
+		for _, sp := range sims {
+			if sp.on {
+				spare -= sp.cfg.Consumption
+			}
+		}
+
+		for _, sp := range sims {
+			if !sp.lastToggle.IsZero() && t.Sub(sp.lastToggle) < *minToggle {
+				continue
+			}
+			if !sp.on && !sp.lastToggle.IsZero() && t.Sub(sp.lastToggle) < sp.cfg.MinOffTime {
+				continue
+			}
+			if !sp.cfg.inWindows(t) {
+				continue
+			}
+			if sp.on && !sp.lastToggle.IsZero() && t.Sub(sp.lastToggle) < sp.cfg.MinRun {
+				continue
+			}
+			margin := config.Margin
+			if sp.cfg.OnMargin != nil {
+				margin = *sp.cfg.OnMargin
+			}
+			if sp.on && spare < -sp.cfg.OffMargin.of(solar[i]) {
+				sp.shortFor++
+			} else {
+				sp.shortFor = 0
+			}
+			if sp.shortFor > 0 && sp.shortFor >= sp.cfg.OffAfter && sp.cfg.TurnOff {
+				sp.on = false
+				sp.shortFor = 0
+				spare += sp.cfg.Consumption
+			} else if !sp.on && spare-margin.of(solar[i]) > sp.cfg.Consumption && sp.cfg.TurnOn {
+				sp.on = true
+				spare -= sp.cfg.Consumption
+			} else {
+				continue
+			}
+			sp.lastToggle = t
+			sp.toggles++
+		}
+
+		// Account for the step that follows this evaluation.
+		var discOn Power
+		for _, sp := range sims {
+			if sp.on {
+				discOn += sp.cfg.Consumption
+				sp.onFor += *step
+			}
+		}
+		captured := discOn
+		if avail < captured {
+			captured = avail
+		}
+		if captured < 0 {
+			captured = 0
+		}
+		h := step.Hours()
+		if avail > 0 {
+			surplusWh += float64(avail) * h
+		}
+		capturedWh += float64(captured) * h
+		importWh += float64(discOn-captured) * h
+	}
+
+	fmt.Printf("Backtest from %v to %v in %v steps\n", from.Format(time.RFC3339), to.Format(time.RFC3339), *step)
+	if skipped > 0 {
+		fmt.Printf("(%d of %d steps had no solar data and were skipped)\n", skipped, n)
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "plug\ttoggles\ttime on\t")
+	for _, sp := range sims {
+		fmt.Fprintf(tw, "%s\t%d\t%v\t\n", sp.cfg.Alias, sp.toggles, sp.onFor)
+	}
+	tw.Flush()
+	fmt.Println()
+	fmt.Printf("Surplus solar available:   %.2f kWh\n", surplusWh/1000)
+	fmt.Printf("Captured by discretionary: %.2f kWh", capturedWh/1000)
+	if surplusWh > 0 {
+		fmt.Printf(" (%.0f%%)", 100*capturedWh/surplusWh)
+	}
+	fmt.Println()
+	fmt.Printf("Imported by discretionary: %.2f kWh\n", importWh/1000)
+	if per := config.savingPerKWh(); per != 0 {
+		fmt.Printf("Estimated saving:          $%.2f\n", capturedWh/1000*per)
+	}
+	return nil
+}
+
+func parseBacktestTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q: want RFC3339 or a duration", s)
+	}
+	return t, nil
+}
+
+func stepIndex(ts prommodel.Time, from time.Time, step time.Duration, n int) int {
+	i := int(ts.Time().Sub(from) / step)
+	if i < 0 || i >= n {
+		return -1
+	}
+	return i
+}
+
+func queryRangeMatrix(ctx context.Context, promAPI promclient.API, query string, r promclient.Range) (prommodel.Matrix, error) {
+	v, warns, err := promAPI.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, fmt.Errorf("Prometheus query evaluation: %w", err)
+	}
+	for _, w := range warns {
+		vlogf("During Prometheus query evaluation: %s", w)
+	}
+	if v.Type() != prommodel.ValMatrix {
+		return nil, fmt.Errorf("Prometheus query yielded %v, want matrix", v.Type())
+	}
+	return v.(prommodel.Matrix), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CalendarProfile is a named set of overrides that applies on days matching its rules,
+// such as summer/winter, weekends or public holidays.
+// A day matches if it satisfies every rule that is set.
+type CalendarProfile struct {
+	Name string
+
+	Months   []time.Month // 1-12
+	Weekdays []string     // "mon", "tue", etc.
+	// From and To ("01-02") bound an inclusive range of days each year,
+	// which may wrap over the new year.
+	From, To string
+	// Dates lists specific days, either "2006-01-02" or "01-02" for every year.
+	Dates []string
+
+	// Margin, if set, replaces the top-level margin.
+	Margin *Margin
+	// Plugs overrides control of loads, keyed by plug alias or group name.
+	Plugs map[string]PlugOverride
+}
+
+// PlugOverride changes control of a load while a calendar profile is active.
+// Fields that are not set are left as configured.
+type PlugOverride struct {
+	TurnOn          *bool          `yaml:"turn_on"`
+	TurnOff         *bool          `yaml:"turn_off"`
+	MinDailyRuntime *time.Duration `yaml:"min_daily_runtime"`
+	RuntimeCutoff   *string        `yaml:"runtime_cutoff"`
+	MinRun          *time.Duration `yaml:"min_run"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// checkCalendar validates the calendar profiles.
+func checkCalendar(config Config) error {
+	loadCfgs := make(map[string]TPPlugConfig) // keyed by load name
+	for _, tp := range config.DiscretionaryPlugs {
+		loadCfgs[tp.loadName()] = tp
+	}
+	for i := range config.Calendar {
+		cp := &config.Calendar[i]
+		if cp.Name == "" {
+			return fmt.Errorf("calendar profile needs a name")
+		}
+		for _, m := range cp.Months {
+			if m < time.January || m > time.December {
+				return fmt.Errorf("calendar profile %q has bad month %d", cp.Name, m)
+			}
+		}
+		for _, wd := range cp.Weekdays {
+			if _, ok := weekdays[strings.ToLower(wd)]; !ok {
+				return fmt.Errorf("calendar profile %q has bad weekday %q", cp.Name, wd)
+			}
+		}
+		if (cp.From == "") != (cp.To == "") {
+			return fmt.Errorf("calendar profile %q needs both from and to, or neither", cp.Name)
+		}
+		for _, d := range []string{cp.From, cp.To} {
+			if _, err := time.Parse("01-02", d); d != "" && err != nil {
+				return fmt.Errorf("calendar profile %q has bad day %q (want MM-DD)", cp.Name, d)
+			}
+		}
+		for _, d := range cp.Dates {
+			_, err1 := time.Parse("01-02", d)
+			_, err2 := time.Parse("2006-01-02", d)
+			if err1 != nil && err2 != nil {
+				return fmt.Errorf("calendar profile %q has bad date %q (want YYYY-MM-DD or MM-DD)", cp.Name, d)
+			}
+		}
+		for name := range cp.Plugs {
+			tp, ok := loadCfgs[name]
+			if !ok {
+				return fmt.Errorf("calendar profile %q overrides unknown plug %q", cp.Name, name)
+			}
+			if tp = cp.apply(name, tp); tp.MinDailyRuntime > 0 {
+				if _, err := parseClock(tp.RuntimeCutoff, time.Now()); err != nil {
+					return fmt.Errorf("calendar profile %q, plug %q: runtime_cutoff: %w", cp.Name, name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the profile applies on the day of t.
+func (cp *CalendarProfile) matches(t time.Time) bool {
+	if len(cp.Months) > 0 {
+		ok := false
+		for _, m := range cp.Months {
+			ok = ok || m == t.Month()
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(cp.Weekdays) > 0 {
+		ok := false
+		for _, wd := range cp.Weekdays {
+			ok = ok || weekdays[strings.ToLower(wd)] == t.Weekday()
+		}
+		if !ok {
+			return false
+		}
+	}
+	md := t.Format("01-02")
+	if cp.From != "" {
+		if cp.From <= cp.To {
+			if md < cp.From || md > cp.To {
+				return false
+			}
+		} else if md < cp.From && md > cp.To {
+			return false
+		}
+	}
+	if len(cp.Dates) > 0 {
+		ymd := t.Format("2006-01-02")
+		ok := false
+		for _, d := range cp.Dates {
+			ok = ok || d == md || d == ymd
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// calendarProfile returns the first calendar profile that applies at t, or nil.
+func (c Config) calendarProfile(t time.Time) *CalendarProfile {
+	for i := range c.Calendar {
+		if c.Calendar[i].matches(t) {
+			return &c.Calendar[i]
+		}
+	}
+	return nil
+}
+
+// margin returns the margin in effect under the profile.
+func (cp *CalendarProfile) margin(def Margin) Margin {
+	if cp == nil || cp.Margin == nil {
+		return def
+	}
+	return *cp.Margin
+}
+
+// apply returns cfg, for the load with the given name, with the profile's overrides.
+func (cp *CalendarProfile) apply(name string, cfg TPPlugConfig) TPPlugConfig {
+	if cp == nil {
+		return cfg
+	}
+	po, ok := cp.Plugs[name]
+	if !ok {
+		return cfg
+	}
+	if po.TurnOn != nil {
+		cfg.TurnOn = *po.TurnOn
+	}
+	if po.TurnOff != nil {
+		cfg.TurnOff = *po.TurnOff
+	}
+	if po.MinDailyRuntime != nil {
+		cfg.MinDailyRuntime = *po.MinDailyRuntime
+	}
+	if po.RuntimeCutoff != nil {
+		cfg.RuntimeCutoff = *po.RuntimeCutoff
+	}
+	if po.MinRun != nil {
+		cfg.MinRun = *po.MinRun
+	}
+	return cfg
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var plugTimeout = flag.Duration("plug_timeout", 2*time.Second, "how long to wait for a TP-Link plug to answer each try of a request")
+
+// switchDriver controls a smart switch of some kind.
+type switchDriver interface {
+	query(ctx context.Context) (switchState, error)
+	setRelay(ctx context.Context, on bool) error
+	String() string // address, for logging
+}
+
+// condSwitcher is implemented by switchDrivers that can switch a relay
+// only if it is still in the state it was last seen in.
+type condSwitcher interface {
+	setRelayIf(ctx context.Context, wasOn, on bool) error
+}
+
+// setRelayIf switches a relay, but if the driver supports it, only if it is still
+// in the state it was last seen in, so as not to override a change made by
+// something else, such as the plug's own app. That is reported as an error
+// wrapping tpplug.ErrStateChanged.
+func setRelayIf(ctx context.Context, drv switchDriver, wasOn, on bool) error {
+	if cs, ok := drv.(condSwitcher); ok {
+		return cs.setRelayIf(ctx, wasOn, on)
+	}
+	return drv.setRelay(ctx, on)
+}
+
+// switchState is what a switchDriver reports about a switch.
+type switchState struct {
+	On    bool
+	Power Power
+}
+
+// driverFor returns the driver for a discretionary plug,
+// resolving its address if necessary.
+func (s *server) driverFor(ctx context.Context, dp discPlug) (switchDriver, error) {
+	drv, err := s.baseDriverFor(ctx, dp)
+	if err != nil || !dp.cfg.Inverted {
+		return drv, err
+	}
+	return invertedDriver{drv}, nil
+}
+
+func (s *server) baseDriverFor(ctx context.Context, dp discPlug) (switchDriver, error) {
+	switch dp.cfg.Driver {
+	case "shelly":
+		return shellyDriver{host: dp.cfg.IP}, nil
+	case "shelly_rpc":
+		return shellyRPCDriver{host: dp.cfg.IP}, nil
+	case "tasmota":
+		return tasmotaDriver{host: dp.cfg.IP}, nil
+	}
+	addr, err := s.resolver.resolve(ctx, dp)
+	if err != nil {
+		return nil, err
+	}
+	sess := s.sessions.get(addr)
+	if dp.cfg.Child != "" {
+		return tpplugChildDriver{sess: sess, child: dp.cfg.Child}, nil
+	}
+	return tpplugDriver{sess: sess}, nil
+}
+
+// checkDriver validates the driver-related parts of a plug's configuration.
+func checkDriver(cfg TPPlugConfig) error {
+	switch cfg.Driver {
+	case "", "tpplug":
+		if cfg.Child != "" && cfg.IP == "" && cfg.MAC == "" {
+			return fmt.Errorf("plug %q: child needs the strip's ip or mac", cfg.Alias)
+		}
+		return nil
+	case "shelly", "shelly_rpc", "tasmota":
+		if cfg.Child != "" {
+			return fmt.Errorf("plug %q: %s driver doesn't support child", cfg.Alias, cfg.Driver)
+		}
+		if cfg.IP == "" {
+			return fmt.Errorf("plug %q: %s driver needs ip", cfg.Alias, cfg.Driver)
+		}
+		if cfg.MAC != "" {
+			return fmt.Errorf("plug %q: %s driver can't be resolved by mac", cfg.Alias, cfg.Driver)
+		}
+		return nil
+	}
+	return fmt.Errorf("plug %q: unknown driver %q", cfg.Alias, cfg.Driver)
+}
+
+// sessions keeps a tpplug.Session for each plug address, so that its socket
+// is reused from one evaluation to the next. Its zero value is ready to use.
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]*tpplug.Session
+}
+
+func (ss *sessions) get(addr *net.UDPAddr) *tpplug.Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.m == nil {
+		ss.m = make(map[string]*tpplug.Session)
+	}
+	sess, ok := ss.m[addr.String()]
+	if !ok {
+		// Retry once, for a packet lost on busy Wi-Fi. Without a timeout,
+		// an unreachable plug would hold up the whole evaluation.
+		sess = tpplug.DialWithOptions(addr, tpplug.SessionOptions{Retries: 1, Timeout: *plugTimeout})
+		ss.m[addr.String()] = sess
+	}
+	return sess
+}
+
+// tpplugDriver controls a TP-Link smart plug.
+type tpplugDriver struct {
+	sess *tpplug.Session
+}
+
+func (td tpplugDriver) String() string { return td.sess.Addr().String() }
+
+func (td tpplugDriver) query(ctx context.Context) (switchState, error) {
+	state, err := td.sess.Query(ctx)
+	if err != nil {
+		return switchState{}, err
+	}
+	return switchState{
+		On:    state.System.Info.RelayState == 1,
+		Power: Power(state.EnergyMeter.Realtime.Power / 1000), // mW -> W
+	}, nil
+}
+
+func (td tpplugDriver) setRelay(ctx context.Context, on bool) error {
+	state := 0
+	if on {
+		state = 1
+	}
+	return td.sess.SetRelayState(ctx, state)
+}
+
+func (td tpplugDriver) setRelayIf(ctx context.Context, wasOn, on bool) error {
+	return td.sess.SetRelayStateIf(ctx, boolState(wasOn), boolState(on))
+}
+
+// tpplugChildDriver controls one outlet of a TP-Link power strip, such as an HS300.
+type tpplugChildDriver struct {
+	sess  *tpplug.Session // of the strip
+	child string          // ID, last two digits of ID, or alias
+}
+
+func (cd tpplugChildDriver) String() string { return cd.sess.Addr().String() + "/" + cd.child }
+
+// childCtx returns a context for operations on the outlet, found by the strip's system information.
+func (cd tpplugChildDriver) childCtx(ctx context.Context) (context.Context, error) {
+	strip, err := cd.sess.QuerySysinfoOnly(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := strip.Child(cd.child)
+	if !ok {
+		return nil, fmt.Errorf("plug at %v has no child outlet %q", cd.sess.Addr(), cd.child)
+	}
+	return tpplug.WithChild(ctx, c.ID), nil
+}
+
+func (cd tpplugChildDriver) query(ctx context.Context) (switchState, error) {
+	cctx, err := cd.childCtx(ctx)
+	if err != nil {
+		return switchState{}, err
+	}
+	return tpplugDriver{cd.sess}.query(cctx)
+}
+
+func (cd tpplugChildDriver) setRelay(ctx context.Context, on bool) error {
+	cctx, err := cd.childCtx(ctx)
+	if err != nil {
+		return err
+	}
+	return tpplugDriver{cd.sess}.setRelay(cctx, on)
+}
+
+func (cd tpplugChildDriver) setRelayIf(ctx context.Context, wasOn, on bool) error {
+	cctx, err := cd.childCtx(ctx)
+	if err != nil {
+		return err
+	}
+	return tpplugDriver{cd.sess}.setRelayIf(cctx, wasOn, on)
+}
+
+var httpDriverClient = &http.Client{Timeout: 5 * time.Second}
+
+// getJSON fetches a URL and decodes its JSON response.
+func getJSON(ctx context.Context, u string, resp interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	hresp, err := httpDriverClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", hresp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(hresp.Body, 64<<10)).Decode(resp); err != nil {
+		return fmt.Errorf("decoding JSON response: %w", err)
+	}
+	return nil
+}
+
+// shellyDriver controls a first generation Shelly device via its HTTP API.
+type shellyDriver struct {
+	host string
+}
+
+func (sd shellyDriver) String() string { return sd.host }
+
+func (sd shellyDriver) query(ctx context.Context) (switchState, error) {
+	var resp struct {
+		Relays []struct {
+			IsOn bool `json:"ison"`
+		} `json:"relays"`
+		Meters []struct {
+			Power float64 `json:"power"` // W
+		} `json:"meters"`
+	}
+	if err := getJSON(ctx, "http://"+sd.host+"/status", &resp); err != nil {
+		return switchState{}, err
+	}
+	if len(resp.Relays) == 0 {
+		return switchState{}, fmt.Errorf("Shelly at %s has no relays", sd.host)
+	}
+	var ss switchState
+	ss.On = resp.Relays[0].IsOn
+	if len(resp.Meters) > 0 {
+		ss.Power = Power(resp.Meters[0].Power)
+	}
+	return ss, nil
+}
+
+func (sd shellyDriver) setRelay(ctx context.Context, on bool) error {
+	var resp struct {
+		IsOn bool `json:"ison"`
+	}
+	if err := getJSON(ctx, "http://"+sd.host+"/relay/0?turn="+onOff(boolState(on)), &resp); err != nil {
+		return err
+	}
+	if resp.IsOn != on {
+		return fmt.Errorf("Shelly at %s didn't switch %s", sd.host, onOff(boolState(on)))
+	}
+	return nil
+}
+
+// shellyRPCDriver controls a second generation (Plus/Pro) Shelly device via its RPC API.
+type shellyRPCDriver struct {
+	host string
+}
+
+func (sd shellyRPCDriver) String() string { return sd.host }
+
+func (sd shellyRPCDriver) query(ctx context.Context) (switchState, error) {
+	var resp struct {
+		Output bool    `json:"output"`
+		APower float64 `json:"apower"` // W
+	}
+	if err := getJSON(ctx, "http://"+sd.host+"/rpc/Switch.GetStatus?id=0", &resp); err != nil {
+		return switchState{}, err
+	}
+	return switchState{On: resp.Output, Power: Power(resp.APower)}, nil
+}
+
+func (sd shellyRPCDriver) setRelay(ctx context.Context, on bool) error {
+	var resp struct {
+		WasOn bool `json:"was_on"`
+	}
+	return getJSON(ctx, fmt.Sprintf("http://%s/rpc/Switch.Set?id=0&on=%t", sd.host, on), &resp)
+}
+
+// tasmotaDriver controls a device running Tasmota firmware via its HTTP command API.
+type tasmotaDriver struct {
+	host string
+}
+
+func (td tasmotaDriver) String() string { return td.host }
+
+func (td tasmotaDriver) cmnd(ctx context.Context, cmd string, resp interface{}) error {
+	return getJSON(ctx, "http://"+td.host+"/cm?cmnd="+url.QueryEscape(cmd), resp)
+}
+
+func (td tasmotaDriver) query(ctx context.Context) (switchState, error) {
+	var power struct {
+		Power string `json:"POWER"`
+	}
+	if err := td.cmnd(ctx, "Power", &power); err != nil {
+		return switchState{}, err
+	}
+	var status struct {
+		StatusSNS struct {
+			Energy struct {
+				Power float64 `json:"Power"` // W
+			} `json:"ENERGY"`
+		} `json:"StatusSNS"`
+	}
+	if err := td.cmnd(ctx, "Status 8", &status); err != nil {
+		return switchState{}, err
+	}
+	return switchState{
+		On:    strings.EqualFold(power.Power, "ON"),
+		Power: Power(status.StatusSNS.Energy.Power),
+	}, nil
+}
+
+func (td tasmotaDriver) setRelay(ctx context.Context, on bool) error {
+	var resp struct {
+		Power string `json:"POWER"`
+	}
+	if err := td.cmnd(ctx, "Power "+onOff(boolState(on)), &resp); err != nil {
+		return err
+	}
+	if strings.EqualFold(resp.Power, "ON") != on {
+		return fmt.Errorf("Tasmota device at %s reported %q after switching", td.host, resp.Power)
+	}
+	return nil
+}
+
+// boolState converts a bool to a relay state.
+func boolState(on bool) int {
+	if on {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EditorConfig enables the /config page, for editing the config file from
+// a browser. It is protected by HTTP basic auth:
+//
+//	config_editor:
+//	  username: admin
+//	  password_file: /etc/solarctrl/editor-password
+//
+// An edit is checked as it would be at startup (unknown keys, bad IPs and
+// MACs, overlapping peak windows and so on), and the page lists how it would
+// change what is controlled. Applying it rewrites the config file, and the
+// new config takes effect at the next evaluation, keeping runtimes, toggle
+// times, pauses and the rest of the controller's state.
+// Changes to prometheus_addr, prometheus, mqtt and whether adopt is set need a restart,
+// so edits that make them are refused.
+type EditorConfig struct {
+	Username     string
+	Password     string
+	PasswordFile string `yaml:"password_file"`
+}
+
+func (ec *EditorConfig) check() error {
+	if ec.Username == "" {
+		return fmt.Errorf("config_editor needs a username")
+	}
+	if (ec.Password == "") == (ec.PasswordFile == "") {
+		return fmt.Errorf("config_editor needs one of password and password_file")
+	}
+	return nil
+}
+
+// authorized reports whether a request has the editor's credentials.
+func (ec *EditorConfig) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want := ec.Password
+	if ec.PasswordFile != "" {
+		var err error
+		if want, err = readSecret(ec.PasswordFile); err != nil {
+			logger.Error("Reading config editor password", "err", err)
+			return false
+		}
+	}
+	// Compare both, so the time taken doesn't reveal which was wrong.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(ec.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+	return userOK && passOK
+}
+
+// parseConfig parses a config file, along with any adopted plugs.
+func parseConfig(raw []byte) (Config, error) {
+	var config Config
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return Config{}, err
+	}
+	if err := config.loadAdopted(); err != nil {
+		return Config{}, fmt.Errorf("loading adopted plugs: %w", err)
+	}
+	return config, nil
+}
+
+// prepareReload checks a new config as newServer would at startup, and
+// returns a server with it. Only its config, dps, evs and notifier are used;
+// see applyReload. The caller must either queue it or discard it.
+func (s *server) prepareReload(raw []byte) (*server, error) {
+	config, err := parseConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+	cur, _ := s.current()
+	switch {
+	case config.PrometheusAddr != cur.PrometheusAddr:
+		return nil, fmt.Errorf("changing prometheus_addr needs a restart")
+	case !reflect.DeepEqual(config.Prometheus, cur.Prometheus):
+		return nil, fmt.Errorf("changing prometheus needs a restart")
+	case (config.Adopt == nil) != (cur.Adopt == nil):
+		return nil, fmt.Errorf("setting or removing adopt needs a restart")
+	case !reflect.DeepEqual(config.MQTT, cur.MQTT):
+		return nil, fmt.Errorf("changing mqtt needs a restart")
+	}
+	return newServer(config, s.promAPI)
+}
+
+// discardReload releases what a server returned by prepareReload holds.
+func (ns *server) discardReload() { ns.notifier.close() }
+
+// queueReload arranges for the next evaluation to switch to the config of ns.
+func (s *server) queueReload(ns *server) {
+	s.mu.Lock()
+	prev := s.pendingReload
+	s.pendingReload = ns
+	s.mu.Unlock()
+	if prev != nil {
+		prev.discardReload()
+	}
+}
+
+// applyReload switches to a queued config, if there is one. It is called by
+// evaluate, so nothing else changes the config or plugs during an evaluation.
+func (s *server) applyReload(elogf func(string, ...interface{})) {
+	s.mu.Lock()
+	ns := s.pendingReload
+	s.pendingReload = nil
+	if ns == nil {
+		s.mu.Unlock()
+		return
+	}
+	changes := configChanges(s.config, s.dps, ns.config, ns.dps)
+	old := s.notifier
+	s.config, s.dps, s.evs, s.notifier = ns.config, ns.dps, ns.evs, ns.notifier
+	s.mu.Unlock()
+	old.close()
+
+	elogf("Reloaded config, with %d changes", len(changes))
+	for _, c := range changes {
+		elogf("  %s", c)
+	}
+}
+
+// current returns the config and discretionary plugs, for use outside evaluate.
+func (s *server) current() (Config, []discPlug) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config, s.dps
+}
+
+// configChanges describes how switching from one config to another changes control.
+// Plugs are compared as configured, after profiles are applied, and matched by alias.
+func configChanges(oldCfg Config, oldDPs []discPlug, newCfg Config, newDPs []discPlug) []string {
+	var changes []string
+	oldPlugs := make(map[string]TPPlugConfig)
+	for _, dp := range oldDPs {
+		oldPlugs[dp.cfg.Alias] = dp.cfg
+	}
+	newPlugs := make(map[string]bool)
+	for _, dp := range newDPs {
+		newPlugs[dp.cfg.Alias] = true
+		prev, ok := oldPlugs[dp.cfg.Alias]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("adds plug %q (%v)", dp.cfg.Alias, dp.cfg.Consumption))
+			continue
+		}
+		for _, fc := range fieldChanges(prev, dp.cfg) {
+			changes = append(changes, fmt.Sprintf("plug %q: %s", dp.cfg.Alias, fc))
+		}
+	}
+	for _, dp := range oldDPs {
+		if !newPlugs[dp.cfg.Alias] {
+			changes = append(changes, fmt.Sprintf("removes plug %q, which is left as it is", dp.cfg.Alias))
+		}
+	}
+
+	// Everything else counts as changing as a whole.
+	oldCfg.DiscretionaryPlugs, newCfg.DiscretionaryPlugs = nil, nil
+	changes = append(changes, fieldChanges(oldCfg, newCfg)...)
+	return changes
+}
+
+// fieldChanges lists the fields that differ between two structs of the same type, by YAML name.
+func fieldChanges(a, b interface{}) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var changes []string
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		x, y := va.Field(i).Interface(), vb.Field(i).Interface()
+		if reflect.DeepEqual(x, y) {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		switch f.Type.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64, reflect.String:
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", name, x, y))
+		default:
+			changes = append(changes, name+" changes")
+		}
+	}
+	return changes
+}
+
+// writeConfigFile replaces the config file, keeping its permissions.
+func writeConfigFile(raw []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(*configFile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(*configFile), ".solarctrl-config-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *configFile)
+}
+
+func (s *server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, _ := s.current()
+	ec := cfg.Editor
+	if ec == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !ec.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="solarctrl"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data := struct {
+		File    string
+		YAML    string
+		Err     string
+		Changes []string
+		Checked bool // Err or Changes are set from checking YAML
+		Applied bool
+	}{File: *configFile}
+
+	switch r.Method {
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	case "GET":
+		raw, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			http.Error(w, "reading config file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.YAML = string(raw)
+	case "POST":
+		// Basic auth is sent by the browser whatever page the form was on,
+		// so make sure it was this one.
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		raw := []byte(strings.ReplaceAll(r.PostFormValue("yaml"), "\r\n", "\n"))
+		data.YAML, data.Checked = string(raw), true
+		ns, err := s.prepareReload(raw)
+		if err != nil {
+			data.Err = err.Error()
+			break
+		}
+		cur, curDPs := s.current()
+		data.Changes = configChanges(cur, curDPs, ns.config, ns.dps)
+		if r.PostFormValue("action") != "apply" {
+			ns.discardReload()
+			break
+		}
+		if err := writeConfigFile(raw); err != nil {
+			ns.discardReload()
+			data.Err = "writing config file: " + err.Error()
+			break
+		}
+		s.queueReload(ns)
+		data.Applied = true
+		logger.Info("Config edited; it takes effect at the next evaluation", "changes", len(data.Changes))
+	}
+	if err := configTmpl.Execute(w, data); err != nil {
+		logger.Error("Executing template", "template", "config.html", "err", err)
+	}
+}
+
+// sameOrigin reports whether a request came from a page on this server, as far as the browser says.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true // not from a browser that says
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
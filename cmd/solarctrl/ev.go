@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// EVChargerConfig configures an EV charger whose current can be modulated
+// to soak up surplus solar. Chargers are adjusted before any on/off loads are considered.
+type EVChargerConfig struct {
+	Name   string
+	Driver string // "openevse" or "goecharger"
+	Host   string
+
+	MinAmps int `yaml:"min_amps"` // below this the charger is stopped; defaults to 6
+	MaxAmps int `yaml:"max_amps"` // defaults to 16
+	Volts   int // defaults to 230
+	Phases  int // defaults to 1
+}
+
+// evCharger controls an EV charger.
+type evCharger interface {
+	query(ctx context.Context) (evState, error)
+	// setCurrent sets the charging current. Zero stops charging.
+	setCurrent(ctx context.Context, amps int) error
+	String() string
+}
+
+type evState struct {
+	Amps  int   // current setpoint; zero if not charging
+	Power Power // actual draw
+}
+
+type evControl struct {
+	cfg EVChargerConfig
+	drv evCharger
+}
+
+func newEVControls(cfgs []EVChargerConfig) ([]evControl, error) {
+	var evs []evControl
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || cfg.Host == "" {
+			return nil, fmt.Errorf("EV charger needs name and host")
+		}
+		if cfg.MinAmps <= 0 {
+			cfg.MinAmps = 6
+		}
+		if cfg.MaxAmps <= 0 {
+			cfg.MaxAmps = 16
+		}
+		if cfg.MaxAmps < cfg.MinAmps {
+			return nil, fmt.Errorf("EV charger %q has max_amps < min_amps", cfg.Name)
+		}
+		if cfg.Volts <= 0 {
+			cfg.Volts = 230
+		}
+		if cfg.Phases <= 0 {
+			cfg.Phases = 1
+		}
+		ev := evControl{cfg: cfg}
+		switch cfg.Driver {
+		case "openevse":
+			ev.drv = openEVSE{host: cfg.Host}
+		case "goecharger":
+			ev.drv = goECharger{host: cfg.Host}
+		default:
+			return nil, fmt.Errorf("EV charger %q has unknown driver %q", cfg.Name, cfg.Driver)
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+// wattsPerAmp is the power drawn for each amp of charging current.
+func (cfg EVChargerConfig) wattsPerAmp() Power { return Power(cfg.Volts * cfg.Phases) }
+
+// modulateEVs adjusts EV charging current to match the spare solar,
+// and returns the spare solar left over for other loads.
+func (s *server) modulateEVs(ctx context.Context, spare, margin Power, elogf func(string, ...interface{})) Power {
+	now := time.Now()
+	for _, ev := range s.evs {
+		name := ev.cfg.Name
+		st, err := ev.drv.query(ctx)
+		if err != nil {
+			elogf("Querying EV charger %q (%v): %v", name, ev.drv, err)
+			continue
+		}
+		// The charger isn't a smart plug, so its draw isn't accounted for yet.
+		spare -= st.Power
+
+		s.mu.Lock()
+		pause, paused := s.pauses[name]
+		s.mu.Unlock()
+		if paused && pause.After(now) {
+			elogf("EV charger %q has control paused until %v", name, pause)
+			continue
+		}
+
+		// Work out how much current the available power would support.
+		avail := spare + st.Power - margin
+		amps := int(avail / ev.cfg.wattsPerAmp())
+		if amps > ev.cfg.MaxAmps {
+			amps = ev.cfg.MaxAmps
+		}
+		if amps < ev.cfg.MinAmps {
+			amps = 0
+		}
+		if amps == st.Amps {
+			elogf("EV charger %q staying at %dA (%v)", name, amps, st.Power)
+			continue
+		}
+		newPower := Power(amps) * ev.cfg.wattsPerAmp()
+		if *dryRun || s.isStandby() {
+			elogf("[dry run] Would set EV charger %q from %dA to %dA", name, st.Amps, amps)
+		} else {
+			if err := ev.drv.setCurrent(ctx, amps); err != nil {
+				elogf("Setting EV charger %q to %dA: %v", name, amps, err)
+				logger.Error("Setting EV charger current", "charger", name, "amps", amps, "err", err)
+				s.notifier.notify(notifyToggleFailure, name, "Failed to set EV charger %q to %dA: %v", name, amps, err)
+				continue
+			}
+			elogf("Set EV charger %q from %dA to %dA", name, st.Amps, amps)
+			logger.Info("Set EV charger current", "charger", name, "from", st.Amps, "amps", amps)
+			s.events.publish(event{Kind: "toggle", Plug: name, Text: fmt.Sprintf("%dA", amps)})
+		}
+		spare += st.Power - newPower
+	}
+	return spare
+}
+
+// openEVSE controls an OpenEVSE charger via the RAPI passthrough of its WiFi module.
+type openEVSE struct {
+	host string
+}
+
+func (oe openEVSE) String() string { return oe.host }
+
+func (oe openEVSE) rapi(ctx context.Context, cmd string) (string, error) {
+	var resp struct {
+		Cmd string `json:"cmd"`
+		Ret string `json:"ret"`
+	}
+	u := "http://" + oe.host + "/r?json=1&rapi=" + url.QueryEscape(cmd)
+	if err := getJSON(ctx, u, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Ret) < 3 || resp.Ret[:3] != "$OK" {
+		return "", fmt.Errorf("RAPI %q returned %q", cmd, resp.Ret)
+	}
+	return resp.Ret, nil
+}
+
+func (oe openEVSE) query(ctx context.Context) (evState, error) {
+	var resp struct {
+		State   int     `json:"state"` // 3 = charging
+		Amp     int     `json:"amp"`   // mA
+		Pilot   int     `json:"pilot"` // A
+		Voltage float64 `json:"voltage"`
+	}
+	if err := getJSON(ctx, "http://"+oe.host+"/status", &resp); err != nil {
+		return evState{}, err
+	}
+	var st evState
+	if resp.State == 3 {
+		st.Amps = resp.Pilot
+		st.Power = Power(float64(resp.Amp) / 1000 * resp.Voltage)
+	}
+	return st, nil
+}
+
+func (oe openEVSE) setCurrent(ctx context.Context, amps int) error {
+	if amps == 0 {
+		_, err := oe.rapi(ctx, "$FS") // sleep
+		return err
+	}
+	if _, err := oe.rapi(ctx, fmt.Sprintf("$SC %d V", amps)); err != nil {
+		return err
+	}
+	_, err := oe.rapi(ctx, "$FE") // enable
+	return err
+}
+
+// goECharger controls a go-eCharger via its local HTTP API (v2).
+type goECharger struct {
+	host string
+}
+
+func (ge goECharger) String() string { return ge.host }
+
+func (ge goECharger) query(ctx context.Context) (evState, error) {
+	var resp struct {
+		Amp int       `json:"amp"` // A
+		Frc int       `json:"frc"` // 0 = neutral, 1 = off, 2 = on
+		Car int       `json:"car"` // 2 = charging
+		Nrg []float64 `json:"nrg"` // nrg[11] is total power in W
+	}
+	if err := getJSON(ctx, "http://"+ge.host+"/api/status?filter=amp,frc,car,nrg", &resp); err != nil {
+		return evState{}, err
+	}
+	var st evState
+	if resp.Frc != 1 {
+		st.Amps = resp.Amp
+	}
+	if len(resp.Nrg) > 11 {
+		st.Power = Power(resp.Nrg[11])
+	}
+	return st, nil
+}
+
+func (ge goECharger) setCurrent(ctx context.Context, amps int) error {
+	q := "frc=1"
+	if amps > 0 {
+		q = fmt.Sprintf("amp=%d&frc=0", amps)
+	}
+	var resp map[string]interface{}
+	if err := getJSON(ctx, "http://"+ge.host+"/api/set?"+q, &resp); err != nil {
+		return err
+	}
+	for k, v := range resp {
+		if v != true {
+			return fmt.Errorf("setting %s failed: %v", k, v)
+		}
+	}
+	return nil
+}
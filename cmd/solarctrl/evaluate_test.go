@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplugtest"
+	promrawapi "github.com/prometheus/client_golang/api"
+	promclient "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// newTestServer returns a server controlling the harness's plugs as config says,
+// reading solar production of *solar, and plug power from the plugs themselves.
+func newTestServer(t *testing.T, h *tpplugtest.Harness, config Config, solar *float64) *server {
+	t.Helper()
+	srv := tpplugtest.NewPromServer(t, func(query string) ([]tpplugtest.Sample, error) {
+		switch query {
+		case solarQuery:
+			return []tpplugtest.Sample{{Labels: map[string]string{"job": "solarmon"}, Value: *solar}}, nil
+		case plugQuery:
+			return h.PowerSamples(), nil
+		}
+		return nil, fmt.Errorf("unexpected query %q", query)
+	})
+	client, err := promrawapi.NewClient(promrawapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatalf("Creating Prometheus client: %v", err)
+	}
+	s, err := newServer(config, promclient.NewAPI(client))
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	return s
+}
+
+func (s *server) testStatus(alias string) plugStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.status {
+		if st.Name == alias {
+			return st
+		}
+	}
+	return plugStatus{}
+}
+
+func TestEvaluate(t *testing.T) {
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater", Power: 1000, Off: true},
+		tpplugtest.PlugConfig{Alias: "Pool pump", Power: 2500, Off: true},
+		tpplugtest.PlugConfig{Alias: "Fridge", Power: 150},
+	)
+	solar := 3300.0
+	s := newTestServer(t, h, Config{
+		DiscretionaryPlugs: []TPPlugConfig{
+			{Alias: "Pool pump", Consumption: 2500, TurnOn: true, TurnOff: true},
+			{Alias: "Heater", Consumption: 1000, TurnOn: true, TurnOff: true, Priority: 1},
+		},
+	}, &solar)
+
+	// 3300 W less the fridge's 150 W would run either, but not both;
+	// the heater has priority.
+	if err := s.evaluate(context.Background()); err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if !h.Plug("Heater").On() || h.Plug("Pool pump").On() {
+		t.Errorf("After evaluate, heater on = %t, pool pump on = %t; want true, false",
+			h.Plug("Heater").On(), h.Plug("Pool pump").On())
+	}
+	if st := s.testStatus("Heater"); !st.On || st.Err != nil || st.Degraded {
+		t.Errorf("Heater status = %+v, want on and reachable", st)
+	}
+}
+
+func TestEvaluateDegraded(t *testing.T) {
+	defer func(pt, dt, mr time.Duration) { *plugTimeout, *discoverTime, *minRediscovery = pt, dt, mr }(*plugTimeout, *discoverTime, *minRediscovery)
+	*plugTimeout, *discoverTime, *minRediscovery = 50*time.Millisecond, 200*time.Millisecond, 0
+
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater", Power: 1000},
+		tpplugtest.PlugConfig{Alias: "Fridge", Power: 150},
+	)
+	h.Script(
+		tpplugtest.At(1*time.Minute, "Heater", tpplugtest.GoOffline),
+		tpplugtest.At(5*time.Minute, "Heater", tpplugtest.GoOnline),
+	)
+	solar := 3000.0
+	s := newTestServer(t, h, Config{
+		DiscretionaryPlugs: []TPPlugConfig{
+			{Alias: "Heater", Consumption: 1000, TurnOn: true, TurnOff: true},
+		},
+	}, &solar)
+
+	// The heater fails from the second evaluation, and is degraded on the third failure.
+	// Once it is back, it's reachable again on the next evaluation.
+	want := []bool{false, false, false, true, true, false}
+	var got []bool
+	err := h.Run(context.Background(), len(want), time.Minute, func(ctx context.Context) error {
+		err := s.evaluate(ctx)
+		st := s.testStatus("Heater")
+		got = append(got, st.Degraded)
+		if (st.Err != nil) != (h.Elapsed() >= 1*time.Minute && h.Elapsed() < 5*time.Minute) {
+			t.Errorf("At %v, heater query error is %v", h.Elapsed(), st.Err)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Heater degraded at each evaluation = %v, want %v", got, want)
+	}
+	if !h.Plug("Heater").On() {
+		t.Errorf("Heater turned off")
+	}
+}
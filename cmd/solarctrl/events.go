@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event is something that happened during an evaluation,
+// streamed to web clients via server-sent events.
+type event struct {
+	Kind string    `json:"kind"` // "start", "log", "toggle", "override", "done"
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+	Plug string    `json:"plug,omitempty"` // for "toggle"
+}
+
+// broker fans out events to subscribers.
+// Slow subscribers miss events rather than holding up evaluation.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan event]bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan event]bool)}
+}
+
+func (b *broker) publish(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (b *broker) subscribe() chan event {
+	ch := make(chan event, 100)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (s *server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	// Periodic comments keep intermediate proxies from timing out the connection.
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-ch:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				// Shouldn't happen.
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// ForecastConfig enables forecasting household demand from its history,
+// to keep long-running loads from running into predictable demand spikes,
+// such as cooking in the evening after the solar has gone.
+//
+// Demand is learned as its average in each half hour of the week,
+// over the last History (default 4 weeks), and relearned every Refresh (default 6h).
+// A half hour whose typical demand exceeds SpikeAbove is a spike. A load with
+// run_for set isn't turned on for spare solar if it would still be running
+// in a spike. Other reasons to turn it on, such as a minimum daily runtime
+// or cheap imports, aren't affected.
+//
+//	forecast:
+//	  demand_query: sum(household_power_w)
+//	  spike_above: 3000
+//	discretionary_plugs:
+//	  - alias: Dishwasher
+//	    run_for: 2h
+type ForecastConfig struct {
+	// DemandQuery is a Prometheus query expression yielding a 1-vector
+	// of the total household consumption (W). It defaults to peak_demand's.
+	DemandQuery string        `yaml:"demand_query"`
+	SpikeAbove  Power         `yaml:"spike_above"`
+	History     time.Duration `yaml:"history"`
+	Refresh     time.Duration `yaml:"refresh"`
+}
+
+const (
+	forecastSlot  = 30 * time.Minute
+	slotsPerDay   = int(24 * time.Hour / forecastSlot)
+	forecastStep  = 5 * time.Minute // finest resolution of the history it learns from
+	maxPoints     = 10000           // Prometheus refuses ranges of more than 11000 points
+	forecastShown = 12 * time.Hour  // how far ahead the status page shows
+)
+
+// checkForecast validates the forecast configuration, filling in defaults.
+func checkForecast(config *Config) error {
+	fc := config.Forecast
+	if fc == nil {
+		return nil
+	}
+	if fc.DemandQuery == "" && config.PeakDemand != nil {
+		fc.DemandQuery = config.PeakDemand.DemandQuery
+	}
+	if fc.DemandQuery == "" {
+		return fmt.Errorf("forecast needs demand_query")
+	}
+	if fc.SpikeAbove <= 0 {
+		return fmt.Errorf("forecast needs a positive spike_above")
+	}
+	if fc.History <= 0 {
+		fc.History = 28 * 24 * time.Hour
+	}
+	if fc.History < 24*time.Hour {
+		return fmt.Errorf("forecast history must be at least a day")
+	}
+	if fc.Refresh <= 0 {
+		fc.Refresh = 6 * time.Hour
+	}
+	return nil
+}
+
+// forecast is the typical household demand in each half hour of the week.
+type forecast struct {
+	learned time.Time
+	demand  [7][]Power // by weekday, then slot of the day
+}
+
+// forecastPoint is the forecast demand for the half hour starting At.
+type forecastPoint struct {
+	At     time.Time
+	Demand Power
+	Spike  bool
+}
+
+func slotOf(t time.Time) (time.Weekday, int) {
+	return t.Weekday(), (t.Hour()*60 + t.Minute()) / int(forecastSlot/time.Minute)
+}
+
+// learnForecast builds a forecast from the history of the demand query up to now.
+func learnForecast(ctx context.Context, promAPI promclient.API, fc *ForecastConfig, now time.Time) (*forecast, error) {
+	step := forecastStep
+	if s := fc.History / maxPoints; s > step {
+		step = s
+	}
+	r := promclient.Range{Start: now.Add(-fc.History), End: now, Step: step}
+	m, err := queryRangeMatrix(ctx, promAPI, fc.DemandQuery, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(m) != 1 {
+		return nil, fmt.Errorf("demand query yielded %d series, want 1", len(m))
+	}
+	var (
+		sum [7][]float64
+		n   [7][]int
+	)
+	for wd := range sum {
+		sum[wd], n[wd] = make([]float64, slotsPerDay), make([]int, slotsPerDay)
+	}
+	for _, sp := range m[0].Values {
+		wd, slot := slotOf(sp.Timestamp.Time().In(now.Location()))
+		sum[wd][slot] += float64(sp.Value)
+		n[wd][slot]++
+	}
+	// Slots without history for their weekday fall back to the average over all days.
+	daily := make([]Power, slotsPerDay)
+	for slot := 0; slot < slotsPerDay; slot++ {
+		var total float64
+		var count int
+		for wd := range sum {
+			total += sum[wd][slot]
+			count += n[wd][slot]
+		}
+		if count > 0 {
+			daily[slot] = Power(total / float64(count))
+		}
+	}
+	f := &forecast{learned: now}
+	for wd := range sum {
+		f.demand[wd] = make([]Power, slotsPerDay)
+		for slot := 0; slot < slotsPerDay; slot++ {
+			if n[wd][slot] > 0 {
+				f.demand[wd][slot] = Power(sum[wd][slot] / float64(n[wd][slot]))
+			} else {
+				f.demand[wd][slot] = daily[slot]
+			}
+		}
+	}
+	return f, nil
+}
+
+// ahead returns the forecast for each half hour overlapping [now, now+d).
+func (f *forecast) ahead(now time.Time, d time.Duration, spikeAbove Power) []forecastPoint {
+	if f == nil {
+		return nil
+	}
+	var pts []forecastPoint
+	// Not now.Truncate, which works in UTC, and some zones are offset by a quarter hour.
+	mins := int(forecastSlot / time.Minute)
+	start := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()/mins*mins, 0, 0, now.Location())
+	for t := start; t.Before(now.Add(d)); t = t.Add(forecastSlot) {
+		wd, slot := slotOf(t)
+		p := f.demand[wd][slot]
+		pts = append(pts, forecastPoint{At: t, Demand: p, Spike: p > spikeAbove})
+	}
+	return pts
+}
+
+// spikeWithin returns the first spike forecast within d of now, if any.
+func (f *forecast) spikeWithin(now time.Time, d time.Duration, spikeAbove Power) (forecastPoint, bool) {
+	for _, pt := range f.ahead(now, d, spikeAbove) {
+		if pt.Spike {
+			return pt, true
+		}
+	}
+	return forecastPoint{}, false
+}
+
+// updateForecast relearns the forecast if it is due. On failure,
+// it carries on with the previous forecast, if any.
+func (s *server) updateForecast(ctx context.Context, now time.Time, elogf func(string, ...interface{})) *forecast {
+	fc := s.config.Forecast
+	if fc == nil {
+		return nil
+	}
+	s.mu.Lock()
+	f := s.forecast
+	s.mu.Unlock()
+	if f != nil && now.Sub(f.learned) < fc.Refresh {
+		return f
+	}
+	nf, err := learnForecast(ctx, s.promAPI, fc, now)
+	s.notePromResult(err)
+	if err != nil {
+		elogf("WARNING: learning demand forecast: %v", err)
+		return f
+	}
+	elogf("Learned demand forecast from the last %v", fc.History)
+	s.mu.Lock()
+	s.forecast = nf
+	s.mu.Unlock()
+	return nf
+}
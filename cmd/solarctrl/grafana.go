@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// A notifier of kind "grafana" posts each notification as an annotation
+// through Grafana's HTTP API, so power graphs show when and why solarctrl acted:
+//
+//	notify:
+//	  - kind: grafana
+//	    url: http://grafana:3000
+//	    token: glsa_...          # a service account token with annotation:write
+//	    dashboard_uid: abc123    # optional; without it the annotation is org-wide
+//	    panel_id: 2              # optional
+//	    tags: [solar]            # added to "solarctrl" and the plug name
+//
+// Unless events is set, only toggles are annotated.
+
+type grafanaSink struct {
+	client       *http.Client
+	url          string // base URL
+	token        string
+	dashboardUID string
+	panelID      int
+	tags         []string
+}
+
+func (gs grafanaSink) send(ctx context.Context, n notification) error {
+	tags := append([]string{"solarctrl", n.Kind}, gs.tags...)
+	if n.Plug != "" {
+		tags = append(tags, n.Plug)
+	}
+	b, err := json.Marshal(struct {
+		DashboardUID string   `json:"dashboardUID,omitempty"`
+		PanelID      int      `json:"panelId,omitempty"`
+		Time         int64    `json:"time"` // Unix milliseconds
+		Tags         []string `json:"tags"`
+		Text         string   `json:"text"`
+	}{gs.dashboardUID, gs.panelID, n.Time.UnixNano() / 1e6, tags, n.Text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(gs.url, "/")+"/api/annotations", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+gs.token)
+	return do(gs.client, req)
+}
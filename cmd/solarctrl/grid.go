@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// GridConfig brings in what the grid connection and a home battery are doing,
+// for sites that measure them:
+//
+//	grid:
+//	  power_query: grid_power_watts          # importing is positive, exporting negative
+//	  max_import: 500
+//	  battery_soc_query: battery_soc_percent
+//	  min_battery_soc: 80
+type GridConfig struct {
+	// PowerQuery is a Prometheus query expression yielding a 1-vector of the
+	// power (W) imported from the grid, which is negative while exporting.
+	// While importing more than MaxImport, spare solar is taken to be short by
+	// the excess, whatever production and plug use suggest, so loads are turned off.
+	PowerQuery string `yaml:"power_query"`
+	MaxImport  Power  `yaml:"max_import"`
+
+	// BatterySOCQuery is a Prometheus query expression yielding a 1-vector of
+	// the battery's state of charge (percent). Until it reaches MinBatterySOC,
+	// spare solar is left to charge the battery, so loads aren't turned on for it.
+	BatterySOCQuery string  `yaml:"battery_soc_query"`
+	MinBatterySOC   float64 `yaml:"min_battery_soc"`
+}
+
+func (gc *GridConfig) check() error {
+	if gc.PowerQuery == "" && gc.BatterySOCQuery == "" {
+		return fmt.Errorf("grid needs power_query or battery_soc_query")
+	}
+	if gc.MaxImport < 0 {
+		return fmt.Errorf("grid max_import is negative")
+	}
+	if gc.MaxImport > 0 && gc.PowerQuery == "" {
+		return fmt.Errorf("grid max_import needs power_query")
+	}
+	if gc.MinBatterySOC < 0 || gc.MinBatterySOC > 100 {
+		return fmt.Errorf("grid min_battery_soc %v is not a percentage", gc.MinBatterySOC)
+	}
+	if gc.MinBatterySOC > 0 && gc.BatterySOCQuery == "" {
+		return fmt.Errorf("grid min_battery_soc needs battery_soc_query")
+	}
+	return nil
+}
+
+// gridState is what the grid connection and battery are doing for an evaluation.
+type gridState struct {
+	imported *Power   // nil if unknown
+	soc      *float64 // nil if unknown
+}
+
+// queryGrid fetches the grid power and battery state of charge, as configured.
+// Either is left unknown if its query fails.
+func (s *server) queryGrid(ctx context.Context, elogf func(string, ...interface{})) gridState {
+	var gs gridState
+	gc := s.config.Grid
+	if gc == nil {
+		return gs
+	}
+	if gc.PowerQuery != "" {
+		p, err := queryPower(ctx, s.promAPI, gc.PowerQuery)
+		s.notePromResult(err)
+		if err != nil {
+			elogf("WARNING: querying grid power: %v", err)
+		} else {
+			gs.imported = &p
+			gridGauge.Set(float64(p))
+		}
+	}
+	if gc.BatterySOCQuery != "" {
+		soc, err := queryFloat(ctx, s.promAPI, gc.BatterySOCQuery)
+		s.notePromResult(err)
+		if err != nil {
+			elogf("WARNING: querying battery state of charge: %v", err)
+		} else {
+			gs.soc = &soc
+			batteryGauge.Set(soc)
+		}
+	}
+	return gs
+}
+
+// overImport returns how much more than the configured maximum is being imported.
+func (gs gridState) overImport(gc *GridConfig) Power {
+	if gc == nil || gc.MaxImport <= 0 || gs.imported == nil || *gs.imported <= gc.MaxImport {
+		return 0
+	}
+	return *gs.imported - gc.MaxImport
+}
+
+// charging reports whether spare solar should go to the battery.
+func (gs gridState) charging(gc *GridConfig) bool {
+	return gc != nil && gc.MinBatterySOC > 0 && gs.soc != nil && *gs.soc < gc.MinBatterySOC
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var promUnhealthyAfter = flag.Duration("prom_unhealthy_after", 10*time.Minute, "report unhealthy once Prometheus has been unreachable for this long")
+
+// notePromResult records whether a Prometheus query worked, for health checking.
+func (s *server) notePromResult(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.promFailingSince = time.Time{}
+	} else if s.promFailingSince.IsZero() {
+		s.promFailingSince = time.Now()
+	}
+}
+
+// health reports any reason the controller appears to be stuck.
+func (s *server) health(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var problems []string
+	if *loop > 0 {
+		last, what := s.lastSuccess, "last successful evaluation"
+		if last.IsZero() {
+			last, what = s.started, "startup with no successful evaluation since"
+		}
+		if age := now.Sub(last); age > 2**loop {
+			problems = append(problems, fmt.Sprintf("%s was %v ago (loop period %v)", what, age.Truncate(time.Second), *loop))
+		}
+	}
+	if !s.promFailingSince.IsZero() {
+		if d := now.Sub(s.promFailingSince); d > *promUnhealthyAfter {
+			problems = append(problems, fmt.Sprintf("Prometheus unreachable for %v", d.Truncate(time.Second)))
+		}
+	}
+	return problems
+}
+
+func (s *server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	problems := s.health(time.Now())
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+}
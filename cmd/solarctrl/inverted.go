@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Plugs with inverted set drive load-shedding contactors or normally-closed relays,
+// so their relay being on means the load is off. Everything but the driver sees
+// the state of the load: decisions, the web UI, metrics and safe states.
+// Such a plug doesn't measure what the load draws, so it is assumed to draw
+// its configured consumption whenever it is on.
+
+// invertedDriver wraps the driver of an inverted plug.
+type invertedDriver struct {
+	switchDriver
+}
+
+func (id invertedDriver) query(ctx context.Context) (switchState, error) {
+	st, err := id.switchDriver.query(ctx)
+	if err != nil {
+		return switchState{}, err
+	}
+	// Whatever it measures is the contactor or relay coil, not the load.
+	return switchState{On: !st.On}, nil
+}
+
+func (id invertedDriver) setRelay(ctx context.Context, on bool) error {
+	return id.switchDriver.setRelay(ctx, !on)
+}
+
+func (id invertedDriver) setRelayIf(ctx context.Context, wasOn, on bool) error {
+	return setRelayIf(ctx, id.switchDriver, !wasOn, !on)
+}
+
+func checkInverted(cfg TPPlugConfig) error {
+	if !cfg.Inverted {
+		return nil
+	}
+	if cfg.Profile == profileHotWater {
+		return fmt.Errorf("plug %q: inverted plugs can't use the %s profile, since they don't measure the load", cfg.Alias, cfg.Profile)
+	}
+	if cfg.SurgeWatts > 0 {
+		return fmt.Errorf("plug %q: inverted plugs can't have surge_watts, since they don't measure the load", cfg.Alias)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LeaseConfig lets several instances (such as a primary and a backup)
+// run at once, with only the holder of a lease controlling plugs.
+// The others evaluate as if -dry_run were set, copying the holder's state
+// (cooldowns, pauses, daily runtimes and so on) so they can take over
+// seamlessly once its lease expires.
+//
+// The lease is kept in a file that all instances can reach (such as over NFS),
+// or by an HTTP lease server. A lease server handles POST requests
+// with a leaseRecord (expiry ignored) as JSON, replying with the record
+// now in effect, with 200 OK if the lease was granted or renewed,
+// or 409 Conflict if someone else holds it.
+// A DELETE request with the record releases the lease, if held by its holder.
+type LeaseConfig struct {
+	ID  string        // defaults to the hostname
+	TTL time.Duration // how long the lease lasts unrenewed; defaults to three -loop periods
+
+	File string // lease file
+	URL  string // lease server
+
+	// Advertise is the base URL where other instances can reach this one
+	// (such as "http://pi1:8080"), to copy its state when it holds the lease.
+	Advertise string
+}
+
+func (lc *LeaseConfig) check() error {
+	if (lc.File == "") == (lc.URL == "") {
+		return fmt.Errorf("lease needs exactly one of file and url")
+	}
+	if lc.ID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("lease: getting hostname: %w", err)
+		}
+		lc.ID = host
+	}
+	if lc.TTL <= 0 {
+		lc.TTL = 3 * *loop
+		if lc.TTL < time.Minute {
+			lc.TTL = time.Minute
+		}
+	}
+	return nil
+}
+
+// leaseRecord says who holds the lease.
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	Expires   time.Time `json:"expires"`
+	Advertise string    `json:"advertise,omitempty"`
+}
+
+// acquireLease takes or renews the lease if it can, and returns the record in effect.
+func (s *server) acquireLease(ctx context.Context, now time.Time) (leaseRecord, error) {
+	lc := s.config.Lease
+	want := leaseRecord{Holder: lc.ID, Expires: now.Add(lc.TTL), Advertise: lc.Advertise}
+	if lc.URL != "" {
+		return leaseRequest(ctx, "POST", lc.URL, want)
+	}
+
+	// There's no locking, so two instances could both take a free lease at once.
+	// Reading it back after writing leaves whoever wrote last holding it.
+	cur, err := readLeaseFile(lc.File)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	if cur.Holder != lc.ID && cur.Expires.After(now) {
+		return cur, nil
+	}
+	if err := writeLeaseFile(lc.File, want); err != nil {
+		return leaseRecord{}, err
+	}
+	return readLeaseFile(lc.File)
+}
+
+// releaseLease gives up the lease, if this instance holds it,
+// so another can take over without waiting for it to expire.
+func (s *server) releaseLease(ctx context.Context) error {
+	lc := s.config.Lease
+	mine := leaseRecord{Holder: lc.ID}
+	if lc.URL != "" {
+		_, err := leaseRequest(ctx, "DELETE", lc.URL, mine)
+		return err
+	}
+	cur, err := readLeaseFile(lc.File)
+	if err != nil || cur.Holder != lc.ID {
+		return err
+	}
+	return writeLeaseFile(lc.File, mine) // already expired
+}
+
+func readLeaseFile(path string) (leaseRecord, error) {
+	var lr leaseRecord
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lr, nil
+	} else if err != nil {
+		return lr, err
+	}
+	if err := json.Unmarshal(raw, &lr); err != nil {
+		return lr, fmt.Errorf("parsing lease file %s: %w", path, err)
+	}
+	return lr, nil
+}
+
+func writeLeaseFile(path string, lr leaseRecord) error {
+	raw, err := json.Marshal(lr)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".solarctrl-lease-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func leaseRequest(ctx context.Context, method, url string, lr leaseRecord) (leaseRecord, error) {
+	body, err := json.Marshal(lr)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return leaseRecord{}, fmt.Errorf("lease server: HTTP %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var cur leaseRecord
+	if method == "DELETE" {
+		return cur, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cur); err != nil {
+		return leaseRecord{}, fmt.Errorf("lease server: decoding response: %w", err)
+	}
+	return cur, nil
+}
+
+// checkLease works out whether this instance should control plugs in this evaluation,
+// and if not, copies the state of the one that does.
+// Without a lease configured, it always should.
+func (s *server) checkLease(ctx context.Context, now time.Time, elogf func(string, ...interface{})) {
+	lc := s.config.Lease
+	if lc == nil {
+		return
+	}
+	cur, err := s.acquireLease(ctx, now)
+	standby := err != nil || cur.Holder != lc.ID
+	s.mu.Lock()
+	was := s.standby
+	s.standby = standby
+	s.leaseHolder = cur.Holder
+	s.mu.Unlock()
+	leaderGauge.Set(float64(boolState(!standby)))
+
+	switch {
+	case err != nil:
+		// Better that nobody controls plugs than two instances fight over them.
+		elogf("WARNING: checking lease: %v; standing by", err)
+		logger.Error("Checking lease", "err", err)
+		return
+	case !standby:
+		if was {
+			elogf("Acquired lease as %q", lc.ID)
+			logger.Info("Acquired lease", "id", lc.ID)
+		}
+		return
+	}
+	if !was {
+		elogf("Lease held by %q; standing by", cur.Holder)
+		logger.Info("Standing by", "holder", cur.Holder, "expires", cur.Expires)
+	}
+	if cur.Advertise == "" {
+		return
+	}
+	if err := s.syncState(ctx, cur.Advertise); err != nil {
+		elogf("WARNING: copying state from %q: %v", cur.Holder, err)
+	}
+}
+
+// isStandby reports whether another instance holds the lease.
+func (s *server) isStandby() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.standby
+}
+
+// dry reports whether a plug should only be pretended to be switched.
+func (s *server) dry(cfg TPPlugConfig) bool {
+	return *dryRun || cfg.ObserveOnly || s.isStandby()
+}
+
+// syncState copies the state of the instance at base.
+func (s *server) syncState(ctx context.Context, base string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/state", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	var ps persistedState
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return fmt.Errorf("decoding state: %w", err)
+	}
+	s.restoreState(ps)
+	return nil
+}
+
+// serveState serves the controller state, for standby instances to copy.
+func (s *server) serveState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshotState())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// load is a unit of discretionary consumption:
+// either a single plug, or a group of plugs that always switch together.
+type load struct {
+	Name  string // plug alias, or group name
+	Plugs []TPPlug
+}
+
+// On reports whether any plug in the load is on.
+func (l *load) On() bool {
+	for _, tp := range l.Plugs {
+		if tp.On() {
+			return true
+		}
+	}
+	return false
+}
+
+// satisfied reports whether every plug in the load that is on has its thermostat satisfied.
+func (l *load) satisfied() bool {
+	sat := false
+	for _, tp := range l.Plugs {
+		if tp.On() && !tp.Satisfied {
+			return false
+		}
+		sat = sat || tp.Satisfied
+	}
+	return sat
+}
+
+func (l *load) Power() Power {
+	var p Power
+	for _, tp := range l.Plugs {
+		p += tp.Power()
+	}
+	return p
+}
+
+func (l *load) Consumption() Power {
+	var p Power
+	for _, tp := range l.Plugs {
+		p += tp.dp.cfg.Consumption
+	}
+	return p
+}
+
+// cfg returns the configuration governing the load's control.
+// newServer checks that group members agree on it.
+func (l *load) cfg() TPPlugConfig { return l.Plugs[0].dp.cfg }
+
+func (l *load) Addrs() string {
+	var addrs []string
+	for _, tp := range l.Plugs {
+		addrs = append(addrs, tp.Addr())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// setRelayState sets every plug in the load to newState.
+// If any fails, the plugs already switched are switched back.
+func (l *load) setRelayState(ctx context.Context, newState int) error {
+	var done []TPPlug
+	for _, tp := range l.Plugs {
+		if tp.On() == (newState == 1) {
+			continue
+		}
+		if err := setRelayIf(ctx, tp.drv, tp.On(), newState == 1); err != nil {
+			for _, dtp := range done {
+				if rerr := dtp.drv.setRelay(ctx, newState != 1); rerr != nil {
+					logger.Error("Rolling back plug in group", "group", l.Name, "plug", dtp.dp.cfg.Alias, "err", rerr)
+				}
+			}
+			if len(l.Plugs) == 1 {
+				return err
+			}
+			return fmt.Errorf("plug %q: %w", tp.dp.cfg.Alias, err)
+		}
+		done = append(done, tp)
+	}
+	return nil
+}
+
+// loadName returns the name of the load the plug belongs to.
+func (cfg TPPlugConfig) loadName() string {
+	if cfg.Group != "" {
+		return cfg.Group
+	}
+	return cfg.Alias
+}
+
+// checkGroups verifies that plug groups are consistently configured.
+func checkGroups(plugs []TPPlugConfig) error {
+	aliases := make(map[string]bool)
+	for _, tp := range plugs {
+		aliases[tp.Alias] = true
+	}
+	first := make(map[string]TPPlugConfig) // group name => first member
+	for _, tp := range plugs {
+		if tp.Group == "" {
+			continue
+		}
+		if aliases[tp.Group] {
+			return fmt.Errorf("group %q has the same name as a plug", tp.Group)
+		}
+		f, ok := first[tp.Group]
+		if !ok {
+			first[tp.Group] = tp
+			continue
+		}
+		if tp.TurnOn != f.TurnOn || tp.TurnOff != f.TurnOff || tp.ObserveOnly != f.ObserveOnly ||
+			tp.MinDailyRuntime != f.MinDailyRuntime || tp.RuntimeCutoff != f.RuntimeCutoff ||
+			tp.MinRun != f.MinRun || tp.MinOffTime != f.MinOffTime || tp.RunFor != f.RunFor || tp.Phase != f.Phase ||
+			tp.OccupiedWhen != f.OccupiedWhen ||
+			tp.Priority != f.Priority || fmt.Sprint(tp.Priorities) != fmt.Sprint(f.Priorities) ||
+			fmt.Sprint(tp.AllowedWindows) != fmt.Sprint(f.AllowedWindows) ||
+			fmt.Sprint(tp.AllowedWeekdays) != fmt.Sprint(f.AllowedWeekdays) ||
+			!reflect.DeepEqual(tp.OnMargin, f.OnMargin) || tp.OffMargin != f.OffMargin || tp.OffAfter != f.OffAfter {
+			return fmt.Errorf("plugs %q and %q in group %q have different control settings", f.Alias, tp.Alias, tp.Group)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckGroups(t *testing.T) {
+	a := TPPlugConfig{Alias: "pump a", Group: "pool", TurnOn: true, RunFor: time.Hour}
+	b := a
+	b.Alias = "pump b"
+	if err := checkGroups([]TPPlugConfig{a, b}); err != nil {
+		t.Errorf("checkGroups with matching members: %v", err)
+	}
+	b.RunFor = 2 * time.Hour
+	if err := checkGroups([]TPPlugConfig{a, b}); err == nil {
+		t.Errorf("checkGroups with members of different run_for succeeded")
+	}
+	b = a
+	b.Alias = "pool"
+	b.Group = ""
+	if err := checkGroups([]TPPlugConfig{a, b}); err == nil {
+		t.Errorf("checkGroups with a group named as a plug succeeded")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+var (
+	logLevel    = flag.String("log_level", "info", "minimum `level` to log (debug, info, warn, error); -v implies debug")
+	logFile     = flag.String("log_file", "", "if set, also write JSON logs to this `filename`, rotating by size")
+	logMaxSize  = flag.Int("log_max_size", 10, "maximum size in `MB` of the log file before it is rotated")
+	logMaxFiles = flag.Int("log_max_files", 5, "number of rotated log files to keep")
+)
+
+// logger is the structured logger, configured by setupLogging.
+var logger = slog.Default()
+
+// setupLogging configures logger from flags, and routes the standard log package through it.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("bad -log_level %q: %w", *logLevel, err)
+	}
+	if *vFlag {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if *logFile != "" {
+		rf, err := newRotatingFile(*logFile, int64(*logMaxSize)<<20, *logMaxFiles)
+		if err != nil {
+			return err
+		}
+		h = teeHandler{h, slog.NewJSONHandler(rf, opts)}
+	}
+	logger = slog.New(h)
+	slog.SetDefault(logger)
+	return nil
+}
+
+func vlogf(format string, args ...interface{}) {
+	logger.Debug(fmt.Sprintf(format, args...))
+}
+
+// teeHandler sends records to multiple handlers.
+type teeHandler []slog.Handler
+
+func (th teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range th {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (th teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range th {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (th teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var nth teeHandler
+	for _, h := range th {
+		nth = append(nth, h.WithAttrs(attrs))
+	}
+	return nth
+}
+
+func (th teeHandler) WithGroup(name string) slog.Handler {
+	var nth teeHandler
+	for _, h := range th {
+		nth = append(nth, h.WithGroup(name))
+	}
+	return nth
+}
+
+// rotatingFile is an io.Writer that appends to a file,
+// renaming it to name.1, name.2, etc. once it exceeds a size.
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		name:     name,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, size, err := openAppend(rf.name)
+	if err != nil {
+		return err
+	}
+	rf.f, rf.size = f, size
+	return nil
+}
+
+func openAppend(name string) (*os.File, int64, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// Keep writing to the old file rather than losing logs.
+			fmt.Fprintf(os.Stderr, "Rotating log file %s: %v\n", rf.name, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log file aside and starts a new one. The old file is kept
+// open until the new one is, so if anything fails, logs still go to the old one;
+// its size is then counted afresh, so rotation isn't tried again on every write.
+func (rf *rotatingFile) rotate() error {
+	var errs []error
+	rename := func(from, to string) {
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		rename(rf.backup(i), rf.backup(i+1))
+	}
+	if err := os.Remove(rf.backup(rf.maxFiles + 1)); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	var err error
+	if rf.maxFiles > 0 {
+		err = os.Rename(rf.name, rf.backup(1))
+	} else {
+		err = os.Remove(rf.name)
+	}
+	if err != nil {
+		rf.size = 0
+		return errors.Join(append(errs, err)...)
+	}
+
+	f, size, err := openAppend(rf.name)
+	if err != nil {
+		rf.size = 0
+		return errors.Join(append(errs, err)...)
+	}
+	if err := rf.f.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	rf.f, rf.size = f, size
+	return errors.Join(errs...)
+}
+
+func (rf *rotatingFile) backup(i int) string { return fmt.Sprintf("%s.%d", rf.name, i) }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	rf, err := newRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.f.Close()
+	for _, s := range []string{"one.....\n", "two.....\n", "three...\n", "four....\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(%q): %v", s, err)
+		}
+	}
+	for _, f := range []struct{ name, want string }{
+		{name, "four....\n"},
+		{name + ".1", "three...\n"},
+		{name + ".2", "two.....\n"},
+	} {
+		b, err := os.ReadFile(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != f.want {
+			t.Errorf("%s holds %q, want %q", f.name, b, f.want)
+		}
+	}
+	if _, err := os.ReadFile(name + ".3"); err == nil {
+		t.Errorf("%s.3 exists, but only 2 backups should be kept", name)
+	}
+}
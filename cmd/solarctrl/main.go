@@ -3,41 +3,47 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"sort"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/dsymonds/tpplug/tpplug"
 	promrawapi "github.com/prometheus/client_golang/api"
 	promclient "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommodel "github.com/prometheus/common/model"
-	"gopkg.in/yaml.v2"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/dsymonds/tpplug/tpplugotel"
 )
 
 var (
 	configFile = flag.String("config_file", "solarctrl.yaml", "configuration `filename`")
 	port       = flag.Int("port", 0, "`port` to serve HTTP (optional)")
 	vFlag      = flag.Bool("v", false, "be verbose")
+	stateFile  = flag.String("state_file", "", "if set, `filename` to persist controller state in across restarts")
 
-	loop      = flag.Duration("loop", 0, "if set, run and evaluate every `period`")
-	minToggle = flag.Duration("min_toggle", 5*time.Minute, "minimum time between toggles")
-)
+	loop       = flag.Duration("loop", 0, "if set, run and evaluate every `period`")
+	alignLoop  = flag.Bool("align", false, "with -loop, evaluate at multiples of the period on the clock (e.g. :00, :05, ... for 5m)")
+	loopJitter = flag.Duration("jitter", 0, "with -loop, delay each evaluation by a random `duration` up to this")
+	minToggle  = flag.Duration("min_toggle", 5*time.Minute, "minimum time between toggles")
+	dryRun     = flag.Bool("dry_run", false, "evaluate and log decisions, but never toggle plugs")
 
-func vlogf(format string, args ...interface{}) {
-	if !*vFlag {
-		return
-	}
-	log.Printf(format, args...)
-}
+	templateDir = flag.String("template_dir", "", "if set, `directory` of web UI templates to use instead of the built-in ones; see templates.go")
+)
 
 const (
 	// solarQuery is the Prometheus query expression to retrieve the current solar production in Watts as a 1-vector.
@@ -51,62 +57,236 @@ const (
 
 type Config struct {
 	PrometheusAddr string `yaml:"prometheus_addr"` // URL
+	// Prometheus, if set, configures TLS, credentials and headers for prometheus_addr.
+	Prometheus *PrometheusConfig `yaml:"prometheus"`
 
 	BaselineConsumption Power `yaml:"baseline_consumption"`
 
-	DiscretionaryPlugs []TPPlugConfig `yaml:"discretionary_plugs"`
+	// Margin is held back from spare solar when deciding whether to turn a plug on,
+	// as a buffer against clouds and measurement noise.
+	Margin Margin
+
+	// Prices per kWh of imported and exported electricity.
+	// These are only used for the savings report.
+	Tariff       float64 `yaml:"tariff"`
+	FeedInTariff float64 `yaml:"feed_in_tariff"`
+
+	// Price, if set, gets current prices from a dynamic tariff to guide decisions.
+	Price *PriceConfig `yaml:"price"`
+
+	// Grid, if set, brings grid import and battery charge into decisions.
+	Grid *GridConfig `yaml:"grid"`
+
+	DiscretionaryPlugs []TPPlugConfig    `yaml:"discretionary_plugs"`
+	EVChargers         []EVChargerConfig `yaml:"ev_chargers"`
+
+	// Phases, if set, describes a multi-phase supply. Unless NetMetered is set,
+	// each discretionary plug must be tagged with its phase, and only surplus
+	// on that phase is used to power it. PlugPhases tags other plugs
+	// (by their Prometheus name) with their phase.
+	Phases     []PhaseConfig
+	NetMetered bool              `yaml:"net_metered"`
+	PlugPhases map[string]string `yaml:"plug_phases"`
+
+	// Calendar lists profiles that override control on particular days.
+	// The first that matches the current day applies.
+	Calendar []CalendarProfile
+
+	Notify []NotifierConfig `yaml:"notify"`
+	// UnreachableAfter is how many consecutive failed queries of a discretionary plug
+	// mark it as degraded. Defaults to 3.
+	UnreachableAfter int `yaml:"unreachable_after"`
+	// EvalErrorsAfter is how many consecutive evaluations must fail
+	// before it is notified. Defaults to 1.
+	EvalErrorsAfter int `yaml:"eval_errors_after"`
+
+	// MaxTotalDiscretionary, if set, caps the total power of discretionary plugs
+	// that are on at once, however much spare solar there is, such as to stay
+	// within what the wiring can carry.
+	MaxTotalDiscretionary Power `yaml:"max_total_discretionary"`
+
+	// PeakDemand, if set, caps household demand during peak windows.
+	PeakDemand *PeakDemandConfig `yaml:"peak_demand"`
+
+	// Webhook, if set, enables the /webhook endpoint for external overrides.
+	Webhook *WebhookConfig `yaml:"webhook"`
+
+	// MQTT, if set, publishes the state of loads to an MQTT broker, and takes commands from it.
+	MQTT *MQTTConfig `yaml:"mqtt"`
+
+	// Pushgateway, if set, is where to push metrics after each evaluation.
+	Pushgateway *PushgatewayConfig `yaml:"pushgateway"`
+
+	// Lease, if set, coordinates with other instances so only one controls plugs.
+	Lease *LeaseConfig `yaml:"lease"`
+
+	// Adopt, if set, offers newly discovered plugs on the web UI for adoption.
+	Adopt *AdoptConfig `yaml:"adopt"`
+
+	// Forecast, if set, learns typical household demand, to keep
+	// long-running loads out of predictable demand spikes.
+	Forecast *ForecastConfig `yaml:"forecast"`
+
+	// Editor, if set, enables the /config page for editing this config.
+	Editor *EditorConfig `yaml:"config_editor"`
 }
 
 type TPPlugConfig struct {
-	Alias       string
+	Alias string
+	// If IP is empty, the plug's address is found by discovery,
+	// matching by MAC if that is set, or else by alias.
 	IP          string
+	MAC         string
 	Consumption Power
 
+	// Driver selects how to talk to the plug: "tpplug" (the default),
+	// "shelly", "shelly_rpc" or "tasmota". The latter need IP set
+	// (which may be a hostname).
+	Driver string
+
+	// Child, if set, selects one outlet of a TP-Link power strip (such as an HS300),
+	// by its child ID (in full, or just its last two digits, like "02") or its alias.
+	// The strip itself is found by IP or MAC.
+	Child string
+
 	TurnOn  bool `yaml:"turn_on"`
 	TurnOff bool `yaml:"turn_off"`
+
+	// ObserveOnly makes this plug behave as if -dry_run were set.
+	ObserveOnly bool `yaml:"observe_only"`
+
+	// Inverted is for plugs driving load-shedding contactors or normally-closed relays,
+	// where the relay being on means the load is off. See inverted.go.
+	Inverted bool
+
+	// SafeState, if set, is the state ("on" or "off") to put this plug in when shutting down.
+	SafeState string `yaml:"safe_state"`
+
+	// Group, if set, names a set of plugs that are treated as a single load,
+	// and are switched on and off together.
+	Group string
+
+	// If MinDailyRuntime is set and the plug hasn't run that long by RuntimeCutoff ("15:04")
+	// each day, it is turned on regardless of solar until it has.
+	MinDailyRuntime time.Duration `yaml:"min_daily_runtime"`
+	RuntimeCutoff   string        `yaml:"runtime_cutoff"`
+
+	// Profile tunes control for a particular kind of appliance.
+	// The only one is "hot_water".
+	Profile string
+	// MinRun is the minimum time to leave the plug on once it's been turned on.
+	MinRun time.Duration `yaml:"min_run"`
+	// MinOffTime is the minimum time to leave the plug off once it's been turned off
+	// (by anything), regardless of -min_toggle, overrides and minimum daily runtimes.
+	// Compressors (in fridges, freezers and heat pumps) can be damaged
+	// by restarting before their pressures equalise.
+	MinOffTime time.Duration `yaml:"min_off_time"`
+
+	// OnMargin, if set, is held back from spare solar when deciding whether
+	// to turn the plug on, instead of Config.Margin.
+	// OffMargin is how short of spare solar it must be before it is turned off,
+	// and OffAfter, if set, how many evaluations in a row it must be short.
+	// Together with MinRun and MinOffTime, these stop loads near the threshold flapping.
+	OnMargin  *Margin `yaml:"on_margin"`
+	OffMargin Margin  `yaml:"off_margin"`
+	OffAfter  int     `yaml:"off_after"`
+
+	// OccupiedWhen, if set, is a Prometheus query expression for whether someone is home
+	// (such as from phones on Wi-Fi, or motion sensors), which holds if it yields any samples.
+	// While it doesn't, the plug isn't turned on for spare solar or cheap imports,
+	// and is turned off if on, leaving the surplus to others.
+	OccupiedWhen string `yaml:"occupied_when"`
+
+	// SurgeWatts, if set, is how much the plug may draw as it starts up
+	// (such as a pump or compressor) without being counted as more than Consumption,
+	// for SurgeDuration (default 5m) after it is turned on.
+	SurgeWatts    Power         `yaml:"surge_watts"`
+	SurgeDuration time.Duration `yaml:"surge_duration"`
+
+	// Phase is the supply phase the plug is on, if Config.Phases is set.
+	Phase string
+
+	// RunFor is how long the load runs once started, such as a dishwasher's cycle.
+	// If set along with Config.Forecast, it isn't turned on for spare solar
+	// if it would still be running in a forecast demand spike.
+	RunFor time.Duration `yaml:"run_for"`
+
+	// Priority orders loads. Higher priority loads get first go at spare solar,
+	// and are turned off last. Loads of the same priority are taken in order of name.
+	// Priorities, if set, change it dynamically: the first rule whose condition holds applies.
+	Priority   int
+	Priorities []PriorityRule
+
+	// AllowedWindows, if set, are the times of day ("09:00-16:00", which may wrap
+	// over midnight) when solarctrl may switch the plug; outside them it is left alone.
+	// AllowedWeekdays ("mon", "tue", etc.), if set, limits them to windows starting
+	// on those days, or on its own, allows switching only on those days.
+	AllowedWindows  []string `yaml:"allowed_windows"`
+	AllowedWeekdays []string `yaml:"allowed_weekdays"`
 }
 
 type TPPlug struct {
 	dp    discPlug
-	state tpplug.State
+	drv   switchDriver
+	state switchState
 
 	// Assumed overrides the power in Raw.
 	AssumedPower Power
+	// Satisfied is set if the plug's own thermostat has cut out.
+	Satisfied bool
 }
 
-func (tp TPPlug) Addr() *net.UDPAddr { return tp.dp.addr }
-func (tp TPPlug) On() bool           { return tp.state.System.Info.RelayState == 1 }
+func (tp TPPlug) Addr() string { return tp.drv.String() }
+func (tp TPPlug) On() bool     { return tp.state.On }
 func (tp TPPlug) Power() Power {
 	if tp.AssumedPower > 0 {
 		return tp.AssumedPower
 	}
-	return Power(tp.state.EnergyMeter.Realtime.Power / 1000) // mw -> W
+	return tp.state.Power
 }
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Setting up logging: %v", err)
+	}
+	if err := loadTemplates(*templateDir); err != nil {
+		log.Fatalf("Loading templates: %v", err)
+	}
 
-	var config Config
 	configRaw, err := ioutil.ReadFile(*configFile)
 	if err != nil {
 		log.Fatalf("Reading config file %s: %v", *configFile, err)
 	}
-	if err := yaml.UnmarshalStrict(configRaw, &config); err != nil {
+	config, err := parseConfig(configRaw)
+	if err != nil {
 		log.Fatalf("Parsing config from %s: %v", *configFile, err)
 	}
 
 	vlogf("Prometheus at %q", config.PrometheusAddr)
+	promRT, err := config.Prometheus.roundTripper()
+	if err != nil {
+		log.Fatalf("Configuring Prometheus client: %v", err)
+	}
 	promClient, err := promrawapi.NewClient(promrawapi.Config{
-		Address: config.PrometheusAddr,
+		Address:      config.PrometheusAddr,
+		RoundTripper: promRT,
 	})
 	if err != nil {
 		log.Fatalf("Creating Prometheus client: %v", err)
 	}
 	promAPI := promclient.NewAPI(promClient)
 
+	if flag.Arg(0) == "backtest" {
+		if err := backtest(context.Background(), config, promAPI, flag.Args()[1:]); err != nil {
+			log.Fatalf("Backtest: %v", err)
+		}
+		return
+	}
+
 	if *port != 0 {
 		go func() {
-			log.Printf("Serving HTTP on port %d", *port)
+			logger.Info("Serving HTTP", "port", *port)
 			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 		}()
 	}
@@ -115,20 +295,86 @@ func main() {
 	if err != nil {
 		log.Fatalf("Initialising server: %v", err)
 	}
+	if err := s.loadState(); err != nil {
+		log.Fatalf("Loading state: %v", err)
+	}
+	if err := s.audit.loadRecent(); err != nil {
+		log.Fatalf("Reading audit log: %v", err)
+	}
 	http.Handle("/", s)
+	http.Handle("/metrics", promhttp.Handler())
+
+	// Stop cleanly on SIGTERM/SIGINT. Any in-progress evaluation is aborted.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownTracing, err := tpplugotel.Setup(ctx, "solarctrl")
+	if err != nil {
+		log.Fatalf("Setting up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if s.config.Adopt != nil && *port != 0 {
+		go s.adoptLoop(ctx)
+	}
+	if mc := s.config.MQTT; mc != nil {
+		if err := s.startMQTT(ctx, mc); err != nil {
+			log.Fatalf("Starting MQTT: %v", err)
+		}
+	}
 
 	// Evaluate at least once.
-	s.evaluate(context.Background())
+	start := time.Now()
+	s.evaluate(ctx)
 
 	if *loop <= 0 {
 		return
 	}
+	go s.reloadLoop(ctx, configRaw)
 
-	for range time.NewTicker(*loop).C {
-		s.evaluate(context.Background())
+	rand.Seed(time.Now().UnixNano()) // so that multiple controllers jitter differently
+	next := start
+	for {
+		next = nextEvaluation(next, time.Now())
+		wait := time.Until(next)
+		if *loopJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(*loopJitter)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.shutdown()
+			return
+		case <-timer.C:
+			s.evaluate(ctx)
+		}
 	}
 }
 
+// nextEvaluation returns when the evaluation after the one scheduled for prev is due
+// in -loop mode, before jitter. Like a ticker, it skips evaluations that are already late.
+func nextEvaluation(prev, now time.Time) time.Time {
+	if *alignLoop {
+		// Truncate works relative to the zero time, which is midnight UTC,
+		// so this is aligned to the (UTC) clock for periods that divide a day.
+		return now.Truncate(*loop).Add(*loop)
+	}
+	next := prev.Add(*loop)
+	for !next.After(now) {
+		next = next.Add(*loop)
+	}
+	return next
+}
+
+// onOff renders a relay state.
+func onOff(state int) string {
+	if state == 1 {
+		return "on"
+	}
+	return "off"
+}
+
 type Power int // measured in Watts
 
 func (p Power) String() string {
@@ -139,7 +385,21 @@ func (p Power) String() string {
 }
 
 func solarPower(ctx context.Context, promAPI promclient.API) (Power, error) {
-	v, warns, err := promAPI.Query(ctx, solarQuery, time.Now())
+	return queryPower(ctx, promAPI, solarQuery)
+}
+
+// queryPower evaluates a Prometheus query expression that yields a power (in Watts) as a 1-vector.
+func queryPower(ctx context.Context, promAPI promclient.API, query string) (Power, error) {
+	v, err := queryFloat(ctx, promAPI, query)
+	return Power(v), err
+}
+
+// queryFloat evaluates a Prometheus query expression that yields a 1-vector.
+func queryFloat(ctx context.Context, promAPI promclient.API, query string) (_ float64, err error) {
+	ctx, end := startSpan(ctx, "prometheus.Query", attribute.String("query", query))
+	defer func() { end(err) }()
+
+	v, warns, err := promAPI.Query(ctx, query, time.Now())
 	if err != nil {
 		return 0, fmt.Errorf("Prometheus query evaluation: %w", err)
 	}
@@ -154,7 +414,7 @@ func solarPower(ctx context.Context, promAPI promclient.API) (Power, error) {
 	if len(vec) != 1 {
 		return 0, fmt.Errorf("Prometheus query yielded vector of %d values, want 1", len(vec))
 	}
-	return Power(vec[0].Value), nil
+	return float64(vec[0].Value), nil
 }
 
 type plugData struct {
@@ -164,7 +424,10 @@ type plugData struct {
 }
 
 // plugPower fetches the recent smart plug power consumption.
-func plugPower(ctx context.Context, promAPI promclient.API) ([]plugData, error) {
+func plugPower(ctx context.Context, promAPI promclient.API) (_ []plugData, err error) {
+	ctx, end := startSpan(ctx, "prometheus.Query", attribute.String("query", plugQuery))
+	defer func() { end(err) }()
+
 	v, warns, err := promAPI.Query(ctx, plugQuery, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("Prometheus query evaluation: %w", err)
@@ -194,80 +457,322 @@ func plugPower(ctx context.Context, promAPI promclient.API) ([]plugData, error)
 }
 
 type server struct {
+	// These are only replaced by evaluate, under mu, when the config is edited;
+	// elsewhere, use current. See editor.go.
 	config  Config
 	dps     []discPlug
+	evs     []evControl
 	promAPI promclient.API
 
 	// State updated with each evaluation.
 	mu          sync.Mutex
 	lastLog     bytes.Buffer
 	lastToggles map[string]time.Time // plug name => time
+	lastOffs    map[string]time.Time // plug name => when it was last seen to turn off
+	wasOn       map[string]bool      // plug name => whether it was on at the previous evaluation
+	shortFor    map[string]int       // load name => evaluations in a row it has been short of spare solar
 	seen        []string             // plug names (discretionary only)
+	status      []plugStatus         // discretionary plugs, ordered by name
+
+	// Health tracking. Also guarded by mu.
+	started          time.Time
+	lastSuccess      time.Time // last evaluation without error
+	promFailingSince time.Time // zero if the last Prometheus query worked
+
+	// Paused plugs. Also guarded by mu.
+	pauses map[string]time.Time // plug name => expiry
+
+	// External overrides from the webhook. Also guarded by mu.
+	forces map[string]time.Time // plug name => expiry
+	shed   shedRequest
+
+	// Whether another instance holds the lease, and who. Also guarded by mu.
+	standby     bool
+	leaseHolder string
+
+	// Plugs that could be adopted, and those adopted since starting. Also guarded by mu.
+	candidates []adoptCandidate
+	adopted    map[tpplug.MAC]bool
+	adoptMu    sync.Mutex // serializes writes to the adopted plugs file
 
-	// Paused plugs.
-	pauseMu sync.Mutex
-	pauses  map[string]time.Time // plug name => expiry
+	// Learned demand forecast, if configured. Also guarded by mu.
+	forecast *forecast
+
+	// An edited config to switch to at the next evaluation. Also guarded by mu.
+	pendingReload *server
+
+	savings  *savings
+	runtimes *runtimes
+	events   *broker
+	notifier *notifier
+	resolver *resolver
+	sessions sessions // see drivers.go
+
+	// Failure tracking for notifications. Only touched by evaluate.
+	queryFailures map[string]int // plug name => consecutive failed queries
+	evalFailures  int            // consecutive failed evaluations
+
+	audit     *auditLog
+	evalSolar Power // solar power at the current evaluation, for the audit log; only touched by evaluate
 }
 
 type discPlug struct {
-	addr *net.UDPAddr
+	addr *net.UDPAddr // nil if it needs resolving, or isn't a TP-Link plug
 	cfg  TPPlugConfig
 }
 
+// describe returns a human-readable form of the plug's configured location.
+func (dp discPlug) describe() string {
+	if dp.addr != nil {
+		return dp.addr.String()
+	}
+	if dp.cfg.IP != "" {
+		return dp.cfg.IP
+	}
+	return dp.resolveKey()
+}
+
+// plugStatus is a snapshot of a discretionary plug as of the last evaluation.
+type plugStatus struct {
+	Name        string
+	Group       string
+	Addr        string
+	Err         error // set if the plug couldn't be queried
+	Degraded    bool  // unreachable for too long
+	On          bool
+	Power       Power  // current (or assumed) power
+	Consumption Power  // configured
+	Blocked     string // why the evaluation left it alone, if it was constrained
+	Inverted    bool   // On is the load's state, the opposite of the relay's
+}
+
 func newServer(config Config, promAPI promclient.API) (*server, error) {
+	if err := checkGroups(config.DiscretionaryPlugs); err != nil {
+		return nil, err
+	}
+	if err := checkPhases(config); err != nil {
+		return nil, err
+	}
+	if err := checkCalendar(config); err != nil {
+		return nil, err
+	}
+	if err := checkPeakDemand(config); err != nil {
+		return nil, err
+	}
+	if err := checkForecast(&config); err != nil {
+		return nil, err
+	}
+	if wc := config.Webhook; wc != nil && wc.Token == "" {
+		return nil, fmt.Errorf("webhook needs a token")
+	}
+	if pc := config.Pushgateway; pc != nil {
+		if err := pc.check(); err != nil {
+			return nil, err
+		}
+	}
+	if pc := config.Price; pc != nil {
+		if err := pc.check(); err != nil {
+			return nil, err
+		}
+	}
+	if mc := config.MQTT; mc != nil {
+		if err := mc.check(); err != nil {
+			return nil, err
+		}
+	}
+	if gc := config.Grid; gc != nil {
+		if err := gc.check(); err != nil {
+			return nil, err
+		}
+	}
+	if lc := config.Lease; lc != nil {
+		if err := lc.check(); err != nil {
+			return nil, err
+		}
+	}
+	if ac := config.Adopt; ac != nil {
+		if err := ac.check(); err != nil {
+			return nil, err
+		}
+	}
+	if ec := config.Editor; ec != nil {
+		if err := ec.check(); err != nil {
+			return nil, err
+		}
+	}
+	devices, err := tpplug.LoadDevices(*devicesFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading devices: %w", err)
+	}
 	var dps []discPlug
 	for _, tp := range config.DiscretionaryPlugs {
-		ip := net.ParseIP(tp.IP)
-		if ip == nil {
-			return nil, fmt.Errorf("bad IP %q", tp.IP)
+		if err := tp.applyProfile(); err != nil {
+			return nil, err
 		}
-		dps = append(dps, discPlug{
-			addr: &net.UDPAddr{
+		if err := tp.checkSurge(); err != nil {
+			return nil, err
+		}
+		if err := checkDriver(tp); err != nil {
+			return nil, err
+		}
+		if err := checkInverted(tp); err != nil {
+			return nil, err
+		}
+		if err := tp.checkPriorities(); err != nil {
+			return nil, err
+		}
+		if err := tp.checkWindows(); err != nil {
+			return nil, err
+		}
+		if tp.MAC != "" {
+			if _, err := tpplug.ParseMAC(tp.MAC); err != nil {
+				return nil, fmt.Errorf("plug %q: %w", tp.Alias, err)
+			}
+		}
+		var addr *net.UDPAddr
+		if tp.IP != "" && (tp.Driver == "" || tp.Driver == "tpplug") {
+			ip := net.ParseIP(tp.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("bad IP %q", tp.IP)
+			}
+			addr = &net.UDPAddr{
 				IP:   ip,
 				Port: 9999, // fixed port
-			},
-			cfg: tp,
+			}
+		}
+		if tp.MinDailyRuntime > 0 {
+			if _, err := parseClock(tp.RuntimeCutoff, time.Now()); err != nil {
+				return nil, fmt.Errorf("plug %q: runtime_cutoff: %w", tp.Alias, err)
+			}
+		}
+		if tp.OffAfter < 0 {
+			return nil, fmt.Errorf("plug %q has negative off_after", tp.Alias)
+		}
+		switch tp.SafeState {
+		case "", "on", "off":
+		default:
+			return nil, fmt.Errorf("plug %q has bad safe_state %q (want on or off)", tp.Alias, tp.SafeState)
+		}
+		dps = append(dps, discPlug{
+			addr: addr,
+			cfg:  tp,
 		})
 	}
 
+	if config.UnreachableAfter <= 0 {
+		config.UnreachableAfter = 3
+	}
+	if config.EvalErrorsAfter <= 0 {
+		config.EvalErrorsAfter = 1
+	}
+	evs, err := newEVControls(config.EVChargers)
+	if err != nil {
+		return nil, err
+	}
+	// The notifier starts a goroutine, so it's made after anything else that can fail.
+	nt, err := newNotifier(config.Notify)
+	if err != nil {
+		return nil, err
+	}
+
 	return &server{
 		config:  config,
 		dps:     dps,
+		evs:     evs,
 		promAPI: promAPI,
 
 		lastToggles: make(map[string]time.Time),
+		lastOffs:    make(map[string]time.Time),
+		wasOn:       make(map[string]bool),
+		shortFor:    make(map[string]int),
+		started:     time.Now(),
 
 		pauses: make(map[string]time.Time),
+		forces: make(map[string]time.Time),
+
+		adopted: make(map[tpplug.MAC]bool),
+
+		savings:  newSavings(),
+		runtimes: newRuntimes(),
+		events:   newBroker(),
+		notifier: nt,
+		resolver: newResolver(devices),
+		audit:    &auditLog{},
+
+		queryFailures: make(map[string]int),
 	}, nil
 }
 
 func (s *server) evaluate(ctx context.Context) (err error) {
 	// Don't spend more than 5m on an evaluation. If something gets stuck,
 	// hopefully it'll be unstuck by the next evaluation.
-	ctx, _ = context.WithTimeout(ctx, 5*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	ctx, end := startSpan(ctx, "solarctrl.evaluate")
+	defer func() { end(err) }()
 
 	var evalLog bytes.Buffer
 	elogf := func(format string, args ...interface{}) {
 		vlogf(format, args...)
-		fmt.Fprintf(&evalLog, format+"\n", args...)
+		msg := fmt.Sprintf(format, args...)
+		fmt.Fprintln(&evalLog, msg)
+		s.events.publish(event{Kind: "log", Text: msg})
 	}
+	s.events.publish(event{Kind: "start"})
 	defer func() {
-		if err != nil {
+		if err != nil && ctx.Err() == context.Canceled {
+			// Shutting down.
+			elogf("Evaluation aborted: %v", err)
+		} else if err != nil {
 			elogf("ERROR: %v", err)
+			s.evalFailures++
+			if n := s.evalFailures; n == s.config.EvalErrorsAfter && n == 1 {
+				s.notifier.notify(notifyEvalError, "", "Evaluation failed: %v", err)
+			} else if n == s.config.EvalErrorsAfter {
+				s.notifier.notify(notifyEvalError, "", "Evaluation failed %d times in a row: %v", n, err)
+			}
+		} else {
+			if s.evalFailures >= s.config.EvalErrorsAfter {
+				s.notifier.notify(notifyEvalError, "", "Evaluation succeeded after %d failures", s.evalFailures)
+			}
+			s.evalFailures = 0
 		}
 		s.mu.Lock()
+		if err == nil {
+			s.lastSuccess = time.Now()
+		}
 		s.lastLog = evalLog
 		s.mu.Unlock()
+		evalTimeGauge.SetToCurrentTime()
+		if err == nil {
+			evalSuccessGauge.Set(1)
+		} else {
+			evalSuccessGauge.Set(0)
+		}
+		s.events.publish(event{Kind: "done"})
+		if err := s.saveState(); err != nil {
+			logger.Error("Saving state", "err", err)
+		}
+		// Use a fresh context, so the result of an aborted evaluation is still pushed.
+		if err := s.pushMetrics(context.Background()); err != nil {
+			logger.Error("Pushing metrics", "err", err)
+		}
 	}()
 	elogf("Starting evaluation at %v", time.Now().Format(time.RFC3339))
+	s.applyReload(elogf)
+	s.checkLease(ctx, time.Now(), elogf)
 
 	// Fetch latest solar production and TPPlug power consumption.
 	solar, err := solarPower(ctx, s.promAPI)
+	s.notePromResult(err)
 	if err != nil {
 		return fmt.Errorf("querying solar power: %w", err)
 	}
 	elogf("Current solar: %v", solar)
+	s.evalSolar = solar
+	solarGauge.Set(float64(solar))
 	plugs, err := plugPower(ctx, s.promAPI)
+	s.notePromResult(err)
 	if err != nil {
 		return fmt.Errorf("querying plug power: %w", err)
 	}
@@ -280,108 +785,560 @@ func (s *server) evaluate(ctx context.Context) (err error) {
 	elogf("Current plug use:\n%s", curUse.String())
 
 	// Query discretionary plugs to check their state.
-	discPlugs := make(map[string]TPPlug) // keyed by alias
-	for _, dp := range s.dps {
+	discPlugs := make(map[string]TPPlug)     // keyed by alias
+	statuses := make(map[string]*plugStatus) // keyed by alias
+	degraded := make(map[string]bool)        // keyed by alias
+	var unmetered Power                      // assumed use of inverted plugs not in Prometheus
+	defer func() {
+		var ss []plugStatus
+		for _, st := range statuses {
+			ss = append(ss, *st)
+		}
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+		s.mu.Lock()
+		s.status = ss
+		s.mu.Unlock()
+		for _, st := range ss {
+			if st.Err == nil {
+				plugOnGauge.WithLabelValues(st.Name).Set(float64(boolState(st.On)))
+			}
+		}
+	}()
+	for i, dp := range s.dps {
 		name := dp.cfg.Alias
-		state, err := tpplug.Query(ctx, dp.addr)
+		st := &plugStatus{
+			Name:        name,
+			Group:       dp.cfg.Group,
+			Addr:        dp.describe(),
+			Consumption: dp.cfg.Consumption,
+			Inverted:    dp.cfg.Inverted,
+		}
+		statuses[name] = st
+		drv, err := s.driverFor(ctx, dp)
+		var state switchState
+		if err == nil {
+			st.Addr = drv.String()
+			state, err = drv.query(ctx)
+			if err != nil {
+				// It may have moved.
+				s.resolver.invalidate(s.dps[i])
+			}
+		}
 		if err != nil {
-			elogf("Querying discretionary plug %q (%v): %v", name, dp.addr, err)
+			st.Err = err
+			s.queryFailures[name]++
+			n := s.queryFailures[name]
+			switch {
+			case n < s.config.UnreachableAfter:
+				elogf("Querying discretionary plug %q (%v): %v", name, st.Addr, err)
+			case n == s.config.UnreachableAfter:
+				elogf("Discretionary plug %q (%v) now degraded after %d failed queries: %v", name, st.Addr, n, err)
+				logger.Warn("Discretionary plug degraded", "plug", name, "addr", st.Addr, "err", err)
+				s.notifier.notify(notifyUnreachable, name, "Plug %q (%v) unreachable for %d evaluations: %v", name, st.Addr, n, err)
+				degradedGauge.WithLabelValues(name).Set(1)
+			}
+			if n >= s.config.UnreachableAfter {
+				st.Degraded = true
+				degraded[name] = true
+			}
 			continue
 		}
+		if s.queryFailures[name] >= s.config.UnreachableAfter {
+			elogf("Discretionary plug %q (%v) reachable again", name, st.Addr)
+			logger.Info("Discretionary plug recovered", "plug", name, "addr", st.Addr)
+			s.notifier.notify(notifyUnreachable, name, "Plug %q (%v) is reachable again", name, st.Addr)
+		}
+		s.queryFailures[name] = 0
+		degradedGauge.WithLabelValues(name).Set(0)
 		tp := TPPlug{
 			dp:    dp,
+			drv:   drv,
 			state: state,
 		}
-		if pd, ok := plugIndex[name]; ok {
+		pd, ok := plugIndex[name]
+		peak := state.Power
+		if ok && pd.Power > peak {
+			peak = pd.Power
+		}
+		s.mu.Lock()
+		toggled := s.lastToggles[dp.cfg.loadName()]
+		s.mu.Unlock()
+		if dp.cfg.Inverted {
+			// Whatever Prometheus has for it is the relay, not the load.
+			if tp.On() {
+				tp.AssumedPower = dp.cfg.Consumption
+			}
+			if ok {
+				pd.Power = tp.Power()
+			} else {
+				unmetered += tp.Power()
+			}
+		} else if tp.cutOut() {
+			// It's drawing nothing now, so the recent history isn't relevant.
+			elogf("Plug %q is on but only drawing %v; assuming its thermostat has cut out", name, state.Power)
+			tp.Satisfied = true
+		} else if ok && state.On && dp.cfg.withinSurge(peak, toggled, time.Now()) {
+			elogf("Plug %q drew up to %v after turning on, within its surge allowance; counting it as %v", name, peak, dp.cfg.Consumption)
+			pd.Power = dp.cfg.Consumption
+			if state.Power > dp.cfg.Consumption {
+				tp.AssumedPower = dp.cfg.Consumption
+			}
+		} else if ok {
 			// Use the maximum of its current reported power and the Prometheus-measured power
 			// to be conservative for spiky appliances.
-			if state.System.Info.RelayState == 1 && pd.Power > tp.Power() {
+			if state.On && pd.Power > tp.Power() {
 				elogf("Plug %q nudged up from %v to %v based on recent usage", name, tp.Power(), pd.Power)
 				tp.AssumedPower = pd.Power
 			}
 		} else {
 			// Not fatal, but suspicious.
-			elogf("WARNING: discretionary plug at %v has configured alias %q that wasn't reported via Prometheus", dp.addr, name)
+			elogf("WARNING: discretionary plug at %v has configured alias %q that wasn't reported via Prometheus", st.Addr, name)
 		}
 		discPlugs[name] = tp
+		st.On = tp.On()
+		st.Power = tp.Power()
 		elogf("Discretionary plug %q -> %v", name, tp.Power())
 	}
 
 	// Enumerate the plugs. Compute how much spare solar there is.
-	spareSolar := solar - s.config.BaselineConsumption
+	// Degraded plugs are left out; whatever Prometheus has for them is stale,
+	// and we can't control them anyway.
+	spareSolar := solar - s.config.BaselineConsumption - unmetered
 	for _, p := range plugs {
+		if degraded[p.Name] {
+			continue
+		}
 		spareSolar -= p.Power
 	}
 	elogf("Found %d plugs, %d discretionary", len(plugs), len(discPlugs))
 	elogf("Spare solar: %v", spareSolar)
+	cal := s.config.calendarProfile(time.Now())
+	if cal != nil {
+		elogf("Calendar profile: %s", cal.Name)
+	}
+	margin := cal.margin(s.config.Margin).of(solar)
+	if margin != 0 {
+		elogf("Turn-on margin: %v", margin)
+	}
+	if self := s.accountSavings(time.Now(), solar, plugs, discPlugs); self > 0 {
+		elogf("Discretionary loads self-consuming %v of solar", self)
+	}
 
-	// See if there are any discretionary plugs to toggle.
-	// TODO: sort them first so this is deterministic.
-	var seen []string // names
+	bud := &budget{total: spareSolar}
+	if s.config.phaseBalanced() {
+		bud.phases, err = s.phaseSpare(ctx, plugs, degraded)
+		if err != nil {
+			return err
+		}
+		elogf("Spare solar per phase: %v", bud)
+	}
+
+	if shed := s.shedding(time.Now()); shed > 0 {
+		bud.spread(-shed)
+		elogf("Shedding %v on request; spare solar now %v", shed, bud)
+	}
+	gs := s.queryGrid(ctx, elogf)
+	if gs.imported != nil {
+		elogf("Grid import: %v", *gs.imported)
+	}
+	if over := gs.overImport(s.config.Grid); over > 0 && bud.total > -over {
+		bud.spread(-over - bud.total)
+		elogf("Importing %v more than the maximum; spare solar now %v", over, bud)
+	}
+	if gs.soc != nil {
+		elogf("Battery state of charge: %.1f%%", *gs.soc)
+	}
+	charging := gs.charging(s.config.Grid)
+
+	// EV chargers can be modulated, so they get first go at the spare solar.
+	if len(s.evs) > 0 {
+		bud.spread(s.modulateEVs(ctx, bud.total, margin, elogf) - bud.total)
+		elogf("Spare solar after EV charging: %v", bud)
+	}
+
+	// Gather plugs into loads. A group can only be controlled if all its plugs are reachable.
+	// Plugs are taken in configuration order, so the first of a group, whose settings govern it, is fixed.
+	loads := make(map[string]*load) // keyed by name
+	for _, dp := range s.dps {
+		tp, ok := discPlugs[dp.cfg.Alias]
+		if !ok {
+			continue
+		}
+		name := dp.cfg.loadName()
+		l, ok := loads[name]
+		if !ok {
+			l = &load{Name: name}
+			loads[name] = l
+		}
+		l.Plugs = append(l.Plugs, tp)
+	}
+	for _, dp := range s.dps {
+		name := dp.cfg.loadName()
+		if _, ok := discPlugs[dp.cfg.Alias]; !ok && loads[name] != nil {
+			elogf("Group %q has unreachable plug %q; leaving it alone", name, dp.cfg.Alias)
+			for _, tp := range loads[name].Plugs {
+				statuses[tp.dp.cfg.Alias].Blocked = fmt.Sprintf("group member %q unreachable", dp.cfg.Alias)
+			}
+			delete(loads, name)
+		}
+	}
+
+	prio := make(map[string]int) // load name => priority
+	var order []string
+	for name, l := range loads {
+		prio[name] = s.priority(ctx, cal.apply(name, l.cfg()), elogf)
+		order = append(order, name)
+	}
+	orderLoads(order, prio)
+	if len(order) > 1 {
+		elogf("Load order: %q", order)
+	}
+
+	// During a peak window, shed loads to get under the demand cap,
+	// and only turn on loads that fit under it.
 	now := time.Now()
-	for _, tp := range discPlugs {
-		name := tp.dp.cfg.Alias
+	pk, err := s.peakHeadroom(ctx, now)
+	if err != nil {
+		return err
+	}
+	if pk.active {
+		elogf("Peak demand window; headroom under cap: %v", pk.headroom)
+		s.shedForPeak(ctx, now, &pk, cal, loads, order, bud, statuses, elogf)
+	}
+
+	// With a dynamic tariff, run loads while importing is cheap,
+	// and hold spare solar for export while that pays well.
+	pc := s.config.Price
+	pr, err := s.currentPrices(ctx, now)
+	if err != nil {
+		// Carry on as if prices were fixed.
+		elogf("WARNING: getting prices: %v", err)
+		pr = nil
+	}
+	cheap, exportPays := pr.cheap(pc), pr.exportPays(pc)
+	if pr != nil {
+		elogf("Electricity prices: %v", pr)
+		priceGauge.WithLabelValues("import").Set(pr.Import)
+		if pr.Export != nil {
+			priceGauge.WithLabelValues("export").Set(*pr.Export)
+		}
+	}
+	if cheap {
+		elogf("Importing costs under %v/kWh; running loads regardless of solar", pc.CheapBelow)
+	}
+	fcast := s.updateForecast(ctx, now, elogf)
+
+	// lowerOn returns the power of the loads after the i'th in order, on the given phase,
+	// that could be turned off instead, since lower priority loads should go first.
+	// It doesn't know what will stop them being turned off (like a cooldown),
+	// so a higher priority load may be left on for an evaluation or two.
+	lowerOn := func(i int, phase string) Power {
+		var p Power
+		for _, name := range order[i+1:] {
+			l := loads[name]
+			cfg := cal.apply(name, l.cfg())
+			if l.On() && cfg.TurnOff && (!s.config.phaseBalanced() || cfg.Phase == phase) {
+				p += l.Power()
+			}
+		}
+		return p
+	}
+
+	// Track the total discretionary load, for MaxTotalDiscretionary.
+	var discOn Power
+	for _, l := range loads {
+		if l.On() {
+			discOn += l.Power()
+		}
+	}
+	overCap := func(power Power) bool {
+		max := s.config.MaxTotalDiscretionary
+		return max > 0 && discOn+power > max
+	}
+
+	// See if there are any discretionary loads to toggle, highest priority first.
+	var seen []string // names
+	for i, name := range order {
+		l := loads[name]
 		seen = append(seen, name)
+		block := func(reason string) {
+			for _, tp := range l.Plugs {
+				statuses[tp.dp.cfg.Alias].Blocked = reason
+			}
+		}
+		cfg := cal.apply(name, l.cfg())
+		ran := s.runtimes.update(now, name, l.On())
 
-		// If this plug was toggled too recently, don't consider it.
+		// If this load was toggled too recently, don't consider it.
 		// If it has been paused, also don't consider it.
 		s.mu.Lock()
+		if s.wasOn[name] && !l.On() {
+			s.lastOffs[name] = now
+		}
+		s.wasOn[name] = l.On()
 		last, ok := s.lastToggles[name]
+		lastOff, offOK := s.lastOffs[name]
 		pause, pauseOK := s.pauses[name]
 		if pause.Before(now) {
 			delete(s.pauses, name)
 			pauseOK = false
 		}
+		force, forceOK := s.forces[name]
+		if force.Before(now) {
+			delete(s.forces, name)
+			forceOK = false
+		}
 		s.mu.Unlock()
+		if !l.On() && offOK && cfg.MinOffTime > 0 && now.Sub(lastOff) < cfg.MinOffTime {
+			// Protecting the equipment trumps everything else.
+			left := (cfg.MinOffTime - now.Sub(lastOff)).Truncate(time.Second)
+			elogf("Plug %q has been off for less than its minimum off time of %v; leaving it off", name, cfg.MinOffTime)
+			block(fmt.Sprintf("minimum off time (%v left)", left))
+			continue
+		}
+		if forceOK {
+			// An external override trumps everything else.
+			if l.On() {
+				elogf("Plug %q is forced on until %v", name, force.Format("15:04"))
+				block(fmt.Sprintf("forced on until %v", force.Format("15:04")))
+				continue
+			}
+			power := l.Power()
+			if l.Consumption() > power {
+				power = l.Consumption()
+			}
+			if overCap(power) {
+				elogf("Plug %q is forced on, but would take discretionary load over %v; leaving it off", name, s.config.MaxTotalDiscretionary)
+				block(fmt.Sprintf("total discretionary cap (%v on)", discOn))
+				continue
+			}
+			dry := s.dry(cfg)
+			verb := "Turning"
+			if dry {
+				verb = "[dry run] Would turn"
+			}
+			elogf("%s on %q at %v, forced on until %v", verb, name, l.Addrs(), force.Format("15:04"))
+			logger.Info(verb+" on plug by override", "plug", name, "addr", l.Addrs(), "until", force, "dry_run", dry)
+			why := reason{"force_on", "forced on until " + force.Format("15:04"), bud.spare(cfg.Phase)}
+			bud.add(cfg.Phase, -power)
+			pk.headroom -= power
+			if s.switchLoad(ctx, l, 1, why, dry, statuses, elogf) {
+				discOn += power
+			}
+			continue
+		}
 		if ok && time.Since(last) < *minToggle {
 			elogf("Plug %q toggled too recently; leaving it alone", name)
+			block(fmt.Sprintf("cooldown (toggled %v ago)", time.Since(last).Truncate(time.Second)))
 			continue
 		}
 		if pauseOK {
 			elogf("Plug %q has control paused until %v", name, pause)
+			block(fmt.Sprintf("paused until %v", pause.Format("15:04")))
+			continue
+		}
+		if !cfg.inWindows(now) {
+			elogf("Plug %q is outside its allowed windows; leaving it alone", name)
+			block("outside allowed windows")
+			continue
+		}
+		if l.On() && ok && cfg.MinRun > 0 && time.Since(last) < cfg.MinRun {
+			elogf("Plug %q has been on for less than its minimum run of %v; leaving it on", name, cfg.MinRun)
+			block(fmt.Sprintf("minimum run (%v left)", (cfg.MinRun - time.Since(last)).Truncate(time.Minute)))
+			continue
+		}
+		if l.satisfied() {
+			// Turning it off would save nothing, and it needs to stay on to reheat.
+			elogf("Plug %q has its thermostat satisfied; leaving it on", name)
+			block("thermostat satisfied")
 			continue
 		}
 
-		// If the plug is on but can't be turned off (or vice versa),
+		// If the load is on but can't be turned off (or vice versa),
 		// pretend it isn't discretionary.
-		if tp.On() && !tp.dp.cfg.TurnOff {
+		if l.On() && !cfg.TurnOff {
+			block("not permitted to turn off")
 			continue
 		}
-		if !tp.On() && !tp.dp.cfg.TurnOn {
+		if !l.On() && !cfg.TurnOn {
+			block("not permitted to turn on")
 			continue
 		}
 
-		power := tp.Power()
-		if !tp.On() && tp.dp.cfg.Consumption > power {
-			power = tp.dp.cfg.Consumption
+		power := l.Power()
+		if !l.On() && l.Consumption() > power {
+			power = l.Consumption()
+		}
+		if !l.On() && pk.active && power > pk.headroom {
+			elogf("Plug %q would take demand over the peak cap; leaving it off", name)
+			block(fmt.Sprintf("peak demand cap (%v headroom)", pk.headroom))
+			continue
+		}
+		if !l.On() && overCap(power) {
+			elogf("Plug %q would take discretionary load over %v; leaving it off", name, s.config.MaxTotalDiscretionary)
+			block(fmt.Sprintf("total discretionary cap (%v on)", discOn))
+			continue
+		}
+		dry := s.dry(cfg)
+		verb := "Turning"
+		if dry {
+			verb = "[dry run] Would turn"
 		}
-		if spareSolar < 0 && tp.On() {
-			elogf("Turning off %q at %v to save %v", name, tp.Addr(), power)
-			log.Printf("Turning off %q at %v", name, tp.Addr())
-			spareSolar += power
-		} else if spareSolar > power && !tp.On() {
-			elogf("Turning on %q at %v, estimated to use %v", name, tp.Addr(), power)
-			log.Printf("Turning on %q at %v", name, tp.Addr())
-			spareSolar -= power
+		short, mustRun := cfg.runtimeShortfall(now, ran)
+		occupied := s.occupied(ctx, cfg, elogf)
+		var newState int
+		why := reason{spare: bud.spare(cfg.Phase)}
+		deficit := l.On() && bud.spare(cfg.Phase)+lowerOn(i, cfg.Phase) < -cfg.OffMargin.of(solar)
+		shortFor := s.noteShort(name, deficit)
+		onMargin := margin
+		if cfg.OnMargin != nil {
+			onMargin = cfg.OnMargin.of(solar)
+		}
+		if mustRun && l.On() {
+			elogf("Plug %q needs to run %v more today; leaving it on", name, short.Truncate(time.Minute))
+			block(fmt.Sprintf("meeting minimum daily runtime (%v left)", short.Truncate(time.Minute)))
+			continue
+		} else if mustRun {
+			elogf("%s on %q at %v to meet minimum daily runtime (ran %v of %v)", verb, name, l.Addrs(), ran.Truncate(time.Minute), cfg.MinDailyRuntime)
+			logger.Info(verb+" on plug for minimum daily runtime", "plug", name, "addr", l.Addrs(), "ran", ran, "dry_run", dry)
+			bud.add(cfg.Phase, -power)
+			pk.headroom -= power
+			newState, why.code, why.text = 1, "min_runtime", "minimum daily runtime"
+		} else if !occupied && l.On() {
+			elogf("%s off %q at %v since nobody is home", verb, name, l.Addrs())
+			logger.Info(verb+" off plug while unoccupied", "plug", name, "addr", l.Addrs(), "power", power, "dry_run", dry)
+			bud.add(cfg.Phase, power)
+			pk.headroom += power
+			newState, why.code, why.text = 0, "unoccupied", "nobody home"
+		} else if !occupied {
+			block("nobody home")
+			continue
+		} else if cheap && !l.On() {
+			elogf("%s on %q at %v while importing is cheap (%v)", verb, name, l.Addrs(), pr)
+			logger.Info(verb+" on plug for cheap import", "plug", name, "addr", l.Addrs(), "price", pr.Import, "dry_run", dry)
+			bud.add(cfg.Phase, -power)
+			pk.headroom -= power
+			newState, why.code, why.text = 1, "cheap_import", "cheap import"
+		} else if cheap {
+			block("importing is cheap")
+			continue
+		} else if deficit && shortFor < cfg.OffAfter {
+			elogf("Plug %q has been short of spare solar for %d of %d evaluations; leaving it on", name, shortFor, cfg.OffAfter)
+			block(fmt.Sprintf("short of spare solar (%d of %d evaluations)", shortFor, cfg.OffAfter))
+			continue
+		} else if deficit {
+			elogf("%s off %q at %v to save %v", verb, name, l.Addrs(), power)
+			logger.Info(verb+" off plug", "plug", name, "addr", l.Addrs(), "power", power, "spare", bud.spare(cfg.Phase), "dry_run", dry)
+			bud.add(cfg.Phase, power)
+			pk.headroom += power
+			newState, why.code, why.text = 0, "not_enough_solar", "not enough spare solar"
+		} else if bud.spare(cfg.Phase)-onMargin > power && !l.On() {
+			if charging {
+				elogf("Plug %q could run on spare solar, but the battery is charging (%.1f%%); leaving it off", name, *gs.soc)
+				block(fmt.Sprintf("battery charging (%.0f%% of %.0f%%)", *gs.soc, s.config.Grid.MinBatterySOC))
+				continue
+			}
+			if exportPays {
+				elogf("Plug %q could run on spare solar, but exporting pays %.4g/kWh; leaving it off", name, *pr.Export)
+				block(fmt.Sprintf("exporting pays %.4g/kWh", *pr.Export))
+				continue
+			}
+			if cfg.RunFor > 0 && fcast != nil {
+				if pt, ok := fcast.spikeWithin(now, cfg.RunFor, s.config.Forecast.SpikeAbove); ok {
+					elogf("Plug %q could run on spare solar, but would still be running at %v, when demand typically reaches %v; leaving it off", name, pt.At.Format("15:04"), pt.Demand)
+					block(fmt.Sprintf("forecast demand spike at %v (%v)", pt.At.Format("15:04"), pt.Demand))
+					continue
+				}
+			}
+			elogf("%s on %q at %v, estimated to use %v", verb, name, l.Addrs(), power)
+			logger.Info(verb+" on plug", "plug", name, "addr", l.Addrs(), "power", power, "spare", bud.spare(cfg.Phase), "dry_run", dry)
+			bud.add(cfg.Phase, -power)
+			pk.headroom -= power
+			newState, why.code, why.text = 1, "spare_solar", "spare solar"
 		} else {
 			continue
 		}
 
-		newState := 1 - tp.state.System.Info.RelayState
-		err := tpplug.SetRelayState(ctx, tp.Addr(), newState)
+		if s.switchLoad(ctx, l, newState, why, dry, statuses, elogf) {
+			if newState == 1 {
+				discOn += power
+			} else {
+				discOn -= power
+			}
+		}
+	}
+	s.mu.Lock()
+	s.seen = seen
+	s.mu.Unlock()
+	return nil
+}
+
+// switchLoad sets the relay state of a load, or pretends to if dry is set,
+// and records the outcome, including in the audit log.
+// It reports whether the load was switched.
+func (s *server) switchLoad(ctx context.Context, l *load, newState int, why reason, dry bool, statuses map[string]*plugStatus, elogf func(string, ...interface{})) bool {
+	name := l.Name
+	audit := func(err error) {
+		e := auditEntry{
+			Time:   time.Now(),
+			Plug:   name,
+			Action: onOff(newState),
+			Reason: why.code,
+			Detail: why.text,
+			Solar:  s.evalSolar,
+			Spare:  why.spare,
+			DryRun: dry,
+		}
 		if err != nil {
-			elogf("Failed to toggle %q: %v", name, err)
-			log.Printf("Failed to toggle %q: %v", name, err)
-			continue
+			e.Error = err.Error()
 		}
+		s.audit.record(e)
+	}
+	if dry {
+		audit(nil)
+		// Carry on as if it happened so later decisions match what would really occur,
+		// but don't start a cooldown.
+		for _, tp := range l.Plugs {
+			statuses[tp.dp.cfg.Alias].Blocked = fmt.Sprintf("dry run (would turn %s)", onOff(newState))
+		}
+		s.events.publish(event{Kind: "toggle", Plug: name, Text: "would turn " + onOff(newState) + " (dry run)"})
+		return true
+	}
+	err := l.setRelayState(ctx, newState)
+	if errors.Is(err, tpplug.ErrStateChanged) {
+		// Someone else got there first. Give them a cooldown's grace.
+		elogf("Plug %q was switched by something else; leaving it alone: %v", name, err)
+		logger.Info("Plug switched externally", "plug", name, "addr", l.Addrs(), "err", err)
+		s.events.publish(event{Kind: "toggle", Plug: name, Text: "switched externally"})
+		audit(err)
 		s.mu.Lock()
 		s.lastToggles[name] = time.Now()
 		s.mu.Unlock()
+		return false
+	}
+	if err != nil {
+		elogf("Failed to toggle %q: %v", name, err)
+		logger.Error("Failed to toggle plug", "plug", name, "addr", l.Addrs(), "err", err)
+		s.events.publish(event{Kind: "toggle", Plug: name, Text: "failed: " + err.Error()})
+		audit(err)
+		s.notifier.notify(notifyToggleFailure, name, "Failed to turn %s %q: %v", onOff(newState), name, err)
+		return false
 	}
+	s.events.publish(event{Kind: "toggle", Plug: name, Text: onOff(newState)})
+	audit(nil)
+	togglesCounter.WithLabelValues(name, onOff(newState)).Inc()
+	s.notifier.notify(notifyToggle, name, "Turned %s %q: %s", onOff(newState), name, why.text)
 	s.mu.Lock()
-	s.seen = seen
+	s.lastToggles[name] = time.Now()
+	if newState == 0 {
+		s.lastOffs[name] = time.Now()
+	}
+	s.wasOn[name] = newState == 1
 	s.mu.Unlock()
-	return nil
+	for _, tp := range l.Plugs {
+		statuses[tp.dp.cfg.Alias].On = newState == 1
+	}
+	return true
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -393,6 +1350,24 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.serveFront(w, r)
 	case "/pause":
 		s.servePause(w, r)
+	case "/on", "/off":
+		s.serveManual(w, r)
+	case "/adopt":
+		s.serveAdopt(w, r)
+	case "/webhook":
+		s.serveWebhook(w, r)
+	case "/report":
+		s.serveReport(w, r)
+	case "/events":
+		s.serveEvents(w, r)
+	case "/healthz":
+		s.serveHealthz(w, r)
+	case "/state":
+		s.serveState(w, r)
+	case "/config":
+		s.serveConfig(w, r)
+	case "/audit":
+		s.serveAudit(w, r)
 	}
 }
 
@@ -402,12 +1377,26 @@ func (s *server) serveFront(w http.ResponseWriter, r *http.Request) {
 		LastToggles map[string]time.Time
 		Seen        []string             // names
 		Pauses      map[string]time.Time // name => pause expiry
+		Status      []plugStatus
+		Calendar    string // active calendar profile
+		Standby     string // lease holder, if not this instance
+		Candidates  []adoptCandidate
+		Forecast    []forecastPoint // the next few hours, if configured
+		Editor      bool            // whether /config is enabled
+		Audit       []auditEntry    // recent relay actions, newest first
+		AuditLog    bool            // whether /audit is enabled
 	}{
 		LastLog:     "never evaluated",
 		LastToggles: make(map[string]time.Time),
 		Pauses:      make(map[string]time.Time),
 	}
 	now := time.Now()
+	cfg, _ := s.current()
+	if cal := cfg.calendarProfile(now); cal != nil {
+		data.Calendar = cal.Name
+	}
+	data.Editor = cfg.Editor != nil
+	data.Audit, data.AuditLog = s.audit.latest(), *auditLogFile != ""
 	s.mu.Lock()
 	if s.lastLog.Len() > 0 {
 		data.LastLog = s.lastLog.String()
@@ -416,6 +1405,17 @@ func (s *server) serveFront(w http.ResponseWriter, r *http.Request) {
 		data.LastToggles[name] = t
 	}
 	data.Seen = s.seen
+	data.Status = s.status
+	data.Candidates = s.candidates
+	if fc := s.config.Forecast; fc != nil {
+		data.Forecast = s.forecast.ahead(now, forecastShown, fc.SpikeAbove)
+	}
+	if s.standby {
+		data.Standby = s.leaseHolder
+		if data.Standby == "" {
+			data.Standby = "unknown"
+		}
+	}
 	for _, name := range s.seen {
 		if t, ok := s.pauses[name]; ok && t.After(now) {
 			data.Pauses[name] = t
@@ -425,67 +1425,13 @@ func (s *server) serveFront(w http.ResponseWriter, r *http.Request) {
 
 	var buf bytes.Buffer
 	if err := serveTmpl.Execute(&buf, data); err != nil {
-		log.Printf("Internal error rendering template: %v", err)
+		logger.Error("Internal error rendering template", "err", err)
 		http.Error(w, "rendering template: "+err.Error(), 500)
 		return
 	}
 	io.Copy(w, &buf)
 }
 
-var serveTmpl = template.Must(template.New("").Funcs(template.FuncMap{
-	"roughSince": func(t time.Time) string {
-		d := time.Since(t).Truncate(1 * time.Second)
-		return d.String()
-	},
-	"roughUntil": func(t time.Time) string {
-		d := time.Until(t).Truncate(1 * time.Second)
-		return d.String()
-	},
-}).Parse(`
-<!doctype html><html lang="en">
-<head><title>solarctrl</title></head>
-<body>
-
-<h1>solarctrl</h1>
-
-Last evaluation:
-<pre>
-{{.LastLog}}
-</pre>
-
-Last toggles:
-<dl>
-{{range $name, $t := .LastToggles}}
-<dt>{{$name}}</dt>
-<dd>{{roughSince $t}} ago</dd>
-{{end}}
-</dl>
-
-{{with .Pauses}}
-Paused control for these plugs:
-<ul>
-{{range $name, $t := .}}
-<li>{{$name}} ({{roughUntil $t}} left)</li>
-{{end}}
-</ul>
-{{end}}
-
-<form action="/pause" method="POST">
-	<label for="plug-select">Pause control of plug:</label>
-	<select name="plug" id="plug-select">
-		{{range .Seen}}
-		<option value="{{.}}">{{.}}</option>
-		{{end}}
-	</select>
-	<label for="duration">for:</label>
-	<input type="text" value="2h" name="dur" id="duration">
-	<input type="submit" value="Pause">
-</form>
-
-</body>
-</html>
-`))
-
 func (s *server) servePause(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
@@ -501,9 +1447,13 @@ func (s *server) servePause(w http.ResponseWriter, r *http.Request) {
 
 	// In theory we should do an XSRF check here, but the threat model isn't worth the effort.
 
-	s.pauseMu.Lock()
+	s.mu.Lock()
 	s.pauses[name] = until
-	s.pauseMu.Unlock()
-	log.Printf("Paused %q until %v", name, until)
+	delete(s.forces, name)
+	s.mu.Unlock()
+	logger.Info("Paused plug", "plug", name, "until", until)
+	if err := s.saveState(); err != nil {
+		logger.Error("Saving state", "err", err)
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// /on and /off switch a load (a plug alias, or group name) right away, as the
+// front page's buttons do. With a dur form value, control of the load is also
+// paused for that long, replacing any override, so that the next evaluation
+// doesn't undo it. Otherwise only the -min_toggle cooldown holds it.
+
+// manualTimeout bounds how long switching a load by hand may take.
+const manualTimeout = 30 * time.Second
+
+func (s *server) serveManual(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	newState := 0
+	if r.URL.Path == "/on" {
+		newState = 1
+	}
+	name := r.PostFormValue("plug")
+	var d time.Duration
+	if v := r.PostFormValue("dur"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("bad duration %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// As with /pause, there's no XSRF check.
+
+	s.mu.Lock()
+	ok := s.isLoad(name)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown plug %q", name), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), manualTimeout)
+	defer cancel()
+	if err := s.switchByHand(ctx, name, newState, d, "the web UI"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logger.Info("Switched plug by hand", "plug", name, "state", onOff(newState), "pause", d, "remote", r.RemoteAddr)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// switchByHand switches a load, and if d is positive, pauses control of it for that long.
+// from says where the request came from, for the audit log.
+func (s *server) switchByHand(ctx context.Context, name string, newState int, d time.Duration, from string) error {
+	_, dps := s.current()
+	l := &load{Name: name}
+	statuses := make(map[string]*plugStatus)
+	for _, dp := range dps {
+		if dp.cfg.loadName() != name {
+			continue
+		}
+		drv, err := s.driverFor(ctx, dp)
+		var state switchState
+		if err == nil {
+			state, err = drv.query(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("querying plug %q: %w", dp.cfg.Alias, err)
+		}
+		l.Plugs = append(l.Plugs, TPPlug{dp: dp, drv: drv, state: state})
+		statuses[dp.cfg.Alias] = &plugStatus{Name: dp.cfg.Alias}
+	}
+	if len(l.Plugs) == 0 {
+		return fmt.Errorf("unknown plug %q", name)
+	}
+	var failure string
+	elogf := func(format string, args ...interface{}) { failure = fmt.Sprintf(format, args...) }
+	why := reason{code: "manual", text: "switched " + onOff(newState) + " from " + from}
+	if !s.switchLoad(ctx, l, newState, why, s.dry(l.cfg()), statuses, elogf) {
+		return fmt.Errorf("%s", failure)
+	}
+
+	if d > 0 {
+		until := time.Now().Add(d)
+		s.mu.Lock()
+		s.pauses[name] = until
+		delete(s.forces, name)
+		s.mu.Unlock()
+		if err := s.saveState(); err != nil {
+			logger.Error("Saving state", "err", err)
+		}
+	}
+	return nil
+}
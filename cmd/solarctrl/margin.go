@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Margin is an amount of power, either absolute or relative to solar production.
+// In YAML it is written as a number of Watts (e.g. 200) or a percentage (e.g. "10%").
+type Margin struct {
+	Watts   Power
+	Percent float64
+}
+
+func (m *Margin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		pc, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pc < 0 {
+			return fmt.Errorf("bad margin %q", s)
+		}
+		*m = Margin{Percent: pc}
+		return nil
+	}
+	w, err := strconv.Atoi(strings.TrimSuffix(s, "W"))
+	if err != nil || w < 0 {
+		return fmt.Errorf("bad margin %q (want Watts or a percentage)", s)
+	}
+	*m = Margin{Watts: Power(w)}
+	return nil
+}
+
+// of returns the margin given the current solar production.
+func (m Margin) of(solar Power) Power {
+	if m.Percent > 0 {
+		return Power(float64(solar) * m.Percent / 100)
+	}
+	return m.Watts
+}
+
+// noteShort records whether a load is short of spare solar in this evaluation,
+// and returns for how many evaluations in a row it has been, including this one.
+func (s *server) noteShort(name string, short bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !short {
+		delete(s.shortFor, name)
+		return 0
+	}
+	s.shortFor[name]++
+	return s.shortFor[name]
+}
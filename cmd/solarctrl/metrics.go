@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	selfConsumedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "solarctrl_self_consumed_wh_total",
+		Help: "Energy (Wh) routed into discretionary loads from surplus solar",
+	})
+	savingsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "solarctrl_savings_dollars_total",
+		Help: "Estimated money saved by self-consuming surplus solar",
+	})
+	degradedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "solarctrl_plug_degraded",
+		Help: "Whether a discretionary plug has been unreachable for too many evaluations",
+	}, []string{"plug"})
+
+	evalTimeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_last_evaluation_timestamp_seconds",
+		Help: "When the last evaluation finished",
+	})
+	evalSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_last_evaluation_success",
+		Help: "Whether the last evaluation succeeded",
+	})
+	solarGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_solar_watts",
+		Help: "Solar production (W) used by the last evaluation",
+	})
+	plugOnGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "solarctrl_plug_on",
+		Help: "Whether a discretionary plug was on after the last evaluation",
+	}, []string{"plug"})
+	togglesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "solarctrl_toggles_total",
+		Help: "Count of discretionary plugs switched by solarctrl",
+	}, []string{"plug", "state"})
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_lease_held",
+		Help: "Whether this instance held the lease (and so controlled plugs) in the last evaluation",
+	})
+	priceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "solarctrl_price_per_kwh",
+		Help: "Electricity price per kWh from the dynamic tariff, used by the last evaluation",
+	}, []string{"direction"}) // "import" or "export"
+	gridGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_grid_import_watts",
+		Help: "Power (W) imported from the grid, negative if exporting, used by the last evaluation",
+	})
+	batteryGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "solarctrl_battery_soc_percent",
+		Help: "Battery state of charge used by the last evaluation",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(selfConsumedCounter, savingsCounter, degradedGauge)
+	prometheus.MustRegister(evalTimeGauge, evalSuccessGauge, solarGauge, plugOnGauge, togglesCounter, priceGauge, leaderGauge)
+	prometheus.MustRegister(gridGauge, batteryGauge)
+}
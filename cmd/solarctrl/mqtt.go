@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig publishes the state of discretionary loads to an MQTT broker,
+// and takes commands to switch them, so that Home Assistant (or anything else)
+// can show and override them without polling the plugs itself:
+//
+//	mqtt:
+//	  broker: tcp://localhost:1883
+//	  username: solarctrl
+//	  password_file: /etc/solarctrl/mqtt-password
+//	  discovery_prefix: homeassistant
+//
+// After each evaluation, each load (a plug alias, or group name) is published (retained) to
+//
+//	<prefix>/<load>/state    JSON object with whether it is on, its power, and what held it back
+//	<prefix>/<load>/relay    "on" or "off"
+//	<prefix>/<load>/power    power in W, as assumed by the evaluation
+//
+// and solarctrl subscribes to
+//
+//	<prefix>/<load>/set      "on" or "off"
+//
+// where <load> is the load's name in lower case, with anything but letters and
+// digits replaced by underscores. A command switches the load as /on or /off do,
+// pausing control of it for OverrideFor. Switches and overrides are published
+// (not retained) to <prefix>/events as they happen, as JSON objects like those
+// of /events. solarctrl's availability is published to <prefix>/status as
+// "online" or "offline".
+//
+// With DiscoveryPrefix set, each load is also announced for Home Assistant's
+// MQTT discovery, as a switch and sensors for its power and constraint.
+//
+// Changing mqtt needs a restart.
+type MQTTConfig struct {
+	Broker       string // URL
+	ClientID     string `yaml:"client_id"` // default "solarctrl"
+	Username     string
+	Password     string
+	PasswordFile string `yaml:"password_file"`
+	Prefix       string // default "solarctrl"
+
+	DiscoveryPrefix string        `yaml:"discovery_prefix"`
+	OverrideFor     time.Duration `yaml:"override_for"` // default 1h
+}
+
+func (mc *MQTTConfig) check() error {
+	if mc.Broker == "" {
+		return fmt.Errorf("mqtt needs broker")
+	}
+	if mc.Password != "" && mc.PasswordFile != "" {
+		return fmt.Errorf("mqtt needs at most one of password and password_file")
+	}
+	if mc.OverrideFor < 0 {
+		return fmt.Errorf("mqtt override_for is negative")
+	}
+	return nil
+}
+
+func (mc *MQTTConfig) prefix() string {
+	if mc.Prefix == "" {
+		return "solarctrl"
+	}
+	return mc.Prefix
+}
+
+// mqttPublisher publishes to MQTT as MQTTConfig describes.
+type mqttPublisher struct {
+	s      *server
+	mc     *MQTTConfig
+	client mqtt.Client
+
+	mu        sync.Mutex
+	announced string // loads last announced for discovery, or "" to announce again
+}
+
+// mqttTopicName returns the form of a load name used in topics.
+func mqttTopicName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, name)
+}
+
+func (mp *mqttPublisher) topic(parts ...string) string {
+	return mp.mc.prefix() + "/" + strings.Join(parts, "/")
+}
+
+// startMQTT connects to the broker, and publishes until ctx is done.
+func (s *server) startMQTT(ctx context.Context, mc *MQTTConfig) error {
+	mp := &mqttPublisher{s: s, mc: mc}
+	clientID := mc.ClientID
+	if clientID == "" {
+		clientID = "solarctrl"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(mc.Broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetWill(mp.topic("status"), "offline", 1, true).
+		SetOnConnectHandler(mp.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warn("Lost MQTT connection", "broker", mc.Broker, "err", err)
+		})
+	if mc.Username != "" {
+		pass := mc.Password
+		if mc.PasswordFile != "" {
+			var err error
+			if pass, err = readSecret(mc.PasswordFile); err != nil {
+				return fmt.Errorf("reading MQTT password: %w", err)
+			}
+		}
+		opts.SetUsername(mc.Username)
+		opts.SetPassword(pass)
+	}
+	mp.client = mqtt.NewClient(opts)
+	if tok := mp.client.Connect(); tok.Wait() && tok.Error() != nil {
+		return fmt.Errorf("connecting to MQTT broker %s: %w", mc.Broker, tok.Error())
+	}
+	logger.Info("Connected to MQTT broker", "broker", mc.Broker)
+	go mp.run(ctx)
+	return nil
+}
+
+// onConnect is called on every (re)connection.
+func (mp *mqttPublisher) onConnect(c mqtt.Client) {
+	c.Publish(mp.topic("status"), 1, true, "online")
+	if tok := c.Subscribe(mp.topic("+", "set"), 1, mp.onSet); tok.Wait() && tok.Error() != nil {
+		logger.Error("Subscribing to MQTT command topics", "err", tok.Error())
+	}
+	// The broker may have lost retained messages.
+	mp.mu.Lock()
+	mp.announced = ""
+	mp.mu.Unlock()
+	mp.publishStatus()
+}
+
+// run forwards events, and the state of loads after each evaluation, until ctx is done.
+func (mp *mqttPublisher) run(ctx context.Context) {
+	ch := mp.s.events.subscribe()
+	defer mp.s.events.unsubscribe(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			mp.client.Publish(mp.topic("status"), 1, true, "offline").Wait()
+			mp.client.Disconnect(1000)
+			return
+		case ev := <-ch:
+			switch ev.Kind {
+			case "toggle", "override":
+				if js, err := json.Marshal(ev); err == nil {
+					mp.client.Publish(mp.topic("events"), 0, false, js)
+				}
+			case "done":
+				mp.publishStatus()
+			}
+		}
+	}
+}
+
+// mqttLoad is the state of a load as published to <prefix>/<load>/state.
+type mqttLoad struct {
+	Name       string `json:"name"`
+	On         bool   `json:"on"`
+	Power      Power  `json:"power_w"`
+	Constraint string `json:"constraint,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// publishStatus publishes the state of each load as of the last evaluation.
+func (mp *mqttPublisher) publishStatus() {
+	mp.s.mu.Lock()
+	status := mp.s.status
+	mp.s.mu.Unlock()
+
+	loads := make(map[string]*mqttLoad)
+	var names []string
+	for _, st := range status {
+		name := st.Name
+		if st.Group != "" {
+			name = st.Group
+		}
+		ml, ok := loads[name]
+		if !ok {
+			ml = &mqttLoad{Name: name}
+			loads[name] = ml
+			names = append(names, name)
+		}
+		ml.On = ml.On || st.On
+		ml.Power += st.Power
+		if ml.Constraint == "" {
+			ml.Constraint = st.Blocked
+		}
+		if st.Err != nil && ml.Error == "" {
+			ml.Error = st.Err.Error()
+		}
+	}
+	sort.Strings(names)
+	mp.announce(names)
+	for _, name := range names {
+		ml := loads[name]
+		js, err := json.Marshal(ml)
+		if err != nil {
+			logger.Error("Encoding MQTT state", "plug", name, "err", err)
+			continue
+		}
+		tn := mqttTopicName(name)
+		mp.client.Publish(mp.topic(tn, "state"), 0, true, js)
+		mp.client.Publish(mp.topic(tn, "relay"), 0, true, onOff(boolState(ml.On)))
+		mp.client.Publish(mp.topic(tn, "power"), 0, true, fmt.Sprintf("%d", int(ml.Power)))
+	}
+}
+
+// announce publishes Home Assistant discovery config for the loads,
+// if they differ from those last announced.
+func (mp *mqttPublisher) announce(names []string) {
+	if mp.mc.DiscoveryPrefix == "" {
+		return
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	key := strings.Join(names, "\x00")
+	if key == mp.announced {
+		return
+	}
+	mp.announced = key
+
+	device := map[string]interface{}{
+		"identifiers": []string{mp.mc.prefix()},
+		"name":        "solarctrl",
+	}
+	for _, name := range names {
+		tn := mqttTopicName(name)
+		id := mp.mc.prefix() + "_" + tn
+		entities := []struct {
+			component, id string
+			cfg           map[string]interface{}
+		}{
+			{"switch", id, map[string]interface{}{
+				"name":          name,
+				"state_topic":   mp.topic(tn, "relay"),
+				"command_topic": mp.topic(tn, "set"),
+				"payload_on":    "on",
+				"payload_off":   "off",
+			}},
+			{"sensor", id + "_power", map[string]interface{}{
+				"name":                name + " power",
+				"state_topic":         mp.topic(tn, "power"),
+				"device_class":        "power",
+				"unit_of_measurement": "W",
+				"state_class":         "measurement",
+			}},
+			{"sensor", id + "_constraint", map[string]interface{}{
+				"name":           name + " constraint",
+				"state_topic":    mp.topic(tn, "state"),
+				"value_template": "{{ value_json.constraint | default('none') }}",
+			}},
+		}
+		for _, e := range entities {
+			e.cfg["unique_id"] = e.id
+			e.cfg["availability_topic"] = mp.topic("status")
+			e.cfg["device"] = device
+			js, err := json.Marshal(e.cfg)
+			if err != nil {
+				logger.Error("Encoding MQTT discovery config", "plug", name, "err", err)
+				continue
+			}
+			mp.client.Publish(mp.mc.DiscoveryPrefix+"/"+e.component+"/"+e.id+"/config", 1, true, js)
+		}
+	}
+}
+
+// onSet handles a message on a command topic.
+func (mp *mqttPublisher) onSet(_ mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), mp.mc.prefix()+"/"), "/")
+	if len(parts) != 2 {
+		return
+	}
+	var name string
+	_, dps := mp.s.current()
+	for _, dp := range dps {
+		if mqttTopicName(dp.cfg.loadName()) == parts[0] {
+			name = dp.cfg.loadName()
+		}
+	}
+	if name == "" {
+		logger.Warn("MQTT command for unknown plug", "topic", msg.Topic())
+		return
+	}
+	var newState int
+	switch cmd := strings.ToLower(strings.TrimSpace(string(msg.Payload()))); cmd {
+	case "on":
+		newState = 1
+	case "off":
+		newState = 0
+	default:
+		logger.Warn("Bad MQTT command", "plug", name, "command", cmd)
+		return
+	}
+	d := mp.mc.OverrideFor
+	if d == 0 {
+		d = time.Hour
+	}
+
+	// Callbacks are run one at a time, so don't hold up others.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), manualTimeout)
+		defer cancel()
+		if err := mp.s.switchByHand(ctx, name, newState, d, "MQTT"); err != nil {
+			logger.Error("Switching plug from MQTT", "plug", name, "err", err)
+			return
+		}
+		logger.Info("Switched plug from MQTT", "plug", name, "state", onOff(newState), "pause", d)
+		// Publish the new state promptly rather than waiting for the next evaluation.
+		mp.client.Publish(mp.topic(parts[0], "relay"), 0, true, onOff(newState))
+	}()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notification kinds.
+const (
+	notifyToggle        = "toggle"
+	notifyToggleFailure = "toggle_failure"
+	notifyUnreachable   = "unreachable"
+	notifyEvalError     = "eval_error"
+)
+
+// NotifierConfig configures a notification sink.
+type NotifierConfig struct {
+	Kind string // "webhook", "slack", "telegram" or "grafana"
+
+	// For webhook, slack and grafana.
+	URL string
+
+	// For webhook, Body, if set, is a text/template for the request body,
+	// instead of the notification as JSON. It is given the notification
+	// (.Kind, .Plug, .Text and .Time), and a json function to quote strings, as in
+	//
+	//	body: '{"topic": "solar", "message": {{json .Text}}}'
+	//
+	// ContentType defaults to application/json, and Headers are added to the request,
+	// such as for credentials or ntfy's Title.
+	Body        string
+	ContentType string `yaml:"content_type"`
+	Headers     map[string]string
+
+	// For telegram.
+	BotToken string `yaml:"bot_token"`
+	ChatID   string `yaml:"chat_id"`
+
+	// For grafana; see grafana.go.
+	Token        string
+	DashboardUID string `yaml:"dashboard_uid"`
+	PanelID      int    `yaml:"panel_id"`
+	Tags         []string
+
+	// Events restricts which notification kinds are sent to this sink.
+	// If empty, all are sent.
+	Events []string
+}
+
+type notification struct {
+	Kind string    `json:"kind"`
+	Plug string    `json:"plug,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+type sink interface {
+	send(ctx context.Context, n notification) error
+}
+
+type filteredSink struct {
+	name   string
+	events map[string]bool // nil means all
+	sink
+}
+
+// notifier delivers notifications to sinks in the background,
+// so a slow or broken sink can't hold up evaluation.
+type notifier struct {
+	sinks []filteredSink
+	queue chan notification
+}
+
+func newNotifier(cfgs []NotifierConfig) (*notifier, error) {
+	nt := &notifier{
+		queue: make(chan notification, 100),
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for i, cfg := range cfgs {
+		fs := filteredSink{name: fmt.Sprintf("%s #%d", cfg.Kind, i)}
+		switch cfg.Kind {
+		default:
+			return nil, fmt.Errorf("unknown notifier kind %q", cfg.Kind)
+		case "webhook":
+			if cfg.URL == "" {
+				return nil, fmt.Errorf("webhook notifier needs url")
+			}
+			ws := webhookSink{client: client, url: cfg.URL, contentType: cfg.ContentType, headers: cfg.Headers}
+			if cfg.Body != "" {
+				var err error
+				if ws.body, err = template.New("body").Funcs(bodyFuncs).Parse(cfg.Body); err != nil {
+					return nil, fmt.Errorf("webhook notifier body: %w", err)
+				}
+			}
+			fs.sink = ws
+		case "slack":
+			if cfg.URL == "" {
+				return nil, fmt.Errorf("slack notifier needs url")
+			}
+			fs.sink = slackSink{client: client, url: cfg.URL}
+		case "telegram":
+			if cfg.BotToken == "" || cfg.ChatID == "" {
+				return nil, fmt.Errorf("telegram notifier needs bot_token and chat_id")
+			}
+			fs.sink = telegramSink{client: client, token: cfg.BotToken, chatID: cfg.ChatID}
+		case "grafana":
+			if cfg.URL == "" || cfg.Token == "" {
+				return nil, fmt.Errorf("grafana notifier needs url and token")
+			}
+			fs.sink = grafanaSink{client: client, url: cfg.URL, token: cfg.Token,
+				dashboardUID: cfg.DashboardUID, panelID: cfg.PanelID, tags: cfg.Tags}
+			if len(cfg.Events) == 0 {
+				cfg.Events = []string{notifyToggle}
+			}
+		}
+		if len(cfg.Events) > 0 {
+			fs.events = make(map[string]bool)
+			for _, ev := range cfg.Events {
+				switch ev {
+				case notifyToggle, notifyToggleFailure, notifyUnreachable, notifyEvalError:
+				default:
+					return nil, fmt.Errorf("unknown notification event %q", ev)
+				}
+				fs.events[ev] = true
+			}
+		}
+		nt.sinks = append(nt.sinks, fs)
+	}
+	if len(nt.sinks) > 0 {
+		go nt.loop()
+	}
+	return nt, nil
+}
+
+// notify queues a notification. It never blocks; if the queue is full the notification is dropped.
+func (nt *notifier) notify(kind, plug, format string, args ...interface{}) {
+	if len(nt.sinks) == 0 {
+		return
+	}
+	n := notification{
+		Kind: kind,
+		Plug: plug,
+		Text: fmt.Sprintf(format, args...),
+		Time: time.Now(),
+	}
+	select {
+	case nt.queue <- n:
+	default:
+		logger.Warn("Notification queue full; dropping", "text", n.Text)
+	}
+}
+
+// close stops the notifier once it has sent what is queued.
+// It must not be used after.
+func (nt *notifier) close() {
+	if len(nt.sinks) > 0 {
+		close(nt.queue)
+	}
+}
+
+func (nt *notifier) loop() {
+	for n := range nt.queue {
+		for _, fs := range nt.sinks {
+			if fs.events != nil && !fs.events[n.Kind] {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			if err := fs.send(ctx, n); err != nil {
+				logger.Error("Sending notification", "sink", fs.name, "kind", n.Kind, "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+func post(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(client, req)
+}
+
+// do sends a request, and turns a non-2xx response into an error.
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// webhookSink POSTs the notification as JSON, or as its body template makes it.
+type webhookSink struct {
+	client      *http.Client
+	url         string
+	body        *template.Template // nil for JSON
+	contentType string
+	headers     map[string]string
+}
+
+var bodyFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func (ws webhookSink) send(ctx context.Context, n notification) error {
+	var buf bytes.Buffer
+	if ws.body != nil {
+		if err := ws.body.Execute(&buf, n); err != nil {
+			return fmt.Errorf("executing body template: %w", err)
+		}
+	} else if err := json.NewEncoder(&buf).Encode(n); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ws.url, &buf)
+	if err != nil {
+		return err
+	}
+	ct := ws.contentType
+	if ct == "" {
+		ct = "application/json"
+	}
+	req.Header.Set("Content-Type", ct)
+	for k, v := range ws.headers {
+		req.Header.Set(k, v)
+	}
+	return do(ws.client, req)
+}
+
+// slackSink POSTs to a Slack incoming webhook.
+type slackSink struct {
+	client *http.Client
+	url    string
+}
+
+func (ss slackSink) send(ctx context.Context, n notification) error {
+	b, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{"solarctrl: " + n.Text})
+	if err != nil {
+		return err
+	}
+	return post(ctx, ss.client, ss.url, "application/json", bytes.NewReader(b))
+}
+
+// telegramSink sends a message via the Telegram Bot API.
+type telegramSink struct {
+	client *http.Client
+	token  string
+	chatID string
+}
+
+func (ts telegramSink) send(ctx context.Context, n notification) error {
+	form := url.Values{
+		"chat_id": {ts.chatID},
+		"text":    {"solarctrl: " + n.Text},
+	}
+	u := "https://api.telegram.org/bot" + ts.token + "/sendMessage"
+	return post(ctx, ts.client, u, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
@@ -0,0 +1,18 @@
+package main
+
+import "context"
+
+// occupied reports whether a load's occupancy condition holds,
+// so it may have surplus diverted to it.
+// Without a condition, or if it fails to evaluate, it is taken to hold.
+func (s *server) occupied(ctx context.Context, cfg TPPlugConfig, elogf func(string, ...interface{})) bool {
+	if cfg.OccupiedWhen == "" {
+		return true
+	}
+	ok, err := queryHolds(ctx, s, cfg.OccupiedWhen)
+	if err != nil {
+		elogf("WARNING: evaluating occupancy of %q: %v; assuming someone is home", cfg.loadName(), err)
+		return true
+	}
+	return ok
+}
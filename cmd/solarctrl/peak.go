@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PeakDemandConfig caps household demand during peak windows, for tariffs
+// that charge by the highest demand in a billing period.
+// While a window is active, discretionary loads are shed to bring demand under the cap,
+// lowest priority first, and loads are only turned on if they fit under it,
+// however much spare solar there is.
+type PeakDemandConfig struct {
+	// DemandQuery is a Prometheus query expression yielding a 1-vector
+	// of the total household consumption (W).
+	DemandQuery string `yaml:"demand_query"`
+	Cap         Power
+	Windows     []PeakWindow
+}
+
+// PeakWindow is a time of day range ("15:04") when the cap applies,
+// which may wrap over midnight. If Weekdays is set, it only applies
+// on windows starting on those days.
+type PeakWindow struct {
+	From, To string
+	Weekdays []string // "mon", "tue", etc.
+}
+
+// checkPeakDemand validates the peak demand configuration.
+func checkPeakDemand(config Config) error {
+	pd := config.PeakDemand
+	if pd == nil {
+		return nil
+	}
+	if pd.DemandQuery == "" {
+		return fmt.Errorf("peak_demand needs demand_query")
+	}
+	if pd.Cap <= 0 {
+		return fmt.Errorf("peak_demand needs a positive cap")
+	}
+	if len(pd.Windows) == 0 {
+		return fmt.Errorf("peak_demand needs windows")
+	}
+	for _, w := range pd.Windows {
+		for _, c := range []string{w.From, w.To} {
+			if _, err := parseClock(c, time.Now()); err != nil {
+				return fmt.Errorf("peak_demand window: %w", err)
+			}
+		}
+		for _, wd := range w.Weekdays {
+			if _, ok := weekdays[strings.ToLower(wd)]; !ok {
+				return fmt.Errorf("peak_demand window has bad weekday %q", wd)
+			}
+		}
+	}
+	// Overlapping windows are harmless, but are likely a mistake in one of them.
+	// Check each minute of a week.
+	week := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for t := week; t.Before(week.AddDate(0, 0, 7)); t = t.Add(time.Minute) {
+		first := -1
+		for i, w := range pd.Windows {
+			if !w.contains(t) {
+				continue
+			}
+			if first >= 0 {
+				return fmt.Errorf("peak_demand windows %s-%s and %s-%s overlap at %s",
+					pd.Windows[first].From, pd.Windows[first].To, w.From, w.To, t.Format("Mon 15:04"))
+			}
+			first = i
+		}
+	}
+	return nil
+}
+
+// contains reports whether t is within the window.
+func (w PeakWindow) contains(t time.Time) bool {
+	from, _ := parseClock(w.From, t) // validated in newServer
+	to, _ := parseClock(w.To, t)
+	start := t // day the window started
+	if !from.Before(to) {
+		// Wraps over midnight.
+		if t.Before(to) {
+			start = t.AddDate(0, 0, -1)
+		} else if t.Before(from) {
+			return false
+		}
+	} else if t.Before(from) || !t.Before(to) {
+		return false
+	}
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, wd := range w.Weekdays {
+		if weekdays[strings.ToLower(wd)] == start.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// peak is the state of peak demand capping for an evaluation.
+type peak struct {
+	active   bool
+	headroom Power // how far demand is under the cap; negative if over
+}
+
+// peakHeadroom works out whether a peak window is active at now,
+// and if so, how much demand can grow before reaching the cap.
+func (s *server) peakHeadroom(ctx context.Context, now time.Time) (peak, error) {
+	pd := s.config.PeakDemand
+	if pd == nil {
+		return peak{}, nil
+	}
+	in := false
+	for _, w := range pd.Windows {
+		in = in || w.contains(now)
+	}
+	if !in {
+		return peak{}, nil
+	}
+	demand, err := queryPower(ctx, s.promAPI, pd.DemandQuery)
+	s.notePromResult(err)
+	if err != nil {
+		return peak{}, fmt.Errorf("querying demand: %w", err)
+	}
+	return peak{active: true, headroom: pd.Cap - demand}, nil
+}
+
+// shedForPeak turns off loads, in reverse of their order (so lowest priority first),
+// until demand is under the cap. Shed loads are marked as off in loads.
+// Paused or forced on loads, and those not permitted to be turned off are left alone,
+// but cooldowns and minimum runs are not honoured, since exceeding the cap is costly.
+func (s *server) shedForPeak(ctx context.Context, now time.Time, pk *peak, cal *CalendarProfile, loads map[string]*load, order []string, bud *budget, statuses map[string]*plugStatus, elogf func(string, ...interface{})) {
+	for i := len(order) - 1; i >= 0 && pk.headroom < 0; i-- {
+		name := order[i]
+		l := loads[name]
+		if !l.On() || l.satisfied() {
+			continue
+		}
+		cfg := cal.apply(name, l.cfg())
+		if !cfg.TurnOff {
+			continue
+		}
+		s.mu.Lock()
+		pause, paused := s.pauses[name]
+		force, forced := s.forces[name]
+		s.mu.Unlock()
+		if paused && pause.After(now) || forced && force.After(now) {
+			continue
+		}
+
+		power := l.Power()
+		dry := s.dry(cfg)
+		verb := "Turning"
+		if dry {
+			verb = "[dry run] Would turn"
+		}
+		elogf("%s off %q at %v to shed %v for peak demand", verb, name, l.Addrs(), power)
+		logger.Info(verb+" off plug for peak demand", "plug", name, "addr", l.Addrs(), "power", power, "headroom", pk.headroom, "dry_run", dry)
+		if !s.switchLoad(ctx, l, 0, reason{"peak_cap", "peak demand cap", bud.spare(cfg.Phase)}, dry, statuses, elogf) {
+			continue
+		}
+		for j := range l.Plugs {
+			l.Plugs[j].state.On = false
+		}
+		pk.headroom += power
+		bud.add(cfg.Phase, power)
+	}
+	if pk.headroom < 0 {
+		elogf("WARNING: demand still %v over the peak cap after shedding", -pk.headroom)
+	}
+}
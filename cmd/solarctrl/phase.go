@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// PhaseConfig describes one phase of a multi-phase supply.
+type PhaseConfig struct {
+	Name string
+	// SolarQuery is a Prometheus query expression yielding a 1-vector
+	// of the solar production (W) on this phase.
+	SolarQuery          string `yaml:"solar_query"`
+	BaselineConsumption Power  `yaml:"baseline_consumption"`
+}
+
+// budget is the spare solar available to discretionary loads,
+// optionally tracked per phase.
+type budget struct {
+	total  Power
+	phases map[string]Power // nil unless balancing per phase
+}
+
+// spare returns the spare solar usable by a load on the given phase.
+func (b *budget) spare(phase string) Power {
+	if b.phases == nil {
+		return b.total
+	}
+	return b.phases[phase]
+}
+
+// add adjusts the spare solar on a phase.
+func (b *budget) add(phase string, p Power) {
+	b.total += p
+	if b.phases != nil {
+		b.phases[phase] += p
+	}
+}
+
+// spread adjusts the spare solar evenly across all phases,
+// for loads that aren't tied to a single phase.
+func (b *budget) spread(p Power) {
+	b.total += p
+	for ph := range b.phases {
+		b.phases[ph] += p / Power(len(b.phases))
+	}
+}
+
+func (b *budget) String() string {
+	if b.phases == nil {
+		return b.total.String()
+	}
+	var phs []string
+	for ph := range b.phases {
+		phs = append(phs, ph)
+	}
+	sort.Strings(phs)
+	str := b.total.String() + " ("
+	for i, ph := range phs {
+		if i > 0 {
+			str += ", "
+		}
+		str += fmt.Sprintf("%s: %v", ph, b.phases[ph])
+	}
+	return str + ")"
+}
+
+// phaseBalanced reports whether decisions should be balanced per phase.
+// With net metering, export on one phase offsets import on another, so there's no need.
+func (c Config) phaseBalanced() bool { return len(c.Phases) > 0 && !c.NetMetered }
+
+// checkPhases validates the phase configuration.
+func checkPhases(config Config) error {
+	if len(config.Phases) == 0 {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, ph := range config.Phases {
+		if ph.Name == "" || ph.SolarQuery == "" {
+			return fmt.Errorf("phases need name and solar_query")
+		}
+		names[ph.Name] = true
+	}
+	for _, tp := range config.DiscretionaryPlugs {
+		if !names[tp.Phase] {
+			return fmt.Errorf("plug %q has phase %q, want one of the configured phases", tp.Alias, tp.Phase)
+		}
+	}
+	for plug, ph := range config.PlugPhases {
+		if !names[ph] {
+			return fmt.Errorf("plug_phases has %q on unknown phase %q", plug, ph)
+		}
+	}
+	return nil
+}
+
+// phaseSpare computes the spare solar on each phase.
+// Plugs whose phase isn't known are assumed to be spread evenly across all phases.
+func (s *server) phaseSpare(ctx context.Context, plugs []plugData, skip map[string]bool) (map[string]Power, error) {
+	phaseOf := make(map[string]string) // plug name => phase
+	for plug, ph := range s.config.PlugPhases {
+		phaseOf[plug] = ph
+	}
+	for _, dp := range s.dps {
+		phaseOf[dp.cfg.Alias] = dp.cfg.Phase
+	}
+
+	spare := make(map[string]Power)
+	for _, ph := range s.config.Phases {
+		solar, err := queryPower(ctx, s.promAPI, ph.SolarQuery)
+		if err != nil {
+			return nil, fmt.Errorf("querying solar power on phase %s: %w", ph.Name, err)
+		}
+		spare[ph.Name] = solar - ph.BaselineConsumption
+	}
+	for _, p := range plugs {
+		if skip[p.Name] {
+			continue
+		}
+		if ph, ok := phaseOf[p.Name]; ok {
+			spare[ph] -= p.Power
+			continue
+		}
+		for ph := range spare {
+			spare[ph] -= p.Power / Power(len(spare))
+		}
+	}
+	return spare, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// PriceConfig gets the current electricity prices from a dynamic tariff,
+// so that loads are run when importing is cheap (or even pays),
+// and surplus solar is exported instead when that pays well.
+// Prices are per kWh, in the same units as Tariff.
+type PriceConfig struct {
+	// Source is where prices come from: "prometheus", "amber", "awattar" or "tibber".
+	Source string
+
+	// For "prometheus", queries yielding 1-vectors of the current import price
+	// and, optionally, export price.
+	ImportQuery string `yaml:"import_query"`
+	ExportQuery string `yaml:"export_query"`
+
+	// Token is the API token for "amber" and "tibber".
+	// SiteID is the Amber site ID.
+	Token  string
+	SiteID string `yaml:"site_id"`
+
+	// Region is the aWATTar market, "de" (the default) or "at".
+	Region string
+
+	// While importing costs less than CheapBelow, loads permitted to turn on
+	// are turned on (and kept on) without spare solar. The default of 0
+	// means only while the price is negative.
+	CheapBelow float64 `yaml:"cheap_below"`
+
+	// While exporting pays at least ExportAbove, if set, loads aren't turned on
+	// for spare solar, since it is worth more exported.
+	ExportAbove *float64 `yaml:"export_above"`
+}
+
+// Endpoints of the price APIs.
+var (
+	amberURL   = "https://api.amber.com.au/v1"
+	awattarURL = "https://api.awattar.%s/v1/marketdata"
+	tibberURL  = "https://api.tibber.com/v1-beta/gql"
+)
+
+func (pc *PriceConfig) check() error {
+	switch pc.Source {
+	case "prometheus":
+		if pc.ImportQuery == "" {
+			return fmt.Errorf("price source prometheus needs import_query")
+		}
+	case "amber":
+		if pc.Token == "" || pc.SiteID == "" {
+			return fmt.Errorf("price source amber needs token and site_id")
+		}
+	case "awattar":
+		switch pc.Region {
+		case "":
+			pc.Region = "de"
+		case "de", "at":
+		default:
+			return fmt.Errorf("price source awattar has bad region %q (want de or at)", pc.Region)
+		}
+	case "tibber":
+		if pc.Token == "" {
+			return fmt.Errorf("price source tibber needs token")
+		}
+	default:
+		return fmt.Errorf("unknown price source %q", pc.Source)
+	}
+	return nil
+}
+
+// prices are the current electricity prices per kWh.
+type prices struct {
+	Import float64
+	Export *float64 // nil if unknown
+}
+
+// cheap reports whether importing is cheap enough to run loads without solar.
+func (p *prices) cheap(pc *PriceConfig) bool {
+	return p != nil && p.Import < pc.CheapBelow
+}
+
+// exportPays reports whether spare solar is better exported than used.
+func (p *prices) exportPays(pc *PriceConfig) bool {
+	return p != nil && p.Export != nil && pc.ExportAbove != nil && *p.Export >= *pc.ExportAbove
+}
+
+func (p *prices) String() string {
+	if p.Export == nil {
+		return fmt.Sprintf("import %.4g/kWh", p.Import)
+	}
+	return fmt.Sprintf("import %.4g/kWh, export %.4g/kWh", p.Import, *p.Export)
+}
+
+// currentPrices fetches the current prices. It returns nil if there is no price source.
+func (s *server) currentPrices(ctx context.Context, now time.Time) (*prices, error) {
+	pc := s.config.Price
+	if pc == nil {
+		return nil, nil
+	}
+	switch pc.Source {
+	case "prometheus":
+		imp, err := queryFloat(ctx, s.promAPI, pc.ImportQuery)
+		s.notePromResult(err)
+		if err != nil {
+			return nil, fmt.Errorf("querying import price: %w", err)
+		}
+		p := &prices{Import: imp}
+		if pc.ExportQuery != "" {
+			exp, err := queryFloat(ctx, s.promAPI, pc.ExportQuery)
+			s.notePromResult(err)
+			if err != nil {
+				return nil, fmt.Errorf("querying export price: %w", err)
+			}
+			p.Export = &exp
+		}
+		return p, nil
+	case "amber":
+		return amberPrices(ctx, pc)
+	case "awattar":
+		return awattarPrices(ctx, pc, now)
+	case "tibber":
+		return tibberPrices(ctx, pc)
+	}
+	return nil, fmt.Errorf("unknown price source %q", pc.Source)
+}
+
+// fetchJSON makes an HTTP request, and decodes the JSON response into resp.
+func fetchJSON(ctx context.Context, method, url, token string, body []byte, resp interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	hr, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer hr.Body.Close()
+	if hr.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(hr.Body, 512))
+		return fmt.Errorf("HTTP %s: %s", hr.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(hr.Body).Decode(resp); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// amberPrices fetches prices from Amber Electric.
+// Its prices are in c/kWh, and feed-in prices are negative when exporting pays.
+func amberPrices(ctx context.Context, pc *PriceConfig) (*prices, error) {
+	var resp []struct {
+		Type        string  `json:"type"`
+		ChannelType string  `json:"channelType"` // "general", "controlledLoad" or "feedIn"
+		PerKWh      float64 `json:"perKwh"`
+	}
+	url := fmt.Sprintf("%s/sites/%s/prices/current", amberURL, pc.SiteID)
+	if err := fetchJSON(ctx, "GET", url, pc.Token, nil, &resp); err != nil {
+		return nil, fmt.Errorf("fetching Amber prices: %w", err)
+	}
+	var p prices
+	found := false
+	for _, r := range resp {
+		if r.Type != "CurrentInterval" {
+			continue
+		}
+		switch r.ChannelType {
+		case "general":
+			p.Import, found = r.PerKWh/100, true
+		case "feedIn":
+			exp := -r.PerKWh / 100
+			p.Export = &exp
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no current general price from Amber")
+	}
+	return &p, nil
+}
+
+// awattarPrices fetches the current wholesale price from aWATTar.
+// Its prices are in EUR/MWh, and don't include network charges or taxes.
+func awattarPrices(ctx context.Context, pc *PriceConfig, now time.Time) (*prices, error) {
+	var resp struct {
+		Data []struct {
+			Start       int64   `json:"start_timestamp"` // ms
+			End         int64   `json:"end_timestamp"`   // ms
+			MarketPrice float64 `json:"marketprice"`
+		} `json:"data"`
+	}
+	if err := fetchJSON(ctx, "GET", fmt.Sprintf(awattarURL, pc.Region), "", nil, &resp); err != nil {
+		return nil, fmt.Errorf("fetching aWATTar prices: %w", err)
+	}
+	ms := now.UnixNano() / 1e6
+	for _, d := range resp.Data {
+		if d.Start <= ms && ms < d.End {
+			return &prices{Import: d.MarketPrice / 1000}, nil
+		}
+	}
+	return nil, fmt.Errorf("no current price from aWATTar")
+}
+
+// tibberPrices fetches the current price of the first Tibber home with a subscription.
+func tibberPrices(ctx context.Context, pc *PriceConfig) (*prices, error) {
+	query, _ := json.Marshal(map[string]string{
+		"query": `{viewer{homes{currentSubscription{priceInfo{current{total}}}}}}`,
+	})
+	var resp struct {
+		Data struct {
+			Viewer struct {
+				Homes []struct {
+					CurrentSubscription *struct {
+						PriceInfo struct {
+							Current *struct {
+								Total float64 `json:"total"`
+							} `json:"current"`
+						} `json:"priceInfo"`
+					} `json:"currentSubscription"`
+				} `json:"homes"`
+			} `json:"viewer"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := fetchJSON(ctx, "POST", tibberURL, pc.Token, query, &resp); err != nil {
+		return nil, fmt.Errorf("fetching Tibber prices: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return nil, fmt.Errorf("fetching Tibber prices: %s", resp.Errors[0].Message)
+	}
+	for _, h := range resp.Data.Viewer.Homes {
+		if cs := h.CurrentSubscription; cs != nil && cs.PriceInfo.Current != nil {
+			return &prices{Import: cs.PriceInfo.Current.Total}, nil
+		}
+	}
+	return nil, fmt.Errorf("no current price from Tibber")
+}
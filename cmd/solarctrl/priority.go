@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	prommodel "github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PriorityRule sets a load's priority while a condition holds,
+// such as giving an EV charger a high priority until the car is mostly charged.
+type PriorityRule struct {
+	// When is a Prometheus query expression. The rule applies if it yields any samples,
+	// so a comparison like `ev_soc_percent < 80` works as a condition.
+	When     string
+	Priority int
+}
+
+// checkPriorities validates the priority rules of a plug.
+func (cfg TPPlugConfig) checkPriorities() error {
+	for _, pr := range cfg.Priorities {
+		if pr.When == "" {
+			return fmt.Errorf("plug %q has a priority rule without a when", cfg.Alias)
+		}
+	}
+	return nil
+}
+
+// queryHolds evaluates a Prometheus query expression as a condition,
+// which holds if it yields a non-empty vector.
+func queryHolds(ctx context.Context, s *server, query string) (_ bool, err error) {
+	ctx, end := startSpan(ctx, "prometheus.Query", attribute.String("query", query))
+	defer func() { end(err) }()
+
+	v, warns, err := s.promAPI.Query(ctx, query, time.Now())
+	s.notePromResult(err)
+	if err != nil {
+		return false, fmt.Errorf("Prometheus query evaluation: %w", err)
+	}
+	for _, w := range warns {
+		vlogf("During Prometheus query evaluation: %s", w)
+	}
+	vec, ok := v.(prommodel.Vector)
+	if !ok {
+		return false, fmt.Errorf("Prometheus query yielded %v, want vector", v.Type())
+	}
+	return len(vec) > 0, nil
+}
+
+// priority works out a load's priority for this evaluation: that of its first
+// priority rule that holds, or else its configured priority.
+// Rules that fail to evaluate are skipped.
+func (s *server) priority(ctx context.Context, cfg TPPlugConfig, elogf func(string, ...interface{})) int {
+	for _, pr := range cfg.Priorities {
+		ok, err := queryHolds(ctx, s, pr.When)
+		if err != nil {
+			elogf("Evaluating priority rule %q for %q: %v", pr.When, cfg.loadName(), err)
+			continue
+		}
+		if ok {
+			return pr.Priority
+		}
+	}
+	return cfg.Priority
+}
+
+// orderLoads sorts the names of loads, highest priority first.
+// Loads of the same priority are in order of name.
+func orderLoads(names []string, prio map[string]int) {
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := prio[names[i]], prio[names[j]]
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+}
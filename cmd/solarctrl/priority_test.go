@@ -0,0 +1,16 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderLoads(t *testing.T) {
+	names := []string{"pool", "spa", "ev", "heater", "dryer"}
+	prio := map[string]int{"ev": 10, "spa": -1, "heater": 10}
+	orderLoads(names, prio)
+	want := []string{"ev", "heater", "dryer", "pool", "spa"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("orderLoads = %q, want %q", names, want)
+	}
+}
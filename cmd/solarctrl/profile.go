@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Load profiles tune control for particular kinds of appliance.
+const (
+	// profileHotWater is a resistive hot water heater with its own thermostat.
+	// It runs for long stretches, and once the tank is hot the thermostat cuts out,
+	// so the plug is on but draws almost nothing.
+	profileHotWater = "hot_water"
+
+	defaultHotWaterMinRun = 30 * time.Minute
+
+	// cutOutFraction is the fraction of configured consumption below which
+	// an on hot water plug is assumed to have had its thermostat cut out.
+	cutOutFraction = 0.1
+)
+
+// applyProfile checks the profile and fills in its defaults.
+func (cfg *TPPlugConfig) applyProfile() error {
+	switch cfg.Profile {
+	case "":
+	case profileHotWater:
+		if cfg.MinRun == 0 {
+			cfg.MinRun = defaultHotWaterMinRun
+		}
+	default:
+		return fmt.Errorf("plug %q has unknown profile %q", cfg.Alias, cfg.Profile)
+	}
+	return nil
+}
+
+// cutOut reports whether the plug appears to be on but with its own thermostat satisfied.
+func (tp TPPlug) cutOut() bool {
+	cfg := tp.dp.cfg
+	return cfg.Profile == profileHotWater && tp.state.On &&
+		float64(tp.state.Power) < cutOutFraction*float64(cfg.Consumption)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	promrawapi "github.com/prometheus/client_golang/api"
+)
+
+// PrometheusConfig configures how to connect to prometheus_addr, for a
+// Prometheus (or VictoriaMetrics, or hosted equivalent) that needs TLS
+// client certificates, credentials or extra headers:
+//
+//	prometheus_addr: https://prom.example.com
+//	prometheus:
+//	  tls:
+//	    ca_file: /etc/solarctrl/ca.pem
+//	    cert_file: /etc/solarctrl/client.pem
+//	    key_file: /etc/solarctrl/client-key.pem
+//	  bearer_token_file: /etc/solarctrl/prom-token
+//	  headers:
+//	    X-Scope-OrgID: home
+//
+// Token and password files are read for each request, so they can be rotated
+// without a restart.
+type PrometheusConfig struct {
+	TLS *PromTLSConfig `yaml:"tls"`
+
+	// At most one of these may be set.
+	BearerToken     string         `yaml:"bearer_token"`
+	BearerTokenFile string         `yaml:"bearer_token_file"`
+	BasicAuth       *PromBasicAuth `yaml:"basic_auth"`
+	Headers         map[string]string
+}
+
+type PromTLSConfig struct {
+	CAFile             string `yaml:"ca_file"` // if unset, the system roots are used
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type PromBasicAuth struct {
+	Username     string
+	Password     string
+	PasswordFile string `yaml:"password_file"`
+}
+
+// roundTripper returns what the Prometheus client should make requests with.
+// A nil PrometheusConfig gets the client's default.
+func (pc *PrometheusConfig) roundTripper() (http.RoundTripper, error) {
+	if pc == nil {
+		return promrawapi.DefaultRoundTripper, nil
+	}
+	n := 0
+	if pc.BearerToken != "" {
+		n++
+	}
+	if pc.BearerTokenFile != "" {
+		n++
+	}
+	if pc.BasicAuth != nil {
+		n++
+		ba := pc.BasicAuth
+		if ba.Username == "" {
+			return nil, fmt.Errorf("prometheus: basic_auth needs a username")
+		}
+		if ba.Password != "" && ba.PasswordFile != "" {
+			return nil, fmt.Errorf("prometheus: give only one of basic_auth password and password_file")
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("prometheus: give only one of bearer_token, bearer_token_file and basic_auth")
+	}
+	for k := range pc.Headers {
+		if strings.EqualFold(k, "Authorization") && n > 0 {
+			return nil, fmt.Errorf("prometheus: Authorization header conflicts with credentials")
+		}
+	}
+
+	t := promrawapi.DefaultRoundTripper.(*http.Transport).Clone()
+	if pc.TLS != nil {
+		tc, err := pc.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: tls: %w", err)
+		}
+		t.TLSClientConfig = tc
+	}
+	return promAuthTransport{t, pc}, nil
+}
+
+func (tc *PromTLSConfig) config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.CAFile != "" {
+		pem, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", tc.CAFile)
+		}
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be given together")
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// promAuthTransport adds credentials and headers to each request.
+type promAuthTransport struct {
+	base http.RoundTripper
+	pc   *PrometheusConfig
+}
+
+func (t promAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pc := t.pc
+	req = req.Clone(req.Context()) // RoundTrippers mustn't modify the request
+	for k, v := range pc.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case pc.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+pc.BearerToken)
+	case pc.BearerTokenFile != "":
+		token, err := readSecret(pc.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case pc.BasicAuth != nil:
+		password := pc.BasicAuth.Password
+		if f := pc.BasicAuth.PasswordFile; f != "" {
+			var err error
+			if password, err = readSecret(f); err != nil {
+				return nil, err
+			}
+		}
+		req.SetBasicAuth(pc.BasicAuth.Username, password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// readSecret reads a token or password from a file, without its trailing newline.
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading Prometheus credentials: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushgatewayConfig configures pushing metrics to a Prometheus Pushgateway
+// after each evaluation. This is for when Prometheus can't scrape solarctrl,
+// such as when it runs behind NAT or only intermittently.
+type PushgatewayConfig struct {
+	URL      string `yaml:"url"`
+	Job      string `yaml:"job"`      // defaults to "solarctrl"
+	Instance string `yaml:"instance"` // defaults to the hostname
+}
+
+func (pc *PushgatewayConfig) check() error {
+	if pc.URL == "" {
+		return fmt.Errorf("pushgateway: url is required")
+	}
+	if _, err := url.Parse(pc.URL); err != nil {
+		return fmt.Errorf("pushgateway: bad url: %w", err)
+	}
+	if pc.Job == "" {
+		pc.Job = "solarctrl"
+	}
+	if pc.Instance == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("pushgateway: no instance set, and getting hostname: %w", err)
+		}
+		pc.Instance = h
+	}
+	return nil
+}
+
+// pushMetrics pushes all metrics to the Pushgateway, if one is configured,
+// replacing those previously pushed by this instance.
+func (s *server) pushMetrics(ctx context.Context) error {
+	pc := s.config.Pushgateway
+	if pc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	ctx, end := startSpan(ctx, "pushgateway.Push")
+	err := push.New(pc.URL, pc.Job).
+		Grouping("instance", pc.Instance).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&ctxClient{ctx}).
+		Push()
+	end(err)
+	return err
+}
+
+// ctxClient is a push.HTTPDoer that applies a context to each request.
+type ctxClient struct{ ctx context.Context }
+
+func (cc *ctxClient) Do(req *http.Request) (*http.Response, error) {
+	return http.DefaultClient.Do(req.WithContext(cc.ctx))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// With -loop, solarctrl rereads its config file on SIGHUP, and with -watch_config,
+// whenever the file changes. The new config is checked as an edit through
+// /config is (see EditorConfig), with the same restrictions, and takes effect
+// at the next evaluation. If it is bad, the old config stays, and the error is logged.
+
+var watchConfig = flag.Duration("watch_config", 0, "with -loop, if set, check the config file for changes every `period`, and reload it when it does")
+
+// reloadFile checks the config file's new contents, and queues them for the next evaluation.
+func (s *server) reloadFile(raw []byte) error {
+	ns, err := s.prepareReload(raw)
+	if err != nil {
+		return err
+	}
+	cur, curDPs := s.current()
+	changes := configChanges(cur, curDPs, ns.config, ns.dps)
+	s.queueReload(ns)
+	logger.Info("Config reloaded; it takes effect at the next evaluation", "file", *configFile, "changes", len(changes))
+	return nil
+}
+
+// reloadLoop reloads the config on SIGHUP, and with -watch_config,
+// when the file changes, until ctx is done.
+func (s *server) reloadLoop(ctx context.Context, raw []byte) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if *watchConfig > 0 {
+		t := time.NewTicker(*watchConfig)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		var why string
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			why = "SIGHUP"
+		case <-tick:
+			why = "file changed"
+		}
+		cur, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			logger.Error("Reading config file", "file", *configFile, "err", err)
+			continue
+		}
+		if why != "SIGHUP" && bytes.Equal(cur, raw) {
+			continue
+		}
+		// Remember it even if it's bad, so it's only reported once.
+		raw = cur
+		if err := s.reloadFile(raw); err != nil {
+			logger.Error("Reloading config; keeping the old one", "file", *configFile, "reason", why, "err", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	discoverTime   = flag.Duration("discover_time", 2*time.Second, "how long to wait for discovery when resolving plugs without a configured IP")
+	minRediscovery = flag.Duration("min_rediscovery", 30*time.Second, "minimum time between discovery broadcasts when resolving plugs")
+	devicesFile    = flag.String("devices", "", "devices `file` giving canonical plug names, which may be used as aliases (default $"+tpplug.DevicesEnv+")")
+)
+
+// resolver maps plugs configured by MAC or alias to their current address,
+// so DHCP lease changes don't break control.
+type resolver struct {
+	devices *tpplug.Devices
+
+	mu       sync.Mutex
+	cache    map[string]*net.UDPAddr // resolveKey => addr
+	lastScan time.Time
+}
+
+func newResolver(ds *tpplug.Devices) *resolver {
+	return &resolver{
+		devices: ds,
+		cache:   make(map[string]*net.UDPAddr),
+	}
+}
+
+// resolveKey is the cache key for a plug without a static address.
+func (dp discPlug) resolveKey() string {
+	if dp.cfg.MAC != "" {
+		return "mac:" + tpplug.CanonicalMAC(dp.cfg.MAC).String()
+	}
+	return "alias:" + dp.cfg.Alias
+}
+
+// resolve returns the plug's address, running discovery if needed.
+func (r *resolver) resolve(ctx context.Context, dp discPlug) (*net.UDPAddr, error) {
+	if dp.addr != nil {
+		return dp.addr, nil
+	}
+	key := dp.resolveKey()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr, ok := r.cache[key]; ok {
+		return addr, nil
+	}
+	if time.Since(r.lastScan) < *minRediscovery {
+		return nil, fmt.Errorf("%s not found by recent discovery", key)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(dctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering plugs: %w", err)
+	}
+	r.lastScan = time.Now()
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		r.cache["mac:"+info.MAC.String()] = dr.Addr
+		r.cache["alias:"+info.Alias] = dr.Addr
+		r.cache["alias:"+r.devices.Name(dr.State)] = dr.Addr
+	}
+	if addr, ok := r.cache[key]; ok {
+		return addr, nil
+	}
+	return nil, fmt.Errorf("%s not found by discovery", key)
+}
+
+// invalidate forgets a plug's resolved address, so it'll be resolved again next time.
+func (r *resolver) invalidate(dp discPlug) {
+	if dp.addr != nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.cache, dp.resolveKey())
+	r.mu.Unlock()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// runtimes tracks how long each load has been on today,
+// for enforcing min_daily_runtime.
+type runtimes struct {
+	mu    sync.Mutex
+	loads map[string]*loadRuntime // load name => runtime
+}
+
+type loadRuntime struct {
+	Day   string        `json:"day"` // "2006-01-02"
+	On    time.Duration `json:"on"`  // time on during Day
+	Last  time.Time     `json:"last"`
+	WasOn bool          `json:"was_on"`
+}
+
+func newRuntimes() *runtimes {
+	return &runtimes{loads: make(map[string]*loadRuntime)}
+}
+
+// update records the load's current state, and returns how long it has been on today.
+// The interval since the previous update is attributed to the state seen then.
+func (rt *runtimes) update(now time.Time, name string, on bool) time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	day := now.Format("2006-01-02")
+	lr, ok := rt.loads[name]
+	if !ok {
+		lr = &loadRuntime{Day: day}
+		rt.loads[name] = lr
+	}
+	if lr.Day != day {
+		// A new day. Anything before midnight counted towards the old one.
+		*lr = loadRuntime{Day: day}
+	} else if lr.WasOn && !lr.Last.IsZero() {
+		dt := now.Sub(lr.Last)
+		if dt > maxAccountingGap {
+			dt = maxAccountingGap
+		}
+		lr.On += dt
+	}
+	lr.Last, lr.WasOn = now, on
+	return lr.On
+}
+
+// runtimeShortfall reports how much longer the plug must run today to meet its minimum daily runtime,
+// if it is past its cutoff time.
+func (cfg TPPlugConfig) runtimeShortfall(now time.Time, ran time.Duration) (time.Duration, bool) {
+	if cfg.MinDailyRuntime <= 0 {
+		return 0, false
+	}
+	cutoff, _ := parseClock(cfg.RuntimeCutoff, now) // validated in newServer
+	if now.Before(cutoff) || ran >= cfg.MinDailyRuntime {
+		return 0, false
+	}
+	return cfg.MinDailyRuntime - ran, true
+}
+
+// parseClock parses a time of day ("15:04") as a time on the same day as ref.
+func parseClock(s string, ref time.Time) (time.Time, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time of day %q (want HH:MM)", s)
+	}
+	y, m, d := ref.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, ref.Location()), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAccountingGap caps how long a single power reading is assumed to have lasted.
+	// This stops a long outage (or the first evaluation) from attributing hours of
+	// energy to one sample.
+	maxAccountingGap = 15 * time.Minute
+
+	// savingsRetention is how many days of savings history are kept.
+	savingsRetention = 35
+)
+
+// savings tracks energy that discretionary loads drew from surplus solar.
+type savings struct {
+	mu   sync.Mutex
+	last time.Time          // time of last recorded reading
+	days map[string]float64 // "2006-01-02" => Wh
+}
+
+func newSavings() *savings {
+	return &savings{days: make(map[string]float64)}
+}
+
+// record notes that discretionary loads were drawing the given power from surplus solar at now,
+// and returns the energy (Wh) attributed to the interval since the previous reading.
+func (sv *savings) record(now time.Time, p Power) float64 {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	last := sv.last
+	sv.last = now
+	if last.IsZero() {
+		return 0
+	}
+	dt := now.Sub(last)
+	if dt > maxAccountingGap {
+		dt = maxAccountingGap
+	}
+	wh := float64(p) * dt.Hours()
+	sv.days[now.Format("2006-01-02")] += wh
+
+	// Prune old days.
+	cutoff := now.AddDate(0, 0, -savingsRetention).Format("2006-01-02")
+	for day := range sv.days {
+		if day < cutoff {
+			delete(sv.days, day)
+		}
+	}
+	return wh
+}
+
+type savingsDay struct {
+	Day     string
+	KWh     float64
+	Dollars float64
+}
+
+// report returns the last n days of savings, most recent first.
+func (sv *savings) report(now time.Time, n int, perKWh float64) []savingsDay {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	var sds []savingsDay
+	for i := 0; i < n; i++ {
+		day := now.AddDate(0, 0, -i).Format("2006-01-02")
+		kwh := sv.days[day] / 1000
+		sds = append(sds, savingsDay{
+			Day:     day,
+			KWh:     kwh,
+			Dollars: kwh * perKWh,
+		})
+	}
+	return sds
+}
+
+// accountSavings works out how much of the current discretionary load is being met by surplus solar,
+// and records it.
+func (s *server) accountSavings(now time.Time, solar Power, plugs []plugData, discPlugs map[string]TPPlug) (self Power) {
+	// Surplus available to discretionary loads is whatever isn't used by everything else.
+	avail := solar - s.config.BaselineConsumption
+	for _, p := range plugs {
+		if _, ok := discPlugs[p.Name]; !ok {
+			avail -= p.Power
+		}
+	}
+	var discOn Power
+	for _, tp := range discPlugs {
+		if tp.On() {
+			discOn += tp.Power()
+		}
+	}
+	self = discOn
+	if avail < self {
+		self = avail
+	}
+	if self < 0 {
+		self = 0
+	}
+
+	wh := s.savings.record(now, self)
+	selfConsumedCounter.Add(wh)
+	savingsCounter.Add(wh / 1000 * s.config.savingPerKWh())
+	return self
+}
+
+// savingPerKWh is the money saved by using a kWh of solar instead of exporting it
+// and importing it again later.
+func (c Config) savingPerKWh() float64 { return c.Tariff - c.FeedInTariff }
+
+func (s *server) serveReport(w http.ResponseWriter, r *http.Request) {
+	cfg, _ := s.current()
+	data := struct {
+		Days             []savingsDay
+		WeekKWh, WeekDol float64
+		PerKWh           float64
+	}{
+		PerKWh: cfg.savingPerKWh(),
+	}
+	data.Days = s.savings.report(time.Now(), 7, data.PerKWh)
+	for _, sd := range data.Days {
+		data.WeekKWh += sd.KWh
+		data.WeekDol += sd.Dollars
+	}
+
+	var buf bytes.Buffer
+	if err := reportTmpl.Execute(&buf, data); err != nil {
+		logger.Error("Internal error rendering template", "err", err)
+		http.Error(w, "rendering template: "+err.Error(), 500)
+		return
+	}
+	io.Copy(w, &buf)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// shutdown persists state and puts discretionary plugs into their configured safe states.
+// It is called once the main loop has stopped.
+func (s *server) shutdown() {
+	logger.Info("Shutting down")
+	if err := s.saveState(); err != nil {
+		logger.Error("Saving state", "err", err)
+	}
+
+	if s.config.Lease != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.releaseLease(ctx); err != nil {
+			logger.Error("Releasing lease", "err", err)
+		}
+		cancel()
+	}
+
+	for _, dp := range s.dps {
+		if dp.cfg.SafeState == "" {
+			continue
+		}
+		name := dp.cfg.Alias
+		if s.dry(dp.cfg) {
+			logger.Info("[dry run] Would set plug to safe state", "plug", name, "state", dp.cfg.SafeState)
+			s.audit.record(auditEntry{Time: time.Now(), Plug: name, Action: dp.cfg.SafeState, Reason: "safe_state", Detail: "shutting down", DryRun: true})
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		drv, err := s.driverFor(ctx, dp)
+		if err == nil {
+			err = drv.setRelay(ctx, dp.cfg.SafeState == "on")
+		}
+		cancel()
+		e := auditEntry{Time: time.Now(), Plug: name, Action: dp.cfg.SafeState, Reason: "safe_state", Detail: "shutting down"}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		s.audit.record(e)
+		if err != nil {
+			logger.Error("Setting plug to safe state", "plug", name, "addr", dp.describe(), "state", dp.cfg.SafeState, "err", err)
+			continue
+		}
+		logger.Info("Set plug to safe state", "plug", name, "addr", drv.String(), "state", dp.cfg.SafeState)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedState is the controller state that survives restarts.
+// Without it, a crash-looping controller would ignore toggle cooldowns and pauses.
+type persistedState struct {
+	LastToggles map[string]time.Time    `json:"last_toggles"` // plug name => time
+	LastOffs    map[string]time.Time    `json:"last_offs"`    // plug name => time
+	Pauses      map[string]time.Time    `json:"pauses"`       // plug name => expiry
+	Forces      map[string]time.Time    `json:"forces"`       // plug name => expiry
+	Shed        shedRequest             `json:"shed"`
+	SavingsDays map[string]float64      `json:"savings_days"` // "2006-01-02" => Wh
+	SavingsLast time.Time               `json:"savings_last"`
+	Runtimes    map[string]*loadRuntime `json:"runtimes"` // load name => runtime
+}
+
+// loadState restores state from *stateFile, if it exists.
+func (s *server) loadState() error {
+	if *stateFile == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(*stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var ps persistedState
+	if err := json.Unmarshal(raw, &ps); err != nil {
+		return fmt.Errorf("parsing state file %s: %w", *stateFile, err)
+	}
+
+	s.restoreState(ps)
+	return nil
+}
+
+// restoreState replaces the controller state with ps.
+func (s *server) restoreState(ps persistedState) {
+	now := time.Now()
+	s.mu.Lock()
+	s.lastToggles = make(map[string]time.Time)
+	for name, t := range ps.LastToggles {
+		s.lastToggles[name] = t
+	}
+	s.lastOffs = make(map[string]time.Time)
+	for name, t := range ps.LastOffs {
+		s.lastOffs[name] = t
+	}
+	s.pauses = make(map[string]time.Time)
+	for name, t := range ps.Pauses {
+		if t.After(now) {
+			s.pauses[name] = t
+		}
+	}
+	s.forces = make(map[string]time.Time)
+	for name, t := range ps.Forces {
+		if t.After(now) {
+			s.forces[name] = t
+		}
+	}
+	s.shed = ps.Shed
+	s.mu.Unlock()
+
+	s.savings.mu.Lock()
+	s.savings.days = make(map[string]float64)
+	for day, wh := range ps.SavingsDays {
+		s.savings.days[day] = wh
+	}
+	s.savings.last = ps.SavingsLast
+	s.savings.mu.Unlock()
+
+	s.runtimes.mu.Lock()
+	s.runtimes.loads = make(map[string]*loadRuntime)
+	for name, lr := range ps.Runtimes {
+		s.runtimes.loads[name] = lr
+	}
+	s.runtimes.mu.Unlock()
+}
+
+// saveState writes the current state to *stateFile.
+// It is written to a temporary file and renamed so a crash never leaves a partial file.
+func (s *server) saveState() error {
+	if *stateFile == "" {
+		return nil
+	}
+	ps := s.snapshotState()
+	raw, err := json.MarshalIndent(ps, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(*stateFile), ".solarctrl-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), *stateFile)
+}
+
+// snapshotState returns a copy of the controller state.
+func (s *server) snapshotState() persistedState {
+	ps := persistedState{
+		LastToggles: make(map[string]time.Time),
+		LastOffs:    make(map[string]time.Time),
+		Pauses:      make(map[string]time.Time),
+		Forces:      make(map[string]time.Time),
+		SavingsDays: make(map[string]float64),
+		Runtimes:    make(map[string]*loadRuntime),
+	}
+	s.mu.Lock()
+	for name, t := range s.lastToggles {
+		ps.LastToggles[name] = t
+	}
+	for name, t := range s.lastOffs {
+		ps.LastOffs[name] = t
+	}
+	for name, t := range s.pauses {
+		ps.Pauses[name] = t
+	}
+	for name, t := range s.forces {
+		ps.Forces[name] = t
+	}
+	ps.Shed = s.shed
+	s.mu.Unlock()
+	s.savings.mu.Lock()
+	for day, wh := range s.savings.days {
+		ps.SavingsDays[day] = wh
+	}
+	ps.SavingsLast = s.savings.last
+	s.savings.mu.Unlock()
+	s.runtimes.mu.Lock()
+	for name, lr := range s.runtimes.loads {
+		lrCopy := *lr
+		ps.Runtimes[name] = &lrCopy
+	}
+	s.runtimes.mu.Unlock()
+
+	return ps
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Motors and compressors draw several times their running power for a moment
+// as they start. Seen in the plug readings, that spike looks like a load
+// using far more than expected, which would have it turned off again at the next
+// evaluation. A surge allowance counts such readings as the plug's Consumption
+// for a while after it is turned on.
+
+// defaultSurgeDuration covers the window of plugQuery, by the end of which
+// a start-up spike has aged out of the readings.
+const defaultSurgeDuration = 5 * time.Minute
+
+// checkSurge checks the surge allowance and fills in its defaults.
+func (cfg *TPPlugConfig) checkSurge() error {
+	if cfg.SurgeWatts == 0 {
+		return nil
+	}
+	if cfg.SurgeWatts <= cfg.Consumption {
+		return fmt.Errorf("plug %q has surge_watts %v, not above its consumption %v", cfg.Alias, cfg.SurgeWatts, cfg.Consumption)
+	}
+	if cfg.SurgeDuration <= 0 {
+		cfg.SurgeDuration = defaultSurgeDuration
+	}
+	return nil
+}
+
+// withinSurge reports whether a power reading from the plug, turned on at onAt,
+// is a start-up surge within its allowance.
+func (cfg TPPlugConfig) withinSurge(power Power, onAt, now time.Time) bool {
+	return cfg.SurgeWatts > 0 && !onAt.IsZero() && now.Sub(onAt) < cfg.SurgeDuration &&
+		power > cfg.Consumption && power <= cfg.SurgeWatts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The web UI is rendered from the templates in the templates directory,
+// which are built in. With -template_dir, any of them (front.html, report.html,
+// config.html) found in that directory are used instead, so the pages can be
+// restyled without rebuilding. Start from a copy of the built-in ones; the data
+// they are given is in serveFront, serveReport and serveConfig, and isn't
+// promised to stay the same.
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+var (
+	serveTmpl  *template.Template
+	reportTmpl *template.Template
+	configTmpl *template.Template
+)
+
+var templateFuncs = template.FuncMap{
+	"roughSince": func(t time.Time) string {
+		d := time.Since(t).Truncate(1 * time.Second)
+		return d.String()
+	},
+	"roughUntil": func(t time.Time) string {
+		d := time.Until(t).Truncate(1 * time.Second)
+		return d.String()
+	},
+}
+
+// loadTemplates parses the templates, preferring those in dir if it is set.
+func loadTemplates(dir string) error {
+	var err error
+	if serveTmpl, err = loadTemplate(dir, "front.html"); err != nil {
+		return err
+	}
+	if reportTmpl, err = loadTemplate(dir, "report.html"); err != nil {
+		return err
+	}
+	if configTmpl, err = loadTemplate(dir, "config.html"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func loadTemplate(dir, name string) (*template.Template, error) {
+	raw, err := fs.ReadFile(builtinTemplates, "templates/"+name)
+	if err != nil {
+		return nil, err // shouldn't happen
+	}
+	if dir != "" {
+		override, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			raw = override
+			logger.Info("Using template override", "file", filepath.Join(dir, name))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return t, nil
+}
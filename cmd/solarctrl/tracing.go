@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/dsymonds/tpplug/tpplugotel"
+)
+
+// Tracing is enabled by setting OTEL_EXPORTER_OTLP_ENDPOINT; see tpplugotel.Setup.
+var tracer = otel.Tracer("github.com/dsymonds/tpplug/cmd/solarctrl")
+
+// startSpan starts a tracing span. The returned function ends it with the operation's result.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, name)
+	span.SetAttributes(attrs...)
+	return ctx, func(err error) { tpplugotel.End(span, err) }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebhookConfig enables the /webhook endpoint, through which other systems
+// (such as Home Assistant automations, or demand response signals)
+// can override control. Overrides take effect at the next evaluation.
+//
+// Requests are POSTed as JSON, with the token as a bearer token
+// ("Authorization: Bearer <token>"). The action is one of
+//
+//	{"action": "shed", "watts": 1500, "for": "30m"}
+//	{"action": "pause", "plug": "pool pump", "for": "1h"}
+//	{"action": "force_on", "plug": "heater", "for": "1h"}
+//
+// Shedding treats the given power as extra consumption, so loads are turned off
+// to make room for it. A plug may be a plug alias or group name.
+// A zero duration cancels the override.
+type WebhookConfig struct {
+	Token string `yaml:"token"`
+}
+
+type webhookRequest struct {
+	Action string   `json:"action"`
+	Plug   string   `json:"plug"`
+	Watts  Power    `json:"watts"`
+	For    duration `json:"for"`
+}
+
+// duration is a time.Duration that is encoded in JSON as a string, like "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1h30m\"")
+	}
+	x, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(x)
+	return nil
+}
+
+// shedRequest is a request to shed some power.
+type shedRequest struct {
+	Watts Power     `json:"watts"`
+	Until time.Time `json:"until"`
+}
+
+// shedding returns how much power has been requested to be shed at now.
+func (s *server) shedding(now time.Time) Power {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.shed.Until) {
+		return 0
+	}
+	return s.shed.Watts
+}
+
+func (s *server) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg, _ := s.current()
+	wc := cfg.Webhook
+	if wc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(wc.Token)) != 1 {
+		http.Error(w, "bad or missing token", http.StatusUnauthorized)
+		return
+	}
+	var req webhookRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.For < 0 {
+		http.Error(w, "negative duration", http.StatusBadRequest)
+		return
+	}
+	until := time.Now().Add(time.Duration(req.For))
+
+	s.mu.Lock()
+	switch req.Action {
+	case "shed":
+		if req.Watts < 0 {
+			s.mu.Unlock()
+			http.Error(w, "negative watts", http.StatusBadRequest)
+			return
+		}
+		s.shed = shedRequest{Watts: req.Watts, Until: until}
+	case "pause", "force_on":
+		if !s.isLoad(req.Plug) {
+			s.mu.Unlock()
+			http.Error(w, fmt.Sprintf("unknown plug %q", req.Plug), http.StatusBadRequest)
+			return
+		}
+		// Only one of these applies at a time; the latest wins.
+		delete(s.pauses, req.Plug)
+		delete(s.forces, req.Plug)
+		if req.For > 0 && req.Action == "pause" {
+			s.pauses[req.Plug] = until
+		} else if req.For > 0 {
+			s.forces[req.Plug] = until
+		}
+	default:
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("unknown action %q", req.Action), http.StatusBadRequest)
+		return
+	}
+	s.mu.Unlock()
+
+	logger.Info("Webhook override", "action", req.Action, "plug", req.Plug, "watts", req.Watts, "until", until, "remote", r.RemoteAddr)
+	s.events.publish(event{Kind: "override", Plug: req.Plug, Text: fmt.Sprintf("%s until %v", req.Action, until.Format("15:04"))})
+	if err := s.saveState(); err != nil {
+		logger.Error("Saving state", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"until": until})
+}
+
+// isLoad reports whether name is the name of a discretionary load.
+// s.mu must be held.
+func (s *server) isLoad(name string) bool {
+	for _, dp := range s.dps {
+		if dp.cfg.loadName() == name {
+			return true
+		}
+	}
+	return false
+}
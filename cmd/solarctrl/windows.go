@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// windows returns a plug's allowed windows as PeakWindows, for their contains method.
+func (cfg TPPlugConfig) windows() ([]PeakWindow, error) {
+	var ws []PeakWindow
+	for _, aw := range cfg.AllowedWindows {
+		from, to, ok := strings.Cut(aw, "-")
+		if !ok {
+			return nil, fmt.Errorf("plug %q: allowed window %q is not of the form 09:00-16:00", cfg.Alias, aw)
+		}
+		w := PeakWindow{From: strings.TrimSpace(from), To: strings.TrimSpace(to), Weekdays: cfg.AllowedWeekdays}
+		for _, c := range []string{w.From, w.To} {
+			if _, err := parseClock(c, time.Now()); err != nil {
+				return nil, fmt.Errorf("plug %q: allowed window %q: %w", cfg.Alias, aw, err)
+			}
+		}
+		ws = append(ws, w)
+	}
+	if len(ws) == 0 && len(cfg.AllowedWeekdays) > 0 {
+		// Just weekdays means all of those days.
+		ws = append(ws, PeakWindow{From: "00:00", To: "00:00", Weekdays: cfg.AllowedWeekdays})
+	}
+	return ws, nil
+}
+
+// checkWindows validates the allowed windows of a plug.
+func (cfg TPPlugConfig) checkWindows() error {
+	for _, wd := range cfg.AllowedWeekdays {
+		if _, ok := weekdays[strings.ToLower(wd)]; !ok {
+			return fmt.Errorf("plug %q has bad allowed weekday %q", cfg.Alias, wd)
+		}
+	}
+	_, err := cfg.windows()
+	return err
+}
+
+// inWindows reports whether solarctrl may switch a plug at t.
+func (cfg TPPlugConfig) inWindows(t time.Time) bool {
+	ws, _ := cfg.windows() // validated in newServer
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+/*
+tpplug-decode decrypts captured TP-Link smart plug traffic,
+writing each message as indented JSON.
+
+	tpplug-decode [-port 9999] <capture.pcap>...
+	tpplug-decode -hex [<hex>...]
+
+Captures may be in pcap or pcapng format, as written by tcpdump or Wireshark:
+
+	tcpdump -i wlan0 -w plugs.pcap port 9999
+
+With -hex, each argument (or each line of standard input, if there are none)
+is a single UDP or TCP payload in hex, such as from Wireshark's
+"Copy as Hex Stream".
+
+The output is suitable for attaching to bug reports about unsupported devices,
+but note that it includes the plugs' MACs, aliases and, for some requests,
+WiFi credentials or locations.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	port   = flag.Int("port", 9999, "`port` the plugs use")
+	useHex = flag.Bool("hex", false, "decode hex payloads instead of capture files")
+	raw    = flag.Bool("raw", false, "write the decrypted messages as they are, without reindenting")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("tpplug-decode: ")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n\ttpplug-decode [flags] <capture.pcap>...\n\ttpplug-decode [flags] -hex [<hex>...]\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *useHex {
+		hexes := flag.Args()
+		if len(hexes) == 0 {
+			sc := bufio.NewScanner(os.Stdin)
+			sc.Buffer(nil, 1<<20)
+			for sc.Scan() {
+				if line := strings.TrimSpace(sc.Text()); line != "" {
+					hexes = append(hexes, line)
+				}
+			}
+			if err := sc.Err(); err != nil {
+				log.Fatalf("Reading stdin: %v", err)
+			}
+		}
+		for i, h := range hexes {
+			b, err := tpplug.DecodeHex(h)
+			if err != nil {
+				log.Fatalf("Decoding message %d: %v", i+1, err)
+			}
+			fmt.Printf("=== message %d (%d bytes)\n", i+1, len(b))
+			write(b)
+		}
+		return
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	exit := 0
+	for _, filename := range flag.Args() {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Print(err)
+			exit = 1
+			continue
+		}
+		msgs, err := tpplug.ReadCapture(f, *port)
+		f.Close()
+		for _, m := range msgs {
+			fmt.Printf("=== %s %s %v -> %v (%d bytes)\n", timestamp(m.Time), m.Src.Network(), m.Src, m.Dst, len(m.Data))
+			write(m.Data)
+		}
+		if err != nil {
+			// Captures cut off mid-packet are common; report what was decoded anyway.
+			log.Printf("%s: %v", filename, err)
+			exit = 1
+		} else if len(msgs) == 0 {
+			log.Printf("%s: no messages on port %d", filename, *port)
+		}
+	}
+	os.Exit(exit)
+}
+
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02T15:04:05.000000Z07:00")
+}
+
+// write writes a decrypted message, indenting it if it is JSON.
+func write(b []byte) {
+	if *raw {
+		fmt.Printf("%s\n", b)
+		return
+	}
+	var buf bytes.Buffer
+	if json.Indent(&buf, b, "", "  ") != nil {
+		// Not JSON; perhaps it was encrypted some other way.
+		fmt.Printf("%q\n", b)
+		return
+	}
+	buf.WriteByte('\n')
+	buf.WriteTo(os.Stdout)
+}
@@ -0,0 +1,18 @@
+module github.com/dsymonds/tpplug/cmd/tpplug-mqtt
+
+go 1.21
+
+require (
+	github.com/dsymonds/tpplug v0.0.0-20241225080319-a9d1b2995096
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+// tpplug.Devices was added after the version above.
+replace github.com/dsymonds/tpplug => ../..
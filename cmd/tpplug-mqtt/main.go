@@ -0,0 +1,245 @@
+/*
+tpplug-mqtt bridges TP-Link smart plugs to MQTT.
+
+For every discovered plug, it publishes (retained) to
+
+	<prefix>/<mac>/state    JSON object with alias, name, room, model, relay state and power
+	<prefix>/<mac>/relay    "on" or "off"
+	<prefix>/<mac>/power    power in W
+
+and it subscribes to
+
+	<prefix>/<mac>/set      "on", "off" or "toggle"
+
+where <mac> is the plug's MAC address in lower case without separators.
+The bridge's own availability is published to <prefix>/bridge/status
+as "online" or "offline".
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	broker       = flag.String("broker", "tcp://localhost:1883", "MQTT broker `URL`")
+	clientID     = flag.String("client_id", "tpplug-mqtt", "MQTT client ID")
+	username     = flag.String("username", "", "MQTT username")
+	prefix       = flag.String("prefix", "tpplug", "topic `prefix`")
+	scanInterval = flag.Duration("scan_interval", 1*time.Minute, "how often to discover plugs")
+	scanTime     = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	pollInterval = flag.Duration("poll_interval", 10*time.Second, "how often to query known plugs")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names and rooms (default $"+tpplug.DevicesEnv+")")
+)
+
+// The MQTT password is taken from the environment so it doesn't appear in process listings.
+const passwordEnv = "MQTT_PASSWORD"
+
+func main() {
+	flag.Parse()
+
+	devices, err := tpplug.LoadDevices(*devicesFile)
+	if err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+	b := &bridge{devices: devices, plugs: make(map[string]*net.UDPAddr)}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*broker).
+		SetClientID(*clientID).
+		SetAutoReconnect(true).
+		SetWill(b.topic("bridge", "status"), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost MQTT connection: %v", err)
+		})
+	if *username != "" {
+		opts.SetUsername(*username)
+		opts.SetPassword(os.Getenv(passwordEnv))
+	}
+	b.client = mqtt.NewClient(opts)
+	if tok := b.client.Connect(); tok.Wait() && tok.Error() != nil {
+		log.Fatalf("Connecting to MQTT broker %s: %v", *broker, tok.Error())
+	}
+	log.Printf("Connected to MQTT broker %s", *broker)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	b.discover()
+	scan := time.NewTicker(*scanInterval)
+	poll := time.NewTicker(*pollInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("Shutting down")
+			b.client.Publish(b.topic("bridge", "status"), 1, true, "offline").Wait()
+			b.client.Disconnect(1000)
+			return
+		case <-scan.C:
+			b.discover()
+		case <-poll.C:
+			b.poll()
+		}
+	}
+}
+
+type bridge struct {
+	client  mqtt.Client
+	devices *tpplug.Devices
+
+	mu    sync.Mutex
+	plugs map[string]*net.UDPAddr // keyed by topic MAC
+}
+
+// topicMAC returns the form of a MAC address used in topics.
+func topicMAC(mac tpplug.MAC) string {
+	return strings.ToLower(mac.Compact())
+}
+
+func (b *bridge) topic(parts ...string) string {
+	return *prefix + "/" + strings.Join(parts, "/")
+}
+
+// onConnect is called on every (re)connection.
+func (b *bridge) onConnect(c mqtt.Client) {
+	c.Publish(b.topic("bridge", "status"), 1, true, "online")
+	if tok := c.Subscribe(b.topic("+", "set"), 1, b.onSet); tok.Wait() && tok.Error() != nil {
+		log.Printf("Subscribing to command topics: %v", tok.Error())
+	}
+}
+
+func (b *bridge) discover() {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		log.Printf("Discovering: %v", err)
+		return
+	}
+	for _, dr := range drs {
+		mac := topicMAC(dr.State.System.Info.MAC)
+		if mac == "" {
+			continue
+		}
+		b.mu.Lock()
+		if _, ok := b.plugs[mac]; !ok {
+			log.Printf("Found plug %s (%q) at %v", mac, dr.State.System.Info.Alias, dr.Addr)
+		}
+		b.plugs[mac] = dr.Addr
+		b.mu.Unlock()
+		b.publish(mac, dr.State)
+	}
+}
+
+func (b *bridge) poll() {
+	b.mu.Lock()
+	plugs := make(map[string]*net.UDPAddr, len(b.plugs))
+	for mac, addr := range b.plugs {
+		plugs[mac] = addr
+	}
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for mac, addr := range plugs {
+		mac, addr := mac, addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			state, err := tpplug.Query(ctx, addr)
+			if err != nil {
+				log.Printf("Querying %s at %v: %v", mac, addr, err)
+				return
+			}
+			b.publish(mac, state)
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *bridge) publish(mac string, state tpplug.State) {
+	info := state.System.Info
+	relay := "off"
+	if info.RelayState == 1 {
+		relay = "on"
+	}
+	power := float64(state.EnergyMeter.Realtime.Power) / 1000
+	dev, _ := b.devices.Lookup(info.MAC)
+	js, err := json.Marshal(struct {
+		MAC   tpplug.MAC `json:"mac"`
+		Alias string     `json:"alias"`
+		Name  string     `json:"name"`
+		Room  string     `json:"room,omitempty"`
+		Model string     `json:"model"`
+		Relay string     `json:"relay"`
+		Power float64    `json:"power_w"`
+	}{info.MAC, info.Alias, b.devices.Name(state), dev.Room, info.Model, relay, power})
+	if err != nil {
+		log.Printf("Encoding state of %s: %v", mac, err)
+		return
+	}
+	b.client.Publish(b.topic(mac, "state"), 0, true, js)
+	b.client.Publish(b.topic(mac, "relay"), 0, true, relay)
+	b.client.Publish(b.topic(mac, "power"), 0, true, fmt.Sprintf("%.1f", power))
+}
+
+// onSet handles a message on a command topic.
+func (b *bridge) onSet(_ mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), *prefix+"/"), "/")
+	if len(parts) != 2 {
+		return
+	}
+	mac := parts[0]
+	b.mu.Lock()
+	addr, ok := b.plugs[mac]
+	b.mu.Unlock()
+	if !ok {
+		log.Printf("Command for unknown plug %s", mac)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var newState int
+	switch cmd := strings.ToLower(strings.TrimSpace(string(msg.Payload()))); cmd {
+	case "on", "1", "true":
+		newState = 1
+	case "off", "0", "false":
+		newState = 0
+	case "toggle":
+		state, err := tpplug.Query(ctx, addr)
+		if err != nil {
+			log.Printf("Querying %s at %v: %v", mac, addr, err)
+			return
+		}
+		newState = 1 - state.System.Info.RelayState
+	default:
+		log.Printf("Bad command %q for plug %s", cmd, mac)
+		return
+	}
+	if err := tpplug.SetRelayState(ctx, addr, newState); err != nil {
+		log.Printf("Setting relay of %s at %v: %v", mac, addr, err)
+		return
+	}
+	// Publish the new state promptly rather than waiting for the next poll.
+	if state, err := tpplug.Query(ctx, addr); err == nil {
+		b.publish(mac, state)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+tpplug-registry maintains a registry of the TP-Link smart plugs on the network,
+served over a Unix socket. Programs using tpplug.Discover on the same host
+(the exporter, solarctrl, tpplugctl, etc.) then ask it which plugs exist
+rather than each broadcasting for themselves.
+
+Clients find the socket at tpplug.DefaultRegistrySocket, or at $TPPLUG_REGISTRY.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	socket       = flag.String("socket", "", "Unix socket `path` to serve on (default $TPPLUG_REGISTRY or "+tpplug.DefaultRegistrySocket+")")
+	scanInterval = flag.Duration("scan_interval", 1*time.Minute, "how often to discover plugs")
+	scanTime     = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	forget       = flag.Duration("forget", 10*time.Minute, "how long to keep a plug that stopped responding")
+)
+
+type registry struct {
+	mu      sync.Mutex
+	entries map[tpplug.MAC]tpplug.RegistryEntry
+}
+
+func main() {
+	flag.Parse()
+	path := *socket
+	if path == "" {
+		if path = tpplug.RegistrySocket(); path == "" {
+			log.Fatalf("No socket path: $%s is %q", tpplug.RegistrySocketEnv, "none")
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Scan before listening, so the first clients get a useful answer.
+	reg := &registry{entries: make(map[tpplug.MAC]tpplug.RegistryEntry)}
+	reg.scan()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Creating socket directory: %v", err)
+	}
+	// Remove any stale socket left behind by an unclean exit.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Removing old socket: %v", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Listening on %s: %v", path, err)
+	}
+	// Any local user may read the registry; it holds nothing that discovery wouldn't reveal.
+	os.Chmod(path, 0666)
+	go func() {
+		<-ctx.Done()
+		l.Close() // also removes the socket file
+	}()
+	go func() {
+		t := time.NewTicker(*scanInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				reg.scan()
+			}
+		}
+	}()
+
+	log.Printf("Serving registry on %s", path)
+	if err := tpplug.ServeRegistry(l, reg.list); err != nil && ctx.Err() == nil {
+		log.Fatalf("Serving: %v", err)
+	}
+}
+
+func (r *registry) scan() {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	// Always broadcast; asking ourselves would be pointless.
+	drs, err := tpplug.DiscoverBroadcast(ctx)
+	if err != nil {
+		log.Printf("Discovering plugs: %v", err)
+		return
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		if info.MAC == "" {
+			continue
+		}
+		if _, ok := r.entries[info.MAC]; !ok {
+			log.Printf("Found plug %s (%q) at %v", info.MAC, info.Alias, dr.Addr)
+		}
+		r.entries[info.MAC] = tpplug.RegistryEntry{
+			Addr:     dr.Addr.String(),
+			MAC:      info.MAC,
+			Alias:    info.Alias,
+			LastSeen: now,
+		}
+	}
+	for mac, e := range r.entries {
+		if now.Sub(e.LastSeen) > *forget {
+			log.Printf("Forgetting plug %s (%q), last seen %v", e.MAC, e.Alias, e.LastSeen.Format(time.RFC3339))
+			delete(r.entries, mac)
+		}
+	}
+}
+
+func (r *registry) list() []tpplug.RegistryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var es []tpplug.RegistryEntry
+	for _, e := range r.entries {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].MAC < es[j].MAC })
+	return es
+}
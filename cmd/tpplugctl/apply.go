@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// apply configures plugs in bulk from a CSV file, for provisioning a batch of
+// new plugs consistently. The first row names the columns: mac is required,
+// and alias, led (on or off) and timezone (the plug's timezone index, as used
+// by the Kasa app) are optional. An empty cell leaves that setting alone.
+//
+//	mac,alias,led,timezone
+//	50:C7:BF:00:00:01,Kettle,off,
+//	50:C7:BF:00:00:02,Fridge,,42
+//
+// Each plug is found by discovery, and only settings that differ are changed.
+// With -n, the changes are only shown.
+
+// applyRow is one plug's settings from the CSV file.
+type applyRow struct {
+	row   int // counting from 1, after the header
+	mac   tpplug.MAC
+	alias string // "" to leave alone
+	led   string // "", "on" or "off"
+	tz    *int
+}
+
+type applyChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type applyResult struct {
+	MAC       tpplug.MAC    `json:"mac"`
+	IP        string        `json:"ip,omitempty"` // empty if not found
+	Changes   []applyChange `json:"changes"`
+	Applied   bool          `json:"applied"`
+	Confirmed bool          `json:"confirmed"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func cmdApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := fs.String("f", "", "CSV `file` of plug settings")
+	dryRun := fs.Bool("n", false, "only show what would change")
+	fs.Parse(args)
+	if *file == "" || fs.NArg() > 0 {
+		return errors.New("usage: tpplugctl apply -f <file> [-n]")
+	}
+	rows, err := readApplyFile(*file)
+	if err != nil {
+		return err
+	}
+
+	dctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(dctx)
+	if err != nil {
+		return fmt.Errorf("discovering plugs: %w", err)
+	}
+	addrs := make(map[tpplug.MAC]*net.UDPAddr)
+	for _, dr := range drs {
+		addrs[dr.State.System.Info.MAC] = dr.Addr
+	}
+
+	res := []applyResult{}
+	failed := 0
+	for _, row := range rows {
+		r := applyResult{MAC: row.mac, Changes: []applyChange{}}
+		if err := applyOne(row, addrs[row.mac], *dryRun, &r); err != nil {
+			r.Error = err.Error()
+			failed++
+		}
+		res = append(res, r)
+	}
+	err = emit(res, func(w io.Writer) { writeApply(w, res, *dryRun) })
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d plugs failed", failed, len(res))
+	}
+	return err
+}
+
+// applyOne works out what needs changing on one plug, and unless dryRun is set, changes it.
+func applyOne(row applyRow, addr *net.UDPAddr, dryRun bool, r *applyResult) error {
+	if addr == nil {
+		return errors.New("not found")
+	}
+	r.IP = addr.IP.String()
+
+	ctx, cancel := opCtx()
+	defer cancel()
+	state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+	if err != nil {
+		return err
+	}
+	info := state.System.Info
+	if row.alias != "" && row.alias != info.Alias {
+		r.Changes = append(r.Changes, applyChange{"alias", info.Alias, row.alias})
+	}
+	if led := onOff(info.LEDOff == 0); row.led != "" && row.led != led {
+		r.Changes = append(r.Changes, applyChange{"led", led, row.led})
+	}
+	if row.tz != nil {
+		tz, err := getTimezone(ctx, addr)
+		if err != nil {
+			return err
+		}
+		if tz != *row.tz {
+			r.Changes = append(r.Changes, applyChange{"timezone", strconv.Itoa(tz), strconv.Itoa(*row.tz)})
+		}
+	}
+	if dryRun || len(r.Changes) == 0 {
+		return nil
+	}
+
+	for _, c := range r.Changes {
+		var err error
+		switch c.Field {
+		case "alias":
+			err = tpplug.SetAlias(ctx, addr, c.To)
+		case "led":
+			err = tpplug.SetLED(ctx, addr, c.To != "off")
+		case "timezone":
+			err = setTimezone(ctx, addr, *row.tz)
+		}
+		if err != nil {
+			return fmt.Errorf("setting %s: %w", c.Field, err)
+		}
+	}
+	r.Applied = true
+
+	// Only sysinfo is read back; the timezone is taken on trust.
+	r.Confirmed, err = confirm("settings", func(ctx context.Context) (bool, error) {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		info := state.System.Info
+		return (row.alias == "" || info.Alias == row.alias) &&
+			(row.led == "" || onOff(info.LEDOff == 0) == row.led), err
+	})
+	return err
+}
+
+func writeApply(w io.Writer, res []applyResult, dryRun bool) {
+	fmt.Fprintln(w, "MAC\tIP\tCHANGE\t")
+	for _, r := range res {
+		switch {
+		case r.Error != "" && len(r.Changes) == 0:
+			fmt.Fprintf(w, "%s\t%s\t%s\t\n", r.MAC, r.IP, r.Error)
+		case len(r.Changes) == 0:
+			fmt.Fprintf(w, "%s\t%s\tup to date\t\n", r.MAC, r.IP)
+		}
+		for _, c := range r.Changes {
+			fmt.Fprintf(w, "%s\t%s\t%s: %q -> %q\t\n", r.MAC, r.IP, c.Field, c.From, c.To)
+		}
+		if r.Error != "" && len(r.Changes) > 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t\n", r.MAC, r.IP, r.Error)
+		}
+	}
+	if dryRun {
+		fmt.Fprintln(w, "(dry run; nothing changed)")
+	}
+}
+
+func readApplyFile(path string) ([]applyRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	recs, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	cols := make(map[string]int)
+	for i, name := range recs[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "mac", "alias", "led", "timezone":
+		default:
+			return nil, fmt.Errorf("%s: unknown column %q", path, name)
+		}
+		if _, dup := cols[name]; dup {
+			return nil, fmt.Errorf("%s: duplicate column %q", path, name)
+		}
+		cols[name] = i
+	}
+	if _, ok := cols["mac"]; !ok {
+		return nil, fmt.Errorf("%s: no mac column", path)
+	}
+
+	var rows []applyRow
+	seen := make(map[tpplug.MAC]int)
+	for i, rec := range recs[1:] {
+		row := applyRow{row: i + 1}
+		get := func(col string) string {
+			if j, ok := cols[col]; ok {
+				return strings.TrimSpace(rec[j])
+			}
+			return ""
+		}
+		bad := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s: row %d: %s", path, row.row, fmt.Sprintf(format, args...))
+		}
+		if row.mac, err = tpplug.ParseMAC(get("mac")); err != nil {
+			return nil, bad("%v", err)
+		}
+		if prev, ok := seen[row.mac]; ok {
+			return nil, bad("%s is also on row %d", row.mac, prev)
+		}
+		seen[row.mac] = row.row
+		row.alias = get("alias")
+		switch row.led = strings.ToLower(get("led")); row.led {
+		case "", "on", "off":
+		default:
+			return nil, bad("led must be on or off, not %q", row.led)
+		}
+		if s := get("timezone"); s != "" {
+			tz, err := strconv.Atoi(s)
+			if err != nil || tz < 0 {
+				return nil, bad("bad timezone index %q", s)
+			}
+			row.tz = &tz
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+type errResp struct {
+	ErrCode int    `json:"err_code"`
+	ErrMsg  string `json:"err_msg,omitempty"`
+}
+
+func (er errResp) Err() error {
+	if er.ErrCode == 0 {
+		return nil
+	}
+	return fmt.Errorf("error code %d (%s)", er.ErrCode, er.ErrMsg)
+}
+
+type plugInfo struct {
+	IP    string     `json:"ip"`
+	MAC   tpplug.MAC `json:"mac"`
+	Alias string     `json:"alias"`
+	Name  string     `json:"name"` // canonical name; see -devices
+	Room  string     `json:"room,omitempty"`
+	Model string     `json:"model"`
+	Kind  string     `json:"kind,omitempty"` // see tpplug.DeviceKind
+	Relay string     `json:"relay"`
+	Mode  string     `json:"mode,omitempty"` // active_mode
+	Power float64    `json:"power_w"`
+}
+
+func infoOf(ip string, state tpplug.State) plugInfo {
+	info := state.System.Info
+	dev, _ := devices.Lookup(info.MAC)
+	return plugInfo{
+		IP:    ip,
+		MAC:   info.MAC,
+		Alias: info.Alias,
+		Name:  devices.Name(state),
+		Room:  dev.Room,
+		Model: info.Model,
+		Kind:  string(state.Kind()),
+		Relay: onOff(info.RelayState == 1),
+		Mode:  string(info.ActiveMode),
+		Power: float64(state.EnergyMeter.Realtime.Power) / 1000,
+	}
+}
+
+func writeInfos(w io.Writer, pis []plugInfo) {
+	rooms := devices.Len() > 0
+	if rooms {
+		fmt.Fprint(w, "ROOM\t")
+	}
+	fmt.Fprintln(w, "NAME\tMAC\tIP\tMODEL\tRELAY\tMODE\tPOWER\t")
+	for _, pi := range pis {
+		if rooms {
+			fmt.Fprintf(w, "%s\t", pi.Room)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%.1f W\t\n", pi.Name, pi.MAC, pi.IP, pi.Model, pi.Relay, pi.Mode, pi.Power)
+	}
+}
+
+func cmdList(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	pis := []plugInfo{} // so JSON is [] rather than null
+	for _, dr := range drs {
+		pis = append(pis, infoOf(dr.Addr.IP.String(), dr.State))
+	}
+	sort.Slice(pis, func(i, j int) bool {
+		if pis[i].Room != pis[j].Room {
+			return pis[i].Room < pis[j].Room
+		}
+		return pis[i].Name < pis[j].Name
+	})
+	return emit(pis, func(w io.Writer) { writeInfos(w, pis) })
+}
+
+func cmdStatus(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	state, err := tpplug.Query(ctx, addr)
+	if err != nil {
+		return err
+	}
+	pi := infoOf(addr.IP.String(), state)
+	return emit(pi, func(w io.Writer) { writeInfos(w, []plugInfo{pi}) })
+}
+
+func cmdSwitch(args []string, how string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	on := how == "on"
+	if how == "toggle" {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		if err != nil {
+			return err
+		}
+		on = state.System.Info.RelayState != 1
+	}
+	newState := 0
+	if on {
+		newState = 1
+	}
+	if err := tpplug.SetRelayState(ctx, addr, newState); err != nil {
+		return err
+	}
+	confirmed, err := confirm("relay "+onOff(on), func(ctx context.Context) (bool, error) {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		return state.System.Info.RelayState == newState, err
+	})
+	if err != nil {
+		return err
+	}
+	res := struct {
+		IP        string `json:"ip"`
+		Relay     string `json:"relay"`
+		Confirmed bool   `json:"confirmed"`
+	}{addr.IP.String(), onOff(on), confirmed}
+	return emit(res, func(w io.Writer) { fmt.Fprintf(w, "%s\t%s\n", res.IP, res.Relay) })
+}
+
+func cmdEnergy(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+
+	// Older firmware reports floats in natural units instead of integer milli-units.
+	type realtime struct {
+		errResp
+		VoltageMV *int     `json:"voltage_mv"`
+		CurrentMA *int     `json:"current_ma"`
+		PowerMW   *int     `json:"power_mw"`
+		TotalWh   *int     `json:"total_wh"`
+		Voltage   *float64 `json:"voltage"`
+		Current   *float64 `json:"current"`
+		Power     *float64 `json:"power"`
+		Total     *float64 `json:"total"` // kWh
+	}
+	var resp struct {
+		EMeter struct {
+			Realtime realtime `json:"get_realtime"`
+		} `json:"emeter"`
+	}
+	req := map[string]interface{}{"emeter": map[string]interface{}{"get_realtime": struct{}{}}}
+	if err := tpplug.RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return err
+	}
+	rt := resp.EMeter.Realtime
+	if err := rt.Err(); err != nil {
+		return err
+	}
+	milli := func(i *int, f *float64, scale float64) float64 {
+		if i != nil {
+			return float64(*i) / scale
+		}
+		if f != nil {
+			return *f
+		}
+		return 0
+	}
+	res := struct {
+		Voltage float64 `json:"voltage_v"`
+		Current float64 `json:"current_a"`
+		Power   float64 `json:"power_w"`
+		Total   float64 `json:"total_kwh"`
+	}{
+		Voltage: milli(rt.VoltageMV, rt.Voltage, 1000),
+		Current: milli(rt.CurrentMA, rt.Current, 1000),
+		Power:   milli(rt.PowerMW, rt.Power, 1000),
+		Total:   milli(rt.TotalWh, rt.Total, 1000),
+	}
+	return emit(res, func(w io.Writer) {
+		fmt.Fprintf(w, "voltage:\t%.1f V\n", res.Voltage)
+		fmt.Fprintf(w, "current:\t%.3f A\n", res.Current)
+		fmt.Fprintf(w, "power:\t%.1f W\n", res.Power)
+		fmt.Fprintf(w, "total:\t%.3f kWh\n", res.Total)
+	})
+}
+
+func cmdDaystat(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	month := time.Now()
+	if len(args) > 1 {
+		month, err = time.Parse("2006-01", args[1])
+		if err != nil {
+			return fmt.Errorf("bad month %q (want YYYY-MM)", args[1])
+		}
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+
+	des, err := tpplug.EnergyDayStats(ctx, addr, month.Year(), month.Month())
+	if err != nil {
+		return err
+	}
+	type dayEnergy struct {
+		Date   string  `json:"date"`
+		Energy float64 `json:"energy_kwh"`
+	}
+	res := []dayEnergy{}
+	for _, de := range des {
+		res = append(res, dayEnergy{
+			Date:   fmt.Sprintf("%04d-%02d-%02d", de.Year, de.Month, de.Day),
+			Energy: de.Wh / 1000,
+		})
+	}
+	return emit(res, func(w io.Writer) {
+		fmt.Fprintln(w, "DATE\tENERGY\t")
+		for _, de := range res {
+			fmt.Fprintf(w, "%s\t%.3f kWh\t\n", de.Date, de.Energy)
+		}
+	})
+}
+
+func cmdMonthstat(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	year := time.Now().Year()
+	if len(args) > 1 {
+		if year, err = strconv.Atoi(args[1]); err != nil || year < 2000 || year > 9999 {
+			return fmt.Errorf("bad year %q (want YYYY)", args[1])
+		}
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+
+	mes, err := tpplug.EnergyMonthStats(ctx, addr, year)
+	if err != nil {
+		return err
+	}
+	type monthEnergy struct {
+		Month  string  `json:"month"`
+		Energy float64 `json:"energy_kwh"`
+	}
+	res := []monthEnergy{}
+	for _, me := range mes {
+		res = append(res, monthEnergy{
+			Month:  fmt.Sprintf("%04d-%02d", me.Year, me.Month),
+			Energy: me.Wh / 1000,
+		})
+	}
+	return emit(res, func(w io.Writer) {
+		fmt.Fprintln(w, "MONTH\tENERGY\t")
+		for _, me := range res {
+			fmt.Fprintf(w, "%s\t%.3f kWh\t\n", me.Month, me.Energy)
+		}
+	})
+}
+
+func cmdRename(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	alias := args[1]
+	if err := tpplug.SetAlias(ctx, addr, alias); err != nil {
+		return err
+	}
+	confirmed, err := confirm(fmt.Sprintf("alias %q", alias), func(ctx context.Context) (bool, error) {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		return state.System.Info.Alias == alias, err
+	})
+	if err != nil {
+		return err
+	}
+	res := struct {
+		IP        string `json:"ip"`
+		Alias     string `json:"alias"`
+		Confirmed bool   `json:"confirmed"`
+	}{addr.IP.String(), alias, confirmed}
+	return emit(res, func(w io.Writer) { fmt.Fprintf(w, "%s\t%s\n", res.IP, res.Alias) })
+}
+
+// getTimezone returns a plug's timezone index, which is what the Kasa app offers as a list of zones.
+func getTimezone(ctx context.Context, addr *net.UDPAddr) (int, error) {
+	var resp struct {
+		Time struct {
+			GetTimezone struct {
+				errResp
+				Index *int `json:"index"`
+			} `json:"get_timezone"`
+		} `json:"time"`
+	}
+	req := map[string]interface{}{"time": map[string]interface{}{"get_timezone": struct{}{}}}
+	if err := tpplug.RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return 0, err
+	}
+	gt := resp.Time.GetTimezone
+	if err := gt.Err(); err != nil {
+		return 0, err
+	}
+	if gt.Index == nil {
+		return 0, fmt.Errorf("no timezone index reported")
+	}
+	return *gt.Index, nil
+}
+
+// setTimezone sets a plug's timezone index.
+// The plug wants the time along with it, so its clock is set to our local time.
+func setTimezone(ctx context.Context, addr *net.UDPAddr, index int) error {
+	var resp struct {
+		Time struct {
+			SetTimezone errResp `json:"set_timezone"`
+		} `json:"time"`
+	}
+	now := time.Now().Round(time.Second)
+	req := map[string]interface{}{"time": map[string]interface{}{"set_timezone": map[string]int{
+		"index": index,
+		"year":  now.Year(),
+		"month": int(now.Month()),
+		"mday":  now.Day(),
+		"hour":  now.Hour(),
+		"min":   now.Minute(),
+		"sec":   now.Second(),
+	}}}
+	if err := tpplug.RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return err
+	}
+	return resp.Time.SetTimezone.Err()
+}
+
+func cmdSchedule(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	rules, err := tpplug.ScheduleRules(ctx, addr)
+	if err != nil {
+		return err
+	}
+	type schedRule struct {
+		ID      string   `json:"id"`
+		Name    string   `json:"name"`
+		Enabled bool     `json:"enabled"`
+		Days    []string `json:"days"`
+		Time    string   `json:"time"`
+		Action  string   `json:"action"`
+	}
+	res := []schedRule{}
+	for _, r := range rules {
+		sr := schedRule{
+			ID:      r.ID,
+			Name:    r.Name,
+			Enabled: r.Enable == 1,
+			Days:    []string{},
+			Time:    fmt.Sprintf("%02d:%02d", r.SMin/60, r.SMin%60),
+			Action:  onOff(r.SAct == 1),
+		}
+		for i, on := range r.WDay {
+			if on == 1 && i < 7 {
+				sr.Days = append(sr.Days, time.Weekday(i).String()[:3])
+			}
+		}
+		res = append(res, sr)
+	}
+	return emit(res, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tNAME\tENABLED\tDAYS\tTIME\tACTION\t")
+		for _, sr := range res {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\t\n", sr.ID, sr.Name, sr.Enabled, strings.Join(sr.Days, ","), sr.Time, sr.Action)
+		}
+	})
+}
+
+func cmdCountdown(args []string) error {
+	if len(args) == 2 {
+		return fmt.Errorf("need both a duration and on|off")
+	}
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+
+	if len(args) == 3 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		var act int
+		switch args[2] {
+		case "on":
+			act = 1
+		case "off":
+		default:
+			return fmt.Errorf("bad action %q (want on or off)", args[2])
+		}
+		// There is only one rule permitted at a time, so always clear any existing one.
+		if err := tpplug.DeleteCountdowns(ctx, addr); err != nil {
+			return err
+		}
+		delay := int(d / time.Second)
+		if delay > 0 {
+			r := tpplug.CountdownRule{Name: "tpplugctl", Enable: 1, Delay: delay, Act: act}
+			if _, err := tpplug.AddCountdown(ctx, addr, r); err != nil {
+				return err
+			}
+		}
+		confirmed, err := confirm("countdown rule", func(ctx context.Context) (bool, error) {
+			rules, err := tpplug.CountdownRules(ctx, addr)
+			if delay <= 0 {
+				return len(rules) == 0, err
+			}
+			return len(rules) == 1 && rules[0].Delay == delay && rules[0].Act == act, err
+		})
+		if err != nil {
+			return err
+		}
+		res := struct {
+			IP        string `json:"ip"`
+			Delay     string `json:"delay"` // "0s" if cleared
+			Action    string `json:"action"`
+			Confirmed bool   `json:"confirmed"`
+		}{addr.IP.String(), (time.Duration(delay) * time.Second).String(), onOff(act == 1), confirmed}
+		return emit(res, func(w io.Writer) {
+			if delay > 0 {
+				fmt.Fprintf(w, "%s\t%s in %s\n", res.IP, res.Action, res.Delay)
+			} else {
+				fmt.Fprintf(w, "%s\tcleared\n", res.IP)
+			}
+		})
+	}
+
+	rules, err := tpplug.CountdownRules(ctx, addr)
+	if err != nil {
+		return err
+	}
+	type cdRule struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+		Delay   string `json:"delay"`
+		Remain  string `json:"remain"`
+		Action  string `json:"action"`
+	}
+	res := []cdRule{}
+	for _, r := range rules {
+		res = append(res, cdRule{
+			ID:      r.ID,
+			Name:    r.Name,
+			Enabled: r.Enable == 1,
+			Delay:   (time.Duration(r.Delay) * time.Second).String(),
+			Remain:  (time.Duration(r.Remain) * time.Second).String(),
+			Action:  onOff(r.Act == 1),
+		})
+	}
+	return emit(res, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tNAME\tENABLED\tDELAY\tREMAIN\tACTION\t")
+		for _, r := range res {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\t\n", r.ID, r.Name, r.Enabled, r.Delay, r.Remain, r.Action)
+		}
+	})
+}
+
+func cmdMode(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	var confirmed bool
+	if len(args) == 2 {
+		mode := tpplug.Mode(args[1])
+		if err := tpplug.SetMode(ctx, addr, mode); err != nil {
+			return err
+		}
+		confirmed, err = confirm(fmt.Sprintf("mode %q", mode), func(ctx context.Context) (bool, error) {
+			state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+			return state.System.Info.ActiveMode == mode, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+	if err != nil {
+		return err
+	}
+	res := struct {
+		IP        string `json:"ip"`
+		Mode      string `json:"mode"`
+		Confirmed bool   `json:"confirmed"`
+	}{addr.IP.String(), string(state.System.Info.ActiveMode), confirmed}
+	return emit(res, func(w io.Writer) { fmt.Fprintf(w, "%s\t%s\n", res.IP, res.Mode) })
+}
+
+// clockTolerance is how much drift "clock fix" leaves alone.
+// Plugs only keep whole seconds, and the round trip takes some time.
+const clockTolerance = 3 * time.Second
+
+func cmdClock(args []string) error {
+	fix := false
+	if len(args) == 2 {
+		if args[1] != "fix" {
+			return fmt.Errorf("bad argument %q (want fix)", args[1])
+		}
+		fix = true
+	}
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	var drift time.Duration
+	if fix {
+		drift, err = tpplug.CorrectClock(ctx, addr, nil, clockTolerance)
+	} else {
+		drift, err = tpplug.ClockDrift(ctx, addr, nil)
+	}
+	if err != nil {
+		return err
+	}
+	corrected := fix && (drift > clockTolerance || drift < -clockTolerance)
+	var confirmed bool
+	if corrected {
+		confirmed, err = confirm("clock correction", func(ctx context.Context) (bool, error) {
+			d, err := tpplug.ClockDrift(ctx, addr, nil)
+			return d <= clockTolerance && d >= -clockTolerance, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	res := struct {
+		Drift     float64 `json:"drift_seconds"` // positive if the plug is ahead; before any correction
+		Corrected bool    `json:"corrected"`
+		Confirmed bool    `json:"confirmed"`
+	}{drift.Seconds(), corrected, confirmed}
+	return emit(res, func(w io.Writer) {
+		switch {
+		case drift > 0:
+			fmt.Fprintf(w, "Clock is %v ahead.\n", drift)
+		case drift < 0:
+			fmt.Fprintf(w, "Clock is %v behind.\n", -drift)
+		default:
+			fmt.Fprintln(w, "Clock is right.")
+		}
+		if res.Corrected {
+			fmt.Fprintln(w, "Corrected.")
+		}
+	})
+}
+
+func cmdLocation(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	if len(args) == 1 {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		if err != nil {
+			return err
+		}
+		lat, lon, ok := state.Coordinates()
+		res := struct {
+			IP        string   `json:"ip"`
+			Latitude  *float64 `json:"latitude"` // null if unset
+			Longitude *float64 `json:"longitude"`
+		}{IP: addr.IP.String()}
+		if ok {
+			res.Latitude, res.Longitude = &lat, &lon
+		}
+		return emit(res, func(w io.Writer) {
+			if !ok {
+				fmt.Fprintf(w, "%s\tno location\n", res.IP)
+				return
+			}
+			fmt.Fprintf(w, "%s\t%.4f, %.4f\n", res.IP, lat, lon)
+		})
+	}
+	if len(args) != 3 {
+		return fmt.Errorf("want both latitude and longitude")
+	}
+	lat, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("bad latitude %q", args[1])
+	}
+	lon, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return fmt.Errorf("bad longitude %q", args[2])
+	}
+	if err := tpplug.SetDevLocation(ctx, addr, lat, lon); err != nil {
+		return err
+	}
+	confirmed, err := confirm("location", func(ctx context.Context) (bool, error) {
+		state, err := tpplug.QuerySysinfoOnly(ctx, addr)
+		gotLat, gotLon, _ := state.Coordinates()
+		return math.Abs(gotLat-lat) < 1e-4 && math.Abs(gotLon-lon) < 1e-4, err
+	})
+	if err != nil {
+		return err
+	}
+	res := struct {
+		IP        string  `json:"ip"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Confirmed bool    `json:"confirmed"`
+	}{addr.IP.String(), lat, lon, confirmed}
+	return emit(res, func(w io.Writer) { fmt.Fprintf(w, "%s\t%.4f, %.4f\n", res.IP, lat, lon) })
+}
+
+func cmdReboot(args []string) error {
+	addr, err := resolve(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opCtx()
+	defer cancel()
+	if err := tpplug.Reboot(ctx, addr, 1*time.Second); err != nil {
+		return err
+	}
+	// A reboot is confirmed by the plug going away, then coming back.
+	gone := false
+	confirmed, err := confirm("reboot", func(ctx context.Context) (bool, error) {
+		if _, err := tpplug.QuerySysinfoOnly(ctx, addr); err != nil {
+			gone = true
+			return false, nil
+		}
+		return gone, nil
+	})
+	if err != nil {
+		return err
+	}
+	res := struct {
+		IP        string `json:"ip"`
+		Confirmed bool   `json:"confirmed"`
+	}{addr.IP.String(), confirmed}
+	return emit(res, func(w io.Writer) {
+		if confirmed {
+			fmt.Fprintf(w, "%s\trebooted\n", res.IP)
+		} else {
+			fmt.Fprintf(w, "%s\trebooting\n", res.IP)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+/*
+tpplugctl controls TP-Link smart plugs.
+
+	tpplugctl [flags] <command> [args]
+
+Commands:
+
+	list                          discover plugs on the network
+	status <target>               show a plug's state
+	on|off|toggle <target>        switch a plug's relay
+	energy <target>               show realtime energy meter readings
+	daystat <target> [YYYY-MM]    show daily energy use for a month
+	monthstat <target> [YYYY]     show monthly energy use for a year
+	rename <target> <alias>       change a plug's alias
+	schedule <target>             list schedule rules
+	countdown <target> [<duration> on|off]
+	                              list the countdown rule, or set one
+	                              (a zero duration clears it)
+	mode <target> [none|schedule] show or set what a plug's own timers may do
+	clock <target> [fix]          show how far a plug's clock has drifted,
+	                              and with "fix", correct it if more than a few seconds
+	location <target> [<latitude> <longitude>]
+	                              show or set a plug's location, in degrees,
+	                              which it uses for sunrise and sunset rules
+	reboot <target>               reboot a plug
+	apply -f <file> [-n]          set the alias, LED and timezone of many plugs
+	                              from a CSV file keyed by MAC, or with -n,
+	                              show what would change
+
+A target is an IP address, a MAC address, an alias, or a name from the devices file.
+MACs and aliases are resolved by discovery.
+
+With -o json, every command writes a single JSON value to standard output.
+Commands that change a plug write an object with a "confirmed" field,
+which is true if -wait was given and the change was read back from the plug.
+With -wait, such commands poll the plug until the change is read back,
+failing if that doesn't happen in time.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	output       = flag.String("o", "table", "output `format`: table or json")
+	discoverTime = flag.Duration("t", 2*time.Second, "how long to wait for discovery")
+	timeout      = flag.Duration("timeout", 3*time.Second, "how long to wait for a plug to respond")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names and rooms (default $"+tpplug.DevicesEnv+")")
+	wait         = flag.Duration("wait", 0, "after changing a plug, wait up to this `long` for the change to be read back")
+	transportStr = flag.String("transport", "auto", "how to talk to plugs: auto (UDP, falling back to TCP or KLAP), udp, tcp or klap")
+)
+
+var transport tpplug.Transport
+
+var devices *tpplug.Devices
+
+type command struct {
+	args string // usage of arguments
+	min  int    // minimum number of arguments
+	max  int    // maximum number of arguments
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"list":      {"", 0, 0, cmdList},
+	"status":    {"<target>", 1, 1, cmdStatus},
+	"on":        {"<target>", 1, 1, func(args []string) error { return cmdSwitch(args, "on") }},
+	"off":       {"<target>", 1, 1, func(args []string) error { return cmdSwitch(args, "off") }},
+	"toggle":    {"<target>", 1, 1, func(args []string) error { return cmdSwitch(args, "toggle") }},
+	"energy":    {"<target>", 1, 1, cmdEnergy},
+	"daystat":   {"<target> [YYYY-MM]", 1, 2, cmdDaystat},
+	"monthstat": {"<target> [YYYY]", 1, 2, cmdMonthstat},
+	"rename":    {"<target> <alias>", 2, 2, cmdRename},
+	"schedule":  {"<target>", 1, 1, cmdSchedule},
+	"countdown": {"<target> [<duration> on|off]", 1, 3, cmdCountdown},
+	"mode":      {"<target> [none|schedule]", 1, 2, cmdMode},
+	"clock":     {"<target> [fix]", 1, 2, cmdClock},
+	"location":  {"<target> [<latitude> <longitude>]", 1, 3, cmdLocation},
+	"reboot":    {"<target>", 1, 1, cmdReboot},
+	"apply":     {"-f <file> [-n]", 2, 3, cmdApply},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("tpplugctl: ")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: tpplugctl [flags] <command> [args]\n\nCommands:\n")
+		for _, name := range []string{"list", "status", "on", "off", "toggle", "energy", "daystat", "monthstat", "rename", "schedule", "countdown", "mode", "clock", "location", "reboot", "apply"} {
+			fmt.Fprintf(out, "\t%s\n", strings.TrimSpace(name+" "+commands[name].args))
+		}
+		fmt.Fprintf(out, "\nA target is an IP address, a MAC address, an alias, or a name from the devices file.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch *output {
+	case "table", "json":
+	default:
+		log.Fatalf("unknown output format %q", *output)
+	}
+	var err error
+	if transport, err = tpplug.ParseTransport(*transportStr); err != nil {
+		log.Fatal(err)
+	}
+	if devices, err = tpplug.LoadDevices(*devicesFile); err != nil {
+		log.Fatalf("loading devices: %v", err)
+	}
+
+	name, args := flag.Arg(0), flag.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		log.Printf("unknown command %q", name)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(args) < cmd.min || len(args) > cmd.max {
+		log.Fatalf("usage: tpplugctl %s %s", name, cmd.args)
+	}
+	if err := cmd.run(args); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+func opCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(tpplug.WithTransport(context.Background(), transport), *timeout)
+}
+
+// resolve finds the address of a target, which is an IP address, MAC address, alias or canonical name.
+func resolve(target string) (*net.UDPAddr, error) {
+	if addr, err := tpplug.ParseAddr(target, tpplug.DefaultPort); err == nil {
+		return addr, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *discoverTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("discovering plugs: %w", err)
+	}
+	var match []tpplug.DiscoveryResponse
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		if info.MAC == tpplug.CanonicalMAC(target) || info.Alias == target || devices.Name(dr.State) == target {
+			match = append(match, dr)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return nil, fmt.Errorf("no plug found matching %q", target)
+	case 1:
+		return match[0].Addr, nil
+	}
+	return nil, fmt.Errorf("%d plugs match %q", len(match), target)
+}
+
+// emit writes v as JSON, or calls table to write it for humans.
+func emit(v interface{}, table func(w io.Writer)) error {
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+// confirmPoll is how often -wait reads a plug back.
+const confirmPoll = 500 * time.Millisecond
+
+// confirm calls check until it reports that the plug is as wanted, if -wait is set,
+// and reports whether it was.
+// what describes the change, for the error if it doesn't happen within the wait.
+func confirm(what string, check func(ctx context.Context) (bool, error)) (bool, error) {
+	if *wait <= 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(tpplug.WithTransport(context.Background(), transport), *wait)
+	defer cancel()
+	var lastErr error
+	for {
+		qctx, qcancel := context.WithTimeout(ctx, *timeout)
+		ok, err := check(qctx)
+		qcancel()
+		if err == nil && ok {
+			return true, nil
+		}
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return false, fmt.Errorf("%s not confirmed within %v: %w", what, *wait, lastErr)
+			}
+			return false, fmt.Errorf("%s not confirmed within %v", what, *wait)
+		case <-time.After(confirmPoll):
+		}
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
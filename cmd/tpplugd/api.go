@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// plugJSON is the API representation of a plug.
+type plugJSON struct {
+	MAC   tpplug.MAC `json:"mac"`
+	Addr  string     `json:"addr"`
+	Alias string     `json:"alias"`
+	Name  string     `json:"name"` // canonical name; see -devices
+	Room  string     `json:"room,omitempty"`
+	Model string     `json:"model"`
+	On    bool       `json:"on"`
+	Power float64    `json:"power_w"`
+	Seen  time.Time  `json:"seen"`
+	Err   string     `json:"error,omitempty"`
+}
+
+func (p plug) toJSON(ds *tpplug.Devices) plugJSON {
+	info := p.State.System.Info
+	dev, _ := ds.Lookup(info.MAC)
+	return plugJSON{
+		MAC:   info.MAC,
+		Addr:  p.Addr.String(),
+		Alias: info.Alias,
+		Name:  ds.Name(p.State),
+		Room:  dev.Room,
+		Model: info.Model,
+		On:    info.RelayState == 1,
+		Power: float64(p.State.EnergyMeter.Realtime.Power) / 1000,
+		Seen:  p.Seen,
+		Err:   p.Err,
+	}
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	need := scopeRead
+	if r.Method != "GET" && r.Method != "HEAD" {
+		need = scopeControl
+	}
+	if !d.authorize(w, r, need) {
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "api/events" {
+		d.serveEvents(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] != "api" || parts[1] != "plugs" {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch len(parts) {
+	case 2:
+		d.serveList(w, r)
+		return
+	case 3:
+		d.serveGet(w, r, parts[2])
+		return
+	case 4:
+		switch parts[3] {
+		case "relay":
+			d.serveRelay(w, r, parts[2])
+			return
+		case "energy":
+			d.serveEnergy(w, r, parts[2])
+			return
+		}
+	}
+	httpError(w, http.StatusNotFound, "not found")
+}
+
+func (d *daemon) serveList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	list := []plugJSON{}
+	d.mu.Lock()
+	for _, p := range d.plugs {
+		list = append(list, p.toJSON(d.devices))
+	}
+	d.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, list)
+}
+
+func (d *daemon) serveGet(w http.ResponseWriter, r *http.Request, mac string) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	p, ok := d.lookup(mac)
+	if !ok {
+		httpError(w, http.StatusNotFound, errNotFound.Error())
+		return
+	}
+	writeJSON(w, p.toJSON(d.devices))
+}
+
+func (d *daemon) serveRelay(w http.ResponseWriter, r *http.Request, mac string) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		httpError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var req struct {
+		On *bool `json:"on"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || req.On == nil {
+		httpError(w, http.StatusBadRequest, `body must be {"on": true|false}`)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := d.setRelay(ctx, mac, *req.On); errors.Is(err, errNotFound) {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Setting relay of %s: %v", mac, err)
+		httpError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	p, _ := d.lookup(mac)
+	writeJSON(w, p.toJSON(d.devices))
+}
+
+func (d *daemon) serveEnergy(w http.ResponseWriter, r *http.Request, mac string) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	since := *history
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		since, err = time.ParseDuration(s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "bad since: "+err.Error())
+			return
+		}
+	}
+	p, ok := d.lookup(mac)
+	if !ok {
+		httpError(w, http.StatusNotFound, errNotFound.Error())
+		return
+	}
+	cutoff := time.Now().Add(-since)
+	samples := []sample{}
+	var wh float64
+	for i, s := range p.Samples {
+		if s.Time.Before(cutoff) {
+			continue
+		}
+		samples = append(samples, s)
+		if i > 0 && !p.Samples[i-1].Time.Before(cutoff) {
+			prev := p.Samples[i-1]
+			wh += prev.Power * s.Time.Sub(prev.Time).Hours()
+		}
+	}
+	writeJSON(w, struct {
+		MAC     tpplug.MAC `json:"mac"`
+		Energy  float64    `json:"energy_wh"` // integrated over the samples
+		Samples []sample   `json:"samples"`
+	}{p.State.System.Info.MAC, wh, samples})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Writing JSON response: %v", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The -token_file has one token per line, optionally followed by its scope
+// and a name to log it by:
+//
+//	# token                           scope    name
+//	3f9c2d7e1b8a4f6c0e5d9b2a7c4f1e8d  read     dashboard
+//	8b1e4c7f2a9d6e3c0f5b8a1d4e7c2f9b  control  automation
+//
+// A read token can only GET; a control token can also switch relays;
+// an admin token, which is the default, can do anything.
+// Requests that change something or are refused are logged with the token's name.
+
+// scope is what a token allows. Each allows all that those before it do.
+type scope int
+
+const (
+	scopeRead scope = iota
+	scopeControl
+	scopeAdmin
+)
+
+var scopeNames = []string{"read", "control", "admin"}
+
+func (s scope) String() string { return scopeNames[s] }
+
+func parseScope(s string) (scope, error) {
+	for i, name := range scopeNames {
+		if s == name {
+			return scope(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q (want read, control or admin)", s)
+}
+
+type token struct {
+	name  string
+	scope scope
+}
+
+// loadTokens reads a token file.
+func loadTokens(path string) (map[string]token, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]token)
+	for i, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: too many fields", path, i+1)
+		}
+		t := token{name: fmt.Sprintf("line %d", i+1), scope: scopeAdmin}
+		if len(fields) > 1 {
+			if t.scope, err = parseScope(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+			}
+		}
+		if len(fields) > 2 {
+			t.name = fields[2]
+		}
+		if _, dup := tokens[fields[0]]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, i+1)
+		}
+		tokens[fields[0]] = t
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s has no tokens", path)
+	}
+	return tokens, nil
+}
+
+// authorize checks that a request's token allows the given scope,
+// and writes an error response if it doesn't.
+func (d *daemon) authorize(w http.ResponseWriter, r *http.Request, need scope) bool {
+	if len(d.tokens) == 0 {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var (
+		t     token
+		found bool
+	)
+	for tok, tt := range d.tokens {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(got)) == 1 {
+			t, found = tt, true
+		}
+	}
+	switch {
+	case !found:
+		log.Printf("Refused %s %s from %s: missing or bad token", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, http.StatusUnauthorized, "missing or bad token")
+		return false
+	case t.scope < need:
+		log.Printf("Refused %s %s from %s: token %q is %s, not %s", r.Method, r.URL.Path, r.RemoteAddr, t.name, t.scope, need)
+		httpError(w, http.StatusForbidden, fmt.Sprintf("token does not allow %s", need))
+		return false
+	}
+	if need > scopeRead {
+		log.Printf("%s %s from %s with token %q", r.Method, r.URL.Path, r.RemoteAddr, t.name)
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// event is a change noticed by discovery or polling,
+// streamed to clients of /api/events as server-sent events.
+type event struct {
+	Kind      string     `json:"kind"` // "relay", "power", "reachable", "unreachable", "forgotten"
+	Time      time.Time  `json:"time"`
+	MAC       tpplug.MAC `json:"mac"`
+	Name      string     `json:"name"`
+	On        *bool      `json:"on,omitempty"`          // for "relay"
+	Power     *float64   `json:"power_w,omitempty"`     // for "power"
+	Above     *bool      `json:"above,omitempty"`       // for "power": whether it rose past Threshold
+	Threshold float64    `json:"threshold_w,omitempty"` // for "power"
+	Err       string     `json:"error,omitempty"`       // for "unreachable"
+}
+
+// broker fans out events to subscribers.
+// Slow subscribers miss events rather than holding up polling.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan event]bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan event]bool)}
+}
+
+func (b *broker) publish(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (b *broker) subscribe() chan event {
+	ch := make(chan event, 100)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// parseThresholds parses the -power_thresholds flag.
+func parseThresholds(s string) ([]float64, error) {
+	var ts []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		t, err := strconv.ParseFloat(f, 64)
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("bad power threshold %q", f)
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// noteChanges publishes events for how a plug has changed after a successful query.
+func (d *daemon) noteChanges(old, cur plugJSON) {
+	ev := event{Time: cur.Seen, MAC: cur.MAC, Name: cur.Name}
+	if old.Err != "" {
+		rev := ev
+		rev.Kind = "reachable"
+		d.events.publish(rev)
+	}
+	if old.On != cur.On {
+		rev := ev
+		rev.Kind, rev.On = "relay", &cur.On
+		d.events.publish(rev)
+	}
+	for _, t := range d.thresholds {
+		if was, is := old.Power > t, cur.Power > t; was != is {
+			rev := ev
+			rev.Kind, rev.Power, rev.Above, rev.Threshold = "power", &cur.Power, &is, t
+			d.events.publish(rev)
+		}
+	}
+}
+
+func (d *daemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	var mac tpplug.MAC // only this plug, if set
+	if m := r.FormValue("mac"); m != "" {
+		mac = tpplug.CanonicalMAC(m)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := d.events.subscribe()
+	defer d.events.unsubscribe(ch)
+
+	// Periodic comments keep intermediate proxies from timing out the connection.
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-ch:
+			if mac != "" && ev.MAC != mac {
+				continue
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				// Shouldn't happen.
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,251 @@
+/*
+tpplugd is a daemon that discovers and polls TP-Link smart plugs,
+and exposes their state over a REST API so that multiple clients
+can share one discovery and polling loop.
+
+API:
+
+	GET  /api/plugs                     list all known plugs
+	GET  /api/plugs/<mac>               get one plug
+	POST /api/plugs/<mac>/relay         set the relay; body is {"on": true}
+	GET  /api/plugs/<mac>/energy?since=1h
+	                                    recent power samples
+	GET  /api/events[?mac=<mac>]        stream of changes, as server-sent events
+
+Events are sent when polling or discovery notices a plug's relay change,
+its power cross one of -power_thresholds, or it stop or resume responding
+(or be forgotten). Each is a JSON object in the data field, of the form
+
+	{"kind":"relay","time":"...","mac":"50:C7:BF:00:00:01","name":"Kettle","on":true}
+
+MACs may be given with or without separators.
+If -token_file is set, requests must carry "Authorization: Bearer <token>"
+with a token from that file (one per line). A token may be followed by its
+scope and a name: read tokens can only GET, and control tokens can also set
+relays. Tokens without a scope are admin tokens, which can do anything.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	httpAddr     = flag.String("http", ":8080", "`address` to serve the API on")
+	scanInterval = flag.Duration("scan_interval", 1*time.Minute, "how often to discover plugs")
+	scanTime     = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	pollInterval = flag.Duration("poll_interval", 10*time.Second, "how often to query known plugs")
+	forget       = flag.Duration("forget", 10*time.Minute, "how long to keep a plug that stopped responding")
+	history      = flag.Duration("history", 24*time.Hour, "how long to keep power samples")
+	tokenFile    = flag.String("token_file", "", "if set, require a bearer token from this `file`")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names and rooms (default $"+tpplug.DevicesEnv+")")
+	thresholds   = flag.String("power_thresholds", "", "comma-separated `watts`; crossing any of these sends a power event")
+)
+
+func main() {
+	flag.Parse()
+
+	d := newDaemon()
+	var err error
+	if d.devices, err = tpplug.LoadDevices(*devicesFile); err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+	if d.thresholds, err = parseThresholds(*thresholds); err != nil {
+		log.Fatal(err)
+	}
+	if *tokenFile != "" {
+		if d.tokens, err = loadTokens(*tokenFile); err != nil {
+			log.Fatalf("Loading tokens: %v", err)
+		}
+	}
+
+	go d.discoverLoop()
+	go d.pollLoop()
+
+	log.Printf("Serving API on %s", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, d))
+}
+
+// sample is a power reading at a point in time.
+type sample struct {
+	Time  time.Time `json:"time"`
+	Power float64   `json:"power_w"`
+}
+
+// plug is a plug known to the daemon.
+type plug struct {
+	Addr    *net.UDPAddr
+	State   tpplug.State
+	Seen    time.Time // last successful response
+	Err     string    // from the last failed query, cleared on success
+	Samples []sample  // oldest first
+}
+
+type daemon struct {
+	tokens     map[string]token // static after startup; empty if no token is needed
+	devices    *tpplug.Devices  // static after startup
+	thresholds []float64        // static after startup
+	events     *broker
+
+	mu    sync.Mutex
+	plugs map[tpplug.MAC]*plug
+}
+
+func newDaemon() *daemon {
+	return &daemon{
+		events: newBroker(),
+		plugs:  make(map[tpplug.MAC]*plug),
+	}
+}
+
+func (d *daemon) discoverLoop() {
+	for {
+		if err := d.discover(); err != nil {
+			log.Printf("Discovering: %v", err)
+		}
+		time.Sleep(*scanInterval)
+	}
+}
+
+func (d *daemon) discover() error {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dr := range drs {
+		d.update(dr.Addr, dr.State, now)
+	}
+	return nil
+}
+
+func (d *daemon) pollLoop() {
+	for range time.Tick(*pollInterval) {
+		d.poll()
+	}
+}
+
+// poll queries every known plug concurrently.
+func (d *daemon) poll() {
+	type target struct {
+		mac  tpplug.MAC
+		addr *net.UDPAddr
+	}
+	var ts []target
+	d.mu.Lock()
+	for mac, p := range d.plugs {
+		ts = append(ts, target{mac, p.Addr})
+	}
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range ts {
+		t := t
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			state, err := tpplug.Query(ctx, t.addr)
+			now := time.Now()
+
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if err == nil {
+				d.update(t.addr, state, now)
+				return
+			}
+			p, ok := d.plugs[t.mac]
+			if !ok {
+				return
+			}
+			ev := event{Time: now, MAC: p.State.System.Info.MAC, Name: d.devices.Name(p.State)}
+			if p.Err == "" {
+				ev.Kind, ev.Err = "unreachable", err.Error()
+				d.events.publish(ev)
+			}
+			p.Err = err.Error()
+			if now.Sub(p.Seen) > *forget {
+				log.Printf("Forgetting plug %s (%q) at %v; last seen %v", t.mac, p.State.System.Info.Alias, p.Addr, p.Seen)
+				delete(d.plugs, t.mac)
+				ev.Kind, ev.Err = "forgotten", ""
+				d.events.publish(ev)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// update records a plug's state. d.mu must be held.
+func (d *daemon) update(addr *net.UDPAddr, state tpplug.State, now time.Time) {
+	mac := state.System.Info.MAC
+	if mac == "" {
+		return
+	}
+	p, ok := d.plugs[mac]
+	if !ok {
+		log.Printf("Found plug %s (%q) at %v", mac, state.System.Info.Alias, addr)
+		p = &plug{Addr: addr}
+		d.plugs[mac] = p
+	}
+	old := p.toJSON(d.devices)
+	p.Addr, p.State, p.Seen, p.Err = addr, state, now, ""
+	if ok {
+		d.noteChanges(old, p.toJSON(d.devices))
+	}
+	p.Samples = append(p.Samples, sample{
+		Time:  now,
+		Power: float64(state.EnergyMeter.Realtime.Power) / 1000,
+	})
+	cut := 0
+	for cut < len(p.Samples) && now.Sub(p.Samples[cut].Time) > *history {
+		cut++
+	}
+	p.Samples = p.Samples[cut:]
+}
+
+func (d *daemon) lookup(mac string) (plug, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.plugs[tpplug.CanonicalMAC(mac)]
+	if !ok {
+		return plug{}, false
+	}
+	return *p, true
+}
+
+func (d *daemon) setRelay(ctx context.Context, mac string, on bool) error {
+	p, ok := d.lookup(mac)
+	if !ok {
+		return errNotFound
+	}
+	state := 0
+	if on {
+		state = 1
+	}
+	if err := tpplug.SetRelayState(ctx, p.Addr, state); err != nil {
+		return err
+	}
+	// Refresh so the change is visible immediately.
+	if st, err := tpplug.Query(ctx, p.Addr); err == nil {
+		d.mu.Lock()
+		d.update(p.Addr, st, time.Now())
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+var errNotFound = errors.New("no such plug")
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+type column struct {
+	title string
+	width int
+	right bool // right-aligned
+	value func(p plug) string
+	less  func(a, b plug) bool
+}
+
+func byString(f func(p plug) string) func(a, b plug) bool {
+	return func(a, b plug) bool { return f(a) < f(b) }
+}
+
+func byInt(f func(p plug) int) func(a, b plug) bool {
+	return func(a, b plug) bool { return f(a) < f(b) }
+}
+
+func name(p plug) string   { return devices.Name(p.State) }
+func room(p plug) string   { d, _ := devices.Lookup(p.MAC); return d.Room }
+func addr(p plug) string   { return p.Addr.IP.String() }
+func model(p plug) string  { return p.State.System.Info.Model }
+func relay(p plug) int     { return p.State.System.Info.RelayState }
+func power(p plug) int     { return p.State.EnergyMeter.Realtime.Power }
+func current(p plug) int   { return p.State.EnergyMeter.Realtime.Current }
+func rssi(p plug) int      { return p.State.System.Info.RSSI }
+func mac(p plug) string    { return p.MAC.String() }
+func updated(p plug) int64 { return p.Updated.UnixNano() }
+
+var columns = []column{
+	{"NAME", 20, false, name, byString(name)},
+	{"ROOM", 12, false, room, byString(room)},
+	{"MAC", 17, false, mac, byString(mac)},
+	{"IP", 15, false, addr, byString(addr)},
+	{"MODEL", 10, false, model, byString(model)},
+	{"RELAY", 6, false, func(p plug) string { return onOff(relay(p)) }, byInt(relay)},
+	{"POWER", 9, true, func(p plug) string { return fmt.Sprintf("%.1f W", float64(power(p))/1000) }, byInt(power)},
+	{"AMPS", 7, true, func(p plug) string { return fmt.Sprintf("%.2f A", float64(current(p))/1000) }, byInt(current)},
+	{"RSSI", 8, true, func(p plug) string {
+		if rssi(p) == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d dBm", rssi(p))
+	}, byInt(rssi)},
+	{"AGE", 6, true, func(p plug) string {
+		if p.Err != nil {
+			return "ERR"
+		}
+		return time.Since(p.Updated).Round(time.Second).String()
+	}, func(a, b plug) bool { return updated(a) > updated(b) }},
+}
+
+// rows returns the plugs in display order.
+func (u *ui) rows() []plug {
+	ps, _ := u.t.snapshot()
+	less := columns[u.sortCol].less
+	sort.Slice(ps, func(i, j int) bool {
+		a, b := ps[i], ps[j]
+		if u.reverse {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return ps[i].MAC < ps[j].MAC
+	})
+	return ps
+}
+
+func (u *ui) draw() {
+	u.scr.Clear()
+	w, h := u.scr.Size()
+	rows := u.rows()
+	_, status := u.t.snapshot()
+
+	var total int
+	for _, p := range rows {
+		total += power(p)
+	}
+	bold := tcell.StyleDefault.Bold(true)
+	put(u.scr, 0, 0, w, bold, fmt.Sprintf("tpplugtop — %d plugs, %.1f W total", len(rows), float64(total)/1000))
+
+	x := 0
+	for i, c := range columns {
+		title := c.title
+		if i == u.sortCol {
+			if u.reverse {
+				title += "↑"
+			} else {
+				title += "↓"
+			}
+		}
+		put(u.scr, x, 2, w, bold.Reverse(true), cell(c, title))
+		x += c.width + 1
+	}
+
+	// Keep the selection valid.
+	found := false
+	for _, p := range rows {
+		found = found || p.MAC == u.selected
+	}
+	if !found && len(rows) > 0 {
+		u.selected = rows[0].MAC
+	}
+
+	for i, p := range rows {
+		y := 3 + i
+		if y >= h-2 {
+			break
+		}
+		st := tcell.StyleDefault
+		switch {
+		case p.Err != nil:
+			st = st.Foreground(tcell.ColorRed)
+		case relay(p) == 1:
+			st = st.Foreground(tcell.ColorGreen)
+		}
+		if p.MAC == u.selected {
+			st = st.Reverse(true)
+		}
+		var b strings.Builder
+		for _, c := range columns {
+			b.WriteString(cell(c, c.value(p)))
+			b.WriteByte(' ')
+		}
+		put(u.scr, 0, y, w, st, b.String())
+	}
+
+	put(u.scr, 0, h-2, w, tcell.StyleDefault.Dim(true), "↑↓ select  space toggle  1-0 sort  d discover  q quit")
+	put(u.scr, 0, h-1, w, tcell.StyleDefault, status)
+	u.scr.Show()
+}
+
+// cell pads or truncates s to fit the column.
+func cell(c column, s string) string {
+	r := []rune(s)
+	if len(r) > c.width {
+		return string(r[:c.width-1]) + "…"
+	}
+	pad := strings.Repeat(" ", c.width-len(r))
+	if c.right {
+		return pad + s
+	}
+	return s + pad
+}
+
+// put writes s at (x, y), clipped to width w.
+func put(scr tcell.Screen, x, y, w int, st tcell.Style, s string) {
+	for _, r := range s {
+		if x >= w {
+			return
+		}
+		scr.SetContent(x, y, r, nil, st)
+		x++
+	}
+}
@@ -0,0 +1,22 @@
+module github.com/dsymonds/tpplug/cmd/tpplugtop
+
+go 1.21
+
+require (
+	github.com/dsymonds/tpplug v0.0.0-20241225080319-a9d1b2995096
+	github.com/gdamore/tcell/v2 v2.7.4
+)
+
+require (
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/term v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+// RSSI was added to tpplug.State after the version above.
+replace github.com/dsymonds/tpplug => ../..
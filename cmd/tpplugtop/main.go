@@ -0,0 +1,153 @@
+/*
+tpplugtop is a live terminal dashboard of TP-Link smart plugs.
+
+It shows every discovered plug with its relay state, power draw and
+Wi-Fi signal strength, refreshed continuously.
+
+Keys:
+
+	up/down, j/k    select a plug
+	space, t        toggle the selected plug's relay
+	1-9, 0          sort by the nth column (again to reverse)
+	d               rediscover plugs now
+	q, Esc          quit
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+var (
+	scanInterval = flag.Duration("scan_interval", 30*time.Second, "how often to discover plugs")
+	scanTime     = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	pollInterval = flag.Duration("poll_interval", 2*time.Second, "how often to query known plugs")
+	devicesFile  = flag.String("devices", "", "devices `file` giving canonical names and rooms (default $"+tpplug.DevicesEnv+")")
+)
+
+var devices *tpplug.Devices
+
+func main() {
+	flag.Parse()
+	var err error
+	if devices, err = tpplug.LoadDevices(*devicesFile); err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+
+	scr, err := tcell.NewScreen()
+	if err != nil {
+		log.Fatalf("Creating screen: %v", err)
+	}
+	if err := scr.Init(); err != nil {
+		log.Fatalf("Initialising screen: %v", err)
+	}
+	// Library logging would scribble over the display.
+	log.SetOutput(discard{})
+
+	t := newTracker(func() { scr.PostEvent(tcell.NewEventInterrupt(nil)) })
+	go t.run()
+
+	ui := &ui{scr: scr, t: t}
+	err = ui.loop()
+	scr.Fini()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tpplugtop: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+type ui struct {
+	scr tcell.Screen
+	t   *tracker
+
+	sortCol  int
+	reverse  bool
+	selected tpplug.MAC // of the selected plug
+}
+
+func (u *ui) loop() error {
+	for {
+		u.draw()
+		switch ev := u.scr.PollEvent().(type) {
+		case nil:
+			return nil
+		case *tcell.EventResize:
+			u.scr.Sync()
+		case *tcell.EventKey:
+			if quit := u.key(ev); quit {
+				return nil
+			}
+		}
+	}
+}
+
+// key handles a key press, reporting whether to quit.
+func (u *ui) key(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return true
+	case tcell.KeyUp:
+		u.move(-1)
+	case tcell.KeyDown:
+		u.move(1)
+	case tcell.KeyRune:
+		switch r := ev.Rune(); {
+		case r == 'q':
+			return true
+		case r == 'k':
+			u.move(-1)
+		case r == 'j':
+			u.move(1)
+		case r == ' ' || r == 't':
+			if u.selected != "" {
+				go u.t.toggle(u.selected)
+			}
+		case r == 'd':
+			go u.t.discover()
+		case r >= '0' && r <= '9':
+			col := (int(r-'0') + 9) % 10 // '1' is the first column, '0' the tenth
+			if col >= len(columns) {
+				break
+			}
+			if col == u.sortCol {
+				u.reverse = !u.reverse
+			} else {
+				u.sortCol, u.reverse = col, false
+			}
+		}
+	}
+	return false
+}
+
+// move shifts the selection by delta rows.
+func (u *ui) move(delta int) {
+	rows := u.rows()
+	if len(rows) == 0 {
+		return
+	}
+	i := 0
+	for j, p := range rows {
+		if p.MAC == u.selected {
+			i = j + delta
+			break
+		}
+	}
+	if i < 0 {
+		i = 0
+	} else if i >= len(rows) {
+		i = len(rows) - 1
+	}
+	u.selected = rows[i].MAC
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// plug is a snapshot of what is known about a plug.
+type plug struct {
+	MAC     tpplug.MAC
+	Addr    *net.UDPAddr
+	State   tpplug.State
+	Updated time.Time
+	Err     error // from the most recent query
+}
+
+// tracker keeps track of plugs on the network.
+type tracker struct {
+	changed func() // called whenever something changes
+
+	mu     sync.Mutex
+	plugs  map[tpplug.MAC]*plug
+	status string // for the status line
+}
+
+func newTracker(changed func()) *tracker {
+	return &tracker{
+		changed: changed,
+		plugs:   make(map[tpplug.MAC]*plug),
+	}
+}
+
+func (t *tracker) run() {
+	t.discover()
+	scan := time.NewTicker(*scanInterval)
+	poll := time.NewTicker(*pollInterval)
+	for {
+		select {
+		case <-scan.C:
+			t.discover()
+		case <-poll.C:
+			t.poll()
+		}
+	}
+}
+
+// snapshot returns a copy of all the plugs.
+func (t *tracker) snapshot() (ps []plug, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.plugs {
+		ps = append(ps, *p)
+	}
+	return ps, t.status
+}
+
+func (t *tracker) setStatus(format string, args ...interface{}) {
+	t.mu.Lock()
+	t.status = time.Now().Format("15:04:05 ") + fmt.Sprintf(format, args...)
+	t.mu.Unlock()
+	t.changed()
+}
+
+func (t *tracker) update(mac tpplug.MAC, addr *net.UDPAddr, state tpplug.State, err error) {
+	t.mu.Lock()
+	p, ok := t.plugs[mac]
+	if !ok {
+		p = &plug{MAC: mac}
+		t.plugs[mac] = p
+	}
+	p.Addr, p.Err = addr, err
+	if err == nil {
+		p.State, p.Updated = state, time.Now()
+	}
+	t.mu.Unlock()
+	t.changed()
+}
+
+func (t *tracker) discover() {
+	t.setStatus("Discovering...")
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		t.setStatus("Discovering: %v", err)
+		return
+	}
+	for _, dr := range drs {
+		if mac := dr.State.System.Info.MAC; mac != "" {
+			t.update(mac, dr.Addr, dr.State, nil)
+		}
+	}
+	t.setStatus("Discovered %d plugs", len(drs))
+}
+
+func (t *tracker) poll() {
+	ps, _ := t.snapshot()
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *pollInterval)
+			defer cancel()
+			state, err := tpplug.Query(ctx, p.Addr)
+			t.update(p.MAC, p.Addr, state, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (t *tracker) toggle(mac tpplug.MAC) {
+	t.mu.Lock()
+	p, ok := t.plugs[mac]
+	var cp plug
+	if ok {
+		cp = *p
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	info := cp.State.System.Info
+	newState := 1 - info.RelayState
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := tpplug.SetRelayState(ctx, cp.Addr, newState); err != nil {
+		t.setStatus("Switching %q: %v", devices.Name(cp.State), err)
+		return
+	}
+	t.setStatus("Switched %q %s", devices.Name(cp.State), onOff(newState))
+	state, err := tpplug.Query(ctx, cp.Addr)
+	t.update(mac, cp.Addr, state, err)
+}
+
+func onOff(state int) string {
+	if state == 1 {
+		return "on"
+	}
+	return "off"
+}
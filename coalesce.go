@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Each scrape scans for plugs, so two Prometheus servers (or remote write)
+// scraping at once would each broadcast, and each query every plug.
+// Instead, a scrape that arrives while a scan is under way waits for it,
+// and gets the same metrics, so only one scan runs at a time.
+//
+// With -scan_interval, scans happen in the background instead (or as
+// -scan_schedule says), and scrapes get the metrics of the latest scan
+// straight away, along with scan_age_seconds to show how stale they are.
+// The min, max and average power (see poll.go) are then since the previous scan.
+
+var (
+	coalescedDesc = prometheus.NewDesc("coalesced_scrapes_total",
+		"Count of scrapes that shared the results of a scan already under way",
+		nil, nil)
+	scanAgeDesc = prometheus.NewDesc("scan_age_seconds",
+		"How long ago the scan whose metrics these are finished, with -scan_interval",
+		nil, nil)
+)
+
+// scan is a scan under way, or done.
+type scan struct {
+	done    chan struct{} // closed once metrics is complete
+	metrics []prometheus.Metric
+	at      time.Time // when it finished
+}
+
+func (dc *dataCollector) Collect(ch chan<- prometheus.Metric) {
+	var s *scan
+	if *scanInterval > 0 {
+		dc.mu.Lock()
+		s = dc.lastScan
+		dc.mu.Unlock()
+		if s == nil {
+			s = dc.runScan() // the first background scan is yet to finish
+		}
+	} else {
+		s = dc.runScan()
+	}
+
+	for _, m := range s.metrics {
+		ch <- m
+	}
+	dc.mu.Lock()
+	n := dc.coalesced
+	dc.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(coalescedDesc, prometheus.CounterValue, float64(n))
+	if *scanInterval > 0 {
+		ch <- prometheus.MustNewConstMetric(scanAgeDesc, prometheus.GaugeValue, time.Since(s.at).Seconds())
+	}
+}
+
+// runScan runs a scan, or waits for the one under way, and returns it.
+func (dc *dataCollector) runScan() *scan {
+	dc.mu.Lock()
+	if s := dc.scanning; s != nil {
+		dc.coalesced++
+		dc.mu.Unlock()
+		<-s.done
+		return s
+	}
+	s := &scan{done: make(chan struct{})}
+	dc.scanning = s
+	dc.mu.Unlock()
+
+	buf := make(chan prometheus.Metric)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for m := range buf {
+			s.metrics = append(s.metrics, m)
+		}
+	}()
+	dc.scrape(buf)
+	close(buf)
+	<-collected
+	s.at = time.Now()
+
+	dc.mu.Lock()
+	dc.scanning = nil
+	dc.lastScan = s
+	dc.mu.Unlock()
+	close(s.done)
+	return s
+}
+
+// scanForever runs a scan every interval (or as -scan_schedule says), forever.
+func (dc *dataCollector) scanForever(interval time.Duration) {
+	for {
+		dc.runScan()
+		waitScan(interval)
+	}
+}
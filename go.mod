@@ -2,4 +2,8 @@ module github.com/dsymonds/tpplug
 
 go 1.16
 
-require github.com/prometheus/client_golang v1.11.1
+require (
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	gopkg.in/yaml.v2 v2.3.0
+)
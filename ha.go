@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Two exporters can run on the same LAN for redundancy. Each one given the
+// other with -peers fetches its seen plugs from /plugs on every scrape,
+// and queries any that its own discovery missed.
+// If one is also given -standby, it omits plug metrics while a peer is answering,
+// so that summing across exporters doesn't count plugs twice.
+// With -mac_labels, plug metrics are labelled by MAC alone, so the series from
+// both exporters match however their devices files and plug addresses differ,
+// and they can be scraped as one job and combined with max by (mac).
+
+var standbyDesc = prometheus.NewDesc("standby",
+	"Whether plug metrics are omitted because this exporter is a -standby and a peer is answering",
+	nil, nil)
+
+// peerTimeout is how long to wait for a peer's seen plugs.
+const peerTimeout = 1 * time.Second
+
+// plugLabels returns the label values (mac, ip, name, host) for a plug's metrics.
+// Prometheus treats empty labels as absent.
+func (dc *dataCollector) plugLabels(state tpplug.State, addr *net.UDPAddr) []string {
+	mac := string(state.System.Info.MAC)
+	if *macLabels {
+		return []string{mac, "", "", ""}
+	}
+	return []string{mac, addr.IP.String(), dc.devices.Name(state), dc.hosts.host(addr.IP)}
+}
+
+// fetchPeers gets the plugs seen by each of -peers. It reports whether any answered.
+func fetchPeers(ctx context.Context) (map[tpplug.MAC]macInfo, bool) {
+	if *peers == "" {
+		return nil, false
+	}
+	macs := make(map[tpplug.MAC]macInfo)
+	answered := false
+	for _, base := range strings.Split(*peers, ",") {
+		pm, err := fetchPeer(ctx, strings.TrimSuffix(base, "/"))
+		if err != nil {
+			log.Printf("Fetching plugs from peer %s: %v", base, err)
+			continue
+		}
+		answered = true
+		for mac, info := range pm {
+			if info.Addr == nil {
+				continue
+			}
+			if cur, ok := macs[mac]; !ok || info.Seen.After(cur.Seen) {
+				macs[mac] = info
+			}
+		}
+	}
+	return macs, answered
+}
+
+func fetchPeer(ctx context.Context, base string) (map[tpplug.MAC]macInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/plugs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	var pm map[tpplug.MAC]macInfo
+	if err := json.NewDecoder(resp.Body).Decode(&pm); err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+	return pm, nil
+}
+
+// servePlugs serves the plugs seen by the most recent scrape as JSON, for peers.
+func (dc *dataCollector) servePlugs(w http.ResponseWriter, r *http.Request) {
+	dc.mu.Lock()
+	prev := dc.prev
+	dc.mu.Unlock()
+	if prev == nil {
+		prev = map[tpplug.MAC]macInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prev)
+}
+
+// discard returns a channel that drops whatever is sent on it, until closed.
+func discard() chan prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	return ch
+}
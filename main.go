@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"sort"
@@ -26,26 +28,138 @@ var (
 	scanTime = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
 	history  = flag.Duration("history", 10*time.Minute, "how long to keep trying to contact a plug that stopped responding")
 	ignore   = flag.String("ignore", "", "comma-separated list of MACs to ignore")
+	devices  = flag.String("devices", "", "devices `file` giving canonical names, rooms and tags (default $"+tpplug.DevicesEnv+")")
+
+	queryRetries    = flag.Int("query_retries", 2, "how many more times to send a query that gets no response, such as on busy Wi-Fi")
+	queryRetryDelay = flag.Duration("query_retry_delay", 50*time.Millisecond, "how long to wait before retrying a query, doubling for each retry after")
+
+	targets          = flag.String("targets", "", "comma-separated `addresses` (IP, optionally with port) of plugs to query directly on every scan")
+	noBroadcast      = flag.Bool("no_broadcast", false, "never broadcast to discover plugs; only query -targets and -plugs")
+	plugsFile        = flag.String("plugs", "", "if set, YAML `file` of known plugs to query directly when discovery doesn't find them")
+	networksFile     = flag.String("networks", "", "if set, YAML `file` of several networks to scan independently, instead of -targets and -no_broadcast")
+	scanInterval     = flag.Duration("scan_interval", 0, "if positive, scan for plugs in the background this often, and serve scrapes from the latest scan")
+	deepScanInterval = flag.Duration("deep_scan_interval", 0, "if positive, broadcast to discover plugs at most this often, and in between only query known plugs")
+
+	pollInterval = flag.Duration("poll_interval", 0, "if positive, how often to poll plugs between scrapes for min/max/avg power")
+	scanSchedule = flag.String("scan_schedule", "", "if set, semicolon-separated cron `specs` for when to do background scans, instead of their intervals")
+
+	fileSD     = flag.String("file_sd", "", "if set, `file` to keep updated with discovered plugs as Prometheus file_sd targets for /probe")
+	sdInterval = flag.Duration("sd_interval", time.Minute, "how often to rediscover plugs for -file_sd")
+
+	remoteWriteURL      = flag.String("remote_write", "", "if set, `URL` of a Prometheus remote write endpoint to push metrics to")
+	remoteWriteInterval = flag.Duration("remote_write_interval", time.Minute, "how often to scan and push metrics for -remote_write")
+
+	alertsFile = flag.String("alerts", "", "if set, YAML `file` of simple alerts to evaluate and serve on /alerts")
+	tariffFile = flag.String("tariff", "", "if set, YAML `file` of electricity prices, for the running cost of each plug")
+
+	peers     = flag.String("peers", "", "comma-separated base `URLs` of other exporters on the LAN to share seen plugs with")
+	standby   = flag.Bool("standby", false, "omit plug metrics while any of -peers is answering")
+	macLabels = flag.Bool("mac_labels", false, "label plug metrics by MAC alone, leaving out ip and name")
+
+	reverseDNS    = flag.Bool("reverse_dns", false, "label plug metrics with the host name found by a reverse DNS lookup of each plug's IP")
+	reverseDNSTTL = flag.Duration("reverse_dns_ttl", time.Hour, "how long to cache reverse DNS lookups for -reverse_dns")
 )
 
 func main() {
 	flag.Parse()
 
-	dc := newDataCollector()
+	ds, err := tpplug.LoadDevices(*devices)
+	if err != nil {
+		log.Fatalf("Loading devices: %v", err)
+	}
+	dc := newDataCollector(ds)
+	if *networksFile != "" {
+		if *targets != "" || *noBroadcast {
+			log.Fatal("-networks can't be used with -targets or -no_broadcast; put them in the networks file")
+		}
+		if dc.networks, err = loadNetworks(*networksFile); err != nil {
+			log.Fatalf("Loading networks: %v", err)
+		}
+	} else {
+		n := &network{Name: "default", NoBroadcast: *noBroadcast}
+		if n.targets, err = parseTargets(*targets); err != nil {
+			log.Fatalf("Parsing -targets: %v", err)
+		}
+		if n.NoBroadcast && len(n.targets) == 0 && *plugsFile == "" {
+			log.Fatal("-no_broadcast needs -targets or -plugs")
+		}
+		dc.networks = []*network{n}
+	}
+	if *plugsFile != "" {
+		if dc.static, err = loadStaticPlugs(*plugsFile); err != nil {
+			log.Fatalf("Loading plugs: %v", err)
+		}
+	}
+	if *tariffFile != "" {
+		if dc.tariff, err = loadTariff(*tariffFile); err != nil {
+			log.Fatalf("Loading tariff: %v", err)
+		}
+	}
+	if *scanSchedule != "" {
+		if scanSched, err = parseSchedule(*scanSchedule); err != nil {
+			log.Fatalf("Parsing -scan_schedule: %v", err)
+		}
+	}
 	prometheus.MustRegister(dc)
+	if *scanInterval > 0 {
+		go dc.scanForever(*scanInterval)
+	}
+	if *pollInterval > 0 {
+		go dc.poll(*pollInterval)
+	}
+
+	if *remoteWriteURL != "" {
+		go remoteWrite(*remoteWriteURL, *remoteWriteInterval, prometheus.DefaultGatherer)
+	}
+	if *fileSD != "" {
+		go dc.writeFileSD(*fileSD, *sdInterval)
+	}
+	if *alertsFile != "" {
+		rules, err := loadAlerts(*alertsFile)
+		if err != nil {
+			log.Fatalf("Loading alerts: %v", err)
+		}
+		al := newAlerter(dc, rules)
+		prometheus.MustRegister(al)
+		go al.run(alertInterval)
+		http.Handle("/alerts", al)
+	}
 
 	http.Handle("/", dc)
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/probe", dc.serveProbe)
+	http.HandleFunc("/sd", dc.serveSD)
+	http.HandleFunc("/plug/", dc.servePlug)
+	http.HandleFunc("/plugs", dc.servePlugs)
+	http.HandleFunc("/api/plugs", dc.serveAPIPlugs)
+	http.HandleFunc("/api/plugs/", dc.serveAPIPlugs)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
 
+// scanSched is the parsed -scan_schedule, or nil. It is static after main.
+var scanSched schedule
+
 // dataCollector implements prometheus.Collector.
 type dataCollector struct {
-	ignore map[string]bool // static after newDataCollector
-
-	mu   sync.Mutex
-	last time.Time
-	prev map[string]macInfo
+	ignore   map[tpplug.MAC]bool // static after newDataCollector
+	devices  *tpplug.Devices
+	networks []*network    // static after main; see networks.go
+	static   []*staticPlug // static after main; see static.go
+	tariff   *tariff       // static after main; see tariff.go
+	hosts    hostCache     // see rdns.go
+
+	mu           sync.Mutex
+	last         time.Time
+	lastDeep     time.Time      // last broadcast; see static.go
+	networkPlugs map[string]int // by network name, as of lastDeep; see networks.go
+	prev         map[tpplug.MAC]macInfo
+	standingBy   bool                        // see ha.go
+	stats        map[tpplug.MAC]*powerStats  // keyed by MAC; see poll.go
+	hist         map[tpplug.MAC]*plugHistory // keyed by MAC; see plugpage.go
+	costs        map[tpplug.MAC]float64      // keyed by MAC; see tariff.go
+	scanning     *scan                       // under way, if any; see coalesce.go
+	lastScan     *scan                       // the latest to finish, if any
+	coalesced    int
 }
 
 var (
@@ -54,19 +168,50 @@ var (
 		nil, nil)
 	powerDesc = prometheus.NewDesc("power_mw",
 		"Power (mW)",
-		[]string{"mac", "ip", "name"}, nil)
+		[]string{"mac", "ip", "name", "host"}, nil)
+	apparentPowerDesc = prometheus.NewDesc("apparent_power_mva",
+		"Apparent power (mVA), the product of voltage and current",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	powerFactorDesc = prometheus.NewDesc("power_factor",
+		"Ratio of real to apparent power; low for inductive loads like motors and compressors",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	relayStateDesc = prometheus.NewDesc("relay_state",
+		"Whether the relay is on",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	voltageDesc = prometheus.NewDesc("voltage_mv",
+		"Voltage (mV)",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	currentDesc = prometheus.NewDesc("current_ma",
+		"Current (mA)",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	energyTotalDesc = prometheus.NewDesc("energy_total_wh",
+		"Energy used since the plug's meter was last reset (Wh)",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	rssiDesc = prometheus.NewDesc("rssi_dbm",
+		"Wi-Fi signal strength (dBm)",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	onTimeDesc = prometheus.NewDesc("on_time_seconds",
+		"How long the relay has been on, or 0 if it is off (s)",
+		[]string{"mac", "ip", "name", "host"}, nil)
 	undiscoveredDesc = prometheus.NewDesc("undiscovered",
 		"Count of undiscovered plugs that nonetheless respond to queries",
 		nil, nil)
+	deviceInfoDesc = prometheus.NewDesc("device_info",
+		"Details of plugs from the devices file; always 1",
+		[]string{"mac", "name", "room", "tags"}, nil)
 )
 
-func newDataCollector() *dataCollector {
+func newDataCollector(ds *tpplug.Devices) *dataCollector {
 	dc := &dataCollector{
-		ignore: make(map[string]bool),
+		ignore:  make(map[tpplug.MAC]bool),
+		devices: ds,
+		stats:   make(map[tpplug.MAC]*powerStats),
+		hist:    make(map[tpplug.MAC]*plugHistory),
+		costs:   make(map[tpplug.MAC]float64),
 	}
 	if *ignore != "" {
 		for _, mac := range strings.Split(*ignore, ",") {
-			dc.ignore[mac] = true
+			dc.ignore[tpplug.CanonicalMAC(mac)] = true
 		}
 	}
 	return dc
@@ -75,10 +220,31 @@ func newDataCollector() *dataCollector {
 func (dc *dataCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- okDesc
 	ch <- powerDesc
+	ch <- powerMinDesc
+	ch <- powerMaxDesc
+	ch <- powerAvgDesc
+	ch <- apparentPowerDesc
+	ch <- powerFactorDesc
+	ch <- relayStateDesc
+	ch <- voltageDesc
+	ch <- currentDesc
+	ch <- energyTotalDesc
+	ch <- rssiDesc
+	ch <- onTimeDesc
+	ch <- outletPowerDesc
+	ch <- outletRelayDesc
 	ch <- undiscoveredDesc
+	ch <- networkPlugsDesc
+	ch <- deviceInfoDesc
+	ch <- standbyDesc
+	ch <- costDesc
+	ch <- tariffRateDesc
+	ch <- coalescedDesc
+	ch <- scanAgeDesc
 }
 
-func (dc *dataCollector) Collect(ch chan<- prometheus.Metric) {
+// scrape runs a scan, and sends its metrics. See Collect in coalesce.go.
+func (dc *dataCollector) scrape(ch chan<- prometheus.Metric) {
 	var ok float64
 	if err := dc.collect(ch); err != nil {
 		log.Printf("Collecting: %v", err)
@@ -89,6 +255,11 @@ func (dc *dataCollector) Collect(ch chan<- prometheus.Metric) {
 		okDesc, prometheus.GaugeValue, ok)
 }
 
+// withRetries makes queries of plugs with the returned context retry as -query_retries says.
+func withRetries(ctx context.Context) context.Context {
+	return tpplug.WithRetries(ctx, tpplug.RetryPolicy{Retries: *queryRetries, Delay: *queryRetryDelay})
+}
+
 // macInfo represents a previously seen plug.
 type macInfo struct {
 	Addr  *net.UDPAddr
@@ -97,39 +268,66 @@ type macInfo struct {
 }
 
 func (dc *dataCollector) collect(ch chan<- prometheus.Metric) error {
-	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	// Raw responses are kept for the fields State doesn't have; see sendReadings.
+	ctx, cancel := context.WithTimeout(withRetries(tpplug.KeepRaw(context.Background())), *scanTime)
 	defer cancel()
 
-	sendPower := func(state tpplug.State, addr *net.UDPAddr) {
-		info := state.System.Info
-		rt := state.EnergyMeter.Realtime
-		//log.Printf("(%s, %s) %q: %.1f W", info.MAC, addr, info.Alias, float64(rt.Power)/1000)
-
-		if dc.ignore[info.MAC] {
-			return
-		}
+	var (
+		peerMACs   map[tpplug.MAC]macInfo
+		peerActive bool
+		peersDone  = make(chan struct{})
+	)
+	go func() {
+		defer close(peersDone)
+		peerMACs, peerActive = fetchPeers(context.Background())
+	}()
+
+	drs, err := dc.discover(ctx)
+	<-peersDone
+	if err != nil {
+		return err
+	}
 
-		ch <- prometheus.MustNewConstMetric(
-			powerDesc, prometheus.GaugeValue,
-			float64(rt.Power),
-			info.MAC, addr.IP.String(), info.Alias)
+	// Plug metrics go to plugCh, which discards them while standing by.
+	standingBy := *standby && peerActive
+	plugCh := ch
+	if standingBy {
+		plugCh = discard()
+		defer close(plugCh)
 	}
+	sendPower := func(state tpplug.State, addr *net.UDPAddr) { dc.sendPower(plugCh, state, addr) }
 
-	drs, err := tpplug.Discover(ctx)
-	if err != nil {
-		return err
+	ips := make([]net.IP, len(drs))
+	for i, dr := range drs {
+		ips[i] = dr.Addr.IP
 	}
-	macs := make(map[string]macInfo)
+	dc.hosts.resolve(ips)
+
+	macs := make(map[tpplug.MAC]macInfo)
 	now := time.Now()
 	for _, dr := range drs {
 		macs[dr.State.System.Info.MAC] = macInfo{Addr: dr.Addr, Seen: now, State: dr.State}
+		dc.noteScan(dr.State.System.Info.MAC, "discovered", dr.Addr.String(), now)
 		sendPower(dr.State, dr.Addr)
 	}
+	dc.sendOutlets(plugCh, drs)
 
-	// Query MACs that we saw last time but didn't see this time.
+	// Query MACs that we (or a peer) saw last time but didn't see this time.
 	dc.mu.Lock()
 	prev := dc.prev
 	dc.mu.Unlock()
+	if len(peerMACs) > 0 {
+		merged := make(map[tpplug.MAC]macInfo)
+		for mac, info := range prev {
+			merged[mac] = info
+		}
+		for mac, info := range peerMACs {
+			if cur, ok := merged[mac]; !ok || info.Seen.After(cur.Seen) {
+				merged[mac] = info
+			}
+		}
+		prev = merged
+	}
 	var undiscovered int
 	for mac, info := range prev {
 		if _, ok := macs[mac]; ok {
@@ -140,65 +338,150 @@ func (dc *dataCollector) collect(ch chan<- prometheus.Metric) error {
 		}
 
 		// TODO: Controllable?
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		ctx, cancel := context.WithTimeout(withRetries(tpplug.KeepRaw(context.Background())), 1*time.Second)
 		state, err := tpplug.Query(ctx, info.Addr)
 		cancel()
 		if err == nil {
 			macs[mac] = macInfo{Addr: info.Addr, Seen: now, State: state}
 			sendPower(state, info.Addr)
 			undiscovered++
+			dc.noteScan(mac, "queried", info.Addr.String(), now)
 		} else {
 			// Keep remembering it for now; it'll age out eventually if it never responds.
 			macs[mac] = info
+			dc.noteScan(mac, "missed", info.Addr.String(), now)
 		}
 	}
 
 	ch <- prometheus.MustNewConstMetric(
 		undiscoveredDesc, prometheus.GaugeValue,
 		float64(undiscovered))
+	var sb float64
+	if standingBy {
+		sb = 1
+	}
+	ch <- prometheus.MustNewConstMetric(standbyDesc, prometheus.GaugeValue, sb)
+	dc.sendNetworkPlugs(ch)
+	dc.sendStats(plugCh, macs)
+	dc.sendCosts(plugCh, macs)
 
 	// Remember the set of responding plugs and the ones that aren't
 	// responding but did within the history interval.
 	dc.mu.Lock()
 	dc.last = now
 	dc.prev = macs
+	dc.standingBy = standingBy
 	dc.mu.Unlock()
 
 	return nil
 }
 
+// sendPower sends the metrics for a plug's state.
+func (dc *dataCollector) sendPower(ch chan<- prometheus.Metric, state tpplug.State, addr *net.UDPAddr) {
+	info := state.System.Info
+	rt := state.EnergyMeter.Realtime
+	//log.Printf("(%s, %s) %q: %.1f W", info.MAC, addr, info.Alias, float64(rt.Power)/1000)
+
+	if dc.ignore[info.MAC] {
+		return
+	}
+
+	labels := dc.plugLabels(state, addr)
+	ch <- prometheus.MustNewConstMetric(
+		powerDesc, prometheus.GaugeValue,
+		float64(rt.Power), labels...)
+	dc.record(info.MAC, float64(rt.Power))
+	dc.remember(info.MAC, float64(rt.Power))
+	if rt.Voltage > 0 && rt.Current > 0 {
+		// mV * mA = µVA.
+		va := float64(rt.Voltage) * float64(rt.Current) / 1000
+		ch <- prometheus.MustNewConstMetric(
+			apparentPowerDesc, prometheus.GaugeValue, va, labels...)
+		// The readings aren't taken at quite the same moment,
+		// so the ratio can come out a little over 1.
+		ch <- prometheus.MustNewConstMetric(
+			powerFactorDesc, prometheus.GaugeValue, math.Min(float64(rt.Power)/va, 1), labels...)
+	}
+	dc.sendReadings(ch, state, labels)
+	if d, ok := dc.devices.Lookup(info.MAC); ok {
+		ch <- prometheus.MustNewConstMetric(
+			deviceInfoDesc, prometheus.GaugeValue, 1,
+			info.MAC.String(), dc.devices.Name(state), d.Room, strings.Join(d.Tags, ","))
+	}
+}
+
+// sendReadings sends the metrics for a plug's relay, energy meter and Wi-Fi.
+// The on time and total energy are only in the raw response, so are missing
+// for plugs whose state came from a registry.
+func (dc *dataCollector) sendReadings(ch chan<- prometheus.Metric, state tpplug.State, labels []string) {
+	info := state.System.Info
+	rt := state.EnergyMeter.Realtime
+	ch <- prometheus.MustNewConstMetric(
+		relayStateDesc, prometheus.GaugeValue, float64(info.RelayState), labels...)
+	if info.RSSI != 0 {
+		ch <- prometheus.MustNewConstMetric(
+			rssiDesc, prometheus.GaugeValue, float64(info.RSSI), labels...)
+	}
+	var sys struct {
+		OnTime *float64 `json:"on_time"` // seconds
+	}
+	if raw := state.Raw("system", "get_sysinfo"); raw != nil && json.Unmarshal(raw, &sys) == nil && sys.OnTime != nil {
+		ch <- prometheus.MustNewConstMetric(
+			onTimeDesc, prometheus.GaugeValue, *sys.OnTime, labels...)
+	}
+	if !state.HasEnergyMeter() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		voltageDesc, prometheus.GaugeValue, float64(rt.Voltage), labels...)
+	ch <- prometheus.MustNewConstMetric(
+		currentDesc, prometheus.GaugeValue, float64(rt.Current), labels...)
+	var em struct {
+		TotalWh *float64 `json:"total_wh"`
+		Total   *float64 `json:"total"` // kWh, on older firmware
+	}
+	if raw := state.Raw("emeter", "get_realtime"); raw != nil && json.Unmarshal(raw, &em) == nil {
+		switch {
+		case em.TotalWh != nil:
+			ch <- prometheus.MustNewConstMetric(
+				energyTotalDesc, prometheus.CounterValue, *em.TotalWh, labels...)
+		case em.Total != nil:
+			ch <- prometheus.MustNewConstMetric(
+				energyTotalDesc, prometheus.CounterValue, *em.Total*1000, labels...)
+		}
+	}
+}
+
 func (dc *dataCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Last    time.Time
-		Plugs   map[string]macInfo
-		PlugSeq []string // MACs
-		Ignore  map[string]bool
+		Last       time.Time
+		StandingBy bool
+		Plugs      map[tpplug.MAC]macInfo
+		PlugSeq    []tpplug.MAC
+		Ignore     map[tpplug.MAC]bool
+		Devices    *tpplug.Devices
+		Control    bool
 	}
 
 	dc.mu.Lock()
 	data.Last = dc.last
+	data.StandingBy = dc.standingBy
 	data.Plugs = dc.prev
 	dc.mu.Unlock()
 
 	data.Ignore = dc.ignore
+	data.Devices = dc.devices
+	data.Control = *control
 
 	// Build list of plug MACs, ordered by IP.
 	for mac := range data.Plugs {
 		data.PlugSeq = append(data.PlugSeq, mac)
 	}
 	sort.Slice(data.PlugSeq, func(i, j int) bool {
-		// lazy sort by IPv4
-		ipi := data.Plugs[data.PlugSeq[i]].Addr.IP.To4()
-		ipj := data.Plugs[data.PlugSeq[j]].Addr.IP.To4()
-		if ipi == nil || ipj == nil {
-			return false
-		}
-		for n := 0; n < 4; n++ {
-			if ipi[n] != ipj[n] {
-				return ipi[n] < ipj[n]
-			}
-		}
-		return false
+		// IPv4 addresses sort together, as they are all v4-mapped in 16 bytes.
+		ipi := data.Plugs[data.PlugSeq[i]].Addr.IP.To16()
+		ipj := data.Plugs[data.PlugSeq[j]].Addr.IP.To16()
+		return bytes.Compare(ipi, ipj) < 0
 	})
 
 	var buf bytes.Buffer
@@ -223,21 +506,26 @@ var frontTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 <h1>tpplug</h1>
 
 Last scan: <b>{{if .Last.IsZero}}never{{else}}{{roughSince .Last}}{{end}}</b>
+{{if .StandingBy}}<p>Standing by: a peer is answering, so plug metrics are omitted.</p>{{end}}
 
 <table>
 <tr>
 	<th>MAC</th><th>IP:port</th><th>seen</th>
-	<th>model</th><th>name</th><th>last power</th>
+	<th>model</th><th>name</th><th>relay</th><th>last power</th>
 </tr>
 {{range .PlugSeq}}
 {{$p := index $.Plugs .}}
 <tr>
-	{{/* TODO: $p.State.System.Info.RelayState (0=off, 1=on) */}}
-	<td>{{$p.State.System.Info.MAC}}</td>
+	<td><a href="/plug/{{$p.State.System.Info.MAC}}">{{$p.State.System.Info.MAC}}</a></td>
 	<td>{{$p.Addr}}</td>
 	<td>{{roughSince $p.Seen}}</td>
 	<td>{{$p.State.System.Info.Model}}</td>
-	<td>{{$p.State.System.Info.Alias}}</td>
+	<td>{{$.Devices.Name $p.State}}</td>
+	<td>{{if eq $p.State.System.Info.RelayState 1}}on{{else}}off{{end}}
+	{{if $.Control}}<form method="post" action="/api/plugs/{{$p.State.System.Info.MAC}}/toggle" style="display: inline">
+		<input type="hidden" name="redirect" value="/">
+		<button type="submit">turn {{if eq $p.State.System.Info.RelayState 1}}off{{else}}on{{end}}</button>
+	</form>{{end}}</td>
 	<td>{{printf "%.1f" (mWtoW $p.State.EnergyMeter.Realtime.Power)}}W</td>
 	<td>{{if (index $.Ignore $p.State.System.Info.MAC)}}<b>ignored</b>{{end}}</td>
 </tr>
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/dsymonds/tpplug/tpplugtest"
+)
+
+func newTestCollector() *dataCollector {
+	dc := newDataCollector(&tpplug.Devices{})
+	dc.networks = []*network{{Name: "default"}}
+	return dc
+}
+
+// byName returns the values of the named metric, keyed by their name label.
+func byName(ss []tpplugtest.Sample, metric string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, s := range ss {
+		if s.Name == metric {
+			m[s.Labels["name"]] = s.Value
+		}
+	}
+	return m
+}
+
+func value(t *testing.T, ss []tpplugtest.Sample, metric string) float64 {
+	t.Helper()
+	for _, s := range ss {
+		if s.Name == metric {
+			return s.Value
+		}
+	}
+	t.Fatalf("No %s metric", metric)
+	return 0
+}
+
+func TestCollect(t *testing.T) {
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater", Power: 1500},
+		tpplugtest.PlugConfig{Alias: "Pump", Power: 400, Off: true},
+	)
+	dc := newTestCollector()
+
+	ss, err := tpplugtest.Collect(dc)
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if ok := value(t, ss, "ok"); ok != 1 {
+		t.Errorf("ok = %v, want 1", ok)
+	}
+	power, relay := byName(ss, "power_mw"), byName(ss, "relay_state")
+	if len(power) != 2 || power["Heater"] != 1500000 || power["Pump"] != 0 {
+		t.Errorf("power_mw = %v, want Heater 1500000, Pump 0", power)
+	}
+	if len(relay) != 2 || relay["Heater"] != 1 || relay["Pump"] != 0 {
+		t.Errorf("relay_state = %v, want Heater 1, Pump 0", relay)
+	}
+	for _, s := range ss {
+		if s.Name == "power_mw" && s.Labels["mac"] != string(h.Plug(s.Labels["name"]).MAC()) {
+			t.Errorf("power_mw for %q has MAC %q, want %q", s.Labels["name"], s.Labels["mac"], h.Plug(s.Labels["name"]).MAC())
+		}
+	}
+}
+
+func TestCollectScenario(t *testing.T) {
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater", Power: 1500},
+		tpplugtest.PlugConfig{Alias: "Pump", Curve: func(elapsed time.Duration) float64 {
+			return 100 * elapsed.Minutes() // spinning up
+		}},
+	)
+	h.Script(
+		tpplugtest.At(2*time.Minute, "Heater", tpplugtest.Malform),
+		tpplugtest.At(4*time.Minute, "Heater", tpplugtest.Repair),
+	)
+	dc := newTestCollector()
+
+	// The heater is missing from the scrapes while it is malformed,
+	// and the pump's power follows its curve throughout.
+	err := h.Run(context.Background(), 6, time.Minute, func(context.Context) error {
+		ss, err := tpplugtest.Collect(dc)
+		if err != nil {
+			return err
+		}
+		at := h.Elapsed()
+		if ok := value(t, ss, "ok"); ok != 1 {
+			t.Errorf("At %v, ok = %v, want 1", at, ok)
+		}
+		power := byName(ss, "power_mw")
+		heater, found := power["Heater"]
+		if malformed := at >= 2*time.Minute && at < 4*time.Minute; found == malformed || (found && heater != 1500000) {
+			t.Errorf("At %v, heater power_mw = %v (found %t), want 1500000 unless malformed", at, heater, found)
+		}
+		if want := 100000 * at.Minutes(); power["Pump"] != want {
+			t.Errorf("At %v, pump power_mw = %v, want %v", at, power["Pump"], want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// With -networks, the exporter scans several networks independently,
+// such as the main LAN and an isolated IoT VLAN that the host has a leg in,
+// and merges what it finds. The file is a YAML list of networks:
+//
+//	- name: lan                 # broadcasts as usual
+//	- name: iot
+//	  interface: eth1           # broadcast to the subnets of this interface
+//	  targets: [10.20.0.5]      # and query these directly, as with -targets
+//	- name: garage
+//	  broadcast: [192.168.7.255]
+//	- name: shed
+//	  no_broadcast: true        # only query targets
+//	  targets: ["192.168.9.20:9999"]
+//
+// A plug found on more than one network is counted on the first.
+// Without -networks, -targets and -no_broadcast describe a single network.
+
+var networkPlugsDesc = prometheus.NewDesc("network_plugs",
+	"Count of plugs found on each of -networks by the last scan",
+	[]string{"network"}, nil)
+
+// network is one network to scan.
+type network struct {
+	Name        string
+	Interface   string   // if set, broadcast to the directed broadcast address of each of its subnets
+	Broadcast   []string // addresses to broadcast to, instead of 255.255.255.255
+	Targets     []string // as with -targets
+	NoBroadcast bool     `yaml:"no_broadcast"`
+
+	bcast   []*net.UDPAddr
+	targets []*net.UDPAddr
+}
+
+func loadNetworks(path string) ([]*network, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nets []*network
+	if err := yaml.UnmarshalStrict(raw, &nets); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("%s lists no networks", path)
+	}
+	names := make(map[string]bool)
+	for i, n := range nets {
+		if n.Name == "" {
+			return nil, fmt.Errorf("network %d has no name", i+1)
+		}
+		if names[n.Name] {
+			return nil, fmt.Errorf("duplicate network %q", n.Name)
+		}
+		names[n.Name] = true
+		for _, b := range n.Broadcast {
+			addr, err := probeAddr(b)
+			if err != nil {
+				return nil, fmt.Errorf("network %q: broadcast: %w", n.Name, err)
+			}
+			n.bcast = append(n.bcast, addr)
+		}
+		for _, t := range n.Targets {
+			addr, err := probeAddr(t)
+			if err != nil {
+				return nil, fmt.Errorf("network %q: targets: %w", n.Name, err)
+			}
+			n.targets = append(n.targets, addr)
+		}
+		switch {
+		case n.NoBroadcast && len(n.targets) == 0:
+			return nil, fmt.Errorf("network %q: no_broadcast needs targets", n.Name)
+		case n.NoBroadcast && (n.Interface != "" || len(n.bcast) > 0):
+			return nil, fmt.Errorf("network %q: no_broadcast contradicts interface and broadcast", n.Name)
+		case n.Interface != "" && len(n.bcast) > 0:
+			return nil, fmt.Errorf("network %q: give only one of interface and broadcast", n.Name)
+		}
+	}
+	return nets, nil
+}
+
+// scan finds the plugs on a network, broadcasting if broadcast is set
+// and the network allows it.
+func (n *network) scan(ctx context.Context, broadcast bool) ([]tpplug.DiscoveryResponse, error) {
+	var static []tpplug.DiscoveryResponse
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		static = queryTargets(ctx, n.targets, true)
+	}()
+	var drs []tpplug.DiscoveryResponse
+	var err error
+	if broadcast && !n.NoBroadcast {
+		opts := tpplug.DiscoverOptions{Broadcast: n.bcast}
+		if n.Interface != "" {
+			// Look it up each time, in case its addresses have changed.
+			opts.Broadcast, err = tpplug.InterfaceBroadcasts(n.Interface, tpplug.DefaultPort)
+		}
+		if err == nil {
+			drs, err = tpplug.DiscoverWithOptions(ctx, opts)
+		}
+	}
+	<-done
+	return append(drs, static...), err
+}
+
+// scanNetworks scans each network at once, and merges the results.
+// It only fails if every network failed.
+func (dc *dataCollector) scanNetworks(ctx context.Context, broadcast bool) ([]tpplug.DiscoveryResponse, error) {
+	results := make([][]tpplug.DiscoveryResponse, len(dc.networks))
+	errs := make([]error, len(dc.networks))
+	var wg sync.WaitGroup
+	for i, n := range dc.networks {
+		i, n := i, n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = n.scan(ctx, broadcast)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		drs      []tpplug.DiscoveryResponse
+		firstErr error
+		failed   int
+	)
+	seen := make(map[tpplug.MAC]bool)
+	counts := make(map[string]int)
+	for i, n := range dc.networks {
+		if err := errs[i]; err != nil {
+			failed++
+			if len(dc.networks) == 1 {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("network %q: %w", n.Name, err)
+			}
+			log.Printf("Scanning network %q: %v", n.Name, err)
+		}
+		for _, dr := range results[i] {
+			if mac := dr.State.System.Info.MAC; !seen[mac] {
+				seen[mac] = true
+				drs = append(drs, dr)
+				counts[n.Name]++
+			}
+		}
+	}
+	if failed == len(dc.networks) {
+		return nil, firstErr
+	}
+	if broadcast {
+		// Shallow scans only find targets.
+		dc.mu.Lock()
+		dc.networkPlugs = counts
+		dc.mu.Unlock()
+	}
+	return drs, nil
+}
+
+// sendNetworkPlugs sends the count of plugs on each network, if -networks is set.
+func (dc *dataCollector) sendNetworkPlugs(ch chan<- prometheus.Metric) {
+	if *networksFile == "" {
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for _, n := range dc.networks {
+		ch <- prometheus.MustNewConstMetric(networkPlugsDesc, prometheus.GaugeValue,
+			float64(dc.networkPlugs[n.Name]), n.Name)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Power strips, such as the HS300, get metrics for each outlet, labelled
+// with the strip's labels, the outlet's index (the last two digits of its ID)
+// and its alias. Outlets are queried after the strip is found by a scan.
+
+var (
+	outletPowerDesc = prometheus.NewDesc("outlet_power_mw",
+		"Power of an outlet of a power strip (mW)",
+		[]string{"mac", "ip", "name", "host", "outlet", "outlet_alias"}, nil)
+	outletRelayDesc = prometheus.NewDesc("outlet_relay_state",
+		"Whether an outlet of a power strip is on",
+		[]string{"mac", "ip", "name", "host", "outlet", "outlet_alias"}, nil)
+)
+
+// outletTimeout bounds the queries of a strip's outlets.
+const outletTimeout = 1 * time.Second
+
+// sendOutlets sends the metrics for the outlets of each power strip among drs.
+func (dc *dataCollector) sendOutlets(ch chan<- prometheus.Metric, drs []tpplug.DiscoveryResponse) {
+	ctx, cancel := context.WithTimeout(context.Background(), outletTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, dr := range drs {
+		if dc.ignore[dr.State.System.Info.MAC] {
+			continue
+		}
+		labels := dc.plugLabels(dr.State, dr.Addr)
+		for _, c := range dr.State.Children() {
+			c, addr := c, dr.Addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dc.sendOutlet(ctx, ch, addr, c, labels)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (dc *dataCollector) sendOutlet(ctx context.Context, ch chan<- prometheus.Metric, addr *net.UDPAddr, c tpplug.Child, stripLabels []string) {
+	outlet := c.ID
+	if len(outlet) > 2 {
+		outlet = outlet[len(outlet)-2:]
+	}
+	labels := append(append([]string(nil), stripLabels...), outlet, c.Alias)
+	ch <- prometheus.MustNewConstMetric(outletRelayDesc, prometheus.GaugeValue, float64(c.RelayState), labels...)
+	state, err := tpplug.Query(tpplug.WithChild(ctx, c.ID), addr)
+	if err != nil {
+		return // the strip's own metrics show whether it is answering
+	}
+	ch <- prometheus.MustNewConstMetric(outletPowerDesc, prometheus.GaugeValue,
+		float64(state.EnergyMeter.Realtime.Power), labels...)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// The exporter keeps a little history of each plug in memory,
+// shown on /plug/<mac>, for diagnosing a plug without going to Grafana.
+
+const (
+	recentReadings = 120 // power readings kept per plug
+	recentEvents   = 20  // discovery events kept per plug
+)
+
+// plugHistory is the recent history of a plug.
+type plugHistory struct {
+	readings [recentReadings]reading // ring buffer
+	n        int                     // total readings ever added
+	events   []discoveryEvent        // oldest first
+}
+
+type reading struct {
+	Time  time.Time
+	Power float64 // mW
+}
+
+// discoveryEvent records a run of scans that found (or missed) a plug the same way.
+type discoveryEvent struct {
+	First, Last time.Time
+	How         string // "discovered", "queried" (responded, but not to discovery) or "missed"
+	Addr        string
+	Count       int
+}
+
+// recent returns the readings, oldest first.
+func (ph *plugHistory) recent() []reading {
+	if ph.n <= recentReadings {
+		return append([]reading(nil), ph.readings[:ph.n]...)
+	}
+	i := ph.n % recentReadings
+	return append(append([]reading(nil), ph.readings[i:]...), ph.readings[:i]...)
+}
+
+// history returns the history for a MAC, creating it if needed. dc.mu must be held.
+func (dc *dataCollector) history(mac tpplug.MAC) *plugHistory {
+	ph, ok := dc.hist[mac]
+	if !ok {
+		ph = new(plugHistory)
+		dc.hist[mac] = ph
+	}
+	return ph
+}
+
+// remember notes a power reading for a plug.
+func (dc *dataCollector) remember(mac tpplug.MAC, mw float64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	ph := dc.history(mac)
+	rd := reading{Time: time.Now(), Power: mw}
+	if ph.n > 0 {
+		dc.accrue(mac, ph.readings[(ph.n-1)%recentReadings], rd)
+	}
+	ph.readings[ph.n%recentReadings] = rd
+	ph.n++
+}
+
+// noteScan notes how a scan found a plug.
+func (dc *dataCollector) noteScan(mac tpplug.MAC, how, addr string, now time.Time) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	ph := dc.history(mac)
+	if n := len(ph.events); n > 0 && ph.events[n-1].How == how && ph.events[n-1].Addr == addr {
+		ph.events[n-1].Last = now
+		ph.events[n-1].Count++
+		return
+	}
+	ph.events = append(ph.events, discoveryEvent{First: now, Last: now, How: how, Addr: addr, Count: 1})
+	if len(ph.events) > recentEvents {
+		ph.events = ph.events[len(ph.events)-recentEvents:]
+	}
+}
+
+func (dc *dataCollector) servePlug(w http.ResponseWriter, r *http.Request) {
+	mac := tpplug.CanonicalMAC(strings.TrimPrefix(r.URL.Path, "/plug/"))
+	var data struct {
+		MAC      tpplug.MAC
+		Info     macInfo
+		Name     string
+		Readings []reading // newest first
+		Spark    template.HTML
+		Events   []discoveryEvent // newest first
+		Sysinfo  string           // indented JSON
+		Err      error
+	}
+	data.MAC = mac
+
+	dc.mu.Lock()
+	info, seen := dc.prev[mac]
+	ph, ok := dc.hist[mac]
+	if ok {
+		rs := ph.recent()
+		data.Spark = sparkline(rs)
+		for i := len(rs) - 1; i >= 0; i-- {
+			data.Readings = append(data.Readings, rs[i])
+		}
+		for i := len(ph.events) - 1; i >= 0; i-- {
+			data.Events = append(data.Events, ph.events[i])
+		}
+	}
+	dc.mu.Unlock()
+	if !seen && !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data.Info = info
+	data.Name = dc.devices.Name(info.State)
+
+	// Fetch the full sysinfo afresh, since State only has the fields we know about.
+	if info.Addr != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), *scanTime)
+		defer cancel()
+		var resp struct {
+			System struct {
+				Sysinfo map[string]interface{} `json:"get_sysinfo"`
+			} `json:"system"`
+		}
+		req := map[string]interface{}{"system": map[string]interface{}{"get_sysinfo": struct{}{}}}
+		if err := tpplug.RawJSONOp(ctx, info.Addr, req, &resp); err != nil {
+			data.Err = err
+		} else {
+			b, _ := json.MarshalIndent(resp.System.Sysinfo, "", "  ")
+			data.Sysinfo = string(b)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := plugTmpl.Execute(&buf, data); err != nil {
+		http.Error(w, "internal error: "+err.Error(), 500)
+		return
+	}
+	io.Copy(w, &buf)
+}
+
+// sparkline renders power readings as an inline SVG.
+func sparkline(rs []reading) template.HTML {
+	const width, height = 480, 60
+	if len(rs) < 2 {
+		return ""
+	}
+	max := 1.0
+	for _, r := range rs {
+		if r.Power > max {
+			max = r.Power
+		}
+	}
+	t0, span := rs[0].Time, rs[len(rs)-1].Time.Sub(rs[0].Time)
+	if span <= 0 {
+		span = 1
+	}
+	var pts []string
+	for _, r := range rs {
+		x := float64(width) * float64(r.Time.Sub(t0)) / float64(span)
+		y := height - float64(height)*r.Power/max
+		pts = append(pts, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return template.HTML(fmt.Sprintf(`<svg width="%d" height="%d" style="border: 1px solid #ccc">`+
+		`<polyline fill="none" stroke="#36c" stroke-width="1.5" points="%s"/></svg> max %.1fW`,
+		width, height, strings.Join(pts, " "), max/1000))
+}
+
+var plugTmpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"mWtoW": func(x float64) float64 { return x / 1000 },
+	"ts":    func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`
+<!doctype html><html lang="en">
+<head><title>tpplug: {{.Name}}</title></head>
+<body>
+
+<h1><a href="/">tpplug</a>: {{.Name}}</h1>
+
+<p>MAC <b>{{.MAC}}</b>{{if .Info.Addr}}, last at <b>{{.Info.Addr}}</b>{{end}}</p>
+
+<h2>Recent power</h2>
+{{if .Spark}}<p>{{.Spark}}</p>{{end}}
+<table>
+<tr><th>time</th><th>power</th></tr>
+{{range .Readings}}
+<tr><td>{{ts .Time}}</td><td>{{printf "%.1f" (mWtoW .Power)}}W</td></tr>
+{{else}}
+<tr><td colspan="2">none</td></tr>
+{{end}}
+</table>
+
+<h2>Discovery history</h2>
+<table>
+<tr><th>from</th><th>to</th><th>how</th><th>address</th><th>scans</th></tr>
+{{range .Events}}
+<tr><td>{{ts .First}}</td><td>{{ts .Last}}</td><td>{{.How}}</td><td>{{.Addr}}</td><td>{{.Count}}</td></tr>
+{{end}}
+</table>
+
+<h2>Sysinfo</h2>
+{{if .Err}}<p>Querying plug: {{.Err}}</p>{{end}}
+{{if .Sysinfo}}<pre>{{.Sysinfo}}</pre>{{end}}
+
+</body>
+</html>
+`))
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Scrapes only see the power at one moment, so short spikes (like a compressor
+// starting) are easily missed. With -poll_interval, plugs are also polled
+// between scrapes, and each scrape reports the min, max and average power
+// seen since the previous one. (With several Prometheus servers scraping,
+// that is since whichever scraped last.)
+
+var (
+	powerMinDesc = prometheus.NewDesc("power_min_mw",
+		"Minimum power (mW) seen since the previous scrape",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	powerMaxDesc = prometheus.NewDesc("power_max_mw",
+		"Maximum power (mW) seen since the previous scrape",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	powerAvgDesc = prometheus.NewDesc("power_avg_mw",
+		"Average power (mW) of the readings since the previous scrape",
+		[]string{"mac", "ip", "name", "host"}, nil)
+)
+
+// powerStats summarises the power readings of a plug.
+type powerStats struct {
+	min, max, sum float64
+	n             int
+}
+
+func (ps *powerStats) add(mw float64) {
+	if ps.n == 0 || mw < ps.min {
+		ps.min = mw
+	}
+	if ps.n == 0 || mw > ps.max {
+		ps.max = mw
+	}
+	ps.sum += mw
+	ps.n++
+}
+
+// record notes a power reading for a plug, if polling is enabled.
+func (dc *dataCollector) record(mac tpplug.MAC, mw float64) {
+	if *pollInterval <= 0 {
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	ps, ok := dc.stats[mac]
+	if !ok {
+		ps = new(powerStats)
+		dc.stats[mac] = ps
+	}
+	ps.add(mw)
+}
+
+// sendStats sends the power stats for the given plugs, and starts afresh.
+func (dc *dataCollector) sendStats(ch chan<- prometheus.Metric, macs map[tpplug.MAC]macInfo) {
+	if *pollInterval <= 0 {
+		return
+	}
+	dc.mu.Lock()
+	stats := dc.stats
+	dc.stats = make(map[tpplug.MAC]*powerStats)
+	dc.mu.Unlock()
+
+	for mac, ps := range stats {
+		info, ok := macs[mac]
+		if !ok || ps.n == 0 {
+			continue
+		}
+		labels := dc.plugLabels(info.State, info.Addr)
+		ch <- prometheus.MustNewConstMetric(powerMinDesc, prometheus.GaugeValue, ps.min, labels...)
+		ch <- prometheus.MustNewConstMetric(powerMaxDesc, prometheus.GaugeValue, ps.max, labels...)
+		ch <- prometheus.MustNewConstMetric(powerAvgDesc, prometheus.GaugeValue, ps.sum/float64(ps.n), labels...)
+	}
+}
+
+// poll queries the plugs found by the most recent scrape every interval
+// (or as -scan_schedule says), forever.
+func (dc *dataCollector) poll(interval time.Duration) {
+	for {
+		waitScan(interval)
+		dc.mu.Lock()
+		prev := dc.prev
+		dc.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for mac, info := range prev {
+			if dc.ignore[mac] || time.Since(info.Seen) > *history {
+				continue
+			}
+			mac, addr := mac, info.Addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(withRetries(context.Background()), interval)
+				defer cancel()
+				state, err := tpplug.Query(ctx, addr)
+				if err != nil {
+					return // the next scrape will notice
+				}
+				dc.record(mac, float64(state.EnergyMeter.Realtime.Power))
+				dc.remember(mac, float64(state.EnergyMeter.Realtime.Power))
+			}()
+		}
+		wg.Wait()
+	}
+}
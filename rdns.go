@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -reverse_dns, plug metrics get a host label with the name found by a
+// reverse DNS lookup of the plug's IP, for networks where the DHCP server
+// registers a hostname for each device. Names are cached for -reverse_dns_ttl,
+// including the lack of one. Plugs found by a scan are looked up before their
+// metrics are sent, for at most reverseDNSWait; after that, and for stale names,
+// lookups happen in the background, and the host label is left empty or stale
+// until they finish. With -mac_labels, the host label is always empty.
+
+// reverseDNSWait is how long a scan waits for lookups of newly seen plugs.
+const reverseDNSWait = 500 * time.Millisecond
+
+// hostCache caches reverse DNS lookups. Its zero value is ready to use.
+type hostCache struct {
+	mu sync.Mutex
+	m  map[string]*hostEntry // by IP
+}
+
+type hostEntry struct {
+	name    string // "" if there is none
+	expires time.Time
+	done    chan struct{} // closed when the lookup in progress finishes; nil if none is
+}
+
+// host returns the cached hostname for an IP, or "" if it has none or isn't known yet.
+// It starts a lookup if the name is missing or stale.
+func (hc *hostCache) host(ip net.IP) string {
+	if !*reverseDNS || *macLabels {
+		return ""
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.lookupLocked(ip.String()).name
+}
+
+// resolve looks up the hostnames of IPs not seen before, waiting for at most reverseDNSWait.
+func (hc *hostCache) resolve(ips []net.IP) {
+	if !*reverseDNS || *macLabels {
+		return
+	}
+	var waits []chan struct{}
+	hc.mu.Lock()
+	for _, ip := range ips {
+		s := ip.String()
+		_, known := hc.m[s]
+		if e := hc.lookupLocked(s); !known && e.done != nil {
+			waits = append(waits, e.done)
+		}
+	}
+	hc.mu.Unlock()
+
+	timeout := time.NewTimer(reverseDNSWait)
+	defer timeout.Stop()
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// lookupLocked returns the entry for an IP, starting a lookup if it is missing or stale.
+// hc.mu must be held.
+func (hc *hostCache) lookupLocked(ip string) *hostEntry {
+	if hc.m == nil {
+		hc.m = make(map[string]*hostEntry)
+	}
+	e, ok := hc.m[ip]
+	if !ok {
+		e = new(hostEntry)
+		hc.m[ip] = e
+	}
+	if e.done != nil || (ok && time.Now().Before(e.expires)) {
+		return e
+	}
+	done := make(chan struct{})
+	e.done = done
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		hc.mu.Lock()
+		defer hc.mu.Unlock()
+		switch {
+		case err == nil && len(names) > 0:
+			e.name = strings.TrimSuffix(names[0], ".")
+		case err == nil || isNotFound(err):
+			e.name = ""
+		default:
+			// Keep a stale name through a failure, such as a DNS server timing out.
+			log.Printf("Reverse DNS lookup of %s: %v", ip, err)
+		}
+		e.expires = time.Now().Add(*reverseDNSTTL)
+		e.done = nil
+		close(done)
+	}()
+	return e
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
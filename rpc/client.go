@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/dsymonds/tpplug/rpc/tpplugpb"
+)
+
+// Client is a client of a Plugs service.
+// The generated methods are available directly,
+// and it has some more convenient wrappers too.
+type Client struct {
+	tpplugpb.PlugsClient
+	conn *grpc.ClientConn
+}
+
+// Dial connects to a Plugs service at target (e.g. "host:port").
+// Without any options it uses an insecure (plaintext) connection.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		PlugsClient: tpplugpb.NewPlugsClient(conn),
+		conn:        conn,
+	}, nil
+}
+
+func (c *Client) Close() error { return c.conn.Close() }
+
+// Plugs returns all plugs known to the service.
+func (c *Client) Plugs(ctx context.Context) ([]*tpplugpb.Plug, error) {
+	resp, err := c.ListPlugs(ctx, &tpplugpb.ListPlugsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plugs, nil
+}
+
+// Set turns a plug on or off.
+func (c *Client) Set(ctx context.Context, mac string, on bool) (*tpplugpb.Plug, error) {
+	return c.SetRelay(ctx, &tpplugpb.SetRelayRequest{Mac: mac, On: on})
+}
+
+// SetTemporarily turns a plug on or off, reverting it after the given duration.
+func (c *Client) SetTemporarily(ctx context.Context, mac string, on bool, revert time.Duration) (*tpplugpb.Plug, error) {
+	return c.SetRelay(ctx, &tpplugpb.SetRelayRequest{Mac: mac, On: on, RevertAfter: durationpb.New(revert)})
+}
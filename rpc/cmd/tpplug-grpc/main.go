@@ -0,0 +1,60 @@
+/*
+tpplug-grpc serves the Plugs gRPC service (see ../../tpplugpb/tpplug.proto)
+for TP-Link smart plugs on the local network.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/dsymonds/tpplug/rpc"
+	"github.com/dsymonds/tpplug/rpc/tpplugpb"
+)
+
+var (
+	listenAddr   = flag.String("listen", ":9090", "`address` to serve gRPC on")
+	scanInterval = flag.Duration("scan_interval", 1*time.Minute, "how often to discover plugs")
+	scanTime     = flag.Duration("scan_time", 2*time.Second, "how long to wait for discovery")
+	pollInterval = flag.Duration("poll_interval", 10*time.Second, "how often to query known plugs")
+	forget       = flag.Duration("forget", 10*time.Minute, "how long to keep a plug that stopped responding")
+)
+
+func main() {
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	srv := rpc.NewServer(rpc.Options{
+		ScanInterval: *scanInterval,
+		ScanTime:     *scanTime,
+		PollInterval: *pollInterval,
+		Forget:       *forget,
+	})
+	go srv.Run(ctx)
+
+	lis, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log.Fatalf("Listening on %s: %v", *listenAddr, err)
+	}
+	gs := grpc.NewServer()
+	tpplugpb.RegisterPlugsServer(gs, srv)
+	go func() {
+		<-ctx.Done()
+		log.Print("Shutting down")
+		gs.GracefulStop()
+	}()
+	log.Printf("Serving gRPC on %s", lis.Addr())
+	if err := gs.Serve(lis); err != nil {
+		log.Fatalf("Serving: %v", err)
+	}
+}
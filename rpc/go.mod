@@ -0,0 +1,20 @@
+module github.com/dsymonds/tpplug/rpc
+
+go 1.21
+
+require (
+	github.com/dsymonds/tpplug v0.0.0-20241225080319-a9d1b2995096
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+// RSSI was added to tpplug.State after the version above.
+replace github.com/dsymonds/tpplug => ../
@@ -0,0 +1,320 @@
+/*
+Package rpc provides a gRPC interface to TP-Link smart plugs,
+so that other languages and remote processes can drive them.
+
+The service is defined in tpplugpb/tpplug.proto.
+*/
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/dsymonds/tpplug/rpc/tpplugpb"
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Options configures a Server. Zero fields get defaults.
+type Options struct {
+	ScanInterval time.Duration // how often to discover plugs; default 1m
+	ScanTime     time.Duration // how long to wait for discovery; default 2s
+	PollInterval time.Duration // how often to query known plugs; default 10s
+	Timeout      time.Duration // how long to wait for a plug to respond; default 3s
+	Forget       time.Duration // how long to keep a plug that stopped responding; default 10m
+}
+
+func (o *Options) setDefaults() {
+	def := func(d *time.Duration, v time.Duration) {
+		if *d <= 0 {
+			*d = v
+		}
+	}
+	def(&o.ScanInterval, 1*time.Minute)
+	def(&o.ScanTime, 2*time.Second)
+	def(&o.PollInterval, 10*time.Second)
+	def(&o.Timeout, 3*time.Second)
+	def(&o.Forget, 10*time.Minute)
+}
+
+// Server implements tpplugpb.PlugsServer.
+// Its Run method must be running for it to know about plugs.
+type Server struct {
+	tpplugpb.UnimplementedPlugsServer
+
+	opts Options
+
+	mu    sync.Mutex
+	plugs map[tpplug.MAC]*plug
+	subs  map[chan *tpplugpb.Event]bool
+}
+
+type plug struct {
+	addr     *net.UDPAddr
+	state    tpplug.State
+	lastSeen time.Time
+}
+
+func NewServer(opts Options) *Server {
+	opts.setDefaults()
+	return &Server{
+		opts:  opts,
+		plugs: make(map[tpplug.MAC]*plug),
+		subs:  make(map[chan *tpplugpb.Event]bool),
+	}
+}
+
+// Run discovers and polls plugs until the context is done.
+func (s *Server) Run(ctx context.Context) {
+	s.discover(ctx)
+	scan := time.NewTicker(s.opts.ScanInterval)
+	defer scan.Stop()
+	poll := time.NewTicker(s.opts.PollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scan.C:
+			s.discover(ctx)
+		case <-poll.C:
+			s.poll(ctx)
+		}
+	}
+}
+
+func (s *Server) discover(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.ScanTime)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		log.Printf("Discovering plugs: %v", err)
+		return
+	}
+	for _, dr := range drs {
+		if dr.State.System.Info.MAC != "" {
+			s.update(dr.Addr, dr.State)
+		}
+	}
+}
+
+func (s *Server) poll(ctx context.Context) {
+	s.mu.Lock()
+	addrs := make(map[tpplug.MAC]*net.UDPAddr, len(s.plugs))
+	for mac, p := range s.plugs {
+		addrs[mac] = p.addr
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for mac, addr := range addrs {
+		mac, addr := mac, addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := s.query(ctx, addr)
+			if err != nil {
+				s.maybeForget(mac)
+				return
+			}
+			s.update(addr, state)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr) (tpplug.State, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	return tpplug.Query(ctx, addr)
+}
+
+// update records a plug's state, and notifies subscribers of any change.
+func (s *Server) update(addr *net.UDPAddr, state tpplug.State) *tpplugpb.Plug {
+	mac := state.System.Info.MAC
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.plugs[mac]
+	typ := tpplugpb.Event_DISCOVERED
+	if ok {
+		switch {
+		case p.state.System.Info.RelayState != state.System.Info.RelayState:
+			typ = tpplugpb.Event_RELAY_CHANGED
+		case p.state != state:
+			typ = tpplugpb.Event_UPDATED
+		default:
+			typ = tpplugpb.Event_TYPE_UNSPECIFIED
+		}
+	} else {
+		p = &plug{}
+		s.plugs[mac] = p
+	}
+	p.addr, p.state, p.lastSeen = addr, state, time.Now()
+	pb := p.proto()
+	if typ != tpplugpb.Event_TYPE_UNSPECIFIED {
+		s.notifyLocked(typ, pb)
+	}
+	return pb
+}
+
+// maybeForget drops a plug that hasn't responded for too long.
+func (s *Server) maybeForget(mac tpplug.MAC) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.plugs[mac]
+	if !ok || time.Since(p.lastSeen) < s.opts.Forget {
+		return
+	}
+	delete(s.plugs, mac)
+	s.notifyLocked(tpplugpb.Event_LOST, p.proto())
+}
+
+func (s *Server) notifyLocked(typ tpplugpb.Event_Type, pb *tpplugpb.Plug) {
+	ev := &tpplugpb.Event{Type: typ, Time: timestamppb.Now(), Plug: pb}
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Slow subscriber; it misses out rather than blocking everyone.
+		}
+	}
+}
+
+func (p *plug) proto() *tpplugpb.Plug {
+	info, rt := p.state.System.Info, p.state.EnergyMeter.Realtime
+	return &tpplugpb.Plug{
+		Mac:     info.MAC.String(),
+		Address: p.addr.String(),
+		State: &tpplugpb.PlugState{
+			Model:     info.Model,
+			Alias:     info.Alias,
+			RelayOn:   info.RelayState == 1,
+			Rssi:      int32(info.RSSI),
+			VoltageMv: int64(rt.Voltage),
+			CurrentMa: int64(rt.Current),
+			PowerMw:   int64(rt.Power),
+		},
+		LastSeen: timestamppb.New(p.lastSeen),
+	}
+}
+
+func (s *Server) lookup(mac string) (*net.UDPAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.plugs[tpplug.CanonicalMAC(mac)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no plug with MAC %q", mac)
+	}
+	return p.addr, nil
+}
+
+// deviceError converts an error talking to a plug into a gRPC status.
+func deviceError(err error) error {
+	var neterr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &neterr) && neterr.Timeout()) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *Server) ListPlugs(ctx context.Context, req *tpplugpb.ListPlugsRequest) (*tpplugpb.ListPlugsResponse, error) {
+	if req.Rediscover {
+		s.discover(ctx)
+	}
+	s.mu.Lock()
+	resp := &tpplugpb.ListPlugsResponse{}
+	for _, p := range s.plugs {
+		resp.Plugs = append(resp.Plugs, p.proto())
+	}
+	s.mu.Unlock()
+	sort.Slice(resp.Plugs, func(i, j int) bool { return resp.Plugs[i].Mac < resp.Plugs[j].Mac })
+	return resp, nil
+}
+
+func (s *Server) GetState(ctx context.Context, req *tpplugpb.GetStateRequest) (*tpplugpb.Plug, error) {
+	addr, err := s.lookup(req.Mac)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.query(ctx, addr)
+	if err != nil {
+		return nil, deviceError(err)
+	}
+	return s.update(addr, state), nil
+}
+
+func (s *Server) SetRelay(ctx context.Context, req *tpplugpb.SetRelayRequest) (*tpplugpb.Plug, error) {
+	addr, err := s.lookup(req.Mac)
+	if err != nil {
+		return nil, err
+	}
+	if ra := req.RevertAfter; ra != nil {
+		if err := ra.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad revert_after: %v", err)
+		}
+		if ra.AsDuration() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "negative revert_after")
+		}
+	}
+
+	newState := 0
+	if req.On {
+		newState = 1
+	}
+	sctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	if d := req.RevertAfter.AsDuration(); d > 0 {
+		err = tpplug.SetRelayTemporarily(sctx, addr, newState, 1-newState, d)
+	} else {
+		err = tpplug.SetRelayState(sctx, addr, newState)
+	}
+	if err != nil {
+		return nil, deviceError(fmt.Errorf("setting relay: %w", err))
+	}
+
+	state, err := s.query(ctx, addr)
+	if err != nil {
+		return nil, deviceError(err)
+	}
+	return s.update(addr, state), nil
+}
+
+func (s *Server) StreamEvents(req *tpplugpb.StreamEventsRequest, stream tpplugpb.Plugs_StreamEventsServer) error {
+	want := make(map[tpplug.MAC]bool)
+	for _, mac := range req.Macs {
+		want[tpplug.CanonicalMAC(mac)] = true
+	}
+
+	ch := make(chan *tpplugpb.Event, 16)
+	s.mu.Lock()
+	s.subs[ch] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-ch:
+			if len(want) > 0 && !want[tpplug.MAC(ev.Plug.Mac)] {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
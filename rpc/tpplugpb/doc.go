@@ -0,0 +1,4 @@
+// Package tpplugpb holds the generated protocol buffer and gRPC code for the Plugs service.
+package tpplugpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tpplug.proto
@@ -0,0 +1,827 @@
+// The Plugs service drives TP-Link smart plugs on the server's network.
+//
+// Plugs are identified by MAC address,
+// which may be given with or without separators.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.1
+// 	protoc        v4.25.3
+// source: tpplug.proto
+
+package tpplugpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Event_Type int32
+
+const (
+	Event_TYPE_UNSPECIFIED Event_Type = 0
+	Event_DISCOVERED       Event_Type = 1 // plug seen for the first time
+	Event_RELAY_CHANGED    Event_Type = 2 // relay turned on or off
+	Event_UPDATED          Event_Type = 3 // other state (e.g. power) changed
+	Event_LOST             Event_Type = 4 // plug stopped responding and was forgotten
+)
+
+// Enum value maps for Event_Type.
+var (
+	Event_Type_name = map[int32]string{
+		0: "TYPE_UNSPECIFIED",
+		1: "DISCOVERED",
+		2: "RELAY_CHANGED",
+		3: "UPDATED",
+		4: "LOST",
+	}
+	Event_Type_value = map[string]int32{
+		"TYPE_UNSPECIFIED": 0,
+		"DISCOVERED":       1,
+		"RELAY_CHANGED":    2,
+		"UPDATED":          3,
+		"LOST":             4,
+	}
+)
+
+func (x Event_Type) Enum() *Event_Type {
+	p := new(Event_Type)
+	*p = x
+	return p
+}
+
+func (x Event_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Event_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_tpplug_proto_enumTypes[0].Descriptor()
+}
+
+func (Event_Type) Type() protoreflect.EnumType {
+	return &file_tpplug_proto_enumTypes[0]
+}
+
+func (x Event_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Event_Type.Descriptor instead.
+func (Event_Type) EnumDescriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{7, 0}
+}
+
+type Plug struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mac      string                 `protobuf:"bytes,1,opt,name=mac,proto3" json:"mac,omitempty"`         // as reported by the plug, e.g. "50:C7:BF:00:00:01"
+	Address  string                 `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"` // host:port
+	State    *PlugState             `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	LastSeen *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=last_seen,json=lastSeen,proto3" json:"last_seen,omitempty"`
+}
+
+func (x *Plug) Reset() {
+	*x = Plug{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Plug) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Plug) ProtoMessage() {}
+
+func (x *Plug) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Plug.ProtoReflect.Descriptor instead.
+func (*Plug) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Plug) GetMac() string {
+	if x != nil {
+		return x.Mac
+	}
+	return ""
+}
+
+func (x *Plug) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Plug) GetState() *PlugState {
+	if x != nil {
+		return x.State
+	}
+	return nil
+}
+
+func (x *Plug) GetLastSeen() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastSeen
+	}
+	return nil
+}
+
+type PlugState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Model   string `protobuf:"bytes,1,opt,name=model,proto3" json:"model,omitempty"` // e.g. "HS110(AU)"
+	Alias   string `protobuf:"bytes,2,opt,name=alias,proto3" json:"alias,omitempty"`
+	RelayOn bool   `protobuf:"varint,3,opt,name=relay_on,json=relayOn,proto3" json:"relay_on,omitempty"`
+	Rssi    int32  `protobuf:"varint,4,opt,name=rssi,proto3" json:"rssi,omitempty"` // dBm
+	// Realtime energy meter readings, for plugs that have one.
+	VoltageMv int64 `protobuf:"varint,5,opt,name=voltage_mv,json=voltageMv,proto3" json:"voltage_mv,omitempty"`
+	CurrentMa int64 `protobuf:"varint,6,opt,name=current_ma,json=currentMa,proto3" json:"current_ma,omitempty"`
+	PowerMw   int64 `protobuf:"varint,7,opt,name=power_mw,json=powerMw,proto3" json:"power_mw,omitempty"`
+}
+
+func (x *PlugState) Reset() {
+	*x = PlugState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PlugState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PlugState) ProtoMessage() {}
+
+func (x *PlugState) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PlugState.ProtoReflect.Descriptor instead.
+func (*PlugState) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PlugState) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *PlugState) GetAlias() string {
+	if x != nil {
+		return x.Alias
+	}
+	return ""
+}
+
+func (x *PlugState) GetRelayOn() bool {
+	if x != nil {
+		return x.RelayOn
+	}
+	return false
+}
+
+func (x *PlugState) GetRssi() int32 {
+	if x != nil {
+		return x.Rssi
+	}
+	return 0
+}
+
+func (x *PlugState) GetVoltageMv() int64 {
+	if x != nil {
+		return x.VoltageMv
+	}
+	return 0
+}
+
+func (x *PlugState) GetCurrentMa() int64 {
+	if x != nil {
+		return x.CurrentMa
+	}
+	return 0
+}
+
+func (x *PlugState) GetPowerMw() int64 {
+	if x != nil {
+		return x.PowerMw
+	}
+	return 0
+}
+
+type ListPlugsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// If set, run discovery before responding.
+	Rediscover bool `protobuf:"varint,1,opt,name=rediscover,proto3" json:"rediscover,omitempty"`
+}
+
+func (x *ListPlugsRequest) Reset() {
+	*x = ListPlugsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListPlugsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPlugsRequest) ProtoMessage() {}
+
+func (x *ListPlugsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPlugsRequest.ProtoReflect.Descriptor instead.
+func (*ListPlugsRequest) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListPlugsRequest) GetRediscover() bool {
+	if x != nil {
+		return x.Rediscover
+	}
+	return false
+}
+
+type ListPlugsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Plugs []*Plug `protobuf:"bytes,1,rep,name=plugs,proto3" json:"plugs,omitempty"`
+}
+
+func (x *ListPlugsResponse) Reset() {
+	*x = ListPlugsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListPlugsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPlugsResponse) ProtoMessage() {}
+
+func (x *ListPlugsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPlugsResponse.ProtoReflect.Descriptor instead.
+func (*ListPlugsResponse) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListPlugsResponse) GetPlugs() []*Plug {
+	if x != nil {
+		return x.Plugs
+	}
+	return nil
+}
+
+type GetStateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mac string `protobuf:"bytes,1,opt,name=mac,proto3" json:"mac,omitempty"`
+}
+
+func (x *GetStateRequest) Reset() {
+	*x = GetStateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetStateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStateRequest) ProtoMessage() {}
+
+func (x *GetStateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStateRequest.ProtoReflect.Descriptor instead.
+func (*GetStateRequest) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetStateRequest) GetMac() string {
+	if x != nil {
+		return x.Mac
+	}
+	return ""
+}
+
+type SetRelayRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mac string `protobuf:"bytes,1,opt,name=mac,proto3" json:"mac,omitempty"`
+	On  bool   `protobuf:"varint,2,opt,name=on,proto3" json:"on,omitempty"`
+	// If set, the plug reverts to the opposite state after this long.
+	RevertAfter *durationpb.Duration `protobuf:"bytes,3,opt,name=revert_after,json=revertAfter,proto3" json:"revert_after,omitempty"`
+}
+
+func (x *SetRelayRequest) Reset() {
+	*x = SetRelayRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SetRelayRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetRelayRequest) ProtoMessage() {}
+
+func (x *SetRelayRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetRelayRequest.ProtoReflect.Descriptor instead.
+func (*SetRelayRequest) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SetRelayRequest) GetMac() string {
+	if x != nil {
+		return x.Mac
+	}
+	return ""
+}
+
+func (x *SetRelayRequest) GetOn() bool {
+	if x != nil {
+		return x.On
+	}
+	return false
+}
+
+func (x *SetRelayRequest) GetRevertAfter() *durationpb.Duration {
+	if x != nil {
+		return x.RevertAfter
+	}
+	return nil
+}
+
+type StreamEventsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Only send events for these plugs. Empty means all plugs.
+	Macs []string `protobuf:"bytes,1,rep,name=macs,proto3" json:"macs,omitempty"`
+}
+
+func (x *StreamEventsRequest) Reset() {
+	*x = StreamEventsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StreamEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamEventsRequest) ProtoMessage() {}
+
+func (x *StreamEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamEventsRequest.ProtoReflect.Descriptor instead.
+func (*StreamEventsRequest) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *StreamEventsRequest) GetMacs() []string {
+	if x != nil {
+		return x.Macs
+	}
+	return nil
+}
+
+type Event struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type Event_Type             `protobuf:"varint,1,opt,name=type,proto3,enum=tpplug.v1.Event_Type" json:"type,omitempty"`
+	Time *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	Plug *Plug                  `protobuf:"bytes,3,opt,name=plug,proto3" json:"plug,omitempty"`
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tpplug_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_tpplug_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_tpplug_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Event) GetType() Event_Type {
+	if x != nil {
+		return x.Type
+	}
+	return Event_TYPE_UNSPECIFIED
+}
+
+func (x *Event) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Event) GetPlug() *Plug {
+	if x != nil {
+		return x.Plug
+	}
+	return nil
+}
+
+var File_tpplug_proto protoreflect.FileDescriptor
+
+var file_tpplug_proto_rawDesc = []byte{
+	0x0a, 0x0c, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09,
+	0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x1a, 0x1e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x64, 0x75, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x97, 0x01, 0x0a, 0x04, 0x50,
+	0x6c, 0x75, 0x67, 0x12, 0x10, 0x0a, 0x03, 0x6d, 0x61, 0x63, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x03, 0x6d, 0x61, 0x63, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12,
+	0x2a, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14,
+	0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x53,
+	0x74, 0x61, 0x74, 0x65, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x12, 0x37, 0x0a, 0x09, 0x6c,
+	0x61, 0x73, 0x74, 0x5f, 0x73, 0x65, 0x65, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a,
+	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x08, 0x6c, 0x61, 0x73, 0x74,
+	0x53, 0x65, 0x65, 0x6e, 0x22, 0xbf, 0x01, 0x0a, 0x09, 0x50, 0x6c, 0x75, 0x67, 0x53, 0x74, 0x61,
+	0x74, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x6c, 0x69, 0x61,
+	0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x61, 0x6c, 0x69, 0x61, 0x73, 0x12, 0x19,
+	0x0a, 0x08, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x07, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x4f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x73, 0x73,
+	0x69, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x72, 0x73, 0x73, 0x69, 0x12, 0x1d, 0x0a,
+	0x0a, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x5f, 0x6d, 0x76, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x76, 0x6f, 0x6c, 0x74, 0x61, 0x67, 0x65, 0x4d, 0x76, 0x12, 0x1d, 0x0a, 0x0a,
+	0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x6d, 0x61, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x09, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x4d, 0x61, 0x12, 0x19, 0x0a, 0x08, 0x70,
+	0x6f, 0x77, 0x65, 0x72, 0x5f, 0x6d, 0x77, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x70,
+	0x6f, 0x77, 0x65, 0x72, 0x4d, 0x77, 0x22, 0x32, 0x0a, 0x10, 0x4c, 0x69, 0x73, 0x74, 0x50, 0x6c,
+	0x75, 0x67, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x72, 0x65,
+	0x64, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a,
+	0x72, 0x65, 0x64, 0x69, 0x73, 0x63, 0x6f, 0x76, 0x65, 0x72, 0x22, 0x3a, 0x0a, 0x11, 0x4c, 0x69,
+	0x73, 0x74, 0x50, 0x6c, 0x75, 0x67, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x25, 0x0a, 0x05, 0x70, 0x6c, 0x75, 0x67, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0f,
+	0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x52,
+	0x05, 0x70, 0x6c, 0x75, 0x67, 0x73, 0x22, 0x23, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61,
+	0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x6d, 0x61, 0x63,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6d, 0x61, 0x63, 0x22, 0x71, 0x0a, 0x0f, 0x53,
+	0x65, 0x74, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x10,
+	0x0a, 0x03, 0x6d, 0x61, 0x63, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6d, 0x61, 0x63,
+	0x12, 0x0e, 0x0a, 0x02, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x02, 0x6f, 0x6e,
+	0x12, 0x3c, 0x0a, 0x0c, 0x72, 0x65, 0x76, 0x65, 0x72, 0x74, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x52, 0x0b, 0x72, 0x65, 0x76, 0x65, 0x72, 0x74, 0x41, 0x66, 0x74, 0x65, 0x72, 0x22, 0x29,
+	0x0a, 0x13, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6d, 0x61, 0x63, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x04, 0x6d, 0x61, 0x63, 0x73, 0x22, 0xdf, 0x01, 0x0a, 0x05, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x12, 0x29, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x15, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2e,
+	0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x23,
+	0x0a, 0x04, 0x70, 0x6c, 0x75, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x74,
+	0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x52, 0x04, 0x70,
+	0x6c, 0x75, 0x67, 0x22, 0x56, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x10, 0x54,
+	0x59, 0x50, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10,
+	0x00, 0x12, 0x0e, 0x0a, 0x0a, 0x44, 0x49, 0x53, 0x43, 0x4f, 0x56, 0x45, 0x52, 0x45, 0x44, 0x10,
+	0x01, 0x12, 0x11, 0x0a, 0x0d, 0x52, 0x45, 0x4c, 0x41, 0x59, 0x5f, 0x43, 0x48, 0x41, 0x4e, 0x47,
+	0x45, 0x44, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x50, 0x44, 0x41, 0x54, 0x45, 0x44, 0x10,
+	0x03, 0x12, 0x08, 0x0a, 0x04, 0x4c, 0x4f, 0x53, 0x54, 0x10, 0x04, 0x32, 0x85, 0x02, 0x0a, 0x05,
+	0x50, 0x6c, 0x75, 0x67, 0x73, 0x12, 0x46, 0x0a, 0x09, 0x4c, 0x69, 0x73, 0x74, 0x50, 0x6c, 0x75,
+	0x67, 0x73, 0x12, 0x1b, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x4c,
+	0x69, 0x73, 0x74, 0x50, 0x6c, 0x75, 0x67, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x1c, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x69, 0x73, 0x74,
+	0x50, 0x6c, 0x75, 0x67, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x37, 0x0a,
+	0x08, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1a, 0x2e, 0x74, 0x70, 0x70, 0x6c,
+	0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x0f, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76,
+	0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x12, 0x37, 0x0a, 0x08, 0x53, 0x65, 0x74, 0x52, 0x65, 0x6c,
+	0x61, 0x79, 0x12, 0x1a, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x53,
+	0x65, 0x74, 0x52, 0x65, 0x6c, 0x61, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x0f,
+	0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x12,
+	0x42, 0x0a, 0x0c, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x12,
+	0x1e, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x74, 0x72, 0x65,
+	0x61, 0x6d, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x10, 0x2e, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x2e, 0x76, 0x31, 0x2e, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x30, 0x01, 0x42, 0x29, 0x5a, 0x27, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x64, 0x73, 0x79, 0x6d, 0x6f, 0x6e, 0x64, 0x73, 0x2f, 0x74, 0x70, 0x70, 0x6c, 0x75,
+	0x67, 0x2f, 0x72, 0x70, 0x63, 0x2f, 0x74, 0x70, 0x70, 0x6c, 0x75, 0x67, 0x70, 0x62, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_tpplug_proto_rawDescOnce sync.Once
+	file_tpplug_proto_rawDescData = file_tpplug_proto_rawDesc
+)
+
+func file_tpplug_proto_rawDescGZIP() []byte {
+	file_tpplug_proto_rawDescOnce.Do(func() {
+		file_tpplug_proto_rawDescData = protoimpl.X.CompressGZIP(file_tpplug_proto_rawDescData)
+	})
+	return file_tpplug_proto_rawDescData
+}
+
+var file_tpplug_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_tpplug_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_tpplug_proto_goTypes = []interface{}{
+	(Event_Type)(0),               // 0: tpplug.v1.Event.Type
+	(*Plug)(nil),                  // 1: tpplug.v1.Plug
+	(*PlugState)(nil),             // 2: tpplug.v1.PlugState
+	(*ListPlugsRequest)(nil),      // 3: tpplug.v1.ListPlugsRequest
+	(*ListPlugsResponse)(nil),     // 4: tpplug.v1.ListPlugsResponse
+	(*GetStateRequest)(nil),       // 5: tpplug.v1.GetStateRequest
+	(*SetRelayRequest)(nil),       // 6: tpplug.v1.SetRelayRequest
+	(*StreamEventsRequest)(nil),   // 7: tpplug.v1.StreamEventsRequest
+	(*Event)(nil),                 // 8: tpplug.v1.Event
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),   // 10: google.protobuf.Duration
+}
+var file_tpplug_proto_depIdxs = []int32{
+	2,  // 0: tpplug.v1.Plug.state:type_name -> tpplug.v1.PlugState
+	9,  // 1: tpplug.v1.Plug.last_seen:type_name -> google.protobuf.Timestamp
+	1,  // 2: tpplug.v1.ListPlugsResponse.plugs:type_name -> tpplug.v1.Plug
+	10, // 3: tpplug.v1.SetRelayRequest.revert_after:type_name -> google.protobuf.Duration
+	0,  // 4: tpplug.v1.Event.type:type_name -> tpplug.v1.Event.Type
+	9,  // 5: tpplug.v1.Event.time:type_name -> google.protobuf.Timestamp
+	1,  // 6: tpplug.v1.Event.plug:type_name -> tpplug.v1.Plug
+	3,  // 7: tpplug.v1.Plugs.ListPlugs:input_type -> tpplug.v1.ListPlugsRequest
+	5,  // 8: tpplug.v1.Plugs.GetState:input_type -> tpplug.v1.GetStateRequest
+	6,  // 9: tpplug.v1.Plugs.SetRelay:input_type -> tpplug.v1.SetRelayRequest
+	7,  // 10: tpplug.v1.Plugs.StreamEvents:input_type -> tpplug.v1.StreamEventsRequest
+	4,  // 11: tpplug.v1.Plugs.ListPlugs:output_type -> tpplug.v1.ListPlugsResponse
+	1,  // 12: tpplug.v1.Plugs.GetState:output_type -> tpplug.v1.Plug
+	1,  // 13: tpplug.v1.Plugs.SetRelay:output_type -> tpplug.v1.Plug
+	8,  // 14: tpplug.v1.Plugs.StreamEvents:output_type -> tpplug.v1.Event
+	11, // [11:15] is the sub-list for method output_type
+	7,  // [7:11] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_tpplug_proto_init() }
+func file_tpplug_proto_init() {
+	if File_tpplug_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_tpplug_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Plug); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PlugState); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListPlugsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListPlugsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GetStateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SetRelayRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StreamEventsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tpplug_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Event); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_tpplug_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_tpplug_proto_goTypes,
+		DependencyIndexes: file_tpplug_proto_depIdxs,
+		EnumInfos:         file_tpplug_proto_enumTypes,
+		MessageInfos:      file_tpplug_proto_msgTypes,
+	}.Build()
+	File_tpplug_proto = out.File
+	file_tpplug_proto_rawDesc = nil
+	file_tpplug_proto_goTypes = nil
+	file_tpplug_proto_depIdxs = nil
+}
@@ -0,0 +1,265 @@
+// The Plugs service drives TP-Link smart plugs on the server's network.
+//
+// Plugs are identified by MAC address,
+// which may be given with or without separators.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v4.25.3
+// source: tpplug.proto
+
+package tpplugpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Plugs_ListPlugs_FullMethodName    = "/tpplug.v1.Plugs/ListPlugs"
+	Plugs_GetState_FullMethodName     = "/tpplug.v1.Plugs/GetState"
+	Plugs_SetRelay_FullMethodName     = "/tpplug.v1.Plugs/SetRelay"
+	Plugs_StreamEvents_FullMethodName = "/tpplug.v1.Plugs/StreamEvents"
+)
+
+// PlugsClient is the client API for Plugs service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PlugsClient interface {
+	// ListPlugs returns all known plugs.
+	ListPlugs(ctx context.Context, in *ListPlugsRequest, opts ...grpc.CallOption) (*ListPlugsResponse, error)
+	// GetState queries a plug for its current state.
+	GetState(ctx context.Context, in *GetStateRequest, opts ...grpc.CallOption) (*Plug, error)
+	// SetRelay turns a plug on or off.
+	SetRelay(ctx context.Context, in *SetRelayRequest, opts ...grpc.CallOption) (*Plug, error)
+	// StreamEvents streams changes to plugs until the client goes away.
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Plugs_StreamEventsClient, error)
+}
+
+type plugsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPlugsClient(cc grpc.ClientConnInterface) PlugsClient {
+	return &plugsClient{cc}
+}
+
+func (c *plugsClient) ListPlugs(ctx context.Context, in *ListPlugsRequest, opts ...grpc.CallOption) (*ListPlugsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListPlugsResponse)
+	err := c.cc.Invoke(ctx, Plugs_ListPlugs_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *plugsClient) GetState(ctx context.Context, in *GetStateRequest, opts ...grpc.CallOption) (*Plug, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Plug)
+	err := c.cc.Invoke(ctx, Plugs_GetState_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *plugsClient) SetRelay(ctx context.Context, in *SetRelayRequest, opts ...grpc.CallOption) (*Plug, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Plug)
+	err := c.cc.Invoke(ctx, Plugs_SetRelay_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *plugsClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Plugs_StreamEventsClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Plugs_ServiceDesc.Streams[0], Plugs_StreamEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &plugsStreamEventsClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Plugs_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type plugsStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *plugsStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PlugsServer is the server API for Plugs service.
+// All implementations must embed UnimplementedPlugsServer
+// for forward compatibility
+type PlugsServer interface {
+	// ListPlugs returns all known plugs.
+	ListPlugs(context.Context, *ListPlugsRequest) (*ListPlugsResponse, error)
+	// GetState queries a plug for its current state.
+	GetState(context.Context, *GetStateRequest) (*Plug, error)
+	// SetRelay turns a plug on or off.
+	SetRelay(context.Context, *SetRelayRequest) (*Plug, error)
+	// StreamEvents streams changes to plugs until the client goes away.
+	StreamEvents(*StreamEventsRequest, Plugs_StreamEventsServer) error
+	mustEmbedUnimplementedPlugsServer()
+}
+
+// UnimplementedPlugsServer must be embedded to have forward compatible implementations.
+type UnimplementedPlugsServer struct {
+}
+
+func (UnimplementedPlugsServer) ListPlugs(context.Context, *ListPlugsRequest) (*ListPlugsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPlugs not implemented")
+}
+func (UnimplementedPlugsServer) GetState(context.Context, *GetStateRequest) (*Plug, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetState not implemented")
+}
+func (UnimplementedPlugsServer) SetRelay(context.Context, *SetRelayRequest) (*Plug, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetRelay not implemented")
+}
+func (UnimplementedPlugsServer) StreamEvents(*StreamEventsRequest, Plugs_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedPlugsServer) mustEmbedUnimplementedPlugsServer() {}
+
+// UnsafePlugsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PlugsServer will
+// result in compilation errors.
+type UnsafePlugsServer interface {
+	mustEmbedUnimplementedPlugsServer()
+}
+
+func RegisterPlugsServer(s grpc.ServiceRegistrar, srv PlugsServer) {
+	s.RegisterService(&Plugs_ServiceDesc, srv)
+}
+
+func _Plugs_ListPlugs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPlugsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlugsServer).ListPlugs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugs_ListPlugs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlugsServer).ListPlugs(ctx, req.(*ListPlugsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugs_GetState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlugsServer).GetState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugs_GetState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlugsServer).GetState(ctx, req.(*GetStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugs_SetRelay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRelayRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlugsServer).SetRelay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Plugs_SetRelay_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlugsServer).SetRelay(ctx, req.(*SetRelayRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Plugs_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PlugsServer).StreamEvents(m, &plugsStreamEventsServer{ServerStream: stream})
+}
+
+type Plugs_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type plugsStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *plugsStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Plugs_ServiceDesc is the grpc.ServiceDesc for Plugs service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Plugs_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tpplug.v1.Plugs",
+	HandlerType: (*PlugsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListPlugs",
+			Handler:    _Plugs_ListPlugs_Handler,
+		},
+		{
+			MethodName: "GetState",
+			Handler:    _Plugs_GetState_Handler,
+		},
+		{
+			MethodName: "SetRelay",
+			Handler:    _Plugs_SetRelay_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _Plugs_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "tpplug.proto",
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -scan_schedule, the background scans (-scan_interval, -poll_interval,
+// -file_sd and -remote_write) happen at the times given by cron specs instead
+// of at their intervals, which lets a host on battery or solar keep quiet overnight.
+// Each spec has the usual five fields (minute, hour, day of month, month,
+// day of week), each of which may be *, a number, a range (1-5), a step
+// (*/15 or 0-30/10) or a comma-separated list of those. Several specs may be
+// separated by semicolons, and a scan happens when any of them matches.
+// For instance, to scan every minute from 06:00 to 23:00, and hourly overnight:
+//
+//	-scan_schedule='* 6-22 * * *; 0 23,0-5 * * *'
+//
+// As with cron, if both the day of month and day of week are restricted,
+// a day matching either will do. Times are in the local timezone.
+
+// schedule is a parsed -scan_schedule.
+type schedule []cronSpec
+
+// cronSpec is one cron spec. Each field is a set of the values that match.
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 7 is Sunday too
+}
+
+func parseSchedule(s string) (schedule, error) {
+	var sc schedule
+	for _, spec := range strings.Split(s, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		cs, err := parseCronSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %w", spec, err)
+		}
+		sc = append(sc, cs)
+	}
+	if len(sc) == 0 {
+		return nil, fmt.Errorf("no cron specs")
+	}
+	if sc.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("never matches")
+	}
+	return sc, nil
+}
+
+func parseCronSpec(spec string) (cronSpec, error) {
+	fs := strings.Fields(spec)
+	if len(fs) != len(cronFields) {
+		return cronSpec{}, fmt.Errorf("got %d fields, want %d", len(fs), len(cronFields))
+	}
+	var sets [5]map[int]bool
+	for i, f := range fs {
+		cf := cronFields[i]
+		set, err := parseCronField(f, cf.min, cf.max)
+		if err != nil {
+			return cronSpec{}, fmt.Errorf("%s: %w", cf.name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return cronSpec{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fs[2] == "*", dowStar: fs[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr := part, ""
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng, stepStr = part[:i], part[i+1:]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			loStr, hiStr := rng, rng
+			if i := strings.Index(rng, "-"); i >= 0 {
+				loStr, hiStr = rng[:i], rng[i+1:]
+			}
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return nil, fmt.Errorf("bad value %q", loStr)
+			}
+			if hi, err = strconv.Atoi(hiStr); err != nil {
+				return nil, fmt.Errorf("bad value %q", hiStr)
+			}
+			if stepStr != "" && !strings.Contains(rng, "-") {
+				hi = max // as in "5/10"
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		step := 1
+		if stepStr != "" {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return nil, fmt.Errorf("bad step %q", stepStr)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (cs cronSpec) matchDay(t time.Time) bool {
+	if !cs.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := cs.dom[t.Day()], cs.dow[int(t.Weekday())]
+	switch {
+	case cs.domStar && cs.dowStar:
+		return true
+	case cs.domStar:
+		return dow
+	case cs.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t that a spec matches,
+// or the zero time if none does in the next few years.
+func (sc schedule) next(t time.Time) time.Time {
+	var best time.Time
+	for _, cs := range sc {
+		if n := cs.next(t); !n.IsZero() && (best.IsZero() || n.Before(best)) {
+			best = n
+		}
+	}
+	return best
+}
+
+func (cs cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // long enough for 29 February
+	for t.Before(limit) {
+		if !cs.matchDay(t) {
+			y, m, d := t.Date()
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.hour[t.Hour()] {
+			y, m, d := t.Date()
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// waitScan waits until the next background scan is due:
+// the next time in -scan_schedule if it is set, else after interval.
+func waitScan(interval time.Duration) {
+	if scanSched == nil {
+		time.Sleep(interval)
+		return
+	}
+	time.Sleep(time.Until(scanSched.next(time.Now())))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// As well as exporting every plug it discovers on /metrics, the exporter can
+// be scraped one plug at a time through /probe?target=<ip>, in the style of
+// the blackbox exporter. Prometheus can find the targets for that through
+// /sd (for http_sd_configs), or a file written with -file_sd (for file_sd_configs),
+// and use relabelling to turn each target into a target parameter:
+//
+//	relabel_configs:
+//	  - source_labels: [__address__]
+//	    target_label: __param_target
+//	  - source_labels: [__param_target]
+//	    target_label: instance
+//	  - target_label: __address__
+//	    replacement: localhost:<port>
+
+var probeSuccessDesc = prometheus.NewDesc("probe_success",
+	"Whether the probed plug responded",
+	nil, nil)
+
+// serveProbe serves the metrics for a single plug.
+func (dc *dataCollector) serveProbe(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "missing target parameter", http.StatusBadRequest)
+		return
+	}
+	addr, err := probeAddr(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(probeCollector{dc: dc, addr: addr})
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeAddr parses a probe target, which is an IP address with an optional port.
+func probeAddr(target string) (*net.UDPAddr, error) {
+	addr, err := tpplug.ParseAddr(target, tpplug.DefaultPort)
+	if err != nil {
+		return nil, fmt.Errorf("bad target %q (want IP address, optionally with port): %w", target, err)
+	}
+	return addr, nil
+}
+
+// probeCollector collects the metrics for a single plug.
+type probeCollector struct {
+	dc   *dataCollector
+	addr *net.UDPAddr
+}
+
+func (pc probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeSuccessDesc
+	ch <- powerDesc
+	ch <- apparentPowerDesc
+	ch <- powerFactorDesc
+	ch <- deviceInfoDesc
+}
+
+func (pc probeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(withRetries(context.Background()), *scanTime)
+	defer cancel()
+	var ok float64
+	if state, err := tpplug.Query(ctx, pc.addr); err != nil {
+		log.Printf("Probing %v: %v", pc.addr, err)
+	} else {
+		pc.dc.sendPower(ch, state, pc.addr)
+		ok = 1
+	}
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, ok)
+}
+
+// sdTargetGroup is a target group in the format of file_sd and http_sd.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdTargets discovers plugs, and returns them as target groups, one per plug.
+func (dc *dataCollector) sdTargets(ctx context.Context) ([]sdTargetGroup, error) {
+	drs, err := dc.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tgs := []sdTargetGroup{} // not nil, so it encodes as []
+	for _, dr := range drs {
+		info := dr.State.System.Info
+		if dc.ignore[info.MAC] {
+			continue
+		}
+		target := dr.Addr.IP.String()
+		if dr.Addr.Port != 9999 {
+			target = dr.Addr.String()
+		}
+		tgs = append(tgs, sdTargetGroup{
+			Targets: []string{target},
+			Labels: map[string]string{
+				"mac":   info.MAC.String(),
+				"alias": info.Alias,
+				"name":  dc.devices.Name(dr.State),
+			},
+		})
+	}
+	sort.Slice(tgs, func(i, j int) bool { return tgs[i].Labels["mac"] < tgs[j].Labels["mac"] })
+	return tgs, nil
+}
+
+// serveSD serves the discovered plugs for Prometheus's http_sd.
+func (dc *dataCollector) serveSD(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), *scanTime)
+	defer cancel()
+	tgs, err := dc.sdTargets(ctx)
+	if err != nil {
+		http.Error(w, "discovery failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tgs)
+}
+
+// writeFileSD rediscovers plugs every interval (or as -scan_schedule says),
+// forever, and writes them to filename for Prometheus's file_sd.
+// The file is replaced atomically, so Prometheus never sees it partly written.
+func (dc *dataCollector) writeFileSD(filename string, interval time.Duration) {
+	for {
+		if err := dc.writeFileSDOnce(filename); err != nil {
+			log.Printf("Writing file_sd targets: %v", err)
+		}
+		waitScan(interval)
+	}
+}
+
+func (dc *dataCollector) writeFileSDOnce(filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *scanTime)
+	defer cancel()
+	tgs, err := dc.sdTargets(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(tgs, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
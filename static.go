@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Plugs given with -targets are queried directly on every scan,
+// which finds them even where broadcasts don't reach.
+// With -no_broadcast, they are the only plugs, for networks
+// whose policy forbids monitoring hosts from broadcasting.
+//
+// With -deep_scan_interval, scans broadcast at most that often (a deep scan);
+// the scans between (shallow scans) only query the plugs already known,
+// which keeps power readings as fresh with less Wi-Fi chatter.
+// Shallow scans happen on every scrape, or as often as -poll_interval
+// for the min, max and average power.
+
+// With -plugs, known plugs are listed in a YAML file instead, optionally
+// with the MAC each should answer as:
+//
+//	- ip: 10.20.0.5
+//	  mac: "50:C7:BF:00:00:01"
+//	  discoverable: false       # broadcasts don't reach it; query it on every scan
+//	- ip: "192.168.1.30:9999"
+//
+// A plug is discoverable unless it says otherwise, and only queried directly
+// when a scan doesn't otherwise find it (by MAC if given, or else by address).
+// A plug that answers with a different MAC is left out, and logged.
+
+// staticPlug is a plug from -plugs.
+type staticPlug struct {
+	IP           string
+	MAC          string
+	Discoverable *bool
+
+	addr *net.UDPAddr
+	mac  tpplug.MAC // canonical, if MAC was set
+}
+
+func (sp *staticPlug) discoverable() bool { return sp.Discoverable == nil || *sp.Discoverable }
+
+func loadStaticPlugs(path string) ([]*staticPlug, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sps []*staticPlug
+	if err := yaml.UnmarshalStrict(raw, &sps); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, sp := range sps {
+		if sp.IP == "" {
+			return nil, fmt.Errorf("plug %d has no ip", i+1)
+		}
+		if sp.addr, err = probeAddr(sp.IP); err != nil {
+			return nil, fmt.Errorf("plug %d: %w", i+1, err)
+		}
+		if seen[sp.addr.String()] {
+			return nil, fmt.Errorf("duplicate plug %v", sp.addr)
+		}
+		seen[sp.addr.String()] = true
+		if sp.MAC != "" {
+			if sp.mac, err = tpplug.ParseMAC(sp.MAC); err != nil {
+				return nil, fmt.Errorf("plug %v: %w", sp.addr, err)
+			}
+		}
+	}
+	return sps, nil
+}
+
+// queryStatic queries each of sps at once, and returns the responses
+// from those that answer as the right plug.
+func queryStatic(ctx context.Context, sps []*staticPlug) []tpplug.DiscoveryResponse {
+	addrs := make([]*net.UDPAddr, len(sps))
+	want := make(map[string]tpplug.MAC)
+	for i, sp := range sps {
+		addrs[i] = sp.addr
+		want[sp.addr.String()] = sp.mac
+	}
+	var drs []tpplug.DiscoveryResponse
+	for _, dr := range queryTargets(ctx, addrs, true) {
+		mac := dr.State.System.Info.MAC
+		if w := want[dr.Addr.String()]; w != "" && mac != w {
+			log.Printf("Plug at %v answered as %s, not %s as -plugs says; ignoring it", dr.Addr, mac, w)
+			continue
+		}
+		drs = append(drs, dr)
+	}
+	return drs
+}
+
+// parseTargets parses a comma-separated list of plug addresses.
+func parseTargets(list string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		addr, err := probeAddr(t)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// discover finds plugs on each network (see networks.go), by discovery
+// (unless -no_broadcast is set) and by querying -targets and -plugs.
+// Between deep scans (see -deep_scan_interval), it instead queries the plugs already known.
+func (dc *dataCollector) discover(ctx context.Context) ([]tpplug.DiscoveryResponse, error) {
+	broadcast, known := dc.scanPlan(time.Now())
+	var always, later []*staticPlug
+	for _, sp := range dc.static {
+		if sp.discoverable() {
+			later = append(later, sp)
+		} else {
+			always = append(always, sp)
+		}
+	}
+	var shallow, static []tpplug.DiscoveryResponse
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		shallow = queryTargets(ctx, known, false)
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		static = queryStatic(ctx, always)
+	}()
+	drs, err := dc.scanNetworks(ctx, broadcast)
+	<-done
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	var out []tpplug.DiscoveryResponse
+	seen := make(map[tpplug.MAC]bool)
+	seenAddr := make(map[string]bool)
+	add := func(drs []tpplug.DiscoveryResponse) {
+		for _, dr := range drs {
+			if mac := dr.State.System.Info.MAC; !seen[mac] {
+				seen[mac] = true
+				seenAddr[dr.Addr.String()] = true
+				out = append(out, dr)
+			}
+		}
+	}
+	add(drs)
+	add(shallow)
+	add(static)
+
+	// Discoverable plugs that this scan didn't find get a chance of their own;
+	// ctx has run out by now.
+	var missed []*staticPlug
+	for _, sp := range later {
+		if (sp.mac != "" && !seen[sp.mac]) || (sp.mac == "" && !seenAddr[sp.addr.String()]) {
+			missed = append(missed, sp)
+		}
+	}
+	if len(missed) > 0 {
+		qctx, cancel := context.WithTimeout(withRetries(tpplug.KeepRaw(context.Background())), 1*time.Second)
+		add(queryStatic(qctx, missed))
+		cancel()
+	}
+	return out, nil
+}
+
+// scanPlan decides whether a scan starting at now should broadcast,
+// and which known plugs (other than targets) it should query directly instead.
+func (dc *dataCollector) scanPlan(now time.Time) (broadcast bool, known []*net.UDPAddr) {
+	isTarget := make(map[string]bool)
+	anyBroadcast := false
+	for _, n := range dc.networks {
+		for _, addr := range n.targets {
+			isTarget[addr.String()] = true
+		}
+		anyBroadcast = anyBroadcast || !n.NoBroadcast
+	}
+	for _, sp := range dc.static {
+		if !sp.discoverable() {
+			isTarget[sp.addr.String()] = true
+		}
+	}
+	if !anyBroadcast {
+		return false, nil
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if *deepScanInterval <= 0 || dc.prev == nil || now.Sub(dc.lastDeep) >= *deepScanInterval {
+		dc.lastDeep = now
+		return true, nil
+	}
+	for mac, info := range dc.prev {
+		if !dc.ignore[mac] && now.Sub(info.Seen) <= *history && !isTarget[info.Addr.String()] {
+			known = append(known, info.Addr)
+		}
+	}
+	return false, known
+}
+
+// queryTargets queries each of addrs at once, and returns the responses.
+// If logErrs is set, it logs those that fail.
+func queryTargets(ctx context.Context, addrs []*net.UDPAddr, logErrs bool) []tpplug.DiscoveryResponse {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		drs []tpplug.DiscoveryResponse
+	)
+	for _, addr := range addrs {
+		addr := addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := tpplug.Query(ctx, addr)
+			if err != nil {
+				if logErrs {
+					log.Printf("Querying target %v: %v", addr, err)
+				}
+				return
+			}
+			mu.Lock()
+			drs = append(drs, tpplug.DiscoveryResponse{Addr: addr, State: state, Kind: state.Kind()})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return drs
+}
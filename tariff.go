@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// With -tariff, the exporter works out what each plug costs to run,
+// from its power readings (from scrapes, and -poll_interval if set)
+// and a flat or time of use tariff given by a YAML file:
+//
+//	rate: 0.30          # per kWh, when no period applies
+//	periods:            # time of use; the first that applies wins
+//	  - from: "15:00"
+//	    to: "21:00"
+//	    days: [mon, tue, wed, thu, fri]   # default every day
+//	    rate: 0.45
+//	  - from: "22:00"
+//	    to: "07:00"     # may wrap past midnight
+//	    rate: 0.15
+//
+// The running cost of each plug is exported as cost_dollars_total,
+// though it is in whatever currency the rates are.
+
+var (
+	costDesc = prometheus.NewDesc("cost_dollars_total",
+		"Cost of the energy used by a plug while watched by this exporter, at the rates of -tariff",
+		[]string{"mac", "ip", "name", "host"}, nil)
+	tariffRateDesc = prometheus.NewDesc("tariff_rate_per_kwh",
+		"Current price of energy from -tariff",
+		nil, nil)
+)
+
+type tariff struct {
+	Rate    float64        `yaml:"rate"`
+	Periods []tariffPeriod `yaml:"periods"`
+}
+
+type tariffPeriod struct {
+	From string   `yaml:"from"` // "15:04"
+	To   string   `yaml:"to"`
+	Days []string `yaml:"days"` // "mon", "tue", ...
+	Rate float64  `yaml:"rate"`
+
+	from, to int // minutes after midnight
+	days     map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func loadTariff(path string) (*tariff, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t tariff
+	if err := yaml.UnmarshalStrict(raw, &t); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range t.Periods {
+		p := &t.Periods[i]
+		if p.from, err = minuteOfDay(p.From); err != nil {
+			return nil, fmt.Errorf("tariff period %d: from: %w", i+1, err)
+		}
+		if p.to, err = minuteOfDay(p.To); err != nil {
+			return nil, fmt.Errorf("tariff period %d: to: %w", i+1, err)
+		}
+		if len(p.Days) > 0 {
+			p.days = make(map[time.Weekday]bool)
+		}
+		for _, d := range p.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("tariff period %d: bad day %q", i+1, d)
+			}
+			p.days[wd] = true
+		}
+	}
+	return &t, nil
+}
+
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// rate returns the price per kWh at t.
+func (tf *tariff) rate(t time.Time) float64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, p := range tf.Periods {
+		if p.days != nil && !p.days[t.Weekday()] {
+			continue
+		}
+		in := p.from <= m && m < p.to
+		if p.to <= p.from { // wraps past midnight
+			in = m >= p.from || m < p.to
+		}
+		if in {
+			return p.Rate
+		}
+	}
+	return tf.Rate
+}
+
+// accrue adds the cost of the energy used by a plug between two readings.
+// Readings too far apart are skipped, since nothing is known of what happened between.
+// dc.mu must be held.
+func (dc *dataCollector) accrue(mac tpplug.MAC, prev, cur reading) {
+	if dc.tariff == nil {
+		return
+	}
+	dt := cur.Time.Sub(prev.Time)
+	if dt <= 0 || dt > *history {
+		return
+	}
+	kwh := (prev.Power + cur.Power) / 2 / 1e6 * dt.Hours() // mW to kW
+	dc.costs[mac] += kwh * dc.tariff.rate(prev.Time)
+}
+
+// sendCosts sends the running cost of the given plugs.
+func (dc *dataCollector) sendCosts(ch chan<- prometheus.Metric, macs map[tpplug.MAC]macInfo) {
+	if dc.tariff == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(tariffRateDesc, prometheus.GaugeValue, dc.tariff.rate(time.Now()))
+	dc.mu.Lock()
+	costs := make(map[tpplug.MAC]float64)
+	for mac, c := range dc.costs {
+		costs[mac] = c
+	}
+	dc.mu.Unlock()
+	for mac, c := range costs {
+		info, ok := macs[mac]
+		if !ok || dc.ignore[mac] {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(costDesc, prometheus.CounterValue, c, dc.plugLabels(info.State, info.Addr)...)
+	}
+}
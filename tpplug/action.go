@@ -2,6 +2,7 @@ package tpplug
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -57,7 +58,10 @@ type addRule struct {
 	errResponse
 }
 
-func setRelay(ctx context.Context, addr *net.UDPAddr, newValue, revertValue int, revertDur time.Duration) error {
+func setRelay(ctx context.Context, addr *net.UDPAddr, newValue, revertValue int, revertDur time.Duration) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetRelayState", addr)
+	defer func() { end(err) }()
+
 	revert := revertDur != 0
 
 	s := int(revertDur / time.Second)
@@ -91,23 +95,137 @@ func setRelay(ctx context.Context, addr *net.UDPAddr, newValue, revertValue int,
 		return err
 	}
 
-	// Two possible failure modes: setting relay state, or adding count down rule.
+	return resp.relayErr(revert)
+}
+
+// relayErr returns the error in a response to setRelay's command, if any.
+// There are two possible failure modes: setting relay state, or adding count down rule.
+func (resp *command) relayErr(revert bool) error {
+	if resp.System == nil || resp.System.SetRelayState == nil {
+		return invalidf("no response to set_relay_state")
+	}
 	if err := resp.System.SetRelayState.Err(); err != nil {
 		return err
 	}
-	if revert {
-		return resp.CountDown.AddRule.Err()
+	if !revert {
+		return nil
 	}
-	return nil
+	if resp.CountDown == nil || resp.CountDown.AddRule == nil {
+		return invalidf("no response to add_rule")
+	}
+	return resp.CountDown.AddRule.Err()
 }
 
 func SetRelayState(ctx context.Context, addr *net.UDPAddr, newState int) error {
 	return setRelay(ctx, addr, newState, 0, 0)
 }
 
+// ErrStateChanged is wrapped by the error from SetRelayStateIf
+// when the relay isn't in the expected state.
+var ErrStateChanged = errors.New("relay state changed")
+
+// SetRelayStateIf sets a plug's relay to newState, but only if it is currently in expectCurrent.
+// This avoids overriding a change made by something else (such as the Kasa app)
+// since the caller last looked. Checking and setting are separate operations,
+// so this narrows the window for a race rather than closing it.
+func SetRelayStateIf(ctx context.Context, addr *net.UDPAddr, expectCurrent, newState int) error {
+	state, err := QuerySysinfoOnly(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if cur := state.System.Info.RelayState; cur != expectCurrent {
+		return fmt.Errorf("%w: relay state is %d, want %d", ErrStateChanged, cur, expectCurrent)
+	}
+	return SetRelayState(ctx, addr, newState)
+}
+
 func SetRelayTemporarily(ctx context.Context, addr *net.UDPAddr, newValue, revertValue int, revertDur time.Duration) error {
 	if revertDur <= 0 {
 		return fmt.Errorf("duration %v not positive", revertDur)
 	}
 	return setRelay(ctx, addr, newValue, revertValue, revertDur)
 }
+
+// Mode is what a plug's own timers are doing, as reported in its active_mode.
+// A plug in ModeSchedule or ModeCountdown may switch its relay by itself,
+// fighting with anything else controlling it.
+type Mode string
+
+const (
+	ModeNone      Mode = "none"
+	ModeSchedule  Mode = "schedule"
+	ModeCountdown Mode = "count_down"
+)
+
+type modeCommand struct {
+	Schedule  *modeSchedule  `json:"schedule,omitempty"`
+	CountDown *modeCountDown `json:"count_down,omitempty"`
+}
+
+type modeSchedule struct {
+	SetOverallEnable *setOverallEnable `json:"set_overall_enable,omitempty"`
+}
+
+type modeCountDown struct {
+	DeleteAllRules *struct{} `json:"delete_all_rules,omitempty"`
+}
+
+// modeResponse is the response to a modeCommand.
+type modeResponse struct {
+	Schedule  *modeSchedule `json:"schedule"`
+	CountDown *struct {
+		DeleteAllRules *errResponse `json:"delete_all_rules"`
+	} `json:"count_down"`
+}
+
+type setOverallEnable struct {
+	// Input.
+	Enable int `json:"enable"`
+
+	// Output.
+	errResponse
+}
+
+// SetMode sets what a plug's own timers may do.
+// ModeNone disables its schedule and clears any countdown rule,
+// leaving it entirely under external control.
+// ModeSchedule enables its schedule, and clears any countdown rule,
+// which would otherwise take precedence.
+// A countdown can't be started this way; use SetRelayTemporarily or AddCountdown.
+func SetMode(ctx context.Context, addr *net.UDPAddr, mode Mode) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetMode", addr)
+	defer func() { end(err) }()
+
+	var enable int
+	switch mode {
+	case ModeNone:
+	case ModeSchedule:
+		enable = 1
+	case ModeCountdown:
+		return errors.New("can't set count_down mode directly; use SetRelayTemporarily")
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	req := modeCommand{
+		Schedule:  &modeSchedule{SetOverallEnable: &setOverallEnable{Enable: enable}},
+		CountDown: &modeCountDown{DeleteAllRules: &struct{}{}},
+	}
+	var resp modeResponse
+	if err := RawJSONOp(ctx, addr, &req, &resp); err != nil {
+		return err
+	}
+	if resp.Schedule == nil || resp.Schedule.SetOverallEnable == nil {
+		return errors.New("no response to set_overall_enable")
+	}
+	if err := resp.Schedule.SetOverallEnable.Err(); err != nil {
+		return fmt.Errorf("set_overall_enable: %w", err)
+	}
+	if resp.CountDown == nil || resp.CountDown.DeleteAllRules == nil {
+		return errors.New("no response to delete_all_rules")
+	}
+	if err := resp.CountDown.DeleteAllRules.Err(); err != nil {
+		return fmt.Errorf("delete_all_rules: %w", err)
+	}
+	return nil
+}
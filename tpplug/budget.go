@@ -0,0 +1,120 @@
+package tpplug
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Budget limits how many packets this process sends to plugs,
+// so that a tight loop or too many scrapers can't flood the network.
+// Packets over budget are queued until the budget allows them,
+// or until their context is done.
+// A zero rate means no limit.
+type Budget struct {
+	// PacketsPerSecond limits all packets, including broadcasts.
+	PacketsPerSecond float64
+	// BroadcastsPerSecond additionally limits discovery broadcasts.
+	BroadcastsPerSecond float64
+	// Burst is how many packets (or broadcasts) may be sent at once
+	// after a quiet period. It is at least 1.
+	Burst int
+}
+
+// DefaultBudget is the Budget in effect unless SetBudget is called.
+// It is generous enough for any reasonable use.
+var DefaultBudget = Budget{
+	PacketsPerSecond:    50,
+	BroadcastsPerSecond: 1,
+	Burst:               5,
+}
+
+var (
+	packetLimit    = newLimiter(DefaultBudget.PacketsPerSecond, DefaultBudget.Burst)
+	broadcastLimit = newLimiter(DefaultBudget.BroadcastsPerSecond, DefaultBudget.Burst)
+
+	budgetMu sync.Mutex
+	budget   = DefaultBudget // as last set
+)
+
+// SetBudget sets the packet budget for the whole process.
+// Packets already queued keep their place under the old budget.
+func SetBudget(b Budget) {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	budget = b
+	packetLimit.set(b.PacketsPerSecond, b.Burst)
+	broadcastLimit.set(b.BroadcastsPerSecond, b.Burst)
+}
+
+// CurrentBudget returns the packet budget in effect.
+func CurrentBudget() Budget {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	return budget
+}
+
+// limiter is a token bucket.
+// Callers that find it empty take a token anyway, driving it negative,
+// and wait for it to refill; that makes waiters queue in arrival order.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second; zero for no limit
+	burst  float64
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	l := &limiter{}
+	l.set(rate, burst)
+	return l
+}
+
+func (l *limiter) set(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+	l.tokens, l.last = l.burst, time.Now()
+}
+
+// wait blocks until a token is available, or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back so later callers don't wait for it.
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return fmt.Errorf("waiting for packet budget: %w", ctx.Err())
+	}
+}
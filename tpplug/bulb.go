@@ -0,0 +1,175 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Bulbs and light strips, such as the KL110, KL130 and LB130, speak the same
+// protocol as plugs, but have no relay: their light is driven by
+// the smartlife.iot.smartbulb.lightingservice module instead, with QueryLight
+// and SetLight. Their system information includes the light's state (see
+// State.System.Info.Light). Dimmer switches, such as the HS220, have a relay,
+// and a brightness set with SetBrightness. State.Kind tells them apart.
+
+// LightState is the state of a bulb's light.
+// When the light is off, the rest is what it will return to when turned on.
+type LightState struct {
+	OnOff      int    `json:"on_off"`               // 1 = on, 0 = off
+	Mode       string `json:"mode,omitempty"`       // e.g. "normal", "circadian"
+	Brightness int    `json:"brightness,omitempty"` // percent
+	ColorTemp  int    `json:"color_temp,omitempty"` // K, or 0 when showing Hue and Saturation
+	Hue        int    `json:"hue,omitempty"`        // degrees
+	Saturation int    `json:"saturation,omitempty"` // percent
+	// Other keys: dft_on_state, err_code
+}
+
+func (ls *LightState) UnmarshalJSON(b []byte) error {
+	type plain LightState // without this method
+	var v struct {
+		plain
+		Default *plain `json:"dft_on_state"` // when off
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*ls = LightState(v.plain)
+	if v.Default != nil && ls.OnOff == 0 {
+		*ls = LightState(*v.Default)
+		ls.OnOff = 0
+	}
+	return nil
+}
+
+func (ls LightState) validate() error {
+	if ls.OnOff != 0 && ls.OnOff != 1 {
+		return invalidf("light on_off %d", ls.OnOff)
+	}
+	if len(ls.Mode) > maxStringLen {
+		return invalidf("light mode is %d bytes long", len(ls.Mode))
+	}
+	if ls.Brightness < 0 || ls.Brightness > 100 || ls.Saturation < 0 || ls.Saturation > 100 {
+		return invalidf("light brightness %d, saturation %d", ls.Brightness, ls.Saturation)
+	}
+	if ls.Hue < 0 || ls.Hue > 360 || ls.ColorTemp < 0 {
+		return invalidf("light hue %d, color temperature %d", ls.Hue, ls.ColorTemp)
+	}
+	return nil
+}
+
+// LightChange is a change to a bulb's light, as made by SetLight.
+// Fields that are nil are left as they are.
+type LightChange struct {
+	On         *bool
+	Brightness *int // percent, 1 to 100
+	ColorTemp  *int // K; 0 shows Hue and Saturation instead
+	Hue        *int // degrees, 0 to 360
+	Saturation *int // percent, 0 to 100
+
+	// Transition is how long the light takes to fade to its new state,
+	// in whole milliseconds. Zero leaves it to the bulb.
+	Transition time.Duration
+}
+
+func (lc LightChange) check() error {
+	if lc.Brightness != nil && (*lc.Brightness < 1 || *lc.Brightness > 100) {
+		return fmt.Errorf("brightness %d is not within [1, 100]", *lc.Brightness)
+	}
+	if lc.ColorTemp != nil && *lc.ColorTemp < 0 {
+		return fmt.Errorf("negative color temperature %d", *lc.ColorTemp)
+	}
+	if lc.Hue != nil && (*lc.Hue < 0 || *lc.Hue > 360) {
+		return fmt.Errorf("hue %d is not within [0, 360]", *lc.Hue)
+	}
+	if lc.Saturation != nil && (*lc.Saturation < 0 || *lc.Saturation > 100) {
+		return fmt.Errorf("saturation %d is not within [0, 100]", *lc.Saturation)
+	}
+	if lc.Transition < 0 {
+		return fmt.Errorf("negative transition %v", lc.Transition)
+	}
+	return nil
+}
+
+var (
+	lightGetState       = commandName{"smartlife.iot.smartbulb.lightingservice", "get_light_state"}
+	lightTransition     = commandName{"smartlife.iot.smartbulb.lightingservice", "transition_light_state"}
+	dimmerSetBrightness = commandName{"smartlife.iot.dimmer", "set_brightness"}
+)
+
+// QueryLight returns the state of a bulb's light.
+func QueryLight(ctx context.Context, addr *net.UDPAddr) (_ LightState, err error) {
+	ctx, end := startSpan(ctx, "tpplug.QueryLight", addr)
+	defer func() { end(err) }()
+
+	var ls LightState
+	if err := sendCommand(ctx, addr, lightGetState, struct{}{}, &ls); err != nil {
+		return LightState{}, err
+	}
+	if err := ls.validate(); err != nil {
+		return LightState{}, fmt.Errorf("%s.%s: %w", lightGetState.module, lightGetState.method, err)
+	}
+	return ls, nil
+}
+
+// SetLight changes a bulb's light, returning its state afterwards.
+func SetLight(ctx context.Context, addr *net.UDPAddr, lc LightChange) (_ LightState, err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetLight", addr)
+	defer func() { end(err) }()
+
+	if err := lc.check(); err != nil {
+		return LightState{}, err
+	}
+	req := map[string]int{
+		"ignore_default": 1, // otherwise turning on ignores the rest
+	}
+	if lc.On != nil {
+		req["on_off"] = 0
+		if *lc.On {
+			req["on_off"] = 1
+		}
+	}
+	for _, f := range []struct {
+		key string
+		val *int
+	}{
+		{"brightness", lc.Brightness},
+		{"color_temp", lc.ColorTemp},
+		{"hue", lc.Hue},
+		{"saturation", lc.Saturation},
+	} {
+		if f.val != nil {
+			req[f.key] = *f.val
+		}
+	}
+	if lc.Transition > 0 {
+		req["transition_period"] = int(lc.Transition / time.Millisecond)
+	}
+	if len(req) == 1 {
+		return LightState{}, errors.New("empty light change")
+	}
+
+	var ls LightState
+	if err := sendCommand(ctx, addr, lightTransition, req, &ls); err != nil {
+		return LightState{}, err
+	}
+	if err := ls.validate(); err != nil {
+		return LightState{}, fmt.Errorf("%s.%s: %w", lightTransition.module, lightTransition.method, err)
+	}
+	return ls, nil
+}
+
+// SetBrightness sets the brightness of a dimmer switch, in percent from 1 to 100.
+// Its relay is switched as for a plug. For bulbs, use SetLight.
+func SetBrightness(ctx context.Context, addr *net.UDPAddr, brightness int) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetBrightness", addr)
+	defer func() { end(err) }()
+
+	if brightness < 1 || brightness > 100 {
+		return fmt.Errorf("brightness %d is not within [1, 100]", brightness)
+	}
+	return sendCommand(ctx, addr, dimmerSetBrightness, map[string]int{"brightness": brightness}, nil)
+}
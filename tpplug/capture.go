@@ -0,0 +1,358 @@
+package tpplug
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// A CapturedMessage is a message to or from a plug, found in a packet capture.
+type CapturedMessage struct {
+	Time     time.Time
+	Src, Dst net.Addr // *net.UDPAddr or *net.TCPAddr
+	Data     []byte   // decrypted
+}
+
+// ReadCapture reads a packet capture, in pcap or pcapng format,
+// and returns the decrypted messages sent to or from the given port
+// (normally 9999) over UDP or TCP. TCP streams are reassembled.
+// Packets that can't be parsed are skipped.
+func ReadCapture(r io.Reader, port int) ([]CapturedMessage, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 4 {
+		return nil, errors.New("capture too short")
+	}
+	cd := &captureDecoder{port: port, flows: make(map[string]*tcpFlow)}
+	if binary.LittleEndian.Uint32(raw) == 0x0A0D0D0A {
+		err = cd.readPcapng(raw)
+	} else {
+		err = cd.readPcap(raw)
+	}
+	return cd.msgs, err
+}
+
+// DecodeHex decrypts a single captured message given in hex, such as
+// Wireshark's "Copy as Hex Stream" of a UDP or TCP payload.
+// Whitespace and colons are ignored. The length prefix of a TCP payload
+// is detected and removed.
+func DecodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	s = strings.Map(func(r rune) rune {
+		if r == ':' || r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 4 && int(binary.BigEndian.Uint32(b)) == len(b)-4 {
+		b = b[4:]
+	}
+	Decrypt(b)
+	return b, nil
+}
+
+// maxTCPMessage bounds the length prefix of a TCP message;
+// anything larger means the stream has been misparsed.
+const maxTCPMessage = 1 << 20
+
+type captureDecoder struct {
+	port  int
+	msgs  []CapturedMessage
+	flows map[string]*tcpFlow // keyed by "src>dst"
+}
+
+type tcpFlow struct {
+	started bool
+	next    uint32 // next expected sequence number
+	buf     []byte
+}
+
+func (cd *captureDecoder) readPcap(raw []byte) error {
+	if len(raw) < 24 {
+		return errors.New("pcap header too short")
+	}
+	var bo binary.ByteOrder
+	var nanos bool
+	switch magic := binary.LittleEndian.Uint32(raw); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		bo, nanos = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		bo, nanos = binary.BigEndian, magic == 0x4d3cb2a1
+	default:
+		return fmt.Errorf("not a pcap or pcapng file (magic %#08x)", magic)
+	}
+	linkType := bo.Uint32(raw[20:]) & 0xFFFF
+	raw = raw[24:]
+	for len(raw) > 0 {
+		if len(raw) < 16 {
+			return errors.New("truncated pcap record header")
+		}
+		sec, frac, n := bo.Uint32(raw), bo.Uint32(raw[4:]), int(bo.Uint32(raw[8:]))
+		raw = raw[16:]
+		if n > len(raw) {
+			return errors.New("truncated pcap record")
+		}
+		if !nanos {
+			frac *= 1000
+		}
+		cd.packet(time.Unix(int64(sec), int64(frac)), linkType, raw[:n])
+		raw = raw[n:]
+	}
+	return nil
+}
+
+func (cd *captureDecoder) readPcapng(raw []byte) error {
+	type iface struct {
+		linkType uint32
+		tps      uint64 // timestamp ticks per second
+	}
+	var (
+		bo     binary.ByteOrder = binary.LittleEndian
+		ifaces []iface
+	)
+	for len(raw) > 0 {
+		if len(raw) < 12 {
+			return errors.New("truncated pcapng block")
+		}
+		if binary.LittleEndian.Uint32(raw) == 0x0A0D0D0A {
+			// Section header; sets the byte order for the section.
+			switch binary.LittleEndian.Uint32(raw[8:]) {
+			case 0x1A2B3C4D:
+				bo = binary.LittleEndian
+			case 0x4D3C2B1A:
+				bo = binary.BigEndian
+			default:
+				return errors.New("bad pcapng byte-order magic")
+			}
+			ifaces = nil
+		}
+		typ, n := bo.Uint32(raw), int(bo.Uint32(raw[4:]))
+		if n < 12 || n > len(raw) {
+			return errors.New("bad pcapng block length")
+		}
+		body := raw[8 : n-4]
+		raw = raw[n:]
+
+		switch typ {
+		case 1: // Interface description
+			if len(body) < 8 {
+				continue
+			}
+			ifc := iface{linkType: uint32(bo.Uint16(body)), tps: 1e6}
+			for opts := body[8:]; len(opts) >= 4; {
+				code, ol := bo.Uint16(opts), int(bo.Uint16(opts[2:]))
+				if code == 0 || 4+ol > len(opts) {
+					break
+				}
+				if code == 9 && ol >= 1 { // if_tsresol
+					if v := opts[4]; v&0x80 == 0 && v <= 19 {
+						ifc.tps = 1
+						for i := byte(0); i < v; i++ {
+							ifc.tps *= 10
+						}
+					} else if v&0x80 != 0 && v&0x7F < 64 {
+						ifc.tps = 1 << (v & 0x7F)
+					}
+				}
+				opts = opts[4+(ol+3)&^3:]
+			}
+			ifaces = append(ifaces, ifc)
+		case 6: // Enhanced packet
+			if len(body) < 20 {
+				continue
+			}
+			id, capLen := int(bo.Uint32(body)), int(bo.Uint32(body[12:]))
+			if id >= len(ifaces) || 20+capLen > len(body) {
+				continue
+			}
+			ts := uint64(bo.Uint32(body[4:]))<<32 | uint64(bo.Uint32(body[8:]))
+			tps := ifaces[id].tps
+			ns := (ts % tps) * 1e9 / tps
+			if tps > 1e9 {
+				ns = (ts % tps) / (tps / 1e9) // avoid overflow
+			}
+			t := time.Unix(int64(ts/tps), int64(ns))
+			cd.packet(t, ifaces[id].linkType, body[20:20+capLen])
+		case 3: // Simple packet
+			if len(body) < 4 || len(ifaces) == 0 {
+				continue
+			}
+			capLen := int(bo.Uint32(body))
+			if capLen > len(body)-4 {
+				capLen = len(body) - 4
+			}
+			cd.packet(time.Time{}, ifaces[0].linkType, body[4:4+capLen])
+		}
+	}
+	return nil
+}
+
+// packet handles one captured frame.
+func (cd *captureDecoder) packet(t time.Time, linkType uint32, b []byte) {
+	// Strip the link layer, leaving an IP packet.
+	switch linkType {
+	case 1: // Ethernet
+		if len(b) < 14 {
+			return
+		}
+		et := binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for et == 0x8100 && len(b) >= 4 { // VLAN tags
+			et = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+	case 113: // Linux cooked capture
+		if len(b) < 16 {
+			return
+		}
+		b = b[16:]
+	case 276: // Linux cooked capture v2
+		if len(b) < 20 {
+			return
+		}
+		b = b[20:]
+	case 0: // BSD loopback
+		if len(b) < 4 {
+			return
+		}
+		b = b[4:]
+	case 12, 14, 101, 228, 229: // Raw IP
+	default:
+		return
+	}
+	if len(b) < 1 {
+		return
+	}
+
+	var src, dst net.IP
+	var proto byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return
+		}
+		hl, tl := int(b[0]&0xF)*4, int(binary.BigEndian.Uint16(b[2:]))
+		if hl < 20 || tl < hl || tl > len(b) {
+			return
+		}
+		if binary.BigEndian.Uint16(b[6:])&0x3FFF != 0 {
+			return // fragment
+		}
+		proto = b[9]
+		src, dst = net.IP(b[12:16]), net.IP(b[16:20])
+		b = b[hl:tl]
+	case 6:
+		if len(b) < 40 {
+			return
+		}
+		pl := int(binary.BigEndian.Uint16(b[4:]))
+		if 40+pl > len(b) {
+			return
+		}
+		proto = b[6]
+		src, dst = net.IP(b[8:24]), net.IP(b[24:40])
+		b = b[40 : 40+pl]
+		for proto == 0 || proto == 43 || proto == 60 { // extension headers
+			if len(b) < 8 || 8+int(b[1])*8 > len(b) {
+				return
+			}
+			proto, b = b[0], b[8+int(b[1])*8:]
+		}
+	default:
+		return
+	}
+
+	switch proto {
+	case 17: // UDP
+		if len(b) < 8 {
+			return
+		}
+		sp, dp := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+		if sp != cd.port && dp != cd.port {
+			return
+		}
+		data := append([]byte(nil), b[8:]...)
+		Decrypt(data)
+		cd.msgs = append(cd.msgs, CapturedMessage{
+			Time: t,
+			Src:  &net.UDPAddr{IP: src, Port: sp},
+			Dst:  &net.UDPAddr{IP: dst, Port: dp},
+			Data: data,
+		})
+	case 6: // TCP
+		if len(b) < 20 {
+			return
+		}
+		sp, dp := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+		if sp != cd.port && dp != cd.port {
+			return
+		}
+		off := int(b[12]>>4) * 4
+		if off < 20 || off > len(b) {
+			return
+		}
+		saddr := &net.TCPAddr{IP: src, Port: sp}
+		daddr := &net.TCPAddr{IP: dst, Port: dp}
+		cd.tcp(t, saddr, daddr, binary.BigEndian.Uint32(b[4:]), b[13]&0x02 != 0, b[off:])
+	}
+}
+
+// tcp handles one TCP segment, emitting any messages it completes.
+func (cd *captureDecoder) tcp(t time.Time, src, dst *net.TCPAddr, seq uint32, syn bool, data []byte) {
+	key := src.String() + ">" + dst.String()
+	f := cd.flows[key]
+	if f == nil {
+		f = &tcpFlow{}
+		cd.flows[key] = f
+	}
+	if syn {
+		*f = tcpFlow{started: true, next: seq + 1}
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	if !f.started {
+		f.started, f.next = true, seq
+	}
+	switch d := int32(seq - f.next); {
+	case d > 0:
+		// Missed a segment; resynchronise.
+		f.buf, f.next = nil, seq
+	case d < 0:
+		// Retransmission, possibly with some new data.
+		if -int(d) >= len(data) {
+			return
+		}
+		data = data[-d:]
+	}
+	f.buf = append(f.buf, data...)
+	f.next += uint32(len(data))
+
+	for len(f.buf) >= 4 {
+		n := int(binary.BigEndian.Uint32(f.buf))
+		if n > maxTCPMessage {
+			f.buf = nil
+			return
+		}
+		if len(f.buf) < 4+n {
+			return
+		}
+		msg := append([]byte(nil), f.buf[4:4+n]...)
+		Decrypt(msg)
+		cd.msgs = append(cd.msgs, CapturedMessage{Time: t, Src: src, Dst: dst, Data: msg})
+		f.buf = f.buf[4+n:]
+	}
+}
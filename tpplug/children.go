@@ -0,0 +1,166 @@
+package tpplug
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Power strips, such as the HS300 and KP303, list their outlets as children
+// in their system information (see State.Children), and act on one when
+// a request has a context naming it, as WithChild arranges.
+// Query with such a context returns a State for just that outlet, as if it
+// were a plug of its own: its alias and relay state, its energy meter
+// readings if the strip has them, and DeviceID set to the outlet's ID.
+// SetRelayState, SetRelayStateIf, EnergyForDay and the rest act on the outlet.
+
+// maxChildren bounds how many outlets a strip may have.
+const maxChildren = 16
+
+// Child is an outlet of a power strip.
+type Child struct {
+	ID         string `json:"id"`    // the strip's device ID, followed by two digits
+	Alias      string `json:"alias"` // Human-readable name.
+	RelayState int    `json:"state"` // 0 = off, 1 = on
+}
+
+// childList holds the children of a State as JSON, so a State stays comparable.
+type childList string
+
+func (cl childList) MarshalJSON() ([]byte, error) {
+	if cl == "" {
+		return []byte("null"), nil
+	}
+	return []byte(cl), nil
+}
+
+func (cl *childList) UnmarshalJSON(b []byte) error {
+	var cs []Child
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return err
+	}
+	if len(cs) == 0 {
+		*cl = ""
+		return nil
+	}
+	b, err := json.Marshal(cs) // compact, and without fields that aren't kept
+	*cl = childList(b)
+	return err
+}
+
+// Children returns the outlets of a power strip, or nil for other devices.
+// IDs are made full, since some firmware reports just the two digits.
+func (s State) Children() []Child {
+	info := s.System.Info
+	if info.Children == "" {
+		return nil
+	}
+	var cs []Child
+	if json.Unmarshal([]byte(info.Children), &cs) != nil {
+		return nil
+	}
+	for i := range cs {
+		if len(cs[i].ID) <= 2 {
+			cs[i].ID = info.DeviceID + cs[i].ID
+		}
+	}
+	return cs
+}
+
+// Child finds an outlet of a power strip by its ID, the ID's last two digits, or its alias.
+func (s State) Child(ref string) (Child, bool) {
+	for _, c := range s.Children() {
+		if c.ID == ref || (len(ref) == 2 && strings.HasSuffix(c.ID, ref)) || c.Alias == ref {
+			return c, true
+		}
+	}
+	return Child{}, false
+}
+
+func (cl childList) validate() error {
+	if cl == "" {
+		return nil
+	}
+	var cs []Child
+	if err := json.Unmarshal([]byte(cl), &cs); err != nil {
+		return invalidf("children: %v", err)
+	}
+	if len(cs) > maxChildren {
+		return invalidf("%d children, more than %d", len(cs), maxChildren)
+	}
+	for _, c := range cs {
+		if len(c.ID) > maxStringLen || len(c.Alias) > maxStringLen {
+			return invalidf("child field is too long")
+		}
+		if c.RelayState != 0 && c.RelayState != 1 {
+			return invalidf("child relay state %d", c.RelayState)
+		}
+	}
+	return nil
+}
+
+type childKey struct{}
+
+// WithChild returns a context that makes operations act on the outlet of
+// a power strip with the given ID, as from State.Children.
+// An empty ID acts on the strip as a whole.
+func WithChild(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, childKey{}, id)
+}
+
+func childFor(ctx context.Context) string {
+	id, _ := ctx.Value(childKey{}).(string)
+	return id
+}
+
+// withChildContext returns req, a JSON object, with a context naming a child added.
+func withChildContext(req []byte, id string) []byte {
+	req = bytes.TrimSpace(req)
+	if len(req) < 2 || req[0] != '{' {
+		return req // not an object; let the plug complain
+	}
+	ids, _ := json.Marshal([]string{id})
+	out := make([]byte, 0, len(req)+len(ids)+32)
+	out = append(out, `{"context":{"child_ids":`...)
+	out = append(out, ids...)
+	out = append(out, '}')
+	if rest := bytes.TrimSpace(req[1:]); len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, req[1:]...)
+}
+
+// queryChild is queryState for a child: the strip's system information is
+// asked for as a whole, and anything else of the child.
+func queryChild(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, id string, query []byte) (State, error) {
+	strip, err := decodeQuery(WithChild(ctx, ""), conn, addr, sysinfoQuery)
+	if err != nil {
+		return State{}, err
+	}
+	var c Child
+	found := false
+	for _, sc := range strip.Children() {
+		if sc.ID == id {
+			c, found = sc, true
+		}
+	}
+	if !found {
+		return State{}, fmt.Errorf("plug at %v has no child outlet %q", addr, id)
+	}
+	state := strip
+	info := &state.System.Info
+	info.Alias, info.RelayState, info.DeviceID = c.Alias, c.RelayState, c.ID
+	info.ChildNum, info.Children = 0, ""
+	if bytes.Contains(query, []byte(`"emeter"`)) && strip.HasEnergyMeter() {
+		em, err := decodeQuery(ctx, conn, addr, energyQuery)
+		if err != nil {
+			return State{}, err
+		}
+		state.EnergyMeter = em.EnergyMeter
+		state.raw = mergeRaw(state.raw, em.raw)
+	}
+	return state, nil
+}
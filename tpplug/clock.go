@@ -0,0 +1,113 @@
+package tpplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Plugs keep their own clocks, which drift, and which they reset after
+// a power cut if they can't reach an NTP server. A drifted clock makes
+// schedule and countdown rules fire at the wrong moments.
+
+type deviceTime struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"mday"`
+	Hour  int `json:"hour"`
+	Min   int `json:"min"`
+	Sec   int `json:"sec"`
+}
+
+// getTime returns a plug's wall clock time, labelled as UTC since the plug
+// doesn't say what timezone it is in, and our time when it was fetched.
+func getTime(ctx context.Context, addr *net.UDPAddr) (wall, now time.Time, err error) {
+	var resp struct {
+		Time struct {
+			GetTime struct {
+				errResponse
+				deviceTime
+			} `json:"get_time"`
+		} `json:"time"`
+	}
+	req := map[string]interface{}{"time": map[string]interface{}{"get_time": struct{}{}}}
+	if err := RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	now = time.Now()
+	gt := resp.Time.GetTime
+	if err := gt.Err(); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("get_time: %w", err)
+	}
+	if gt.Year == 0 {
+		return time.Time{}, time.Time{}, errors.New("get_time: no time reported")
+	}
+	wall = time.Date(gt.Year, time.Month(gt.Month), gt.Day, gt.Hour, gt.Min, gt.Sec, 0, time.UTC)
+	return wall, now, nil
+}
+
+// ClockDrift returns how far a plug's clock is ahead of ours (negative if behind),
+// given the timezone the plug should be in (time.Local if nil).
+// Plugs report time to the second, so the result is only accurate to a second or so.
+func ClockDrift(ctx context.Context, addr *net.UDPAddr, loc *time.Location) (_ time.Duration, err error) {
+	ctx, end := startSpan(ctx, "tpplug.ClockDrift", addr)
+	defer func() { end(err) }()
+
+	if loc == nil {
+		loc = time.Local
+	}
+	wall, now, err := getTime(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	now = now.In(loc)
+	ours := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+	return wall.Sub(ours), nil
+}
+
+// SetClock sets a plug's clock to the wall clock time of t, in t's location.
+func SetClock(ctx context.Context, addr *net.UDPAddr, t time.Time) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetClock", addr)
+	defer func() { end(err) }()
+
+	// The plug only has whole seconds, so round to the nearest one.
+	t = t.Round(time.Second)
+	var resp struct {
+		Time struct {
+			SetTime errResponse `json:"set_time"`
+		} `json:"time"`
+	}
+	req := map[string]interface{}{"time": map[string]interface{}{"set_time": deviceTime{
+		Year:  t.Year(),
+		Month: int(t.Month()),
+		Day:   t.Day(),
+		Hour:  t.Hour(),
+		Min:   t.Minute(),
+		Sec:   t.Second(),
+	}}}
+	if err := RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return err
+	}
+	if err := resp.Time.SetTime.Err(); err != nil {
+		return fmt.Errorf("set_time: %w", err)
+	}
+	return nil
+}
+
+// CorrectClock sets a plug's clock to our time in loc (time.Local if nil)
+// if it has drifted by more than tolerance, and returns the drift found.
+func CorrectClock(ctx context.Context, addr *net.UDPAddr, loc *time.Location, tolerance time.Duration) (time.Duration, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	drift, err := ClockDrift(ctx, addr, loc)
+	if err != nil {
+		return 0, err
+	}
+	if drift <= tolerance && drift >= -tolerance {
+		return drift, nil
+	}
+	return drift, SetClock(ctx, addr, time.Now().In(loc))
+}
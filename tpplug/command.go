@@ -0,0 +1,122 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// Plugs have many modules and methods that this package doesn't wrap,
+// some undocumented. RegisterCommand associates a Go type with one of them,
+// so that Do can send it with the same encoding, encryption and error handling
+// as the built-in operations:
+//
+//	type setLEDOff struct {
+//		Off int `json:"off"`
+//	}
+//
+//	func init() { tpplug.RegisterCommand("system", "set_led_off", setLEDOff{}) }
+//
+//	err := tpplug.Do(ctx, addr, setLEDOff{Off: 1}, nil)
+
+type commandName struct {
+	module, method string
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[reflect.Type]commandName)
+)
+
+// RegisterCommand registers the type of req as the argument to the method of the module.
+// It must be a struct type (or a pointer to one), since methods take a JSON object.
+// It panics if the type is already registered.
+func RegisterCommand(module, method string, req interface{}) {
+	t := commandType(req)
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("tpplug: RegisterCommand of non-struct type %v", t))
+	}
+	if module == "" || method == "" {
+		panic("tpplug: RegisterCommand with empty module or method")
+	}
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if cn, ok := commands[t]; ok {
+		panic(fmt.Sprintf("tpplug: type %v already registered for %s.%s", t, cn.module, cn.method))
+	}
+	commands[t] = commandName{module, method}
+}
+
+func commandType(req interface{}) reflect.Type {
+	t := reflect.TypeOf(req)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func lookupCommand(req interface{}) (commandName, bool) {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	cn, ok := commands[commandType(req)]
+	return cn, ok
+}
+
+// Do sends req, whose type must have been registered with RegisterCommand,
+// and decodes the method's result into resp, which should be a pointer
+// (or nil to discard the result). A non-zero err_code in the result,
+// or for the module as a whole (such as when the plug doesn't have it),
+// is returned as an error.
+func Do(ctx context.Context, addr *net.UDPAddr, req, resp interface{}) (err error) {
+	cn, ok := lookupCommand(req)
+	if !ok {
+		return fmt.Errorf("unregistered command type %T", req)
+	}
+	ctx, end := startSpan(ctx, "tpplug.Do", addr)
+	defer func() { end(err) }()
+	return sendCommand(ctx, addr, cn, req, resp)
+}
+
+// sendCommand sends req as the argument to a method, decoding its result into resp.
+func sendCommand(ctx context.Context, addr *net.UDPAddr, cn commandName, req, resp interface{}) error {
+	wire := map[string]map[string]interface{}{cn.module: {cn.method: req}}
+	var out map[string]json.RawMessage
+	if err := RawJSONOp(ctx, addr, wire, &out); err != nil {
+		return fmt.Errorf("%s.%s: %w", cn.module, cn.method, err)
+	}
+	return decodeResult(cn, out, resp)
+}
+
+// decodeResult picks the method's result out of a response, and checks its err_code.
+func decodeResult(cn commandName, out map[string]json.RawMessage, resp interface{}) error {
+	var mod map[string]json.RawMessage
+	if err := json.Unmarshal(out[cn.module], &mod); err != nil || mod == nil {
+		return fmt.Errorf("%s.%s: %w", cn.module, cn.method, invalidf("no %q module in response", cn.module))
+	}
+	raw, ok := mod[cn.method]
+	if !ok {
+		var er errResponse
+		json.Unmarshal(out[cn.module], &er)
+		if err := er.Err(); err != nil {
+			return fmt.Errorf("%s: %w", cn.module, err)
+		}
+		return fmt.Errorf("%s.%s: %w", cn.module, cn.method, invalidf("no result in response"))
+	}
+	var er errResponse
+	if err := json.Unmarshal(raw, &er); err != nil {
+		return fmt.Errorf("%s.%s: %w", cn.module, cn.method, invalidf("result isn't an object: %v", err))
+	}
+	if err := er.Err(); err != nil {
+		return fmt.Errorf("%s.%s: %w", cn.module, cn.method, err)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return fmt.Errorf("%s.%s: decoding result: %w", cn.module, cn.method, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package tpplug
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Plugs can also keep a countdown rule, which switches the relay once, after
+// a delay, as SetRelayTemporarily arranges. While one is pending the plug is in
+// ModeCountdown, and it takes precedence over the schedule. Plugs permit only
+// one countdown rule at a time, so any existing one must be deleted before
+// another is added.
+
+// CountdownRule is a countdown rule as the plug represents it.
+type CountdownRule struct {
+	ID     string `json:"id,omitempty"` // assigned by the plug
+	Name   string `json:"name"`
+	Enable int    `json:"enable"`           // 1 = enabled, 0 = disabled
+	Delay  int    `json:"delay"`            // seconds
+	Act    int    `json:"act"`              // 1 = turn on, 0 = turn off
+	Remain int    `json:"remain,omitempty"` // seconds left, as reported by the plug
+}
+
+var (
+	cdGetRules       = commandName{"count_down", "get_rules"}
+	cdAddRule        = commandName{"count_down", "add_rule"}
+	cdDeleteAllRules = commandName{"count_down", "delete_all_rules"}
+)
+
+func (r CountdownRule) check() error {
+	if r.Delay <= 0 {
+		return fmt.Errorf("countdown rule delay %d is not positive", r.Delay)
+	}
+	if r.Act != 0 && r.Act != 1 {
+		return fmt.Errorf("bad countdown rule action %d", r.Act)
+	}
+	if len(r.Name) > maxStringLen {
+		return fmt.Errorf("countdown rule name of %d bytes is longer than %d", len(r.Name), maxStringLen)
+	}
+	return nil
+}
+
+// CountdownRules returns a plug's countdown rules, of which there is at most one.
+func CountdownRules(ctx context.Context, addr *net.UDPAddr) (_ []CountdownRule, err error) {
+	ctx, end := startSpan(ctx, "tpplug.CountdownRules", addr)
+	defer func() { end(err) }()
+
+	var resp struct {
+		RuleList []CountdownRule `json:"rule_list"`
+	}
+	if err := sendCommand(ctx, addr, cdGetRules, struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.RuleList, nil
+}
+
+// AddCountdown adds a countdown rule to a plug, returning the ID the plug gives it.
+// The rule's ID and Remain are ignored. It fails if the plug already has one;
+// see DeleteCountdowns.
+func AddCountdown(ctx context.Context, addr *net.UDPAddr, r CountdownRule) (_ string, err error) {
+	ctx, end := startSpan(ctx, "tpplug.AddCountdown", addr)
+	defer func() { end(err) }()
+	ctx = WithoutRetries(ctx) // not safe to do twice
+
+	if err := r.check(); err != nil {
+		return "", err
+	}
+	r.ID, r.Remain = "", 0
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := sendCommand(ctx, addr, cdAddRule, r, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// DeleteCountdowns removes a plug's countdown rules.
+func DeleteCountdowns(ctx context.Context, addr *net.UDPAddr) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.DeleteCountdowns", addr)
+	defer func() { end(err) }()
+
+	return sendCommand(ctx, addr, cdDeleteAllRules, struct{}{}, nil)
+}
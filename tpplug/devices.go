@@ -0,0 +1,91 @@
+package tpplug
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DevicesEnv names the environment variable that LoadDevices consults
+// for the devices file path if none is given.
+const DevicesEnv = "TPPLUG_DEVICES"
+
+// Device is the user's description of a plug.
+type Device struct {
+	Name string   `yaml:"name"` // canonical name, overriding the on-device alias
+	Room string   `yaml:"room"`
+	Tags []string `yaml:"tags"`
+}
+
+// Devices is a shared registry of device names, loaded from a YAML file
+// mapping MACs to Devices:
+//
+//	"50:C7:BF:00:00:01":
+//	  name: Heater
+//	  room: Lounge
+//	  tags: [heating, discretionary]
+//
+// It lets every program agree on what a plug is called,
+// even when the alias stored on the device is wrong.
+// A nil *Devices is valid, and knows no devices.
+type Devices struct {
+	m map[MAC]Device
+}
+
+// LoadDevices reads a devices file. If path is empty, the path is taken
+// from $TPPLUG_DEVICES; if that is also empty, an empty registry is returned.
+func LoadDevices(path string) (*Devices, error) {
+	if path == "" {
+		if path = os.Getenv(DevicesEnv); path == "" {
+			return &Devices{}, nil
+		}
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]Device
+	if err := yaml.UnmarshalStrict(raw, &m); err != nil {
+		return nil, fmt.Errorf("parsing devices file %s: %w", path, err)
+	}
+	ds := &Devices{m: make(map[MAC]Device)}
+	for mac, d := range m {
+		nm, err := ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("devices file %s: %w", path, err)
+		}
+		if _, dup := ds.m[nm]; dup {
+			return nil, fmt.Errorf("devices file %s: duplicate MAC %s", path, mac)
+		}
+		ds.m[nm] = d
+	}
+	return ds, nil
+}
+
+// Lookup returns the Device with the given MAC, which need not be canonical.
+func (ds *Devices) Lookup(mac MAC) (Device, bool) {
+	if ds == nil {
+		return Device{}, false
+	}
+	d, ok := ds.m[CanonicalMAC(string(mac))]
+	return d, ok
+}
+
+// Name returns the canonical name of the plug with the given state:
+// its name from the registry if it has one, or else its on-device alias.
+func (ds *Devices) Name(s State) string {
+	if d, ok := ds.Lookup(s.System.Info.MAC); ok && d.Name != "" {
+		return d.Name
+	}
+	return s.System.Info.Alias
+}
+
+// Len reports how many devices are known.
+func (ds *Devices) Len() int {
+	if ds == nil {
+		return 0
+	}
+	return len(ds.m)
+}
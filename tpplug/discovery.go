@@ -2,15 +2,17 @@ package tpplug
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
-func udpConn(ctx context.Context) (*net.UDPConn, error) {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+// udpConn returns a socket for network ("udp4" or "udp6"; see networkFor).
+func udpConn(ctx context.Context, network string) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{})
 	if err != nil {
 		return nil, fmt.Errorf("net.ListenUDP: %v", err)
 	}
@@ -24,30 +26,290 @@ func udpConn(ctx context.Context) (*net.UDPConn, error) {
 // The provided context controls how long to wait for responses;
 // its cancellation or deadline expiry will stop execution of Discover
 // but will not return an error.
+//
+// If a registry is running (see RegistrySocket), Discover asks it
+// which plugs exist instead of broadcasting, and returns early.
+//
+// If there are KLAP credentials (see SetCredentials), Discover also finds
+// plugs that only answer KLAP, and queries them once the context is done,
+// for at most klapQueryTimeout.
 func Discover(ctx context.Context) ([]DiscoveryResponse, error) {
-	conn, err := udpConn(ctx)
+	return DiscoverWithOptions(ctx, DiscoverOptions{})
+}
+
+// DiscoverOptions controls optional behaviour of DiscoverWithOptions.
+type DiscoverOptions struct {
+	// Some firmware answers discovery with system information only.
+	// If BackfillEnergy is set, each plug whose response has no energy meter readings,
+	// but which has an energy meter, is asked for them directly.
+	// This happens after the discovery context is done, and takes at most BackfillTimeout
+	// (default 1s), after which plugs that haven't answered are left as they are.
+	BackfillEnergy  bool
+	BackfillTimeout time.Duration
+
+	// If IPv6 is set, discovery also sends to the IPv6 all-nodes multicast group
+	// on each interface, IPv6's equivalent of the broadcast address.
+	// Plugs that answer over both are listed by their IPv4 address.
+	IPv6 bool
+
+	// Broadcast, if set, lists where to send discovery instead of the limited
+	// broadcast address (255.255.255.255:9999), such as the directed broadcast
+	// addresses of particular subnets (see InterfaceBroadcasts).
+	// No registry is consulted, since it can't say which network a plug is on.
+	Broadcast []*net.UDPAddr
+}
+
+// DiscoverWithOptions is like Discover, with options.
+func DiscoverWithOptions(ctx context.Context, opts DiscoverOptions) (_ []DiscoveryResponse, err error) {
+	ctx, end := startSpan(ctx, "tpplug.Discover", nil)
+	defer func() { end(err) }()
+
+	var drs []DiscoveryResponse
+	fromRegistry := false
+	if path := RegistrySocket(); path != "" && len(opts.Broadcast) == 0 {
+		var rerr error
+		drs, rerr = discoverViaRegistry(ctx, path)
+		fromRegistry = rerr == nil
+	}
+	if !fromRegistry {
+		var (
+			tds  []TapoDevice
+			terr error
+			done = make(chan struct{})
+		)
+		klap := haveCredentials()
+		if klap {
+			go func() {
+				defer close(done)
+				tds, terr = DiscoverTapo(ctx)
+			}()
+		}
+		drs, err = discoverBroadcast(ctx, opts.IPv6, opts.Broadcast)
+		if klap {
+			<-done
+		}
+		if err != nil {
+			return nil, err
+		}
+		if terr != nil {
+			log.Printf("WARNING: Discovery of KLAP plugs failed: %v", terr)
+		}
+		drs = append(drs, queryKLAP(tds, drs, keepingRaw(ctx))...)
+	}
+	if opts.BackfillEnergy {
+		timeout := opts.BackfillTimeout
+		if timeout <= 0 {
+			timeout = 1 * time.Second
+		}
+		backfillEnergy(drs, timeout, keepingRaw(ctx))
+	}
+	return drs, nil
+}
+
+// energyQuery fetches only the energy meter readings.
+var energyQuery = []byte(`{"emeter":{"get_realtime":{}}}`)
+
+// backfillEnergy queries the energy meter of each metered plug whose readings are missing.
+func backfillEnergy(drs []DiscoveryResponse, timeout time.Duration, keepRaw bool) {
+	// The discovery context has run out by now.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if keepRaw {
+		ctx = KeepRaw(ctx)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failed  int
+		lastErr error
+	)
+	for i := range drs {
+		dr := &drs[i]
+		rt := dr.State.EnergyMeter.Realtime
+		if rt.Voltage != 0 || rt.Current != 0 || rt.Power != 0 || !dr.State.HasEnergyMeter() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := queryEnergy(ctx, dr.Addr)
+			if err != nil {
+				mu.Lock()
+				failed, lastErr = failed+1, fmt.Errorf("from %v: %w", dr.Addr, err)
+				mu.Unlock()
+				return
+			}
+			dr.State.EnergyMeter = st.EnergyMeter
+			dr.State.raw = mergeRaw(dr.State.raw, st.raw)
+		}()
+	}
+	wg.Wait()
+	if failed > 0 {
+		log.Printf("WARNING: Failed to backfill energy readings of %d plugs; last was %v", failed, lastErr)
+	}
+}
+
+func queryEnergy(ctx context.Context, addr *net.UDPAddr) (_ State, err error) {
+	ctx, end := startSpan(ctx, "tpplug.queryEnergy", addr)
+	defer func() { end(err) }()
+
+	return queryState(ctx, nil, addr, energyQuery)
+}
+
+// queryState sends a query over conn, or a socket of its own if conn is nil,
+// and decodes the response. See WithChild for how outlets of power strips are queried.
+func queryState(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, query []byte) (State, error) {
+	if id := childFor(ctx); id != "" {
+		return queryChild(ctx, conn, addr, id, query)
+	}
+	return decodeQuery(ctx, conn, addr, query)
+}
+
+// decodeQuery is queryState for what the request is sent to as it is.
+func decodeQuery(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, query []byte) (state State, err error) {
+	err = roundTrip(ctx, conn, addr, query, func(b []byte) error {
+		state, err = decodeState(ctx, b)
+		return err
+	})
+	return state, err
+}
+
+// DiscoverBroadcast is like Discover, but always broadcasts.
+func DiscoverBroadcast(ctx context.Context) (_ []DiscoveryResponse, err error) {
+	ctx, end := startSpan(ctx, "tpplug.DiscoverBroadcast", nil)
+	defer func() { end(err) }()
+	return discoverBroadcast(ctx, false, nil)
+}
+
+// InterfaceBroadcasts returns the directed broadcast address of each IPv4 subnet
+// of the named network interface, with the given port.
+func InterfaceBroadcasts(name string, port int) ([]*net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(name)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("interface %s: %w", name, err)
 	}
-	defer conn.Close()
+	ias, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("addresses of %s: %w", name, err)
+	}
+	var addrs []*net.UDPAddr
+	for _, ia := range ias {
+		ipn, ok := ia.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip4, mask := ipn.IP.To4(), ipn.Mask
+		if ip4 == nil || len(mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ip4[i] | ^mask[i]
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: bcast, Port: port})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no IPv4 addresses", name)
+	}
+	return addrs, nil
+}
 
-	bcast := &net.UDPAddr{
-		IP:   net.IPv4(255, 255, 255, 255),
-		Port: 9999,
+func discoverBroadcast(ctx context.Context, ipv6 bool, dsts []*net.UDPAddr) ([]DiscoveryResponse, error) {
+	if len(dsts) == 0 {
+		dsts = []*net.UDPAddr{{IP: net.IPv4bcast, Port: DefaultPort}}
 	}
-	b, err := json.Marshal(&State{})
+	msg := stateQuery
+	if err := broadcastLimit.wait(ctx); err != nil {
+		return nil, nil // out of time before even being allowed to broadcast
+	}
+	if !ipv6 {
+		return discoverOn(ctx, "udp4", dsts, msg)
+	}
+
+	var (
+		drs6 []DiscoveryResponse
+		err6 error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		drs6, err6 = discoverOn(ctx, "udp6", allNodesAddrs(DefaultPort), msg)
+	}()
+	drs, err := discoverOn(ctx, "udp4", dsts, msg)
+	<-done
 	if err != nil {
-		return nil, fmt.Errorf("encoding JSON discovery message: %w", err)
+		return nil, err
+	}
+	if err6 != nil {
+		log.Printf("WARNING: IPv6 discovery failed: %v", err6)
 	}
-	if err := writeMsg(conn, bcast, b); err != nil {
+	return mergeDiscoveries(drs, drs6), nil
+}
+
+// mergeDiscoveries appends to drs those of drs6 from other plugs.
+// Plugs that answer on both are listed once, by their IPv4 address.
+// They are matched by MAC; without one, a plug can't be matched,
+// so is listed under each address it answers from.
+func mergeDiscoveries(drs, drs6 []DiscoveryResponse) []DiscoveryResponse {
+	seen := make(map[string]bool)
+	key := func(dr DiscoveryResponse) string {
+		switch mac := dr.State.System.Info.MAC; mac {
+		case "", "00:00:00:00:00:00":
+			return dr.Addr.String()
+		default:
+			return string(mac)
+		}
+	}
+	for _, dr := range drs {
+		seen[key(dr)] = true
+	}
+	for _, dr := range drs6 {
+		if k := key(dr); !seen[k] {
+			seen[k] = true
+			drs = append(drs, dr)
+		}
+	}
+	return drs
+}
+
+// discoverOn sends a discovery message to each of dsts from one socket,
+// and collects the responses until the context is done.
+func discoverOn(ctx context.Context, network string, dsts []*net.UDPAddr, msg []byte) ([]DiscoveryResponse, error) {
+	if len(dsts) == 0 {
+		return nil, nil
+	}
+	conn, err := udpConn(ctx, network)
+	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
+
+	for _, dst := range dsts {
+		if err := packetLimit.wait(ctx); err != nil {
+			return nil, nil
+		}
+		b := append([]byte(nil), msg...) // writeMsg overwrites it
+		if err := writeMsg(conn, dst, b); err != nil {
+			return nil, err
+		}
+	}
 
 	// Wait for any responses.
+	// Anything on the network can send us anything, so bogus responses are
+	// dropped (and only logged once, to avoid flooding the log), and each
+	// sender is only counted once.
 	var drs []DiscoveryResponse
-	var scratch [4 << 10]byte
+	seen := make(map[string]int) // addr => index in drs
+	var scratch scratchBuf
+	var bogus int
+	var lastErr error
 	for {
-		b, raddr, err := readMsg(conn, scratch[:])
+		b, raddr, err := readMsg(conn, scratch[:], nil)
+		if errors.Is(err, ErrInvalidResponse) {
+			bogus, lastErr = bogus+1, err
+			continue
+		}
 		if err != nil {
 			var neterr net.Error
 			if errors.As(err, &neterr) && neterr.Timeout() {
@@ -56,16 +318,25 @@ func Discover(ctx context.Context) ([]DiscoveryResponse, error) {
 			}
 			return nil, err
 		}
-		var info State
-		if err := json.Unmarshal(b, &info); err != nil {
-			// One bogus message. Keep going.
-			log.Printf("ERROR: %v", err)
+		info, err := decodeState(ctx, b)
+		if err != nil {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: %w", raddr, err)
+			continue
+		}
+		dr := DiscoveryResponse{Addr: raddr, State: info, Kind: info.Kind()}
+		if i, ok := seen[raddr.String()]; ok {
+			drs[i] = dr
+			continue
+		}
+		if len(drs) >= maxDiscoveries {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: more than %d responses", raddr, maxDiscoveries)
 			continue
 		}
-		drs = append(drs, DiscoveryResponse{
-			Addr:  raddr,
-			State: info,
-		})
+		seen[raddr.String()] = len(drs)
+		drs = append(drs, dr)
+	}
+	if bogus > 0 {
+		log.Printf("WARNING: Ignored %d bogus discovery responses; last was %v", bogus, lastErr)
 	}
 	return drs, nil
 }
@@ -73,20 +344,35 @@ func Discover(ctx context.Context) ([]DiscoveryResponse, error) {
 type DiscoveryResponse struct {
 	Addr  *net.UDPAddr
 	State State
+	Kind  DeviceKind // as from State.Kind
 }
 
 // State represents a plug's state.
-// Its zero value is also used as a query message.
 type State struct {
 	System struct {
 		Info struct {
-			Model      string `json:"model,omitempty"` // e.g. "HS110(AU)"
-			MAC        string `json:"mac,omitempty"`
-			Alias      string `json:"alias,omitempty"`       // Human-readable name.
-			RelayState int    `json:"relay_state,omitempty"` // 0 = off, 1 = on
-			// Other keys: sw_ver, hw_ver, type, dev_name, on_time, active_mode
-			//	feature, updating, icon_hash, rssi, led_off, longitude_i, latitude_i
-			//	hwId, fwId, deviceId, oemId, next_action, err_code
+			Model      string     `json:"model,omitempty"`       // e.g. "HS110(AU)"
+			MAC        MAC        `json:"mac,omitempty"`         // canonicalized when decoded
+			MicMAC     MAC        `json:"mic_mac,omitempty"`     // MAC, from bulbs; copied to MAC when decoded
+			Alias      string     `json:"alias,omitempty"`       // Human-readable name.
+			RelayState int        `json:"relay_state,omitempty"` // 0 = off, 1 = on
+			RSSI       int        `json:"rssi,omitempty"`        // Wi-Fi signal strength, in dBm
+			ActiveMode Mode       `json:"active_mode,omitempty"` // what the plug's own timers are doing
+			Type       string     `json:"type,omitempty"`        // e.g. "IOT.SMARTPLUGSWITCH"; see Kind
+			MicType    string     `json:"mic_type,omitempty"`    // like Type, from bulbs and some plugs
+			DevName    string     `json:"dev_name,omitempty"`    // e.g. "Smart Wi-Fi Plug With Energy Monitoring"
+			ChildNum   int        `json:"child_num,omitempty"`   // number of outlets of a power strip
+			Feature    string     `json:"feature,omitempty"`     // e.g. "TIM:ENE"; see HasEnergyMeter
+			Latitude   int        `json:"latitude_i,omitempty"`  // 1e-4 degrees; see Coordinates
+			Longitude  int        `json:"longitude_i,omitempty"` // 1e-4 degrees
+			LEDOff     int        `json:"led_off,omitempty"`     // 1 if the status LED is turned off
+			Brightness int        `json:"brightness,omitempty"`  // percent, from dimmers
+			Light      LightState `json:"light_state"`           // from bulbs
+			DeviceID   string     `json:"deviceId,omitempty"`
+			Children   childList  `json:"children,omitempty"` // outlets of a power strip; see Children
+			// Other keys: sw_ver, hw_ver, on_time,
+			//	updating, icon_hash
+			//	hwId, fwId, oemId, next_action, err_code
 		} `json:"get_sysinfo"`
 	} `json:"system"`
 	EnergyMeter struct {
@@ -97,12 +383,36 @@ type State struct {
 			// Other keys: total_wh, err_code
 		} `json:"get_realtime"`
 	} `json:"emeter,omitempty"`
+
+	raw string // response the State was decoded from, if kept; see KeepRaw
 }
 
+// stateQuery asks for everything in a State, with get_sysinfo and the emeter's get_realtime.
+var stateQuery = []byte(`{"system":{"get_sysinfo":{}},"emeter":{"get_realtime":{}}}`)
+
 func Query(ctx context.Context, addr *net.UDPAddr) (State, error) {
-	var state State
-	if err := RawJSONOp(ctx, addr, &state, &state); err != nil {
-		return State{}, err
-	}
-	return state, nil
+	return query(ctx, nil, addr)
+}
+
+func query(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr) (_ State, err error) {
+	ctx, end := startSpan(ctx, "tpplug.Query", addr)
+	defer func() { end(err) }()
+	return queryState(ctx, conn, addr, stateQuery)
+}
+
+// sysinfoQuery fetches only the system information.
+var sysinfoQuery = []byte(`{"system":{"get_sysinfo":{}}}`)
+
+// QuerySysinfoOnly is like Query, but doesn't ask for energy meter readings,
+// so the EnergyMeter field of the result is zero.
+// It is cheaper, and avoids errors from plugs without an energy meter,
+// for callers that only need the relay state, alias and so on.
+func QuerySysinfoOnly(ctx context.Context, addr *net.UDPAddr) (State, error) {
+	return querySysinfoOnly(ctx, nil, addr)
+}
+
+func querySysinfoOnly(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr) (_ State, err error) {
+	ctx, end := startSpan(ctx, "tpplug.QuerySysinfoOnly", addr)
+	defer func() { end(err) }()
+	return queryState(ctx, conn, addr, sysinfoQuery)
 }
@@ -0,0 +1,35 @@
+package tpplug
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMergeDiscoveries(t *testing.T) {
+	dr := func(ip string, mac MAC) DiscoveryResponse {
+		var st State
+		st.System.Info.MAC = mac
+		return DiscoveryResponse{Addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: DefaultPort}, State: st}
+	}
+	drs := []DiscoveryResponse{
+		dr("192.168.1.10", "50:C7:BF:00:00:01"),
+		dr("192.168.1.11", ""),
+	}
+	drs6 := []DiscoveryResponse{
+		dr("fe80::1", "50:C7:BF:00:00:01"), // the same plug as 192.168.1.10
+		dr("fe80::2", "50:C7:BF:00:00:02"),
+		dr("fe80::3", ""),
+		dr("fe80::4", ""),
+		dr("fe80::5", "00:00:00:00:00:00"),
+	}
+	got := mergeDiscoveries(drs, drs6)
+	want := []string{"192.168.1.10", "192.168.1.11", "fe80::2", "fe80::3", "fe80::4", "fe80::5"}
+	if len(got) != len(want) {
+		t.Fatalf("mergeDiscoveries gave %d responses, want %d (%v)", len(got), len(want), want)
+	}
+	for i, dr := range got {
+		if ip := dr.Addr.IP.String(); ip != want[i] {
+			t.Errorf("mergeDiscoveries response %d is from %s, want %s", i, ip, want[i])
+		}
+	}
+}
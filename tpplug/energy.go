@@ -0,0 +1,251 @@
+package tpplug
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Plugs keep daily and monthly energy totals, bucketed by days in their own timezone.
+
+// EnergyForDay returns the energy in Wh used by a plug on the day containing date,
+// where days are reckoned in the plug's timezone.
+func EnergyForDay(ctx context.Context, addr *net.UDPAddr, date time.Time) (float64, error) {
+	return EnergyBetween(ctx, addr, date, date)
+}
+
+// EnergyBetween returns the energy in Wh used by a plug from the day containing from
+// to the day containing to, inclusive, where days are reckoned in the plug's timezone.
+// Days that the plug has no record of count as zero.
+func EnergyBetween(ctx context.Context, addr *net.UDPAddr, from, to time.Time) (_ float64, err error) {
+	ctx, end := startSpan(ctx, "tpplug.EnergyBetween", addr)
+	defer func() { end(err) }()
+
+	loc, err := deviceLocation(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	return energyBetween(from, to, loc,
+		func(year int) (map[time.Month]float64, error) { return monthStat(ctx, addr, year) },
+		func(year int, month time.Month) (map[int]float64, error) { return dayStat(ctx, addr, year, month) })
+}
+
+// energyBetween is EnergyBetween for a plug in loc, with monthStat and dayStat
+// getting its totals.
+func energyBetween(from, to time.Time, loc *time.Location,
+	monthStat func(year int) (map[time.Month]float64, error),
+	dayStat func(year int, month time.Month) (map[int]float64, error)) (float64, error) {
+	first, last := dayOf(from.In(loc)), dayOf(to.In(loc))
+	if last.Before(first) {
+		return 0, fmt.Errorf("end %v is before start %v", to, from)
+	}
+
+	// Whole months come from get_monthstat, fetched once per year.
+	// Partial months at either end come from get_daystat.
+	monthly := make(map[int]map[time.Month]float64) // year => month => Wh
+	var total float64
+	for m := monthOf(first); !m.After(last); m = m.AddDate(0, 1, 0) {
+		mEnd := m.AddDate(0, 1, -1) // last day of the month
+		if !m.Before(first) && !mEnd.After(last) {
+			ms, ok := monthly[m.Year()]
+			if !ok {
+				var err error
+				if ms, err = monthStat(m.Year()); err != nil {
+					return 0, err
+				}
+				monthly[m.Year()] = ms
+			}
+			total += ms[m.Month()]
+			continue
+		}
+		ds, err := dayStat(m.Year(), m.Month())
+		if err != nil {
+			return 0, err
+		}
+		for day, wh := range ds {
+			d := time.Date(m.Year(), m.Month(), day, 0, 0, 0, 0, time.UTC)
+			if !d.Before(first) && !d.After(last) {
+				total += wh
+			}
+		}
+	}
+	return total, nil
+}
+
+// dayOf returns the calendar day of t, as midnight UTC, for comparing days.
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// monthOf returns the first day of the month of a day from dayOf.
+func monthOf(d time.Time) time.Time {
+	return time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// energyStat is an entry in a get_daystat or get_monthstat response.
+type energyStat struct {
+	Year     int      `json:"year"`
+	Month    int      `json:"month"`
+	Day      int      `json:"day"`
+	EnergyWh *float64 `json:"energy_wh"`
+	Energy   *float64 `json:"energy"` // kWh, on older firmware
+}
+
+func (es energyStat) wh() float64 {
+	switch {
+	case es.EnergyWh != nil:
+		return *es.EnergyWh
+	case es.Energy != nil:
+		return *es.Energy * 1000
+	}
+	return 0
+}
+
+type energyStatResponse struct {
+	errResponse
+	DayList   []energyStat `json:"day_list"`
+	MonthList []energyStat `json:"month_list"`
+}
+
+// DayEnergy is a plug's total for one day, in its timezone.
+type DayEnergy struct {
+	Year  int
+	Month time.Month
+	Day   int
+	Wh    float64
+}
+
+// MonthEnergy is a plug's total for one month, in its timezone.
+type MonthEnergy struct {
+	Year  int
+	Month time.Month
+	Wh    float64
+}
+
+// EnergyDayStats returns a plug's daily energy totals for a month, in order of day.
+// Days that the plug has no record of are missing.
+func EnergyDayStats(ctx context.Context, addr *net.UDPAddr, year int, month time.Month) (_ []DayEnergy, err error) {
+	ctx, end := startSpan(ctx, "tpplug.EnergyDayStats", addr)
+	defer func() { end(err) }()
+
+	var resp struct {
+		EMeter struct {
+			DayStat energyStatResponse `json:"get_daystat"`
+		} `json:"emeter"`
+	}
+	req := map[string]interface{}{"emeter": map[string]interface{}{
+		"get_daystat": map[string]int{"year": year, "month": int(month)},
+	}}
+	if err := RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return nil, err
+	}
+	ds := resp.EMeter.DayStat
+	if err := ds.Err(); err != nil {
+		return nil, fmt.Errorf("get_daystat: %w", err)
+	}
+	m := make(map[int]float64)
+	for _, es := range ds.DayList {
+		if es.Year == year && es.Month == int(month) && es.Day >= 1 && es.Day <= 31 {
+			m[es.Day] += es.wh()
+		}
+	}
+	var des []DayEnergy
+	for day := 1; day <= 31; day++ {
+		if wh, ok := m[day]; ok {
+			des = append(des, DayEnergy{Year: year, Month: month, Day: day, Wh: wh})
+		}
+	}
+	return des, nil
+}
+
+// EnergyMonthStats returns a plug's monthly energy totals for a year, in order of month.
+// Months that the plug has no record of are missing.
+func EnergyMonthStats(ctx context.Context, addr *net.UDPAddr, year int) (_ []MonthEnergy, err error) {
+	ctx, end := startSpan(ctx, "tpplug.EnergyMonthStats", addr)
+	defer func() { end(err) }()
+
+	var resp struct {
+		EMeter struct {
+			MonthStat energyStatResponse `json:"get_monthstat"`
+		} `json:"emeter"`
+	}
+	req := map[string]interface{}{"emeter": map[string]interface{}{
+		"get_monthstat": map[string]int{"year": year},
+	}}
+	if err := RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return nil, err
+	}
+	ms := resp.EMeter.MonthStat
+	if err := ms.Err(); err != nil {
+		return nil, fmt.Errorf("get_monthstat: %w", err)
+	}
+	m := make(map[time.Month]float64)
+	for _, es := range ms.MonthList {
+		if es.Year == year && es.Month >= 1 && es.Month <= 12 {
+			m[time.Month(es.Month)] += es.wh()
+		}
+	}
+	var mes []MonthEnergy
+	for month := time.January; month <= time.December; month++ {
+		if wh, ok := m[month]; ok {
+			mes = append(mes, MonthEnergy{Year: year, Month: month, Wh: wh})
+		}
+	}
+	return mes, nil
+}
+
+// dayStat returns the energy used on each day of a month, keyed by day of the month.
+func dayStat(ctx context.Context, addr *net.UDPAddr, year int, month time.Month) (map[int]float64, error) {
+	des, err := EnergyDayStats(ctx, addr, year, month)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int]float64)
+	for _, de := range des {
+		m[de.Day] = de.Wh
+	}
+	return m, nil
+}
+
+// monthStat returns the energy used in each month of a year.
+func monthStat(ctx context.Context, addr *net.UDPAddr, year int) (map[time.Month]float64, error) {
+	mes, err := EnergyMonthStats(ctx, addr, year)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[time.Month]float64)
+	for _, me := range mes {
+		m[me.Month] = me.Wh
+	}
+	return m, nil
+}
+
+// deviceLocation works out a plug's timezone from its clock.
+// Plugs report their timezone only as an opaque index, so this compares the
+// plug's local time with ours. If the plug agrees with our local timezone
+// right now, that is used, so that daylight saving changes are handled;
+// otherwise it is a fixed offset.
+func deviceLocation(ctx context.Context, addr *net.UDPAddr) (*time.Location, error) {
+	wall, now, err := getTime(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return plugZone(wall, now), nil
+}
+
+// plugZone is deviceLocation for a plug whose clock read wall, as if in UTC, at now.
+func plugZone(wall, now time.Time) *time.Location {
+	// Timezones are whole multiples of 15 minutes, which absorbs clock skew.
+	offset := wall.Sub(now.UTC()).Round(15 * time.Minute)
+
+	if _, ours := now.Zone(); time.Duration(ours)*time.Second == offset {
+		return time.Local
+	}
+	sign, abs := '+', offset
+	if abs < 0 {
+		sign, abs = '-', -abs
+	}
+	name := fmt.Sprintf("UTC%c%02d:%02d", sign, int(abs.Hours()), int(abs.Minutes())%60)
+	return time.FixedZone(name, int(offset/time.Second))
+}
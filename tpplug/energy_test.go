@@ -0,0 +1,90 @@
+package tpplug
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnergyBetween(t *testing.T) {
+	// The plug records d Wh on day d of each month.
+	daysIn := func(year int, month time.Month) int {
+		return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	}
+	var monthStats, dayStats int
+	monthStat := func(year int) (map[time.Month]float64, error) {
+		monthStats++
+		m := make(map[time.Month]float64)
+		for month := time.January; month <= time.December; month++ {
+			n := daysIn(year, month)
+			m[month] = float64(n * (n + 1) / 2)
+		}
+		return m, nil
+	}
+	dayStat := func(year int, month time.Month) (map[int]float64, error) {
+		dayStats++
+		m := make(map[int]float64)
+		for d := 1; d <= daysIn(year, month); d++ {
+			m[d] = float64(d)
+		}
+		return m, nil
+	}
+
+	chatham := time.FixedZone("UTC+12:45", (12*60+45)*60)
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		desc             string
+		from, to         time.Time
+		loc              *time.Location
+		want             float64
+		monthStats, days int // calls wanted
+	}{
+		{"one day", date(2024, 3, 5), date(2024, 3, 5), time.UTC, 5, 0, 1},
+		{"across a month", date(2024, 1, 30), date(2024, 2, 2), time.UTC, 30 + 31 + 1 + 2, 0, 2},
+		{"across a year", date(2023, 12, 30), date(2024, 1, 2), time.UTC, 30 + 31 + 1 + 2, 0, 2},
+		{"whole leap year", date(2024, 1, 1), date(2024, 12, 31), time.UTC, 7*496 + 4*465 + 435, 1, 0},
+		{"whole months between", date(2023, 11, 15), date(2024, 2, 10), time.UTC, 360 + 496 + 496 + 55, 2, 2},
+		// 11:30 UTC on 31 January is 00:15 on 1 February in UTC+12:45.
+		{"non-whole-hour zone", time.Date(2024, 1, 31, 11, 30, 0, 0, time.UTC), time.Date(2024, 1, 31, 11, 30, 0, 0, time.UTC), chatham, 1, 0, 1},
+		{"just before midnight there", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC), time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC), chatham, 31, 0, 1},
+	} {
+		monthStats, dayStats = 0, 0
+		got, err := energyBetween(tc.from, tc.to, tc.loc, monthStat, dayStat)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want || monthStats != tc.monthStats || dayStats != tc.days {
+			t.Errorf("%s: got %v Wh with %d get_monthstat and %d get_daystat; want %v Wh with %d and %d",
+				tc.desc, got, monthStats, dayStats, tc.want, tc.monthStats, tc.days)
+		}
+	}
+
+	if _, err := energyBetween(date(2024, 2, 1), date(2024, 1, 31), time.UTC, monthStat, dayStat); err == nil {
+		t.Errorf("energyBetween with the end before the start succeeded")
+	}
+}
+
+func TestPlugZone(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.FixedZone("AEST", 10*60*60))
+	for _, tc := range []struct {
+		offset time.Duration // of the plug's clock, including some skew
+		name   string
+	}{
+		{12*time.Hour + 45*time.Minute + 3*time.Second, "UTC+12:45"},
+		{5*time.Hour + 30*time.Minute - 2*time.Second, "UTC+05:30"},
+		{-3*time.Hour - 30*time.Minute, "UTC-03:30"},
+		{-10 * time.Hour, "UTC-10:00"},
+		{0, "UTC+00:00"},
+	} {
+		loc := plugZone(now.UTC().Add(tc.offset), now)
+		name, offset := now.In(loc).Zone()
+		if want := tc.offset.Round(15 * time.Minute); name != tc.name || time.Duration(offset)*time.Second != want {
+			t.Errorf("plugZone for offset %v gave %s (%ds), want %s (%v)", tc.offset, name, offset, tc.name, want)
+		}
+	}
+	if loc := plugZone(now.UTC().Add(10*time.Hour), now); loc != time.Local {
+		t.Errorf("plugZone for a plug agreeing with us gave %v, want time.Local", loc)
+	}
+}
@@ -0,0 +1,82 @@
+package tpplug
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Plugs are usually reached over IPv4, but they may be queried by IPv6 address
+// too, including link-local ones, which need the interface as a zone
+// (e.g. fe80::1%eth0). See DiscoverOptions for discovery over IPv6.
+
+// DefaultPort is the UDP (and TCP) port that plugs listen on.
+const DefaultPort = 9999
+
+// ParseAddr parses a plug address: an IPv4 or IPv6 address, optionally with a zone,
+// and optionally with a port, as in 192.168.1.20, 192.168.1.20:9999, fe80::1%eth0
+// or [fe80::1%eth0]:9999. If there's no port, defPort is used.
+func ParseAddr(s string, defPort int) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port.
+		host, portStr = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), strconv.Itoa(defPort)
+	}
+	var zone string
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad IP %q", host)
+	}
+	if zone != "" && ip.To4() != nil {
+		return nil, fmt.Errorf("zone %q given with IPv4 address %v", zone, ip)
+	}
+	p, err := strconv.Atoi(portStr)
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+	return &net.UDPAddr{IP: ip, Port: p, Zone: zone}, nil
+}
+
+// networkFor returns the network for reaching ip.
+func networkFor(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// isGroup reports whether ip is a broadcast or multicast address,
+// to which replies come from other addresses.
+func isGroup(ip net.IP) bool {
+	return ip.Equal(net.IPv4bcast) || ip.IsMulticast()
+}
+
+// allNodesAddrs returns the IPv6 link-local all-nodes multicast address (ff02::1)
+// on each interface that is up, can multicast, and has an IPv6 address.
+func allNodesAddrs(port int) []*net.UDPAddr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var addrs []*net.UDPAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ias, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ia := range ias {
+			if ipn, ok := ia.(*net.IPNet); ok && ipn.IP.To4() == nil {
+				addrs = append(addrs, &net.UDPAddr{IP: net.IPv6linklocalallnodes, Port: port, Zone: iface.Name})
+				break
+			}
+		}
+	}
+	return addrs
+}
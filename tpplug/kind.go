@@ -0,0 +1,61 @@
+package tpplug
+
+import "strings"
+
+// DeviceKind is a broad class of device, needing different handling.
+type DeviceKind string
+
+const (
+	KindUnknown DeviceKind = ""
+	KindPlug    DeviceKind = "plug"   // a single relay, such as an HS110 or HS200 switch
+	KindStrip   DeviceKind = "strip"  // several relays, such as an HS300; see ChildNum
+	KindDimmer  DeviceKind = "dimmer" // a dimmer switch, such as an HS220
+	KindBulb    DeviceKind = "bulb"   // a bulb or light strip, such as a KL130
+)
+
+// Kind classifies the device from its system information.
+func (s State) Kind() DeviceKind {
+	info := s.System.Info
+	typ := info.Type
+	if typ == "" {
+		typ = info.MicType
+	}
+	typ = strings.ToUpper(typ)
+	switch {
+	case strings.Contains(typ, "SMARTBULB"):
+		return KindBulb
+	case strings.Contains(typ, "SMARTPLUG"): // including IOT.SMARTPLUGSWITCH and IOT.RANGEEXTENDER.SMARTPLUG
+		if info.ChildNum > 0 || strings.Contains(strings.ToLower(info.DevName), "strip") {
+			return KindStrip
+		}
+		if strings.Contains(strings.ToLower(info.DevName), "dimmer") {
+			return KindDimmer
+		}
+		return KindPlug
+	}
+	return KindUnknown
+}
+
+// meteredModels are the model prefixes of devices with an energy meter,
+// for when they don't report their features.
+var meteredModels = []string{"HS110", "HS300", "KP115", "KP125", "EP25"}
+
+// HasEnergyMeter reports whether the device has an energy meter,
+// from its reported features or else its model.
+func (s State) HasEnergyMeter() bool {
+	info := s.System.Info
+	if info.Feature != "" {
+		for _, f := range strings.Split(info.Feature, ":") {
+			if f == "ENE" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range meteredModels {
+		if strings.HasPrefix(strings.ToUpper(info.Model), m) {
+			return true
+		}
+	}
+	return false
+}
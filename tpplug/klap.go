@@ -0,0 +1,418 @@
+package tpplug
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recent firmware for some plugs (such as the HS110 v4) drops the legacy
+// protocol for KLAP: the same JSON, but sent by HTTP (normally on port 80)
+// and encrypted with a key agreed in a handshake that proves both sides know
+// the TP-Link account's credentials.
+//
+// With TransportAuto, a plug that refuses TCP on port 9999 is tried with KLAP,
+// as are plugs noticed by DiscoverTapo to want it; either is remembered.
+// Sessions with plugs are kept, and renewed as the plug asks.
+//
+// The credentials are those given to SetCredentials, or else read from the file
+// named by $TPPLUG_CREDENTIALS, which has the username (an email address) on its
+// first line and the password on its second. Plugs that have never been bound
+// to an account accept blank credentials, or the app's default ones, so those
+// are tried too.
+
+// CredentialsEnv names the environment variable that gives the path of a
+// credentials file, if SetCredentials hasn't been called.
+const CredentialsEnv = "TPPLUG_CREDENTIALS"
+
+// Credentials are a TP-Link account's username and password.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+var (
+	credMu    sync.Mutex
+	creds     *Credentials // nil until set or loaded
+	credsOnce sync.Once
+)
+
+// SetCredentials sets the credentials for KLAP. Existing sessions are dropped.
+func SetCredentials(c Credentials) {
+	credMu.Lock()
+	creds = &c
+	credMu.Unlock()
+	credsOnce.Do(func() {}) // don't load them from the environment later
+	klapMu.Lock()
+	klapSessions = nil
+	klapMu.Unlock()
+}
+
+// haveCredentials reports whether credentials have been set or loaded.
+func haveCredentials() bool {
+	credsOnce.Do(loadCredentials)
+	credMu.Lock()
+	defer credMu.Unlock()
+	return creds != nil
+}
+
+func loadCredentials() {
+	path := os.Getenv(CredentialsEnv)
+	if path == "" {
+		return
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("WARNING: Reading KLAP credentials: %v", err)
+		return
+	}
+	lines := strings.SplitN(string(raw), "\n", 3)
+	if len(lines) < 2 {
+		log.Printf("WARNING: KLAP credentials file %s needs a username and password on separate lines", path)
+		return
+	}
+	credMu.Lock()
+	creds = &Credentials{Username: strings.TrimSpace(lines[0]), Password: strings.TrimRight(lines[1], "\r")}
+	credMu.Unlock()
+}
+
+// klapCandidates returns the credentials to try, in order.
+func klapCandidates() []Credentials {
+	var cs []Credentials
+	if haveCredentials() {
+		credMu.Lock()
+		cs = append(cs, *creds)
+		credMu.Unlock()
+	}
+	return append(cs,
+		Credentials{},
+		Credentials{Username: "kasa@tp-link.net", Password: "kasaSetup"},
+	)
+}
+
+// klapPorts holds the HTTP ports of plugs known to want KLAP, by IP (as a string).
+var klapPorts sync.Map
+
+// noteKLAP records that a plug wants KLAP, on port (80 if 0).
+func noteKLAP(ip net.IP, port int) {
+	if port == 0 {
+		port = 80
+	}
+	klapPorts.Store(ip.String(), port)
+}
+
+func klapHost(addr *net.UDPAddr) string {
+	port := 80
+	if p, ok := klapPorts.Load(addr.IP.String()); ok {
+		port = p.(int)
+	}
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(port))
+}
+
+var (
+	klapMu       sync.Mutex
+	klapSessions map[string]*klapSession // by host:port
+)
+
+// A klapSession is the state of a KLAP session with one plug.
+type klapSession struct {
+	host string
+
+	mu sync.Mutex // held for each handshake and request, in turn
+	// Set by a handshake. block is nil before one, and after a failure.
+	block   cipher.Block
+	iv      []byte // 12 bytes, followed by the sequence number
+	sig     []byte // 28 bytes, to prefix what is signed
+	seq     int32
+	cookie  string
+	expires time.Time
+}
+
+func klapSessionFor(host string) *klapSession {
+	klapMu.Lock()
+	defer klapMu.Unlock()
+	if klapSessions == nil {
+		klapSessions = make(map[string]*klapSession)
+	}
+	ks, ok := klapSessions[host]
+	if !ok {
+		ks = &klapSession{host: host}
+		klapSessions[host] = ks
+	}
+	return ks
+}
+
+// klapRoundTrip is roundTrip over KLAP.
+func klapRoundTrip(ctx context.Context, addr *net.UDPAddr, req []byte, handle func([]byte) error) error {
+	b, err := klapSessionFor(klapHost(addr)).do(ctx, req)
+	if err != nil {
+		return fmt.Errorf("KLAP: %w", err)
+	}
+	return handle(b)
+}
+
+// do sends a request, starting or renewing the session if need be.
+func (ks *klapSession) do(ctx context.Context, req []byte) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	fresh := false
+	if ks.block == nil || time.Now().After(ks.expires) {
+		if err := ks.handshake(ctx); err != nil {
+			return nil, err
+		}
+		fresh = true
+	}
+	b, err := ks.request(ctx, req)
+	if err != nil && !fresh && ctx.Err() == nil {
+		// The plug may have forgotten the session, such as by rebooting.
+		if err = ks.handshake(ctx); err == nil {
+			b, err = ks.request(ctx, req)
+		}
+	}
+	if err != nil {
+		ks.block = nil
+	}
+	return b, err
+}
+
+func (ks *klapSession) handshake(ctx context.Context) error {
+	ks.block = nil
+	local := make([]byte, 16)
+	if _, err := rand.Read(local); err != nil {
+		return err
+	}
+	body, hdr, err := klapPost(ctx, "http://"+ks.host+"/app/handshake1", "", local)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	if len(body) != 48 {
+		return invalidf("handshake response of %d bytes, not 48", len(body))
+	}
+	remote, serverHash := body[:16], body[16:]
+	var auth []byte
+	for _, c := range klapCandidates() {
+		if a := klapAuthHash(c); bytes.Equal(sha256Of(local, remote, a), serverHash) {
+			auth = a
+			break
+		}
+	}
+	if auth == nil {
+		return fmt.Errorf("plug at %s doesn't accept the credentials", ks.host)
+	}
+	cookie, timeout := parseKLAPCookie(hdr.Get("Set-Cookie"))
+	if _, _, err := klapPost(ctx, "http://"+ks.host+"/app/handshake2", cookie, sha256Of(remote, local, auth)); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	if err := ks.setKeys(local, remote, auth); err != nil {
+		return err
+	}
+	ks.cookie = cookie
+	ks.expires = time.Now().Add(timeout - time.Minute)
+	return nil
+}
+
+// setKeys derives the session's keys from the seeds and authentication hash of a handshake.
+func (ks *klapSession) setKeys(local, remote, auth []byte) error {
+	block, err := aes.NewCipher(sha256Of([]byte("lsk"), local, remote, auth)[:16])
+	if err != nil {
+		return err
+	}
+	ivseq := sha256Of([]byte("iv"), local, remote, auth)
+	ks.iv = ivseq[:12]
+	ks.seq = int32(binary.BigEndian.Uint32(ivseq[28:]))
+	ks.sig = sha256Of([]byte("ldk"), local, remote, auth)[:28]
+	ks.block = block
+	return nil
+}
+
+// request sends one request in an established session.
+func (ks *klapSession) request(ctx context.Context, req []byte) ([]byte, error) {
+	if err := packetLimit.wait(ctx); err != nil {
+		return nil, err
+	}
+	ks.seq++
+	seq := ks.seq
+	url := fmt.Sprintf("http://%s/app/request?seq=%d", ks.host, seq)
+	body, _, err := klapPost(ctx, url, ks.cookie, ks.encrypt(seq, req))
+	if err != nil {
+		return nil, err
+	}
+	return ks.decrypt(seq, body)
+}
+
+func (ks *klapSession) ivFor(seq int32) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, ks.iv)
+	binary.BigEndian.PutUint32(iv[12:], uint32(seq))
+	return iv
+}
+
+// encrypt returns a request's body: its signature, then the PKCS#7-padded ciphertext.
+func (ks *klapSession) encrypt(seq int32, msg []byte) []byte {
+	pad := aes.BlockSize - len(msg)%aes.BlockSize
+	out := make([]byte, 32+len(msg)+pad)
+	ct := out[32:]
+	copy(ct, msg)
+	for i := len(msg); i < len(ct); i++ {
+		ct[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(ks.block, ks.ivFor(seq)).CryptBlocks(ct, ct)
+	var seqb [4]byte
+	binary.BigEndian.PutUint32(seqb[:], uint32(seq))
+	copy(out, sha256Of(ks.sig, seqb[:], ct))
+	return out
+}
+
+// decrypt decrypts a response's body, in place, which is laid out like a request's.
+func (ks *klapSession) decrypt(seq int32, b []byte) ([]byte, error) {
+	if len(b) < 32+aes.BlockSize || (len(b)-32)%aes.BlockSize != 0 {
+		return nil, invalidf("KLAP response of %d bytes", len(b))
+	}
+	ct := b[32:]
+	var seqb [4]byte
+	binary.BigEndian.PutUint32(seqb[:], uint32(seq))
+	if subtle.ConstantTimeCompare(b[:32], sha256Of(ks.sig, seqb[:], ct)) != 1 {
+		return nil, invalidf("bad signature on KLAP response")
+	}
+	cipher.NewCBCDecrypter(ks.block, ks.ivFor(seq)).CryptBlocks(ct, ct)
+	pad := int(ct[len(ct)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, invalidf("bad padding in KLAP response")
+	}
+	for _, c := range ct[len(ct)-pad:] {
+		if int(c) != pad {
+			return nil, invalidf("bad padding in KLAP response")
+		}
+	}
+	return ct[:len(ct)-pad], nil
+}
+
+func klapAuthHash(c Credentials) []byte {
+	u := sha1.Sum([]byte(c.Username))
+	p := sha1.Sum([]byte(c.Password))
+	return sha256Of(u[:], p[:])
+}
+
+func sha256Of(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// parseKLAPCookie parses a Set-Cookie header such as "TP_SESSIONID=ABC;TIMEOUT=86400",
+// returning the cookie to send back and how long the session lasts.
+func parseKLAPCookie(h string) (cookie string, timeout time.Duration) {
+	timeout = 24 * time.Hour
+	for _, part := range strings.Split(h, ";") {
+		part = strings.TrimSpace(part)
+		switch {
+		case strings.HasPrefix(part, "TP_SESSIONID="):
+			cookie = part
+		case strings.HasPrefix(part, "TIMEOUT="):
+			if n, err := strconv.Atoi(strings.TrimPrefix(part, "TIMEOUT=")); err == nil && n > 60 {
+				timeout = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return cookie, timeout
+}
+
+// maxKLAPBody bounds the body of a KLAP response: the largest message, padded and signed.
+const maxKLAPBody = 32 + maxRespSize + aes.BlockSize
+
+func klapPost(ctx context.Context, url, cookie string, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKLAPBody+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+	if len(b) > maxKLAPBody {
+		return nil, nil, invalidf("KLAP response larger than %d bytes", maxKLAPBody)
+	}
+	return b, resp.Header, nil
+}
+
+// klapQueryTimeout bounds the queries of plugs found by discovery to want KLAP.
+const klapQueryTimeout = 2 * time.Second
+
+// queryKLAP queries the Kasa plugs among tds that want KLAP, other than those in known,
+// which answered the legacy protocol.
+func queryKLAP(tds []TapoDevice, known []DiscoveryResponse, keepRaw bool) []DiscoveryResponse {
+	seen := make(map[MAC]bool)
+	for _, dr := range known {
+		seen[dr.State.System.Info.MAC] = true
+	}
+	// The discovery context has run out by now.
+	ctx, cancel := context.WithTimeout(context.Background(), klapQueryTimeout)
+	defer cancel()
+	if keepRaw {
+		ctx = KeepRaw(ctx)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		drs     []DiscoveryResponse
+		failed  int
+		lastErr error
+	)
+	for _, td := range tds {
+		if td.EncryptType != "KLAP" || !strings.HasPrefix(td.Type, "IOT.") || seen[td.MAC] {
+			continue // Tapo devices speak something else again
+		}
+		noteKLAP(td.IP, td.HTTPPort)
+		addr := &net.UDPAddr{IP: td.IP, Port: DefaultPort}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := queryState(ctx, nil, addr, stateQuery)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed, lastErr = failed+1, fmt.Errorf("from %v: %w", addr, err)
+				return
+			}
+			drs = append(drs, DiscoveryResponse{Addr: addr, State: st, Kind: st.Kind()})
+		}()
+	}
+	wg.Wait()
+	if failed > 0 {
+		log.Printf("WARNING: Failed to query %d KLAP plugs; last was %v", failed, lastErr)
+	}
+	return drs
+}
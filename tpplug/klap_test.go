@@ -0,0 +1,130 @@
+package tpplug
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testKLAPSessions(t *testing.T) (client, plug *klapSession) {
+	local, remote := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	auth := klapAuthHash(Credentials{Username: "user@example.com", Password: "secret"})
+	client, plug = &klapSession{}, &klapSession{}
+	if err := client.setKeys(local, remote, auth); err != nil {
+		t.Fatal(err)
+	}
+	if err := plug.setKeys(local, remote, auth); err != nil {
+		t.Fatal(err)
+	}
+	return client, plug
+}
+
+func TestKLAPRoundTrip(t *testing.T) {
+	client, plug := testKLAPSessions(t)
+	for i, msg := range []string{"", "{}", "0123456789abcdef", `{"system":{"get_sysinfo":{}}}`, strings.Repeat("x", 1000)} {
+		seq := client.seq + int32(i)
+		body := client.encrypt(seq, []byte(msg))
+		got, err := plug.decrypt(seq, body)
+		if err != nil {
+			t.Errorf("decrypt of %d bytes: %v", len(msg), err)
+			continue
+		}
+		if string(got) != msg {
+			t.Errorf("decrypt of %d bytes gave %q", len(msg), got)
+		}
+	}
+}
+
+func TestKLAPRejectsTampering(t *testing.T) {
+	client, plug := testKLAPSessions(t)
+	msg := []byte(`{"system":{"set_relay_state":{"state":1}}}`)
+	for _, tc := range []struct {
+		desc   string
+		seq    int32 // added to the sequence number used to decrypt
+		tamper func(b []byte) []byte
+	}{
+		{"signature", 0, func(b []byte) []byte { b[3] ^= 1; return b }},
+		{"ciphertext", 0, func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"sequence number", 1, func(b []byte) []byte { return b }},
+		{"truncated", 0, func(b []byte) []byte { return b[:len(b)-16] }},
+		{"short", 0, func(b []byte) []byte { return b[:40] }},
+	} {
+		seq := client.seq
+		body := tc.tamper(client.encrypt(seq, msg))
+		if got, err := plug.decrypt(seq+tc.seq, body); err == nil {
+			t.Errorf("decrypt with tampered %s succeeded, giving %q", tc.desc, got)
+		}
+	}
+}
+
+// fakeKLAPPlug serves the HTTP side of KLAP for a plug with blank credentials,
+// answering each request with reply.
+func fakeKLAPPlug(t *testing.T, reply string) *httptest.Server {
+	auth := klapAuthHash(Credentials{})
+	var (
+		mu            sync.Mutex
+		local, remote []byte
+		ks            *klapSession
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/app/handshake1":
+			local, remote = body, []byte("remote seed 0123")
+			http.SetCookie(w, &http.Cookie{Name: "TP_SESSIONID", Value: "ABC"})
+			w.Write(append(append([]byte(nil), remote...), sha256Of(local, remote, auth)...))
+		case "/app/handshake2":
+			if r.Header.Get("Cookie") != "TP_SESSIONID=ABC" || !bytes.Equal(body, sha256Of(remote, local, auth)) {
+				http.Error(w, "bad handshake", http.StatusForbidden)
+				return
+			}
+			ks = &klapSession{}
+			if err := ks.setKeys(local, remote, auth); err != nil {
+				t.Errorf("setKeys: %v", err)
+			}
+		case "/app/request":
+			seq, err := strconv.Atoi(r.URL.Query().Get("seq"))
+			if ks == nil || err != nil {
+				http.Error(w, "no session", http.StatusForbidden)
+				return
+			}
+			if _, err := ks.decrypt(int32(seq), body); err != nil {
+				t.Errorf("Plug decrypting request: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Write(ks.encrypt(int32(seq), []byte(reply)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestKLAPHandshake(t *testing.T) {
+	const reply = `{"system":{"get_sysinfo":{"alias":"KLAP plug","err_code":0}}}`
+	srv := fakeKLAPPlug(t, reply)
+	ks := &klapSession{host: strings.TrimPrefix(srv.URL, "http://")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ { // the second reuses the session
+		got, err := ks.do(ctx, sysinfoQuery)
+		if err != nil {
+			t.Fatalf("Request %d: %v", i+1, err)
+		}
+		if string(got) != reply {
+			t.Errorf("Request %d got %q, want %q", i+1, got, reply)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package tpplug
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+)
+
+// Plugs have a location, which they use to work out sunrise and sunset
+// for schedule rules. They report it in sysinfo as latitude_i and longitude_i,
+// in units of 1e-4 degrees.
+
+// Coordinates returns the location of the device in degrees,
+// and whether it has one. A device that hasn't been given a location reports 0, 0.
+func (s State) Coordinates() (lat, lon float64, ok bool) {
+	info := s.System.Info
+	if info.Latitude == 0 && info.Longitude == 0 {
+		return 0, 0, false
+	}
+	return float64(info.Latitude) / 1e4, float64(info.Longitude) / 1e4, true
+}
+
+type setDevLocation struct {
+	Latitude  int `json:"latitude_i"`
+	Longitude int `json:"longitude_i"`
+
+	// Older firmware takes degrees, and ignores the fields above; newer ignores these.
+	LatitudeDeg  float64 `json:"latitude"`
+	LongitudeDeg float64 `json:"longitude"`
+}
+
+// SetDevLocation sets the location of a plug, in degrees.
+// It is stored to a precision of 1e-4 degrees (roughly 10 metres).
+func SetDevLocation(ctx context.Context, addr *net.UDPAddr, lat, lon float64) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetDevLocation", addr)
+	defer func() { end(err) }()
+
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("latitude %v out of range", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return fmt.Errorf("longitude %v out of range", lon)
+	}
+	req := map[string]interface{}{"system": map[string]interface{}{"set_dev_location": setDevLocation{
+		Latitude:     int(math.Round(lat * 1e4)),
+		Longitude:    int(math.Round(lon * 1e4)),
+		LatitudeDeg:  lat,
+		LongitudeDeg: lon,
+	}}}
+	var resp struct {
+		System struct {
+			SetDevLocation errResponse `json:"set_dev_location"`
+		} `json:"system"`
+	}
+	if err := RawJSONOp(ctx, addr, req, &resp); err != nil {
+		return err
+	}
+	if err := resp.System.SetDevLocation.Err(); err != nil {
+		return fmt.Errorf("set_dev_location: %w", err)
+	}
+	return nil
+}
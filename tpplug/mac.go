@@ -0,0 +1,84 @@
+package tpplug
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MAC is a MAC address in canonical form: six pairs of upper-case hex digits
+// separated by colons, as in "50:C7:BF:00:00:01". That's how Kasa plugs report
+// themselves, but Tapo devices, cloud listings and humans use other forms, so
+// anything that compares or looks up MACs should go through ParseMAC.
+type MAC string
+
+// ParseMAC parses a 48-bit MAC address in any common form: with colons
+// or dashes (50:c7:bf:00:00:01, 50-C7-BF-00-00-01), in dotted groups of four
+// (50c7.bf00.0001), or with no separators at all (50C7BF000001).
+func ParseMAC(s string) (MAC, error) {
+	hex := strings.NewReplacer(":", "", "-", "", ".", "").Replace(s)
+	if len(hex) != 12 {
+		return "", fmt.Errorf("bad MAC %q", s)
+	}
+	// Separators must be consistent and in the right places.
+	switch len(s) {
+	case 12:
+	case 14:
+		if s[4] != '.' || s[9] != '.' {
+			return "", fmt.Errorf("bad MAC %q", s)
+		}
+	case 17:
+		sep := s[2]
+		if sep != ':' && sep != '-' {
+			return "", fmt.Errorf("bad MAC %q", s)
+		}
+		for i := 2; i < len(s); i += 3 {
+			if s[i] != sep {
+				return "", fmt.Errorf("bad MAC %q", s)
+			}
+		}
+	default:
+		return "", fmt.Errorf("bad MAC %q", s)
+	}
+	var b strings.Builder
+	for i := 0; i < 12; i++ {
+		c := hex[i]
+		switch {
+		case '0' <= c && c <= '9', 'A' <= c && c <= 'F':
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 'A'
+		default:
+			return "", fmt.Errorf("bad MAC %q", s)
+		}
+		if i > 0 && i%2 == 0 {
+			b.WriteByte(':')
+		}
+		b.WriteByte(c)
+	}
+	return MAC(b.String()), nil
+}
+
+// CanonicalMAC returns the canonical form of a MAC address,
+// or s unchanged if it isn't one.
+func CanonicalMAC(s string) MAC {
+	if m, err := ParseMAC(s); err == nil {
+		return m
+	}
+	return MAC(s)
+}
+
+func (m MAC) String() string { return string(m) }
+
+// Compact returns the MAC without separators, as in "50C7BF000001".
+func (m MAC) Compact() string { return strings.Replace(string(m), ":", "", -1) }
+
+// UnmarshalJSON decodes a MAC from a JSON string, canonicalizing it if it parses.
+// Anything else is kept as is, so that State validation can report it.
+func (m *MAC) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*m = CanonicalMAC(s)
+	return nil
+}
@@ -0,0 +1,73 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMAC(t *testing.T) {
+	const want = MAC("50:C7:BF:00:00:0A")
+	for _, s := range []string{
+		"50:C7:BF:00:00:0A",
+		"50:c7:bf:00:00:0a",
+		"50-C7-BF-00-00-0A",
+		"50-c7-Bf-00-00-0a",
+		"50C7BF00000A",
+		"50c7bf00000a",
+		"50c7.bf00.000a",
+	} {
+		if got, err := ParseMAC(s); err != nil || got != want {
+			t.Errorf("ParseMAC(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"not a MAC",
+		"50:C7:BF:00:00",
+		"50:C7:BF:00:00:0A:0B",
+		"50:C7:BF-00:00:0A",
+		"50:C7:BF:00:000A:",
+		"50C7BF00000G",
+		"50c7.bf00000a.",
+		"50c7bf.00.000a",
+		"5:0C7:BF:00:00:0A",
+		" 50C7BF00000A",
+	} {
+		if got, err := ParseMAC(s); err == nil {
+			t.Errorf("ParseMAC(%q) = %q, want error", s, got)
+		}
+	}
+}
+
+func TestMACUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want MAC
+		ok   bool
+	}{
+		{`"50:C7:BF:00:00:0A"`, "50:C7:BF:00:00:0A", true},
+		{`"50-c7-bf-00-00-0a"`, "50:C7:BF:00:00:0A", true},
+		{`"50c7BF00000a"`, "50:C7:BF:00:00:0A", true},
+		{`""`, "", true},
+		{`"not a MAC"`, "not a MAC", true}, // kept for validation to report
+		{`123`, "", false},
+		{`null`, "", true},
+	} {
+		var m MAC
+		err := json.Unmarshal([]byte(tc.in), &m)
+		if (err == nil) != tc.ok || m != tc.want {
+			t.Errorf("Unmarshal(%s) gave %q, %v; want %q, ok = %t", tc.in, m, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestMicMAC(t *testing.T) {
+	state, err := decodeState(context.Background(), []byte(`{"system":{"get_sysinfo":{"mic_mac":"1c3bf300000b"}}}`))
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	if info := state.System.Info; info.MAC != "1C:3B:F3:00:00:0B" || info.MicMAC != "1C:3B:F3:00:00:0B" {
+		t.Errorf("decodeState of mic_mac gave MAC %q, MicMAC %q; want both %q", info.MAC, info.MicMAC, "1C:3B:F3:00:00:0B")
+	}
+}
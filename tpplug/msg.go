@@ -1,10 +1,12 @@
 package tpplug
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 )
 
 // writeMsg encrypts a message, and sends it to the UDP target.
@@ -18,43 +20,157 @@ func writeMsg(conn *net.UDPConn, dst *net.UDPAddr, b []byte) error {
 	return nil
 }
 
-func readMsg(conn *net.UDPConn, scratch []byte) (resp []byte, raddr *net.UDPAddr, err error) {
-	nb, remoteAddr, err := conn.ReadFrom(scratch)
-	if err != nil {
-		return nil, nil, fmt.Errorf("reading message: %w", err)
+// readMsg reads and decrypts one message.
+// If from is set, datagrams from anywhere else are dropped unread.
+// scratch must be one byte larger than the largest message accepted, so oversized
+// messages can be detected; an oversized message yields an error wrapping
+// ErrInvalidResponse, along with its sender.
+func readMsg(conn *net.UDPConn, scratch []byte, from *net.UDPAddr) (resp []byte, raddr *net.UDPAddr, err error) {
+	for {
+		var nb int
+		nb, raddr, err = conn.ReadFromUDP(scratch)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading message: %w", err)
+		}
+		if from != nil && (!raddr.IP.Equal(from.IP) || raddr.Port != from.Port) {
+			continue
+		}
+		if max := len(scratch) - 1; nb > max {
+			return nil, raddr, invalidf("datagram from %v larger than %d bytes", raddr, max)
+		}
+		b := scratch[:nb]
+		Decrypt(b)
+		return b, raddr, nil
 	}
-	b := scratch[:nb]
-	Decrypt(b)
-	return b, remoteAddr.(*net.UDPAddr), nil
 }
 
+// scratchBuf is a buffer for readMsg, for discovery responses.
+type scratchBuf [maxMsgSize + 1]byte
+
+// respBuf is a buffer for readMsg, for the response from the plug asked.
+type respBuf [maxRespSize + 1]byte
+
+// Polling many plugs often makes a lot of garbage, so the buffers for
+// requests and responses are pooled, as are JSON encoders. With a Session,
+// which keeps its socket, an operation allocates little beyond decoding.
+var (
+	scratchPool = sync.Pool{New: func() interface{} { return new(scratchBuf) }}
+	respPool    = sync.Pool{New: func() interface{} { return new(respBuf) }}
+	encoderPool = sync.Pool{New: func() interface{} {
+		e := new(jsonEncoder)
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	}}
+)
+
+type jsonEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// RawOp sends a request to a plug, and returns its response.
+// Unlike writeMsg, it doesn't modify req. See WithTransport for how it is sent.
 func RawOp(ctx context.Context, addr *net.UDPAddr, req []byte) ([]byte, error) {
-	conn, err := udpConn(ctx)
-	if err != nil {
-		return nil, err
+	return rawOp(ctx, nil, addr, req)
+}
+
+// rawOp is RawOp over conn, or a socket of its own if conn is nil.
+func rawOp(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, req []byte) (out []byte, err error) {
+	err = roundTrip(ctx, conn, addr, req, func(b []byte) error {
+		out = append([]byte(nil), b...)
+		return nil
+	})
+	return out, err
+}
+
+// roundTrip sends req to addr, over the transport chosen by ctx,
+// and calls handle with the response, which is only valid during the call.
+// UDP is over conn, or a socket of its own if conn is nil.
+func roundTrip(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, req []byte, handle func([]byte) error) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.RawOp", addr)
+	defer func() { end(err) }()
+
+	if id := childFor(ctx); id != "" {
+		req = withChildContext(req, id)
+	}
+	if isGroup(addr.IP) {
+		return udpRoundTrip(ctx, conn, addr, req, handle)
 	}
-	defer conn.Close()
+	return withRetries(ctx, func(ctx context.Context) error {
+		switch transportFor(ctx) {
+		case TransportUDP:
+			return udpRoundTrip(ctx, conn, addr, req, handle)
+		case TransportTCP:
+			return tcpRoundTrip(ctx, addr, req, handle)
+		case TransportKLAP:
+			return klapRoundTrip(ctx, addr, req, handle)
+		}
+		return autoRoundTrip(ctx, conn, addr, req, handle)
+	})
+}
 
-	if err := writeMsg(conn, addr, req); err != nil {
-		return nil, err
+// udpRoundTrip is roundTrip over UDP.
+func udpRoundTrip(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, req []byte, handle func([]byte) error) (err error) {
+	if conn == nil {
+		if conn, err = udpConn(ctx, networkFor(addr.IP)); err != nil {
+			return err
+		}
+		defer conn.Close()
+	} else {
+		d, _ := ctx.Deadline() // the zero time means none
+		conn.SetReadDeadline(d)
 	}
 
-	var scratch [4 << 10]byte
-	b, _, err := readMsg(conn, scratch[:])
-	return b, err
-}
+	scratch := respPool.Get().(*respBuf)
+	defer respPool.Put(scratch)
+	var msg []byte
+	if len(req) <= len(scratch) {
+		// writeMsg encrypts in place, and is done with the request before the response is read.
+		msg = scratch[:copy(scratch[:], req)]
+	} else {
+		msg = append([]byte(nil), req...)
+	}
 
-func RawJSONOp(ctx context.Context, addr *net.UDPAddr, req, resp interface{}) error {
-	b, err := json.Marshal(req)
-	if err != nil {
-		return fmt.Errorf("encoding JSON request: %w", err)
+	if err := packetLimit.wait(ctx); err != nil {
+		return err
+	}
+	if err := writeMsg(conn, addr, msg); err != nil {
+		return err
+	}
+
+	// Wait for the response, ignoring anything that arrives from elsewhere.
+	// Replies to a broadcast or multicast may come from anywhere, though.
+	from := addr
+	if isGroup(addr.IP) {
+		from = nil
 	}
-	out, err := RawOp(ctx, addr, b)
+	b, _, err := readMsg(conn, scratch[:], from)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(out, resp); err != nil {
-		return fmt.Errorf("decoding JSON request: %w", err)
+	return handle(b)
+}
+
+func RawJSONOp(ctx context.Context, addr *net.UDPAddr, req, resp interface{}) error {
+	return rawJSONOp(ctx, nil, addr, req, resp)
+}
+
+// rawJSONOp is RawJSONOp over conn, or a socket of its own if conn is nil.
+func rawJSONOp(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, req, resp interface{}) error {
+	e := encoderPool.Get().(*jsonEncoder)
+	defer encoderPool.Put(e)
+	e.buf.Reset()
+	if err := e.enc.Encode(req); err != nil {
+		return fmt.Errorf("encoding JSON request: %w", err)
 	}
-	return nil
+	b := bytes.TrimSuffix(e.buf.Bytes(), []byte("\n")) // Encode adds a newline
+	return roundTrip(ctx, conn, addr, b, func(out []byte) error {
+		if err := checkJSON(out); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(out, resp); err != nil {
+			return fmt.Errorf("decoding JSON request: %w", err)
+		}
+		return nil
+	})
 }
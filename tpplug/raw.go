@@ -0,0 +1,77 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// A State can keep the raw response it was decoded from, so callers can get
+// at fields that State doesn't have without another round trip. It's kept
+// only if asked for with KeepRaw, since it costs memory, and since two States
+// with raw responses are only equal if their responses are identical,
+// including fields such as on_time that change all the time.
+// States from a registry (see Discover) have been through JSON, and have none.
+
+type keepRawKey struct{}
+
+// KeepRaw returns a context that makes Query, QuerySysinfoOnly and Discover
+// keep raw responses on the States they return; see State.Raw.
+func KeepRaw(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keepRawKey{}, true)
+}
+
+func keepingRaw(ctx context.Context) bool {
+	keep, _ := ctx.Value(keepRawKey{}).(bool)
+	return keep
+}
+
+// Raw returns the raw JSON of one section of the response a State was decoded
+// from, such as Raw("system", "get_sysinfo"), or nil if there's no such section
+// or the response wasn't kept.
+func (s State) Raw(module, method string) json.RawMessage {
+	if s.raw == "" {
+		return nil
+	}
+	var mods map[string]map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s.raw), &mods); err != nil {
+		return nil
+	}
+	return mods[module][method]
+}
+
+// RawMap is like Raw, but decodes the section into a map.
+func (s State) RawMap(module, method string) (map[string]interface{}, error) {
+	raw := s.Raw(module, method)
+	if raw == nil {
+		return nil, fmt.Errorf("no %s.%s in response", module, method)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("decoding %s.%s: %w", module, method, err)
+	}
+	return m, nil
+}
+
+// mergeRaw merges the modules of raw response b into a,
+// as if they had come in the same response. Modules in both are taken from b.
+func mergeRaw(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	var am, bm map[string]json.RawMessage
+	if json.Unmarshal([]byte(a), &am) != nil || json.Unmarshal([]byte(b), &bm) != nil {
+		return a
+	}
+	for mod, raw := range bm {
+		am[mod] = raw
+	}
+	merged, err := json.Marshal(am)
+	if err != nil {
+		return a
+	}
+	return string(merged)
+}
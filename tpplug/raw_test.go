@@ -0,0 +1,29 @@
+package tpplug
+
+import "testing"
+
+func TestMergeRaw(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, want string
+	}{
+		{"", "", ""},
+		{`{"system":{"get_sysinfo":{}}}`, "", `{"system":{"get_sysinfo":{}}}`},
+		{"", `{"emeter":{"get_realtime":{}}}`, `{"emeter":{"get_realtime":{}}}`},
+		{
+			`{"system":{"get_sysinfo":{"alias":"a"}}}`,
+			`{"emeter":{"get_realtime":{"power_mw":5}}}`,
+			`{"emeter":{"get_realtime":{"power_mw":5}},"system":{"get_sysinfo":{"alias":"a"}}}`,
+		},
+		{
+			`{"system":{"get_sysinfo":{"alias":"a"}},"emeter":{"get_realtime":{}}}`,
+			`{"emeter":{"get_realtime":{"power_mw":5}}}`,
+			`{"emeter":{"get_realtime":{"power_mw":5}},"system":{"get_sysinfo":{"alias":"a"}}}`,
+		},
+		// Either being malformed leaves a alone.
+		{`{"system":{}}`, `{"emeter"`, `{"system":{}}`},
+	} {
+		if got := mergeRaw(tc.a, tc.b); got != tc.want {
+			t.Errorf("mergeRaw(%s, %s) = %s, want %s", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A registry is a local service, reached over a Unix socket, that knows
+// which plugs are on the network. When several programs on one host
+// need discovery, one of them (e.g. cmd/tpplug-registry) can maintain
+// the registry instead of each broadcasting independently.
+//
+// Discover uses the registry if it is present. The socket path is
+// DefaultRegistrySocket, or the value of the $TPPLUG_REGISTRY
+// environment variable; setting that to "none" disables the registry.
+const (
+	DefaultRegistrySocket = "/run/tpplug/registry.sock"
+	RegistrySocketEnv     = "TPPLUG_REGISTRY"
+)
+
+// RegistryEntry is a plug known to a registry.
+type RegistryEntry struct {
+	Addr     string    `json:"addr"` // host:port
+	MAC      MAC       `json:"mac"`
+	Alias    string    `json:"alias"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// RegistrySocket returns the registry socket path to use, or "" if disabled.
+func RegistrySocket() string {
+	switch s := os.Getenv(RegistrySocketEnv); s {
+	case "":
+		return DefaultRegistrySocket
+	case "none":
+		return ""
+	default:
+		return s
+	}
+}
+
+// ReadRegistry fetches the entries from the registry at the given socket path.
+func ReadRegistry(ctx context.Context, path string) ([]RegistryEntry, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	var entries []RegistryEntry
+	if err := json.NewDecoder(conn).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("reading registry: %w", err)
+	}
+	return entries, nil
+}
+
+// ServeRegistry serves a registry on l until l is closed.
+// Each connection is sent the current result of entries.
+func ServeRegistry(l net.Listener, entries func() []RegistryEntry) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			es := entries()
+			if es == nil {
+				es = []RegistryEntry{}
+			}
+			json.NewEncoder(conn).Encode(es)
+		}()
+	}
+}
+
+// discoverViaRegistry finds plugs using the registry,
+// querying each one directly so the returned state is fresh.
+// Plugs that don't respond are omitted, as with broadcast discovery.
+func discoverViaRegistry(ctx context.Context, path string) ([]DiscoveryResponse, error) {
+	entries, err := ReadRegistry(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		drs []DiscoveryResponse
+	)
+	for _, e := range entries {
+		addr, err := net.ResolveUDPAddr("udp", e.Addr)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := Query(ctx, addr)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			drs = append(drs, DiscoveryResponse{Addr: addr, State: state, Kind: state.Kind()})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return drs, nil
+}
@@ -0,0 +1,82 @@
+package tpplug
+
+import (
+	"context"
+	"time"
+)
+
+// UDP on busy Wi-Fi loses datagrams, so a request or its response can go
+// missing even when the plug is fine. A context from WithRetries makes
+// requests be sent again when no response arrives in time. Since the request
+// may have been acted on all the same, an operation may be done twice;
+// that's harmless for queries and for setting the relay, but not for adding
+// a schedule or countdown rule, or for rebooting or resetting, so those are
+// never retried. Callers of RawOp and RawJSONOp with such requests can opt out
+// the same way, with a context from WithoutRetries.
+// A late response to an earlier try may be taken as the response to a later one.
+// Requests to broadcast and multicast addresses are never retried.
+
+// RetryPolicy says how requests are retried; see WithRetries.
+type RetryPolicy struct {
+	// Retries is how many more times a request is sent if no response arrives.
+	Retries int
+
+	// Timeout bounds how long each try waits for a response. If it is zero,
+	// the time left before the context's deadline is shared by the tries left.
+	Timeout time.Duration
+
+	// Delay is how long to wait before the first retry. It doubles for each after.
+	Delay time.Duration
+}
+
+type retryKey struct{}
+
+// WithRetries returns a context that makes requests to plugs be retried as p says.
+// Only timeouts are retried; errors from the plug, and the context ending, are not.
+func WithRetries(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, p)
+}
+
+// WithoutRetries returns a context in which requests to plugs aren't retried,
+// whatever the retry policy of ctx. Its Timeout still bounds the one try.
+func WithoutRetries(ctx context.Context) context.Context {
+	p, ok := ctx.Value(retryKey{}).(RetryPolicy)
+	if !ok {
+		return ctx
+	}
+	return WithRetries(ctx, RetryPolicy{Timeout: p.Timeout})
+}
+
+func retryFor(ctx context.Context) RetryPolicy {
+	p, _ := ctx.Value(retryKey{}).(RetryPolicy)
+	return p
+}
+
+// withRetries calls try until it succeeds, or the retry policy of ctx runs out.
+func withRetries(ctx context.Context, try func(context.Context) error) error {
+	p := retryFor(ctx)
+	delay := p.Delay
+	for n := 0; ; n++ {
+		tctx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			tctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		} else if d, ok := ctx.Deadline(); ok && n < p.Retries {
+			tctx, cancel = context.WithTimeout(ctx, time.Until(d)/time.Duration(p.Retries-n+1))
+		}
+		err := try(tctx)
+		cancel()
+		if err == nil || n >= p.Retries || ctx.Err() != nil || !isTimeout(err) {
+			return err
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+			delay *= 2
+		}
+	}
+}
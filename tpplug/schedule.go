@@ -0,0 +1,122 @@
+package tpplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Plugs keep a schedule of rules that switch the relay at times of the week,
+// which they follow by themselves, even without a network. The schedule only
+// runs while the plug is in ModeSchedule (see SetMode). Times are in the
+// plug's timezone, so make sure its clock is right (see CorrectClock).
+
+// ScheduleRule is a schedule rule as the plug represents it.
+type ScheduleRule struct {
+	ID       string `json:"id,omitempty"` // assigned by the plug
+	Name     string `json:"name"`
+	Enable   int    `json:"enable"`    // 1 = enabled, 0 = disabled
+	WDay     []int  `json:"wday"`      // 7 entries, Sunday first; 1 = on that day
+	StimeOpt int    `json:"stime_opt"` // 0 = clock time, 1 = sunrise, 2 = sunset
+	SMin     int    `json:"smin"`      // minutes after midnight
+	SAct     int    `json:"sact"`      // 1 = turn on, 0 = turn off
+	EtimeOpt int    `json:"etime_opt"` // -1 for no end action
+	EMin     int    `json:"emin"`
+	EAct     int    `json:"eact"` // -1 for no end action
+	Repeat   int    `json:"repeat"`
+	Year     int    `json:"year"` // for a rule that doesn't repeat
+	Month    int    `json:"month"`
+	Day      int    `json:"day"`
+}
+
+var (
+	schedGetRules       = commandName{"schedule", "get_rules"}
+	schedAddRule        = commandName{"schedule", "add_rule"}
+	schedEditRule       = commandName{"schedule", "edit_rule"}
+	schedDeleteRule     = commandName{"schedule", "delete_rule"}
+	schedDeleteAllRules = commandName{"schedule", "delete_all_rules"}
+)
+
+func (r ScheduleRule) check() error {
+	if len(r.WDay) != 7 {
+		return fmt.Errorf("schedule rule has %d weekdays, want 7", len(r.WDay))
+	}
+	if r.StimeOpt < 0 || r.StimeOpt > 2 {
+		return fmt.Errorf("bad schedule rule stime_opt %d", r.StimeOpt)
+	}
+	if r.SMin < 0 || r.SMin >= 24*60 {
+		return fmt.Errorf("schedule rule time %d is not within a day", r.SMin)
+	}
+	if r.SAct != 0 && r.SAct != 1 {
+		return fmt.Errorf("bad schedule rule action %d", r.SAct)
+	}
+	return nil
+}
+
+// ScheduleRules returns the rules in a plug's schedule.
+func ScheduleRules(ctx context.Context, addr *net.UDPAddr) (_ []ScheduleRule, err error) {
+	ctx, end := startSpan(ctx, "tpplug.ScheduleRules", addr)
+	defer func() { end(err) }()
+
+	var resp struct {
+		RuleList []ScheduleRule `json:"rule_list"`
+	}
+	if err := sendCommand(ctx, addr, schedGetRules, struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.RuleList, nil
+}
+
+// AddScheduleRule adds a rule to a plug's schedule, returning the ID the plug gives it.
+// The rule's ID is ignored.
+func AddScheduleRule(ctx context.Context, addr *net.UDPAddr, r ScheduleRule) (_ string, err error) {
+	ctx, end := startSpan(ctx, "tpplug.AddScheduleRule", addr)
+	defer func() { end(err) }()
+	ctx = WithoutRetries(ctx) // not safe to do twice
+
+	if err := r.check(); err != nil {
+		return "", err
+	}
+	r.ID = ""
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := sendCommand(ctx, addr, schedAddRule, r, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// EditScheduleRule replaces the rule in a plug's schedule with the same ID as r.
+func EditScheduleRule(ctx context.Context, addr *net.UDPAddr, r ScheduleRule) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.EditScheduleRule", addr)
+	defer func() { end(err) }()
+
+	if r.ID == "" {
+		return errors.New("schedule rule to edit has no ID")
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	return sendCommand(ctx, addr, schedEditRule, r, nil)
+}
+
+// DeleteScheduleRule removes the rule with the given ID from a plug's schedule.
+func DeleteScheduleRule(ctx context.Context, addr *net.UDPAddr, id string) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.DeleteScheduleRule", addr)
+	defer func() { end(err) }()
+
+	if id == "" {
+		return errors.New("no schedule rule ID to delete")
+	}
+	return sendCommand(ctx, addr, schedDeleteRule, map[string]string{"id": id}, nil)
+}
+
+// DeleteAllScheduleRules empties a plug's schedule.
+func DeleteAllScheduleRules(ctx context.Context, addr *net.UDPAddr) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.DeleteAllScheduleRules", addr)
+	defer func() { end(err) }()
+
+	return sendCommand(ctx, addr, schedDeleteAllRules, struct{}{}, nil)
+}
@@ -0,0 +1,418 @@
+package tpplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UnhealthyAfter is how many consecutive failed operations make a Session unhealthy.
+const UnhealthyAfter = 3
+
+// A Session is a handle on a plug that keeps track of whether it is reachable.
+// Its methods are the same as the package's functions for a single plug,
+// and every one updates the bookkeeping.
+// A Session is safe for concurrent use.
+//
+// Query, QuerySysinfoOnly, RawOp and RawJSONOp reuse a socket of the Session's,
+// one at a time; Close releases it. DialWithOptions sets timeouts, retries and so on.
+type Session struct {
+	addr *net.UDPAddr
+	opts SessionOptions
+
+	connMu sync.Mutex
+	conn   *net.UDPConn // nil until needed, and after a failure
+
+	mu       sync.Mutex
+	lastSeen time.Time // last success
+	failures int       // consecutive failures
+	lastErr  error     // most recent failure, or nil after a success
+}
+
+// SessionOptions controls optional behaviour of a Session.
+type SessionOptions struct {
+	// Port, if set, replaces the port of the plug's address.
+	Port int
+
+	// Timeout, if set, bounds each try of an operation,
+	// within any deadline of the operation's context.
+	Timeout time.Duration
+
+	// Retries is how many more times an operation is tried if it fails
+	// with a network error, such as a timeout from a lost packet.
+	// Failures the plug reports, and the context ending, aren't retried.
+	// These retries are of whole operations, on top of any of the context's (see WithRetries).
+	// Since a request whose response was lost may have been acted on all the same,
+	// operations that aren't safe to do twice (AddScheduleRule, AddCountdown,
+	// Reboot and Reset) are never retried. Do, RawOp and RawJSONOp are,
+	// so callers sending other requests shouldn't use them with Retries.
+	Retries int
+
+	// RetryDelay is how long to wait before the first retry. It doubles for each after.
+	RetryDelay time.Duration
+
+	// Transport, if set, is used as if given to WithTransport,
+	// unless the operation's context picks one itself.
+	Transport Transport
+}
+
+// Dial returns a Session for the plug at addr.
+// Like dialling UDP, it doesn't contact the plug.
+func Dial(addr *net.UDPAddr) *Session {
+	return &Session{addr: addr}
+}
+
+// DialWithOptions is like Dial, with options.
+func DialWithOptions(addr *net.UDPAddr, opts SessionOptions) *Session {
+	if opts.Port != 0 {
+		a := *addr
+		a.Port = opts.Port
+		addr = &a
+	}
+	return &Session{addr: addr, opts: opts}
+}
+
+// Addr returns the plug's address.
+func (s *Session) Addr() *net.UDPAddr { return s.addr }
+
+// op runs an operation f as the options say, and updates the bookkeeping.
+func (s *Session) op(ctx context.Context, f func(context.Context) error) error {
+	return s.tries(ctx, s.opts.Retries, f)
+}
+
+// opOnce is like op, but never retries f, since it isn't safe to do twice.
+func (s *Session) opOnce(ctx context.Context, f func(context.Context) error) error {
+	return s.tries(ctx, 0, f)
+}
+
+func (s *Session) tries(ctx context.Context, retries int, f func(context.Context) error) error {
+	if s.opts.Transport != TransportAuto && ctx.Value(transportKey{}) == nil {
+		ctx = WithTransport(ctx, s.opts.Transport)
+	}
+	delay := s.opts.RetryDelay
+	for try := 0; ; try++ {
+		tctx, cancel := ctx, context.CancelFunc(func() {})
+		if s.opts.Timeout > 0 {
+			tctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+		}
+		err := f(tctx)
+		cancel()
+		var ne net.Error
+		if err == nil || try >= retries || ctx.Err() != nil || !errors.As(err, &ne) {
+			return s.note(err)
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return s.note(err)
+			case <-t.C:
+			}
+			delay *= 2
+		}
+	}
+}
+
+// note updates the bookkeeping after an operation, and returns its error.
+// The plug answered if the relay wasn't in the expected state,
+// and it isn't the plug's fault if the caller gave up.
+func (s *Session) note(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil || errors.Is(err, ErrStateChanged) {
+		s.lastSeen = time.Now()
+		s.failures = 0
+		s.lastErr = nil
+	} else {
+		s.failures++
+		s.lastErr = err
+	}
+	return err
+}
+
+// Healthy reports whether the plug has responded to an operation,
+// and fewer than UnhealthyAfter have failed in a row since.
+func (s *Session) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.lastSeen.IsZero() && s.failures < UnhealthyAfter
+}
+
+// LastSeen returns when an operation last succeeded, or the zero time if none has.
+func (s *Session) LastSeen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeen
+}
+
+// Failures returns how many operations have failed in a row,
+// and the error from the most recent one.
+func (s *Session) Failures() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures, s.lastErr
+}
+
+// withConn calls f with the Session's socket, opening it if need be.
+// The socket is dropped if f fails, lest a late reply be taken as the answer to the next request.
+func (s *Session) withConn(f func(*net.UDPConn) error) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn == nil {
+		conn, err := net.ListenUDP(networkFor(s.addr.IP), &net.UDPAddr{})
+		if err != nil {
+			return fmt.Errorf("net.ListenUDP: %v", err)
+		}
+		s.conn = conn
+	}
+	err := f(s.conn)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// Close releases the Session's socket. The Session may still be used,
+// but will open another.
+func (s *Session) Close() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Session) Query(ctx context.Context) (state State, err error) {
+	err = s.op(ctx, func(ctx context.Context) error {
+		return s.withConn(func(conn *net.UDPConn) (err error) {
+			state, err = query(ctx, conn, s.addr)
+			return err
+		})
+	})
+	return state, err
+}
+
+func (s *Session) QuerySysinfoOnly(ctx context.Context) (state State, err error) {
+	err = s.op(ctx, func(ctx context.Context) error {
+		return s.withConn(func(conn *net.UDPConn) (err error) {
+			state, err = querySysinfoOnly(ctx, conn, s.addr)
+			return err
+		})
+	})
+	return state, err
+}
+
+func (s *Session) RawOp(ctx context.Context, req []byte) (b []byte, err error) {
+	err = s.op(ctx, func(ctx context.Context) error {
+		return s.withConn(func(conn *net.UDPConn) (err error) {
+			b, err = rawOp(ctx, conn, s.addr, req)
+			return err
+		})
+	})
+	return b, err
+}
+
+func (s *Session) RawJSONOp(ctx context.Context, req, resp interface{}) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return s.withConn(func(conn *net.UDPConn) error {
+			return rawJSONOp(ctx, conn, s.addr, req, resp)
+		})
+	})
+}
+
+func (s *Session) SetRelayState(ctx context.Context, newState int) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetRelayState(ctx, s.addr, newState)
+	})
+}
+
+func (s *Session) SetRelayStateIf(ctx context.Context, expectCurrent, newState int) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetRelayStateIf(ctx, s.addr, expectCurrent, newState)
+	})
+}
+
+func (s *Session) SetRelayTemporarily(ctx context.Context, newValue, revertValue int, revertDur time.Duration) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetRelayTemporarily(ctx, s.addr, newValue, revertValue, revertDur)
+	})
+}
+
+func (s *Session) SetMode(ctx context.Context, mode Mode) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetMode(ctx, s.addr, mode)
+	})
+}
+
+func (s *Session) EnergyForDay(ctx context.Context, date time.Time) (wh float64, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		wh, err = EnergyForDay(ctx, s.addr, date)
+		return err
+	})
+	return wh, err
+}
+
+func (s *Session) EnergyBetween(ctx context.Context, from, to time.Time) (wh float64, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		wh, err = EnergyBetween(ctx, s.addr, from, to)
+		return err
+	})
+	return wh, err
+}
+
+func (s *Session) EnergyDayStats(ctx context.Context, year int, month time.Month) (des []DayEnergy, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		des, err = EnergyDayStats(ctx, s.addr, year, month)
+		return err
+	})
+	return des, err
+}
+
+func (s *Session) EnergyMonthStats(ctx context.Context, year int) (mes []MonthEnergy, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		mes, err = EnergyMonthStats(ctx, s.addr, year)
+		return err
+	})
+	return mes, err
+}
+
+func (s *Session) ScheduleRules(ctx context.Context) (rs []ScheduleRule, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		rs, err = ScheduleRules(ctx, s.addr)
+		return err
+	})
+	return rs, err
+}
+
+func (s *Session) AddScheduleRule(ctx context.Context, r ScheduleRule) (id string, err error) {
+	err = s.opOnce(ctx, func(ctx context.Context) (err error) {
+		id, err = AddScheduleRule(ctx, s.addr, r)
+		return err
+	})
+	return id, err
+}
+
+func (s *Session) EditScheduleRule(ctx context.Context, r ScheduleRule) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return EditScheduleRule(ctx, s.addr, r)
+	})
+}
+
+func (s *Session) DeleteScheduleRule(ctx context.Context, id string) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return DeleteScheduleRule(ctx, s.addr, id)
+	})
+}
+
+func (s *Session) DeleteAllScheduleRules(ctx context.Context) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return DeleteAllScheduleRules(ctx, s.addr)
+	})
+}
+
+func (s *Session) CountdownRules(ctx context.Context) (rs []CountdownRule, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		rs, err = CountdownRules(ctx, s.addr)
+		return err
+	})
+	return rs, err
+}
+
+func (s *Session) AddCountdown(ctx context.Context, r CountdownRule) (id string, err error) {
+	err = s.opOnce(ctx, func(ctx context.Context) (err error) {
+		id, err = AddCountdown(ctx, s.addr, r)
+		return err
+	})
+	return id, err
+}
+
+func (s *Session) DeleteCountdowns(ctx context.Context) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return DeleteCountdowns(ctx, s.addr)
+	})
+}
+
+func (s *Session) SetAlias(ctx context.Context, alias string) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetAlias(ctx, s.addr, alias)
+	})
+}
+
+func (s *Session) SetLED(ctx context.Context, on bool) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetLED(ctx, s.addr, on)
+	})
+}
+
+func (s *Session) Reboot(ctx context.Context, delay time.Duration) error {
+	return s.opOnce(ctx, func(ctx context.Context) error {
+		return Reboot(ctx, s.addr, delay)
+	})
+}
+
+func (s *Session) Reset(ctx context.Context, delay time.Duration) error {
+	return s.opOnce(ctx, func(ctx context.Context) error {
+		return Reset(ctx, s.addr, delay)
+	})
+}
+
+func (s *Session) QueryLight(ctx context.Context) (ls LightState, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		ls, err = QueryLight(ctx, s.addr)
+		return err
+	})
+	return ls, err
+}
+
+func (s *Session) SetLight(ctx context.Context, lc LightChange) (ls LightState, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		ls, err = SetLight(ctx, s.addr, lc)
+		return err
+	})
+	return ls, err
+}
+
+func (s *Session) SetBrightness(ctx context.Context, brightness int) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetBrightness(ctx, s.addr, brightness)
+	})
+}
+
+func (s *Session) ClockDrift(ctx context.Context, loc *time.Location) (d time.Duration, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		d, err = ClockDrift(ctx, s.addr, loc)
+		return err
+	})
+	return d, err
+}
+
+func (s *Session) SetClock(ctx context.Context, t time.Time) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return SetClock(ctx, s.addr, t)
+	})
+}
+
+func (s *Session) CorrectClock(ctx context.Context, loc *time.Location, tolerance time.Duration) (d time.Duration, err error) {
+	err = s.op(ctx, func(ctx context.Context) (err error) {
+		d, err = CorrectClock(ctx, s.addr, loc, tolerance)
+		return err
+	})
+	return d, err
+}
+
+func (s *Session) Do(ctx context.Context, req, resp interface{}) error {
+	return s.op(ctx, func(ctx context.Context) error {
+		return Do(ctx, s.addr, req, resp)
+	})
+}
@@ -0,0 +1,113 @@
+package tpplug_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/dsymonds/tpplug/tpplugtest"
+)
+
+func TestSessionRetries(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Lost"})
+	p := h.Plug("Lost")
+	p.SetOffline(true)
+	s := tpplug.DialWithOptions(p.Addr(), tpplug.SessionOptions{Timeout: 20 * time.Millisecond, Retries: 2})
+	defer s.Close()
+	ctx := context.Background()
+
+	if _, err := s.CountdownRules(ctx); err == nil {
+		t.Fatalf("CountdownRules of offline plug succeeded")
+	}
+	if n := p.Requests(); n != 3 {
+		t.Errorf("CountdownRules sent %d requests, want 3", n)
+	}
+	// The plug might act on a request whose response is lost, so adding isn't retried.
+	if _, err := s.AddCountdown(ctx, tpplug.CountdownRule{Enable: 1, Delay: 60, Act: 1}); err == nil {
+		t.Fatalf("AddCountdown to offline plug succeeded")
+	}
+	if n := p.Requests() - 3; n != 1 {
+		t.Errorf("AddCountdown sent %d requests, want 1", n)
+	}
+}
+
+// The benchmarks show the allocations of each operation: those of a Session
+// are fewer, since it keeps its socket. The counts include the emulated plug's,
+// since it runs in the same process.
+
+func benchPlug(b *testing.B) *net.UDPAddr {
+	h := tpplugtest.New(b, tpplugtest.PlugConfig{Alias: "Bench", Power: 100})
+	return h.Plug("Bench").Addr()
+}
+
+func BenchmarkSessionQuerySysinfoOnly(b *testing.B) {
+	s := tpplug.Dial(benchPlug(b))
+	defer s.Close()
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.QuerySysinfoOnly(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchQuery = []byte(`{"system":{"get_sysinfo":{}}}`)
+
+func BenchmarkRawOp(b *testing.B) {
+	addr := benchPlug(b)
+	ctx := context.Background()
+	b.Run("oneshot", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tpplug.RawOp(ctx, addr, benchQuery); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("session", func(b *testing.B) {
+		s := tpplug.Dial(addr)
+		defer s.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.RawOp(ctx, benchQuery); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRawJSONOp(b *testing.B) {
+	addr := benchPlug(b)
+	ctx := context.Background()
+	req := map[string]map[string]struct{}{"emeter": {"get_realtime": {}}}
+	var resp struct {
+		EnergyMeter struct {
+			Realtime struct {
+				Power int `json:"power_mw"`
+			} `json:"get_realtime"`
+		} `json:"emeter"`
+	}
+	b.Run("oneshot", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := tpplug.RawJSONOp(ctx, addr, req, &resp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("session", func(b *testing.B) {
+		s := tpplug.Dial(addr)
+		defer s.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := s.RawJSONOp(ctx, req, &resp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
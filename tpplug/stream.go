@@ -0,0 +1,165 @@
+package tpplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// StreamOptions controls DiscoverStream.
+type StreamOptions struct {
+	// Interface, if set, names the network interface to discover on.
+	// Discovery is sent from its IPv4 address, and, unless Broadcast is set,
+	// to the directed broadcast address of each of its subnets.
+	Interface string
+
+	// Broadcast, if set, lists where to send discovery, as in DiscoverOptions.
+	Broadcast []*net.UDPAddr
+
+	// Rebroadcast, if positive, is how often discovery is sent again,
+	// so that plugs that join the network later are found.
+	Rebroadcast time.Duration
+}
+
+// DiscoverStream probes the network for smart plugs, calling f with each response
+// as it arrives, until ctx is done. Each plug is reported when it first answers,
+// and again only if it answers from a different address; responses are told apart
+// by MAC. f is called from one goroutine at a time, and should not block for long,
+// since responses are not read meanwhile.
+// Unlike Discover, DiscoverStream always broadcasts, and returns nil once ctx is done.
+func DiscoverStream(ctx context.Context, opts StreamOptions, f func(DiscoveryResponse)) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.DiscoverStream", nil)
+	defer func() { end(err) }()
+
+	laddr := &net.UDPAddr{}
+	dsts := opts.Broadcast
+	if opts.Interface != "" {
+		if laddr.IP, err = interfaceIPv4(opts.Interface); err != nil {
+			return err
+		}
+		if len(dsts) == 0 {
+			if dsts, err = InterfaceBroadcasts(opts.Interface, DefaultPort); err != nil {
+				return err
+			}
+		}
+	}
+	if len(dsts) == 0 {
+		dsts = []*net.UDPAddr{{IP: net.IPv4bcast, Port: DefaultPort}}
+	}
+
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return fmt.Errorf("net.ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // unblocks the read below
+		case <-stop:
+		}
+	}()
+
+	broadcast := func() {
+		if broadcastLimit.wait(ctx) != nil {
+			return
+		}
+		for _, dst := range dsts {
+			if packetLimit.wait(ctx) != nil {
+				return
+			}
+			b := append([]byte(nil), stateQuery...) // writeMsg overwrites it
+			if err := writeMsg(conn, dst, b); err != nil && ctx.Err() == nil {
+				log.Printf("WARNING: Sending discovery to %v: %v", dst, err)
+			}
+		}
+	}
+	go func() {
+		broadcast()
+		if opts.Rebroadcast <= 0 {
+			return
+		}
+		ticker := time.NewTicker(opts.Rebroadcast)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				broadcast()
+			}
+		}
+	}()
+
+	// As in discoverOn, bogus responses are dropped, and logged only now and then.
+	seen := make(map[string]string) // MAC, or address if there's none => address
+	var scratch scratchBuf
+	var bogus int
+	var lastErr error
+	lastLog := time.Now()
+	logBogus := func() {
+		if bogus > 0 {
+			log.Printf("WARNING: Ignored %d bogus discovery responses; last was %v", bogus, lastErr)
+		}
+		bogus, lastLog = 0, time.Now()
+	}
+	defer logBogus()
+	for {
+		if time.Since(lastLog) > time.Minute {
+			logBogus()
+		}
+		b, raddr, err := readMsg(conn, scratch[:], nil)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrInvalidResponse) {
+			bogus, lastErr = bogus+1, err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		state, err := decodeState(ctx, b)
+		if err != nil {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: %w", raddr, err)
+			continue
+		}
+		key := string(state.System.Info.MAC)
+		if key == "" {
+			key = raddr.String()
+		}
+		prev, ok := seen[key]
+		if ok && prev == raddr.String() {
+			continue
+		}
+		if !ok && len(seen) >= maxDiscoveries {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: more than %d plugs", raddr, maxDiscoveries)
+			continue
+		}
+		seen[key] = raddr.String()
+		f(DiscoveryResponse{Addr: raddr, State: state, Kind: state.Kind()})
+	}
+}
+
+// interfaceIPv4 returns the first IPv4 address of the named network interface.
+func interfaceIPv4(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	ias, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("addresses of %s: %w", name, err)
+	}
+	for _, ia := range ias {
+		if ipn, ok := ia.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			return ipn.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv4 addresses", name)
+}
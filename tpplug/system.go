@@ -0,0 +1,79 @@
+package tpplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	sysSetAlias = commandName{"system", "set_dev_alias"}
+	sysSetLED   = commandName{"system", "set_led_off"}
+	sysReboot   = commandName{"system", "reboot"}
+	sysReset    = commandName{"system", "reset"}
+)
+
+// SetAlias renames a plug, or with WithChild, an outlet of a power strip.
+func SetAlias(ctx context.Context, addr *net.UDPAddr, alias string) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetAlias", addr)
+	defer func() { end(err) }()
+
+	if alias == "" {
+		return errors.New("empty alias")
+	}
+	if len(alias) > maxStringLen {
+		return fmt.Errorf("alias of %d bytes is longer than %d", len(alias), maxStringLen)
+	}
+	return sendCommand(ctx, addr, sysSetAlias, map[string]string{"alias": alias}, nil)
+}
+
+// SetLED turns a plug's status LED on or off.
+// A plug reports its setting in sysinfo as led_off.
+func SetLED(ctx context.Context, addr *net.UDPAddr, on bool) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.SetLED", addr)
+	defer func() { end(err) }()
+
+	off := 1
+	if on {
+		off = 0
+	}
+	return sendCommand(ctx, addr, sysSetLED, map[string]int{"off": off}, nil)
+}
+
+// Reboot makes a plug restart after delay, which is rounded up to whole seconds.
+// The plug keeps its settings, and its relay state is restored once it is back.
+func Reboot(ctx context.Context, addr *net.UDPAddr, delay time.Duration) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.Reboot", addr)
+	defer func() { end(err) }()
+	ctx = WithoutRetries(ctx) // not safe to do twice
+
+	secs, err := delaySeconds(delay)
+	if err != nil {
+		return err
+	}
+	return sendCommand(ctx, addr, sysReboot, map[string]int{"delay": secs}, nil)
+}
+
+// Reset restores a plug to its factory settings after delay, which is rounded up
+// to whole seconds. It forgets its Wi-Fi network, alias, schedule and the rest,
+// so it will no longer be reachable on the network until it is set up again.
+func Reset(ctx context.Context, addr *net.UDPAddr, delay time.Duration) (err error) {
+	ctx, end := startSpan(ctx, "tpplug.Reset", addr)
+	defer func() { end(err) }()
+	ctx = WithoutRetries(ctx) // not safe to do twice
+
+	secs, err := delaySeconds(delay)
+	if err != nil {
+		return err
+	}
+	return sendCommand(ctx, addr, sysReset, map[string]int{"delay": secs}, nil)
+}
+
+func delaySeconds(d time.Duration) (int, error) {
+	if d < 0 {
+		return 0, fmt.Errorf("negative delay %v", d)
+	}
+	return int((d + time.Second - 1) / time.Second), nil
+}
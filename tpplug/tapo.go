@@ -0,0 +1,231 @@
+package tpplug
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Tapo devices (such as the P100 and P110) don't answer the Kasa protocol.
+// They are discovered by a broadcast to UDP port 20002 of a 16 byte header
+// followed by a JSON object offering an RSA public key, and reply likewise.
+// Controlling them needs a login to their HTTP API, which isn't supported yet,
+// but discovery is enough to list them.
+
+const tapoDiscoveryPort = 20002
+
+// tapoHeaderLen is the length of the header of Tapo discovery messages:
+// version (1 byte, 2), message type (1, 0), op code (2, 1 for a probe),
+// payload size (2), flags (1), padding (1), serial (4), and a CRC-32 (4)
+// of the message computed with the CRC field set to 0x5A6B7C8D.
+const tapoHeaderLen = 16
+
+// TapoDevice is a Tapo device found by DiscoverTapo.
+type TapoDevice struct {
+	IP       net.IP
+	MAC      MAC    // canonical, as with Kasa plugs, e.g. "5C:E9:31:00:00:01"
+	Model    string // e.g. "P110(EU)"
+	Type     string // e.g. "SMART.TAPOPLUG"
+	DeviceID string
+
+	// How to reach its HTTP API.
+	EncryptType string // "AES" or "KLAP"
+	HTTPPort    int
+}
+
+// Kind classifies the device from its type.
+func (td TapoDevice) Kind() DeviceKind {
+	switch t := strings.ToUpper(td.Type); {
+	case strings.Contains(t, "BULB"):
+		return KindBulb
+	case strings.Contains(t, "PLUG"):
+		return KindPlug
+	}
+	return KindUnknown
+}
+
+type tapoDiscoveryResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		DeviceID    string `json:"device_id"`
+		DeviceType  string `json:"device_type"`
+		DeviceModel string `json:"device_model"`
+		IP          string `json:"ip"`
+		MAC         string `json:"mac"` // e.g. "5C-E9-31-00-00-01"
+		Encrypt     struct {
+			EncryptType string `json:"encrypt_type"`
+			HTTPPort    int    `json:"http_port"`
+		} `json:"mgt_encrypt_schm"`
+	} `json:"result"`
+}
+
+var (
+	tapoKeyOnce sync.Once
+	tapoKeyPEM  []byte
+	tapoKeyErr  error
+)
+
+// tapoPublicKey returns the PEM-encoded public key to offer in discovery.
+// Devices only use it to encrypt details that aren't needed here,
+// so one key is generated and reused.
+func tapoPublicKey() ([]byte, error) {
+	tapoKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			tapoKeyErr = fmt.Errorf("generating RSA key: %w", err)
+			return
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			tapoKeyErr = fmt.Errorf("encoding RSA key: %w", err)
+			return
+		}
+		tapoKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	})
+	return tapoKeyPEM, tapoKeyErr
+}
+
+// tapoProbe returns a Tapo discovery message.
+func tapoProbe() ([]byte, error) {
+	key, err := tapoPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"params": map[string]string{"rsa_key": string(key)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var serial [4]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, tapoHeaderLen, tapoHeaderLen+len(payload))
+	msg[0] = 2                                                // version
+	msg[1] = 0                                                // message type
+	binary.BigEndian.PutUint16(msg[2:], 1)                    // op code: probe
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(payload))) // payload size
+	msg[6] = 0x11                                             // flags
+	copy(msg[8:12], serial[:])
+	binary.BigEndian.PutUint32(msg[12:], 0x5A6B7C8D)
+	msg = append(msg, payload...)
+	binary.BigEndian.PutUint32(msg[12:], crc32.ChecksumIEEE(msg))
+	return msg, nil
+}
+
+// decodeTapo decodes a Tapo discovery response from raddr.
+func decodeTapo(b []byte, raddr *net.UDPAddr) (TapoDevice, error) {
+	if len(b) < tapoHeaderLen || b[0] != 2 {
+		return TapoDevice{}, invalidf("not a Tapo discovery response")
+	}
+	payload := b[tapoHeaderLen:]
+	if err := checkJSON(payload); err != nil {
+		return TapoDevice{}, err
+	}
+	var resp tapoDiscoveryResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return TapoDevice{}, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if resp.ErrorCode != 0 {
+		return TapoDevice{}, invalidf("error code %d", resp.ErrorCode)
+	}
+	r := resp.Result
+	mac, err := ParseMAC(r.MAC)
+	if err != nil {
+		return TapoDevice{}, invalidf("bad MAC %q", r.MAC)
+	}
+	for _, f := range []string{r.DeviceID, r.DeviceType, r.DeviceModel, r.Encrypt.EncryptType} {
+		if len(f) > maxStringLen {
+			return TapoDevice{}, invalidf("field is %d bytes long", len(f))
+		}
+	}
+	// Believe where it came from over what it says.
+	return TapoDevice{
+		IP:          raddr.IP,
+		MAC:         mac,
+		Model:       r.DeviceModel,
+		Type:        r.DeviceType,
+		DeviceID:    r.DeviceID,
+		EncryptType: r.Encrypt.EncryptType,
+		HTTPPort:    r.Encrypt.HTTPPort,
+	}, nil
+}
+
+// DiscoverTapo probes the network for Tapo devices.
+// Like Discover, the provided context controls how long to wait for responses.
+func DiscoverTapo(ctx context.Context) (_ []TapoDevice, err error) {
+	ctx, end := startSpan(ctx, "tpplug.DiscoverTapo", nil)
+	defer func() { end(err) }()
+
+	msg, err := tapoProbe()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := udpConn(ctx, "udp4")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := broadcastLimit.wait(ctx); err != nil {
+		return nil, nil
+	}
+	if err := packetLimit.wait(ctx); err != nil {
+		return nil, nil
+	}
+	bcast := &net.UDPAddr{IP: net.IPv4bcast, Port: tapoDiscoveryPort}
+	if _, err := conn.WriteToUDP(msg, bcast); err != nil {
+		return nil, fmt.Errorf("sending message: %w", err)
+	}
+
+	var tds []TapoDevice
+	seen := make(map[string]int) // IP => index in tds
+	var scratch scratchBuf
+	var bogus int
+	var lastErr error
+	for {
+		nb, raddr, err := conn.ReadFromUDP(scratch[:])
+		if err != nil {
+			var neterr net.Error
+			if errors.As(err, &neterr) && neterr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("reading message: %w", err)
+		}
+		if nb > maxMsgSize {
+			bogus, lastErr = bogus+1, invalidf("datagram from %v larger than %d bytes", raddr, maxMsgSize)
+			continue
+		}
+		td, err := decodeTapo(scratch[:nb], raddr)
+		if err != nil {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: %w", raddr, err)
+			continue
+		}
+		if i, ok := seen[raddr.IP.String()]; ok {
+			tds[i] = td
+			continue
+		}
+		if len(tds) >= maxDiscoveries {
+			bogus, lastErr = bogus+1, fmt.Errorf("from %v: more than %d responses", raddr, maxDiscoveries)
+			continue
+		}
+		seen[raddr.IP.String()] = len(tds)
+		tds = append(tds, td)
+	}
+	if bogus > 0 {
+		log.Printf("WARNING: Ignored %d bogus Tapo discovery responses; last was %v", bogus, lastErr)
+	}
+	return tds, nil
+}
@@ -0,0 +1,188 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Plugs also answer on TCP, at the same port, with each message preceded by
+// its length as 4 bytes, big-endian. Some newer firmware answers only on TCP.
+//
+// By default (TransportAuto) an operation is sent over UDP, and if there's
+// no response within udpFallbackAfter, or half the time left if that's less,
+// over TCP. A plug that then answers is remembered, and talked to over TCP
+// from then on, until that fails. Some plugs need KLAP instead; see klap.go.
+// WithTransport picks one. Broadcast and multicast addresses are always sent to over UDP.
+
+// Transport is how operations are sent to plugs.
+type Transport int
+
+const (
+	TransportAuto Transport = iota // UDP, falling back to TCP
+	TransportUDP
+	TransportTCP
+	TransportKLAP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportAuto:
+		return "auto"
+	case TransportUDP:
+		return "udp"
+	case TransportTCP:
+		return "tcp"
+	case TransportKLAP:
+		return "klap"
+	}
+	return fmt.Sprintf("Transport(%d)", int(t))
+}
+
+// ParseTransport parses "auto", "udp", "tcp" or "klap", such as from a flag.
+func ParseTransport(s string) (Transport, error) {
+	for _, t := range []Transport{TransportAuto, TransportUDP, TransportTCP, TransportKLAP} {
+		if s == t.String() {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport %q (want auto, udp, tcp or klap)", s)
+}
+
+type transportKey struct{}
+
+// WithTransport returns a context that makes operations on plugs use t.
+func WithTransport(ctx context.Context, t Transport) context.Context {
+	return context.WithValue(ctx, transportKey{}, t)
+}
+
+func transportFor(ctx context.Context) Transport {
+	t, _ := ctx.Value(transportKey{}).(Transport)
+	return t
+}
+
+// udpFallbackAfter is how long TransportAuto waits for a UDP response before trying TCP.
+const udpFallbackAfter = 1 * time.Second
+
+// tcpOnly holds the addresses (as strings) of plugs that have answered over TCP but not UDP.
+var tcpOnly sync.Map
+
+// autoRoundTrip is roundTrip for TransportAuto.
+func autoRoundTrip(ctx context.Context, conn *net.UDPConn, addr *net.UDPAddr, req []byte, handle func([]byte) error) error {
+	if _, ok := klapPorts.Load(addr.IP.String()); ok {
+		return klapRoundTrip(ctx, addr, req, handle)
+	}
+	key := addr.String()
+	if _, ok := tcpOnly.Load(key); ok {
+		// A Session's socket is dropped when this fails (see withConn),
+		// so a late reply to the UDP attempt can't be taken for another.
+		err := tcpRoundTrip(ctx, addr, req, handle)
+		if err != nil {
+			tcpOnly.Delete(key)
+		}
+		return err
+	}
+
+	wait := udpFallbackAfter
+	if d, ok := ctx.Deadline(); ok && time.Until(d)/2 < wait {
+		wait = time.Until(d) / 2
+	}
+	uctx, cancel := context.WithTimeout(ctx, wait)
+	err := udpRoundTrip(uctx, conn, addr, req, handle)
+	cancel()
+	if !isTimeout(err) || ctx.Err() != nil {
+		return err
+	}
+	err = tcpRoundTrip(ctx, addr, req, handle)
+	if err == nil {
+		tcpOnly.Store(key, true)
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) || ctx.Err() != nil {
+		return err
+	}
+	// Firmware that wants KLAP doesn't listen on the legacy port.
+	if err := klapRoundTrip(ctx, addr, req, handle); err != nil {
+		return err
+	}
+	noteKLAP(addr.IP, 0)
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// tcpRoundTrip sends req to addr over a new TCP connection,
+// and calls handle with the response, which is only valid during the call.
+func tcpRoundTrip(ctx context.Context, addr *net.UDPAddr, req []byte, handle func([]byte) error) error {
+	if err := packetLimit.wait(ctx); err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", (&net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}).String())
+	if err != nil {
+		return fmt.Errorf("dialing TCP: %w", err)
+	}
+	defer conn.Close()
+	dl, _ := ctx.Deadline() // the zero time means none
+	conn.SetDeadline(dl)
+
+	scratch := scratchPool.Get().(*scratchBuf)
+	defer scratchPool.Put(scratch)
+	if err := writeTCPMsg(conn, req, scratch[:]); err != nil {
+		return err
+	}
+	b, err := readTCPMsg(conn, scratch[:])
+	if err != nil {
+		return err
+	}
+	return handle(b)
+}
+
+// writeTCPMsg sends a message over TCP, using buf to build it if it fits.
+func writeTCPMsg(w io.Writer, req, buf []byte) error {
+	var msg []byte
+	if n := 4 + len(req); n <= len(buf) {
+		msg = buf[:n]
+	} else {
+		msg = make([]byte, n)
+	}
+	binary.BigEndian.PutUint32(msg, uint32(len(req)))
+	copy(msg[4:], req)
+	Encrypt(msg[4:])
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("sending message: %w", err)
+	}
+	return nil
+}
+
+// readTCPMsg reads and decrypts one message from TCP into scratch,
+// or a larger buffer if it doesn't fit.
+func readTCPMsg(r io.Reader, scratch []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+		return nil, fmt.Errorf("reading message length: %w", err)
+	}
+	n := binary.BigEndian.Uint32(scratch[:4])
+	if n > maxRespSize {
+		return nil, invalidf("TCP message of %d bytes, larger than %d", n, maxRespSize)
+	}
+	var b []byte
+	if int(n) <= len(scratch) {
+		b = scratch[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	Decrypt(b)
+	return b, nil
+}
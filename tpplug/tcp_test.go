@@ -0,0 +1,57 @@
+package tpplug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTCPFraming(t *testing.T) {
+	for _, msg := range []string{"", `{"system":{"get_sysinfo":{}}}`, strings.Repeat("x", 3000)} {
+		var buf bytes.Buffer
+		if err := writeTCPMsg(&buf, []byte(msg), make([]byte, 64)); err != nil {
+			t.Fatalf("writeTCPMsg: %v", err)
+		}
+		if n := binary.BigEndian.Uint32(buf.Bytes()); int(n) != len(msg) || buf.Len() != 4+len(msg) {
+			t.Errorf("writeTCPMsg of %d bytes wrote %d bytes, with length prefix %d", len(msg), buf.Len(), n)
+		}
+		got, err := readTCPMsg(&buf, make([]byte, 64))
+		if err != nil {
+			t.Errorf("readTCPMsg of %d bytes: %v", len(msg), err)
+			continue
+		}
+		if string(got) != msg {
+			t.Errorf("readTCPMsg of %d bytes gave %q", len(msg), got)
+		}
+	}
+}
+
+func TestTCPFramingErrors(t *testing.T) {
+	prefix := func(n uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, n)
+		return b
+	}
+	for _, tc := range []struct {
+		desc    string
+		msg     []byte
+		invalid bool // whether the error should be ErrInvalidResponse
+	}{
+		{"empty", nil, false},
+		{"truncated length prefix", []byte{0, 0}, false},
+		{"truncated message", append(prefix(10), "short"...), false},
+		{"oversized", append(prefix(maxRespSize+1), "{}"...), true},
+		{"huge", append(prefix(1<<32-1), "{}"...), true},
+	} {
+		_, err := readTCPMsg(bytes.NewReader(tc.msg), make([]byte, 64))
+		if err == nil {
+			t.Errorf("readTCPMsg of %s message succeeded", tc.desc)
+			continue
+		}
+		if errors.Is(err, ErrInvalidResponse) != tc.invalid {
+			t.Errorf("readTCPMsg of %s message gave %v; want ErrInvalidResponse = %t", tc.desc, err, tc.invalid)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package tpplug_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+	"github.com/dsymonds/tpplug/tpplugtest"
+)
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestQuery(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Heater", Power: 1500})
+	p := h.Plug("Heater")
+
+	state, err := tpplug.Query(testContext(t), p.Addr())
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	info := state.System.Info
+	if info.Alias != "Heater" || info.MAC != p.MAC() || info.RelayState != 1 || info.ActiveMode != tpplug.ModeNone {
+		t.Errorf("Query got alias %q, MAC %v, relay state %d, mode %q; want %q, %v, 1, %q",
+			info.Alias, info.MAC, info.RelayState, info.ActiveMode, "Heater", p.MAC(), tpplug.ModeNone)
+	}
+	if got := state.EnergyMeter.Realtime.Power; got != 1500000 {
+		t.Errorf("Query got power %d mW, want 1500000", got)
+	}
+
+	state, err = tpplug.QuerySysinfoOnly(testContext(t), p.Addr())
+	if err != nil {
+		t.Fatalf("QuerySysinfoOnly: %v", err)
+	}
+	if state.System.Info.Alias != "Heater" || state.EnergyMeter.Realtime.Power != 0 {
+		t.Errorf("QuerySysinfoOnly got alias %q, power %d mW; want %q, 0",
+			state.System.Info.Alias, state.EnergyMeter.Realtime.Power, "Heater")
+	}
+}
+
+func TestQueryFailures(t *testing.T) {
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Offline"},
+		tpplugtest.PlugConfig{Alias: "Malformed"},
+	)
+	h.Plug("Offline").SetOffline(true)
+	h.Plug("Malformed").SetMalformed(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := tpplug.Query(ctx, h.Plug("Offline").Addr()); err == nil {
+		t.Errorf("Query of offline plug succeeded")
+	}
+	if _, err := tpplug.Query(testContext(t), h.Plug("Malformed").Addr()); err == nil {
+		t.Errorf("Query of plug giving malformed responses succeeded")
+	}
+}
+
+func TestSetRelayState(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Pump", Off: true})
+	p := h.Plug("Pump")
+	ctx := testContext(t)
+
+	if err := tpplug.SetRelayState(ctx, p.Addr(), 1); err != nil {
+		t.Fatalf("SetRelayState on: %v", err)
+	}
+	if !p.On() {
+		t.Errorf("Plug is off after SetRelayState on")
+	}
+	if err := tpplug.SetRelayStateIf(ctx, p.Addr(), 0, 0); err == nil {
+		t.Errorf("SetRelayStateIf expecting off succeeded on a plug that is on")
+	}
+	if err := tpplug.SetRelayStateIf(ctx, p.Addr(), 1, 0); err != nil {
+		t.Fatalf("SetRelayStateIf expecting on: %v", err)
+	}
+	if p.On() {
+		t.Errorf("Plug is on after SetRelayStateIf off")
+	}
+
+	p.SetStuck(true)
+	if err := tpplug.SetRelayState(ctx, p.Addr(), 1); err == nil {
+		t.Errorf("SetRelayState on a stuck plug succeeded")
+	}
+	if p.On() {
+		t.Errorf("Stuck plug switched on")
+	}
+}
+
+func TestCountdown(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Heater", Off: true})
+	p := h.Plug("Heater")
+	ctx := testContext(t)
+
+	// Turn on for ten minutes. Doing it twice checks that the old rule is replaced.
+	for i := 0; i < 2; i++ {
+		if err := tpplug.SetRelayTemporarily(ctx, p.Addr(), 1, 0, 10*time.Minute); err != nil {
+			t.Fatalf("SetRelayTemporarily: %v", err)
+		}
+	}
+	if ok, on, left := p.Countdown(); !p.On() || !ok || on || left != 10*time.Minute {
+		t.Fatalf("After SetRelayTemporarily, plug on = %t, countdown = %t to %t in %v; want true, true to false in 10m",
+			p.On(), ok, on, left)
+	}
+	state, err := tpplug.QuerySysinfoOnly(ctx, p.Addr())
+	if err != nil {
+		t.Fatalf("QuerySysinfoOnly: %v", err)
+	}
+	if m := state.System.Info.ActiveMode; m != tpplug.ModeCountdown {
+		t.Errorf("Active mode is %q, want %q", m, tpplug.ModeCountdown)
+	}
+
+	h.Advance(4 * time.Minute)
+	rs, err := tpplug.CountdownRules(ctx, p.Addr())
+	if err != nil {
+		t.Fatalf("CountdownRules: %v", err)
+	}
+	if len(rs) != 1 || rs[0].Act != 0 || rs[0].Delay != 600 || rs[0].Remain != 360 {
+		t.Errorf("CountdownRules = %+v, want one turning off after 600s with 360s left", rs)
+	}
+	if _, err := tpplug.AddCountdown(ctx, p.Addr(), tpplug.CountdownRule{Enable: 1, Delay: 60, Act: 1}); err == nil {
+		t.Errorf("AddCountdown succeeded with a rule already pending")
+	}
+
+	h.Advance(6 * time.Minute)
+	if ok, _, _ := p.Countdown(); p.On() || ok {
+		t.Errorf("After countdown, plug on = %t, countdown pending = %t; want false, false", p.On(), ok)
+	}
+
+	if _, err := tpplug.AddCountdown(ctx, p.Addr(), tpplug.CountdownRule{Enable: 1, Delay: 60, Act: 1}); err != nil {
+		t.Fatalf("AddCountdown: %v", err)
+	}
+	if err := tpplug.DeleteCountdowns(ctx, p.Addr()); err != nil {
+		t.Fatalf("DeleteCountdowns: %v", err)
+	}
+	if rs, err := tpplug.CountdownRules(ctx, p.Addr()); err != nil || len(rs) != 0 {
+		t.Errorf("CountdownRules after DeleteCountdowns = %+v, %v; want none", rs, err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater"},
+		tpplugtest.PlugConfig{Alias: "Pump"},
+		tpplugtest.PlugConfig{Alias: "Lamp"},
+	)
+	h.Plug("Lamp").SetOffline(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	drs, err := tpplug.Discover(ctx)
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	found := make(map[string]string) // alias => address
+	for _, dr := range drs {
+		found[dr.State.System.Info.Alias] = dr.Addr.String()
+		if dr.Kind != tpplug.KindPlug {
+			t.Errorf("Plug %q discovered as %v, want %v", dr.State.System.Info.Alias, dr.Kind, tpplug.KindPlug)
+		}
+	}
+	for _, alias := range []string{"Heater", "Pump"} {
+		if got, want := found[alias], h.Plug(alias).Addr().String(); got != want {
+			t.Errorf("Discover found %q at %q, want %q", alias, got, want)
+		}
+	}
+	if _, ok := found["Lamp"]; ok || len(drs) != 2 {
+		t.Errorf("Discover found %d plugs (%v), want Heater and Pump only", len(drs), found)
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Lost"})
+	p := h.Plug("Lost")
+	p.SetOffline(true)
+	ctx := tpplug.WithTransport(context.Background(), tpplug.TransportUDP) // the emulated plug has no TCP
+	ctx = tpplug.WithRetries(ctx, tpplug.RetryPolicy{Retries: 2, Timeout: 20 * time.Millisecond})
+
+	if _, err := tpplug.CountdownRules(ctx, p.Addr()); err == nil {
+		t.Fatalf("CountdownRules of offline plug succeeded")
+	}
+	if n := p.Requests(); n != 3 {
+		t.Errorf("CountdownRules sent %d requests, want 3", n)
+	}
+	if _, err := tpplug.AddCountdown(ctx, p.Addr(), tpplug.CountdownRule{Enable: 1, Delay: 60, Act: 1}); err == nil {
+		t.Fatalf("AddCountdown to offline plug succeeded")
+	}
+	if n := p.Requests() - 3; n != 1 {
+		t.Errorf("AddCountdown sent %d requests, want 1", n)
+	}
+	if _, err := tpplug.RawOp(tpplug.WithoutRetries(ctx), p.Addr(), []byte(`{"system":{"reboot":{"delay":1}}}`)); err == nil {
+		t.Fatalf("RawOp to offline plug succeeded")
+	}
+	if n := p.Requests() - 4; n != 1 {
+		t.Errorf("RawOp without retries sent %d requests, want 1", n)
+	}
+}
+
+func TestTCPFallback(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{Alias: "Old firmware", TCPOnly: true})
+	p := h.Plug("Old firmware")
+	ctx := testContext(t)
+
+	state, err := tpplug.Query(ctx, p.Addr())
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if alias := state.System.Info.Alias; alias != "Old firmware" {
+		t.Errorf("Query got alias %q, want %q", alias, "Old firmware")
+	}
+	if n := p.Requests(); n != 2 {
+		t.Errorf("Query sent %d requests, want 2 (UDP, then TCP)", n)
+	}
+	// The plug is now known to want TCP, so UDP isn't tried first.
+	if err := tpplug.SetRelayState(ctx, p.Addr(), 0); err != nil {
+		t.Fatalf("SetRelayState: %v", err)
+	}
+	if p.On() {
+		t.Errorf("Plug is on after SetRelayState off")
+	}
+	if n := p.Requests() - 2; n != 1 {
+		t.Errorf("SetRelayState sent %d requests, want 1", n)
+	}
+}
+
+func TestChildren(t *testing.T) {
+	h := tpplugtest.New(t, tpplugtest.PlugConfig{
+		Alias:    "Strip",
+		Model:    "HS300(AU)",
+		Power:    1000,
+		Children: []string{"Kettle", "Toaster"},
+	})
+	p := h.Plug("Strip")
+	ctx := testContext(t)
+
+	strip, err := tpplug.Query(ctx, p.Addr())
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	kettle, ok1 := strip.Child("Kettle")
+	toaster, ok2 := strip.Child("Toaster")
+	if n := len(strip.Children()); n != 2 || !ok1 || !ok2 {
+		t.Fatalf("Query of strip got %d children (%+v), want Kettle and Toaster", n, strip.Children())
+	}
+
+	if err := tpplug.SetRelayState(tpplug.WithChild(ctx, kettle.ID), p.Addr(), 0); err != nil {
+		t.Fatalf("SetRelayState of Kettle: %v", err)
+	}
+	if p.ChildOn("Kettle") || !p.ChildOn("Toaster") {
+		t.Errorf("After switching Kettle off, Kettle on = %t, Toaster on = %t; want false, true",
+			p.ChildOn("Kettle"), p.ChildOn("Toaster"))
+	}
+
+	for _, tc := range []struct {
+		c     tpplug.Child
+		relay int
+		power int // mW
+	}{
+		{kettle, 0, 0},
+		{toaster, 1, 1000000},
+	} {
+		state, err := tpplug.Query(tpplug.WithChild(ctx, tc.c.ID), p.Addr())
+		if err != nil {
+			t.Fatalf("Query of %s: %v", tc.c.Alias, err)
+		}
+		info := state.System.Info
+		if info.Alias != tc.c.Alias || info.DeviceID != tc.c.ID || info.RelayState != tc.relay || info.ChildNum != 0 || state.Children() != nil {
+			t.Errorf("Query of %s got alias %q, ID %q, relay state %d, %d children; want %q, %q, %d, none",
+				tc.c.Alias, info.Alias, info.DeviceID, info.RelayState, len(state.Children()), tc.c.Alias, tc.c.ID, tc.relay)
+		}
+		if got := state.EnergyMeter.Realtime.Power; got != tc.power {
+			t.Errorf("Query of %s got power %d mW, want %d", tc.c.Alias, got, tc.power)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package tpplug
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// A Tracer is told about the operations this package performs,
+// so they can be recorded by a tracing system such as OpenTelemetry.
+type Tracer interface {
+	// Start is called at the start of an operation.
+	// addr is the plug being talked to, or nil for discovery.
+	// The returned context is used for the rest of the operation,
+	// and the returned function is called with its result.
+	Start(ctx context.Context, op string, addr *net.UDPAddr) (context.Context, func(error))
+}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   Tracer
+)
+
+// SetTracer sets the Tracer for all operations. A nil Tracer disables tracing.
+func SetTracer(t Tracer) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracer = t
+}
+
+func startSpan(ctx context.Context, op string, addr *net.UDPAddr) (context.Context, func(error)) {
+	tracerMu.RLock()
+	t := tracer
+	tracerMu.RUnlock()
+	if t == nil {
+		return ctx, func(error) {}
+	}
+	return t.Start(ctx, op, addr)
+}
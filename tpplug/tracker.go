@@ -0,0 +1,155 @@
+package tpplug
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A PowerTracker keeps recent power readings of plugs, so a controller can ask
+// for statistics such as the maximum over the last five minutes without keeping
+// them elsewhere. Readings are recorded by Poll, or by the caller with Record,
+// such as from discovery, and kept for the tracker's window.
+// A PowerTracker is safe for concurrent use.
+type PowerTracker struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	plugs map[MAC][]powerSample // oldest first
+}
+
+type powerSample struct {
+	at    time.Time
+	power float64 // W
+	on    bool
+}
+
+// PowerStats are statistics of a plug's power readings over a period.
+type PowerStats struct {
+	Samples int
+	Avg     float64 // W, the mean of the readings
+	Min     float64 // W
+	Max     float64 // W
+	// OnFor is how long the relay was on, taking each reading to hold until the next.
+	OnFor time.Duration
+	// Last is when the latest reading was taken.
+	Last time.Time
+}
+
+// NewPowerTracker returns a PowerTracker that keeps readings for window.
+func NewPowerTracker(window time.Duration) *PowerTracker {
+	return &PowerTracker{
+		window: window,
+		plugs:  make(map[MAC][]powerSample),
+	}
+}
+
+// Record records a plug's state as read at t. States without a MAC are ignored.
+func (pt *PowerTracker) Record(state State, t time.Time) {
+	info := state.System.Info
+	if info.MAC == "" {
+		return
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	ss := pt.plugs[info.MAC]
+	if n := len(ss); n > 0 && t.Before(ss[n-1].at) {
+		return // out of order; keep them sorted
+	}
+	ss = append(ss, powerSample{
+		at:    t,
+		power: float64(state.EnergyMeter.Realtime.Power) / 1000,
+		on:    info.RelayState == 1,
+	})
+	cut := 0
+	for cut < len(ss) && t.Sub(ss[cut].at) > pt.window {
+		cut++
+	}
+	pt.plugs[info.MAC] = ss[cut:]
+}
+
+// Stats returns statistics of a plug's readings over the last d, which is capped at the window.
+// It reports false if there are none.
+func (pt *PowerTracker) Stats(mac MAC, d time.Duration) (PowerStats, bool) {
+	return pt.statsAt(mac, d, time.Now())
+}
+
+func (pt *PowerTracker) statsAt(mac MAC, d time.Duration, now time.Time) (PowerStats, bool) {
+	if d > pt.window {
+		d = pt.window
+	}
+	from := now.Add(-d)
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	var st PowerStats
+	var sum float64
+	ss := pt.plugs[mac]
+	for i, s := range ss {
+		if s.at.Before(from) || s.at.After(now) {
+			continue
+		}
+		if st.Samples == 0 || s.power < st.Min {
+			st.Min = s.power
+		}
+		if st.Samples == 0 || s.power > st.Max {
+			st.Max = s.power
+		}
+		st.Samples++
+		sum += s.power
+		st.Last = s.at
+		if s.on {
+			until := now
+			if i+1 < len(ss) && ss[i+1].at.Before(now) {
+				until = ss[i+1].at
+			}
+			st.OnFor += until.Sub(s.at)
+		}
+	}
+	// The reading before the period holds into it.
+	for i := len(ss) - 1; i >= 0; i-- {
+		if s := ss[i]; s.at.Before(from) {
+			if s.on {
+				until := now
+				if i+1 < len(ss) && ss[i+1].at.Before(now) {
+					until = ss[i+1].at
+				}
+				st.OnFor += until.Sub(from)
+			}
+			break
+		}
+	}
+	if st.Samples == 0 {
+		return PowerStats{}, false
+	}
+	st.Avg = sum / float64(st.Samples)
+	return st, true
+}
+
+// Poll queries each of the plugs every interval, recording their readings,
+// until ctx is done. A plug that fails to answer is skipped until the next time;
+// the Session keeps track of its failures.
+func (pt *PowerTracker) Poll(ctx context.Context, interval time.Duration, plugs ...*Session) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, s := range plugs {
+			s := s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				qctx, cancel := context.WithTimeout(ctx, interval)
+				defer cancel()
+				if state, err := s.Query(qctx); err == nil {
+					pt.Record(state, time.Now())
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package tpplug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Anything on the LAN can send datagrams to our sockets, so responses are
+// checked before being trusted. These limits are far beyond what real plugs send.
+const (
+	maxMsgSize     = 4 << 10  // bytes in a discovery response datagram
+	maxRespSize    = 64 << 10 // bytes in a response from the plug asked, such as a long schedule
+	maxJSONDepth   = 16       // nesting of objects and arrays
+	maxStringLen   = 256      // bytes in a decoded string field
+	maxDiscoveries = 1024     // responses accepted by one discovery
+)
+
+// ErrInvalidResponse is wrapped by errors for responses that are malformed or implausible.
+var ErrInvalidResponse = errors.New("invalid response")
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidResponse, fmt.Sprintf(format, args...))
+}
+
+// checkJSON checks that b is a reasonably sized and nested JSON object,
+// before it is handed to encoding/json.
+func checkJSON(b []byte) error {
+	if len(b) > maxRespSize {
+		return invalidf("%d bytes, more than the limit of %d", len(b), maxRespSize)
+	}
+	if !utf8.Valid(b) {
+		return invalidf("not UTF-8")
+	}
+	depth := 0
+	inString, escaped := false, false
+	for i, c := range b {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			if depth == 0 {
+				return invalidf("not a JSON object")
+			}
+			inString = true
+		case '{', '[':
+			if depth == 0 && c != '{' {
+				return invalidf("not a JSON object")
+			}
+			if depth++; depth > maxJSONDepth {
+				return invalidf("nested deeper than %d at byte %d", maxJSONDepth, i)
+			}
+		case '}', ']':
+			depth--
+		case ' ', '\t', '\r', '\n':
+		default:
+			if depth == 0 {
+				return invalidf("not a JSON object")
+			}
+		}
+	}
+	if !json.Valid(b) {
+		return invalidf("malformed JSON")
+	}
+	return nil
+}
+
+// validate checks that the fields of a decoded State are plausible.
+func (s *State) validate() error {
+	info := s.System.Info
+	for _, f := range []struct{ name, val string }{
+		{"model", info.Model},
+		{"mac", string(info.MAC)},
+		{"alias", info.Alias},
+		{"active_mode", string(info.ActiveMode)},
+		{"type", info.Type},
+		{"mic_type", info.MicType},
+		{"dev_name", info.DevName},
+		{"feature", info.Feature},
+		{"deviceId", info.DeviceID},
+	} {
+		if len(f.val) > maxStringLen {
+			return invalidf("%s is %d bytes long", f.name, len(f.val))
+		}
+	}
+	if info.MicMAC != "" {
+		if _, err := ParseMAC(string(info.MicMAC)); err != nil {
+			return invalidf("bad mic_mac %q", info.MicMAC)
+		}
+	}
+	if info.MAC != "" {
+		if _, err := ParseMAC(string(info.MAC)); err != nil {
+			return invalidf("bad MAC %q", info.MAC)
+		}
+	}
+	if info.Latitude < -90e4 || info.Latitude > 90e4 || info.Longitude < -180e4 || info.Longitude > 180e4 {
+		return invalidf("location %d, %d", info.Latitude, info.Longitude)
+	}
+	if info.RelayState != 0 && info.RelayState != 1 {
+		return invalidf("relay_state %d", info.RelayState)
+	}
+	if info.Brightness < 0 || info.Brightness > 100 {
+		return invalidf("brightness %d", info.Brightness)
+	}
+	if err := info.Light.validate(); err != nil {
+		return err
+	}
+	if err := info.Children.validate(); err != nil {
+		return err
+	}
+	rt := s.EnergyMeter.Realtime
+	if rt.Voltage < 0 || rt.Current < 0 || rt.Power < 0 {
+		return invalidf("negative energy meter reading")
+	}
+	return nil
+}
+
+// decodeState decodes a response into a State, validating it.
+func decodeState(ctx context.Context, b []byte) (State, error) {
+	if err := checkJSON(b); err != nil {
+		return State{}, err
+	}
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return State{}, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if info := &state.System.Info; info.MAC == "" {
+		info.MAC = info.MicMAC
+	}
+	if err := state.validate(); err != nil {
+		return State{}, err
+	}
+	if keepingRaw(ctx) {
+		state.raw = string(b) // b may be a scratch buffer
+	}
+	return state, nil
+}
@@ -0,0 +1,161 @@
+//go:build go1.18
+// +build go1.18
+
+package tpplug
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// These are fuzzed with, for example,
+//
+//	go test -run XXX -fuzz FuzzDecodeState ./tpplug
+//
+// which needs Go 1.18 or later; the module itself needs only Go 1.16,
+// hence the build constraint. Without -fuzz, the seeds are run as tests.
+
+var fuzzSeeds = []string{
+	// An HS110's response to Query.
+	`{"system":{"get_sysinfo":{"sw_ver":"1.5.4 Build 180815 Rel.121440","hw_ver":"2.0","type":"IOT.SMARTPLUGSWITCH",` +
+		`"model":"HS110(AU)","mac":"50:C7:BF:12:34:56","dev_name":"Smart Wi-Fi Plug With Energy Monitoring",` +
+		`"alias":"Heater","relay_state":1,"on_time":1234,"active_mode":"none","feature":"TIM:ENE","updating":0,` +
+		`"icon_hash":"","rssi":-52,"led_off":0,"longitude_i":1511234,"latitude_i":-338765,` +
+		`"hwId":"0123456789ABCDEF0123456789ABCDEF","fwId":"00000000000000000000000000000000",` +
+		`"deviceId":"8006ABCDEF0123456789ABCDEF0123456789AB","oemId":"0123456789ABCDEF0123456789ABCDEF",` +
+		`"next_action":{"type":-1},"err_code":0}},` +
+		`"emeter":{"get_realtime":{"voltage_mv":241235,"current_ma":6190,"power_mw":1493012,"total_wh":98765,"err_code":0}}}`,
+	// An HS300's, with its outlets.
+	`{"system":{"get_sysinfo":{"model":"HS300(AU)","mac":"50C7BF000001","alias":"Strip","child_num":2,` +
+		`"children":[{"id":"00","state":1,"alias":"Kettle","on_time":10},{"id":"01","state":0,"alias":"Toaster","on_time":0}],` +
+		`"feature":"TIM:ENE","err_code":0}}}`,
+	// A KL130's, from a bulb that is off.
+	`{"system":{"get_sysinfo":{"model":"KL130(AU)","mic_mac":"1C3BF3000002","mic_type":"IOT.SMARTBULB","alias":"Lamp",` +
+		`"light_state":{"on_off":0,"dft_on_state":{"mode":"normal","hue":120,"saturation":50,"color_temp":0,"brightness":80}},` +
+		`"err_code":0}}}`,
+	// An emeter response alone.
+	`{"emeter":{"get_realtime":{"voltage_mv":240000,"current_ma":0,"power_mw":0,"err_code":0}}}`,
+	// Implausible or hostile ones.
+	`{"system":{"get_sysinfo":{"relay_state":7}}}`,
+	`{"system":{"get_sysinfo":{"mac":"not a MAC"}}}`,
+	`{"emeter":{"get_realtime":{"power_mw":-1}}}`,
+	`{"system":{"get_sysinfo":{"alias":"` + strings.Repeat("x", maxStringLen+1) + `"}}}`,
+	`{"system":{"get_sysinfo":{"children":[` + strings.Repeat(`{"id":"00"},`, 100) + `{"id":"00"}]}}}`,
+	`{"a":` + strings.Repeat("[", 100) + strings.Repeat("]", 100) + `}`,
+	`{"a":"` + strings.Repeat("y", maxRespSize) + `"}`,
+	`{"system":{"get_sysinfo":{"alias":"\"}{"}}}`,
+	`["not", "an", "object"]`,
+	`{"system":`,
+	"{\"alias\":\"\xff\"}",
+	``,
+}
+
+func FuzzDecodeState(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		state, err := decodeState(context.Background(), b)
+		if err != nil {
+			return
+		}
+		if err := state.validate(); err != nil {
+			t.Errorf("decodeState accepted %q, giving a State that fails to validate: %v", b, err)
+		}
+		if err := checkJSON(b); err != nil {
+			t.Errorf("decodeState accepted %q, which checkJSON rejects: %v", b, err)
+		}
+	})
+}
+
+func FuzzCheckJSON(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if err := checkJSON(b); err != nil {
+			return
+		}
+		if len(b) > maxRespSize {
+			t.Errorf("checkJSON accepted %d bytes, more than the limit of %d", len(b), maxRespSize)
+		}
+		if depth := jsonDepth(b); depth > maxJSONDepth {
+			t.Errorf("checkJSON accepted %q, nested %d deep", b, depth)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Errorf("checkJSON accepted %q, which isn't a JSON object: %v", b, err)
+		}
+	})
+}
+
+// jsonDepth returns how deeply valid JSON is nested, by decoding it.
+func jsonDepth(b []byte) int {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	depth, max := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return max
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > max {
+				max = depth
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+func FuzzRelayResponse(f *testing.F) {
+	for _, s := range []string{
+		`{"system":{"set_relay_state":{"err_code":0}}}`,
+		`{"system":{"set_relay_state":{"err_code":0}},"count_down":{"delete_all_rules":{"err_code":0},"add_rule":{"id":"7E57","err_code":0}}}`,
+		`{"system":{"set_relay_state":{"err_code":-3,"err_msg":"invalid argument"}}}`,
+		`{}`,
+		`{"system":{}}`,
+		`{"system":{"set_relay_state":null}}`,
+		`{"system":{"set_relay_state":{"err_code":0}},"count_down":{}}`,
+	} {
+		f.Add([]byte(s), false)
+		f.Add([]byte(s), true)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, revert bool) {
+		if checkJSON(b) != nil {
+			return
+		}
+		var resp command
+		if json.Unmarshal(b, &resp) != nil {
+			return
+		}
+		resp.relayErr(revert) // mustn't panic
+	})
+}
+
+func TestRelayResponse(t *testing.T) {
+	for _, tc := range []struct {
+		resp   string
+		revert bool
+		ok     bool
+	}{
+		{`{"system":{"set_relay_state":{"err_code":0}}}`, false, true},
+		{`{"system":{"set_relay_state":{"err_code":0}},"count_down":{"add_rule":{"err_code":0}}}`, true, true},
+		{`{"system":{"set_relay_state":{"err_code":-10,"err_msg":"relay failure"}}}`, false, false},
+		{`{"system":{"set_relay_state":{"err_code":0}}}`, true, false},
+		{`{}`, false, false},
+		{`{"system":{}}`, false, false},
+	} {
+		var resp command
+		if err := json.Unmarshal([]byte(tc.resp), &resp); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", tc.resp, err)
+		}
+		if err := resp.relayErr(tc.revert); (err == nil) != tc.ok {
+			t.Errorf("relayErr(%t) of %s = %v, want ok = %t", tc.revert, tc.resp, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Package tpplugotel connects tpplug to OpenTelemetry tracing.
+
+It is a separate module so that the tpplug package itself
+does not depend on OpenTelemetry.
+*/
+package tpplugotel
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Tracer implements tpplug.Tracer by creating OpenTelemetry spans.
+type Tracer struct {
+	T trace.Tracer
+}
+
+func (t Tracer) Start(ctx context.Context, op string, addr *net.UDPAddr) (context.Context, func(error)) {
+	var attrs []attribute.KeyValue
+	if addr != nil {
+		attrs = append(attrs,
+			semconv.ServerAddress(addr.IP.String()),
+			semconv.ServerPort(addr.Port))
+	}
+	ctx, span := t.T.Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx, func(err error) { End(span, err) }
+}
+
+// End ends a span, recording err if it is non-nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Enabled reports whether the environment configures an OTLP endpoint.
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup configures OpenTelemetry tracing for the named service and
+// hooks up tpplug to it. Spans are exported over OTLP/HTTP,
+// configured by the standard OTEL_EXPORTER_OTLP_* environment variables.
+// If no endpoint is configured, Setup does nothing, so tracing is optional.
+//
+// The returned function flushes and stops the exporter,
+// and must be called before the program exits.
+func Setup(ctx context.Context, service string) (shutdown func(context.Context) error, err error) {
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tpplug.SetTracer(Tracer{T: tp.Tracer("github.com/dsymonds/tpplug/tpplug")})
+	return tp.Shutdown, nil
+}
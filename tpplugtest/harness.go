@@ -0,0 +1,222 @@
+/*
+Package tpplugtest runs emulated TP-Link smart plugs in-process,
+for end-to-end tests of programs built on package tpplug.
+
+Each plug answers get_sysinfo and get_realtime, honours set_relay_state,
+set_dev_alias and set_led_off, and keeps a countdown rule, which runs on
+the harness's virtual clock. Plugs may be power strips, whose outlets are
+acted on by requests with a context naming them, as from tpplug.WithChild.
+A Harness starts the plugs on loopback UDP ports (and the same TCP ports,
+for TCPOnly plugs), and a registry (see tpplug.RegistrySocket) listing them,
+so tpplug.Discover finds them without broadcasting. Scripted Events change the plugs' behaviour
+as the harness's virtual clock is advanced:
+
+	h := tpplugtest.New(t,
+		tpplugtest.PlugConfig{Alias: "Heater", Power: 2000},
+		tpplugtest.PlugConfig{Alias: "Pump", Power: 400},
+	)
+	h.Script(
+		tpplugtest.At(5*time.Minute, "Heater", tpplugtest.GoOffline),
+		tpplugtest.At(10*time.Minute, "Pump", tpplugtest.Malform),
+	)
+	err := h.Run(ctx, 20, time.Minute, s.evaluate)
+
+Collect and NewPromServer help with running the exporter's collector,
+and programs that read plug power from Prometheus, against the plugs.
+
+A Harness changes process-wide state (the registry environment variable
+and the tpplug packet budget), so tests using one must not run in parallel.
+*/
+package tpplugtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+// Harness is a set of emulated plugs with a virtual clock.
+type Harness struct {
+	tb    testing.TB
+	plugs []*Plug
+
+	mu      sync.Mutex
+	elapsed time.Duration
+	events  []Event // pending, sorted by At
+}
+
+// New starts a Harness with plugs described by cfgs.
+// It is shut down, and the process-wide state it changed restored,
+// when the test finishes.
+func New(tb testing.TB, cfgs ...PlugConfig) *Harness {
+	tb.Helper()
+	h := &Harness{tb: tb}
+	for i, cfg := range cfgs {
+		if cfg.Alias == "" {
+			cfg.Alias = fmt.Sprintf("Test plug %d", i+1)
+		}
+		if cfg.MAC == "" {
+			cfg.MAC = fmt.Sprintf("50:C7:BF:7E:57:%02X", i+1)
+		}
+		if cfg.Model == "" {
+			cfg.Model = "HS110(AU)"
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			tb.Fatalf("Listening for plug %q: %v", cfg.Alias, err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		p := &Plug{h: h, conn: conn, cfg: cfg, on: !cfg.Off}
+		for j, alias := range cfg.Children {
+			p.children = append(p.children, &child{id: fmt.Sprintf("%s%02d", p.deviceID(), j), alias: alias, on: !cfg.Off})
+		}
+		h.plugs = append(h.plugs, p)
+		go p.serve()
+		if cfg.TCPOnly {
+			l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: p.Addr().IP, Port: p.Addr().Port})
+			if err != nil {
+				tb.Fatalf("Listening over TCP for plug %q: %v", cfg.Alias, err)
+			}
+			tb.Cleanup(func() { l.Close() })
+			go p.serveTCP(l)
+		}
+	}
+
+	sock := filepath.Join(tb.TempDir(), "registry.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		tb.Fatalf("Listening for registry: %v", err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go tpplug.ServeRegistry(l, h.registryEntries)
+
+	old, had := os.LookupEnv(tpplug.RegistrySocketEnv)
+	os.Setenv(tpplug.RegistrySocketEnv, sock)
+	oldBudget := tpplug.CurrentBudget()
+	tpplug.SetBudget(tpplug.Budget{}) // tests may be much busier than a real network
+	tb.Cleanup(func() {
+		if had {
+			os.Setenv(tpplug.RegistrySocketEnv, old)
+		} else {
+			os.Unsetenv(tpplug.RegistrySocketEnv)
+		}
+		tpplug.SetBudget(oldBudget)
+	})
+	return h
+}
+
+func (h *Harness) registryEntries() []tpplug.RegistryEntry {
+	var es []tpplug.RegistryEntry
+	for _, p := range h.plugs {
+		es = append(es, tpplug.RegistryEntry{
+			Addr:     p.Addr().String(),
+			MAC:      p.MAC(),
+			Alias:    p.Alias(),
+			LastSeen: time.Now(),
+		})
+	}
+	return es
+}
+
+// Plugs returns all the plugs, in the order they were configured.
+func (h *Harness) Plugs() []*Plug { return h.plugs }
+
+// Plug returns the plug with the given alias, failing the test if there is none.
+func (h *Harness) Plug(alias string) *Plug {
+	h.tb.Helper()
+	for _, p := range h.plugs {
+		if p.Alias() == alias {
+			return p
+		}
+	}
+	h.tb.Fatalf("No plug with alias %q", alias)
+	return nil
+}
+
+// Elapsed returns the harness's virtual time since it started.
+func (h *Harness) Elapsed() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.elapsed
+}
+
+// An Event is a scripted change to a plug.
+type Event struct {
+	At    time.Duration // virtual time at which it happens
+	Alias string        // the plug it applies to
+	Do    func(*Plug)
+}
+
+// At returns an Event that calls do on the named plug at the given virtual time.
+func At(at time.Duration, alias string, do func(*Plug)) Event {
+	return Event{At: at, Alias: alias, Do: do}
+}
+
+// Things for Events to do.
+var (
+	GoOffline = func(p *Plug) { p.SetOffline(true) }
+	GoOnline  = func(p *Plug) { p.SetOffline(false) }
+	Malform   = func(p *Plug) { p.SetMalformed(true) }
+	Repair    = func(p *Plug) { p.SetMalformed(false); p.SetStuck(false) }
+	Stick     = func(p *Plug) { p.SetStuck(true) }
+)
+
+// DrawPower returns a function for an Event that changes a plug's constant draw.
+func DrawPower(w float64) func(*Plug) {
+	return func(p *Plug) { p.SetPower(w) }
+}
+
+// Script schedules events. Any that are already due happen immediately.
+func (h *Harness) Script(evs ...Event) {
+	h.tb.Helper()
+	for _, ev := range evs {
+		h.Plug(ev.Alias) // check it exists
+	}
+	h.mu.Lock()
+	h.events = append(h.events, evs...)
+	sort.SliceStable(h.events, func(i, j int) bool { return h.events[i].At < h.events[j].At })
+	h.mu.Unlock()
+	h.Advance(0)
+}
+
+// Advance moves the virtual clock forward by d, running any events,
+// and any of the plugs' countdown rules, that become due.
+func (h *Harness) Advance(d time.Duration) {
+	h.tb.Helper()
+	h.mu.Lock()
+	h.elapsed += d
+	var due []Event
+	for len(h.events) > 0 && h.events[0].At <= h.elapsed {
+		due = append(due, h.events[0])
+		h.events = h.events[1:]
+	}
+	h.mu.Unlock()
+
+	for _, ev := range due {
+		ev.Do(h.Plug(ev.Alias))
+	}
+	for _, p := range h.plugs {
+		p.tick(h.Elapsed())
+	}
+}
+
+// Run calls step n times, advancing the virtual clock by interval after each call,
+// as a program's control loop would run. It stops at the first error.
+func (h *Harness) Run(ctx context.Context, n int, interval time.Duration, step func(context.Context) error) error {
+	h.tb.Helper()
+	for i := 0; i < n; i++ {
+		if err := step(ctx); err != nil {
+			return fmt.Errorf("step %d (at %v): %w", i+1, h.Elapsed(), err)
+		}
+		h.Advance(interval)
+	}
+	return nil
+}
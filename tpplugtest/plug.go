@@ -0,0 +1,533 @@
+package tpplugtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dsymonds/tpplug/tpplug"
+)
+
+const voltage = 240.0 // V, nominal
+
+// PlugConfig describes an emulated plug.
+type PlugConfig struct {
+	Alias string
+	MAC   string // default 50:C7:BF:7E:57:NN
+	Model string // default HS110(AU)
+
+	// Power is the draw in W when the relay is on.
+	// If Curve is set, it is used instead, given the harness's elapsed time.
+	Power float64
+	Curve func(elapsed time.Duration) float64
+
+	Off bool // if true, the relay starts off
+
+	// Children makes the plug a power strip, such as an HS300, with outlets
+	// of these aliases. Each draws Power when on, and starts as Off says.
+	Children []string
+
+	// TCPOnly makes the plug answer over TCP, on the same port as it would
+	// over UDP, and ignore UDP, as some firmware does.
+	TCPOnly bool
+}
+
+// Plug is an emulated plug. Its behaviour may be changed at any time,
+// either directly or by a scripted Event.
+type Plug struct {
+	h    *Harness
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	cfg       PlugConfig
+	on        bool
+	offline   bool // ignore all requests
+	malformed bool // reply with truncated JSON
+	stuck     bool // fail to switch the relay
+	ledOff    bool
+	countdown *countdown // pending countdown rule, or nil
+	children  []*child   // outlets, if the plug is a power strip
+	requests  int
+}
+
+// child is an outlet of a power strip.
+type child struct {
+	id, alias string
+	on        bool
+}
+
+// countdown is a countdown rule, which runs on the harness's virtual clock.
+type countdown struct {
+	name  string
+	delay int // seconds
+	act   int
+	due   time.Duration // virtual time at which it switches the relay
+	child *child        // the outlet it switches, or nil for the plug's own relay
+}
+
+// Addr returns the address the plug listens on.
+func (p *Plug) Addr() *net.UDPAddr { return p.conn.LocalAddr().(*net.UDPAddr) }
+
+// Alias returns the plug's current alias.
+func (p *Plug) Alias() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg.Alias
+}
+
+// MAC returns the plug's MAC address.
+func (p *Plug) MAC() tpplug.MAC { return tpplug.CanonicalMAC(p.cfg.MAC) }
+
+// On reports whether the plug's relay is on.
+func (p *Plug) On() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on
+}
+
+// ChildOn reports whether the relay of the outlet with the given alias is on,
+// failing the test if the plug has no such outlet.
+func (p *Plug) ChildOn(alias string) bool {
+	p.h.tb.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.children {
+		if c.alias == alias {
+			return c.on
+		}
+	}
+	p.h.tb.Fatalf("Plug %q has no outlet %q", p.cfg.Alias, alias)
+	return false
+}
+
+// SetOn switches the plug's relay, as if by its button.
+func (p *Plug) SetOn(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.on = on
+}
+
+// Power returns the plug's current draw in W.
+func (p *Plug) Power() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.power()
+}
+
+// SetPower makes the plug draw a constant w Watts when on.
+func (p *Plug) SetPower(w float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg.Power, p.cfg.Curve = w, nil
+}
+
+// SetCurve makes the plug's draw when on follow a function of the harness's elapsed time.
+func (p *Plug) SetCurve(curve func(elapsed time.Duration) float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg.Curve = curve
+}
+
+// SetOffline sets whether the plug ignores all requests.
+func (p *Plug) SetOffline(offline bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offline = offline
+}
+
+// SetMalformed sets whether the plug replies with malformed JSON.
+func (p *Plug) SetMalformed(malformed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.malformed = malformed
+}
+
+// SetStuck sets whether attempts to switch the plug's relay fail.
+func (p *Plug) SetStuck(stuck bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stuck = stuck
+}
+
+// Countdown reports whether the plug has a pending countdown rule,
+// and if so, what it will switch the relay to, and how much virtual time is left.
+func (p *Plug) Countdown() (ok, on bool, left time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.countdown == nil {
+		return false, false, 0
+	}
+	return true, p.countdown.act == 1, p.countdown.due - p.h.Elapsed()
+}
+
+// tick runs any countdown rule that is due by the virtual time now.
+func (p *Plug) tick(now time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cd := p.countdown; cd != nil && cd.due <= now {
+		if cd.child != nil {
+			cd.child.on = cd.act == 1
+		} else {
+			p.on = cd.act == 1
+		}
+		p.countdown = nil
+	}
+}
+
+// Requests returns how many requests the plug has received, including ignored ones.
+func (p *Plug) Requests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+// power returns the current draw in W, of the outlets of cs if there are any,
+// or else of the whole plug. p.mu must be held.
+func (p *Plug) power(cs ...*child) float64 {
+	if len(cs) == 0 && len(p.children) > 0 {
+		cs = p.children
+	}
+	on := 0
+	for _, c := range cs {
+		if c.on {
+			on++
+		}
+	}
+	if len(cs) == 0 && p.on {
+		on = 1
+	}
+	if on == 0 {
+		return 0
+	}
+	if p.cfg.Curve != nil {
+		return float64(on) * p.cfg.Curve(p.h.Elapsed())
+	}
+	return float64(on) * p.cfg.Power
+}
+
+// deviceID returns the plug's device ID, made from its MAC.
+func (p *Plug) deviceID() string {
+	return "8006" + p.MAC().Compact()
+}
+
+func (p *Plug) serve() {
+	var scratch [4 << 10]byte
+	for {
+		n, raddr, err := p.conn.ReadFromUDP(scratch[:])
+		if err != nil {
+			return // closed
+		}
+		if p.cfg.TCPOnly {
+			p.ignore()
+			continue
+		}
+		req := append([]byte(nil), scratch[:n]...)
+		tpplug.Decrypt(req)
+		if resp := p.handle(req); resp != nil {
+			tpplug.Encrypt(resp)
+			p.conn.WriteToUDP(resp, raddr)
+		}
+	}
+}
+
+// serveTCP answers requests over TCP, for a TCPOnly plug.
+func (p *Plug) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return // closed
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			var hdr [4]byte
+			if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(hdr[:])
+			if n > 4<<10 {
+				return
+			}
+			req := make([]byte, n)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			tpplug.Decrypt(req)
+			resp := p.handle(req)
+			if resp == nil {
+				return
+			}
+			tpplug.Encrypt(resp)
+			msg := make([]byte, 4+len(resp))
+			binary.BigEndian.PutUint32(msg, uint32(len(resp)))
+			copy(msg[4:], resp)
+			conn.Write(msg)
+		}()
+	}
+}
+
+// ignore counts a request that the plug doesn't act on or answer.
+func (p *Plug) ignore() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+}
+
+// handle computes the response to a request, or nil for no response.
+func (p *Plug) handle(req []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	if p.offline {
+		return nil
+	}
+	var modules map[string]json.RawMessage
+	if err := json.Unmarshal(req, &modules); err != nil {
+		return nil // real plugs ignore garbage
+	}
+	// A context names the outlets of a power strip that the request acts on.
+	var cs []*child
+	if raw, ok := modules["context"]; ok {
+		delete(modules, "context")
+		var rc struct {
+			ChildIDs []string `json:"child_ids"`
+		}
+		if err := json.Unmarshal(raw, &rc); err != nil {
+			return nil
+		}
+		for _, id := range rc.ChildIDs {
+			c := p.child(id)
+			if c == nil {
+				b, _ := json.Marshal(map[string]interface{}{"context": errResult(-14, "invalid child id")})
+				return b
+			}
+			cs = append(cs, c)
+		}
+	}
+	resp := make(map[string]map[string]interface{})
+	for mod, raw := range modules {
+		// Real plugs run methods in the order given, which matters for count_down.
+		methods, err := orderedMethods(raw)
+		if err != nil {
+			return nil
+		}
+		out := make(map[string]interface{})
+		resp[mod] = out
+		for _, m := range methods {
+			switch mod {
+			case "system":
+				out[m.name] = p.system(m.name, m.arg, cs)
+			case "emeter":
+				out[m.name] = p.emeter(m.name, cs)
+			case "count_down":
+				out[m.name] = p.countDown(m.name, m.arg, cs)
+			default:
+				resp[mod] = errResult(-1, "module not support")
+			}
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil
+	}
+	if p.malformed {
+		b = b[:len(b)/2]
+	}
+	return b
+}
+
+type method struct {
+	name string
+	arg  json.RawMessage
+}
+
+// orderedMethods decodes a module's JSON object of methods, in the order they appear.
+func orderedMethods(raw json.RawMessage) ([]method, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("module is not an object")
+	}
+	var ms []method
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		m := method{name: tok.(string)} // keys of an object are always strings
+		if err := dec.Decode(&m.arg); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func errResult(code int, msg string) map[string]interface{} {
+	return map[string]interface{}{"err_code": code, "err_msg": msg}
+}
+
+var okResult = map[string]interface{}{"err_code": 0}
+
+// child returns the outlet with the given ID, or nil.
+func (p *Plug) child(id string) *child {
+	for _, c := range p.children {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// system handles the system module, acting on the outlets cs if there are any.
+// Like real power strips, it gives the system information of the whole plug regardless.
+func (p *Plug) system(method string, arg json.RawMessage, cs []*child) interface{} {
+	switch method {
+	case "get_sysinfo":
+		info := map[string]interface{}{
+			"sw_ver":      "1.0.0 Build 000000 Rel.000000",
+			"hw_ver":      "2.0",
+			"type":        "IOT.SMARTPLUGSWITCH",
+			"model":       p.cfg.Model,
+			"mac":         p.cfg.MAC,
+			"alias":       p.cfg.Alias,
+			"deviceId":    p.deviceID(),
+			"relay_state": boolInt(p.on),
+			"active_mode": p.activeMode(),
+			"led_off":     boolInt(p.ledOff),
+			"rssi":        -50,
+			"err_code":    0,
+		}
+		if len(p.children) > 0 {
+			var children []interface{}
+			for _, c := range p.children {
+				children = append(children, map[string]interface{}{
+					"id":    c.id,
+					"alias": c.alias,
+					"state": boolInt(c.on),
+				})
+			}
+			delete(info, "relay_state") // each outlet has its own
+			info["child_num"], info["children"] = len(children), children
+		}
+		return info
+	case "set_relay_state":
+		var a struct {
+			State *int `json:"state"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.State == nil {
+			return errResult(-3, "invalid argument")
+		}
+		if p.stuck {
+			return errResult(-10, "relay failure")
+		}
+		for _, c := range cs {
+			c.on = *a.State == 1
+		}
+		if len(cs) == 0 {
+			p.on = *a.State == 1
+		}
+		return okResult
+	case "set_dev_alias":
+		var a struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Alias == "" {
+			return errResult(-3, "invalid argument")
+		}
+		p.cfg.Alias = a.Alias
+		return okResult
+	case "set_led_off":
+		var a struct {
+			Off *int `json:"off"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Off == nil {
+			return errResult(-3, "invalid argument")
+		}
+		p.ledOff = *a.Off == 1
+		return okResult
+	}
+	return errResult(-2, "member not support")
+}
+
+func (p *Plug) activeMode() string {
+	if p.countdown != nil {
+		return "count_down"
+	}
+	return "none"
+}
+
+// countDown handles the count_down module. Like real plugs, it permits one rule at a time.
+// A rule added with outlets named switches the first of them.
+func (p *Plug) countDown(method string, arg json.RawMessage, cs []*child) interface{} {
+	switch method {
+	case "get_rules":
+		rules := []interface{}{}
+		if cd := p.countdown; cd != nil {
+			remain := (cd.due - p.h.Elapsed() + time.Second - 1) / time.Second
+			rules = append(rules, map[string]interface{}{
+				"id":     "7E5700000000000000000000000000",
+				"name":   cd.name,
+				"enable": 1,
+				"delay":  cd.delay,
+				"act":    cd.act,
+				"remain": int(remain),
+			})
+		}
+		return map[string]interface{}{"rule_list": rules, "err_code": 0}
+	case "add_rule":
+		var a struct {
+			Name   string `json:"name"`
+			Enable int    `json:"enable"`
+			Delay  int    `json:"delay"`
+			Act    *int   `json:"act"`
+		}
+		if err := json.Unmarshal(arg, &a); err != nil || a.Delay <= 0 || a.Act == nil || (*a.Act != 0 && *a.Act != 1) {
+			return errResult(-3, "invalid argument")
+		}
+		if p.countdown != nil {
+			return errResult(-10, "table is full")
+		}
+		if a.Enable == 1 {
+			p.countdown = &countdown{
+				name:  a.Name,
+				delay: a.Delay,
+				act:   *a.Act,
+				due:   p.h.Elapsed() + time.Duration(a.Delay)*time.Second,
+			}
+			if len(cs) > 0 {
+				p.countdown.child = cs[0]
+			}
+		}
+		return map[string]interface{}{"id": "7E5700000000000000000000000000", "err_code": 0}
+	case "delete_all_rules":
+		p.countdown = nil
+		return okResult
+	}
+	return errResult(-2, "member not support")
+}
+
+// emeter handles the emeter module, measuring the outlets cs if there are any.
+func (p *Plug) emeter(method string, cs []*child) interface{} {
+	if method != "get_realtime" {
+		return errResult(-2, "member not support")
+	}
+	w := p.power(cs...)
+	return map[string]interface{}{
+		"voltage_mv": int(voltage * 1000),
+		"current_ma": int(w / voltage * 1000),
+		"power_mw":   int(w * 1000),
+		"err_code":   0,
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package tpplugtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Sample is a single labelled value.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Collect gathers the metrics from a Prometheus collector, such as the exporter's,
+// sorted by name and then labels.
+func Collect(c prometheus.Collector) ([]Sample, error) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var ss []Sample
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			s := Sample{Name: mf.GetName(), Labels: make(map[string]string)}
+			for _, lp := range m.GetLabel() {
+				s.Labels[lp.GetName()] = lp.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				s.Value = m.Gauge.GetValue()
+			case m.Counter != nil:
+				s.Value = m.Counter.GetValue()
+			case m.Untyped != nil:
+				s.Value = m.Untyped.GetValue()
+			default:
+				continue // histograms and summaries aren't interesting here
+			}
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+// PowerSamples returns the current draw of each responsive plug as a power_w
+// sample in Watts, labelled with job="tpplug", name and mac,
+// which is the form solarctrl expects from its plug query.
+func (h *Harness) PowerSamples() []Sample {
+	var ss []Sample
+	for _, p := range h.plugs {
+		p.mu.Lock()
+		if !p.offline {
+			ss = append(ss, Sample{
+				Name:   "power_w",
+				Labels: map[string]string{"job": "tpplug", "name": p.cfg.Alias, "mac": p.cfg.MAC},
+				Value:  p.power(),
+			})
+		}
+		p.mu.Unlock()
+	}
+	return ss
+}
+
+// NewPromServer starts a fake Prometheus server answering instant queries
+// (/api/v1/query) with the vectors returned by eval.
+// It is shut down when the test finishes.
+func NewPromServer(tb testing.TB, eval func(query string) ([]Sample, error)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		ss, err := eval(r.FormValue("query"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":    "error",
+				"errorType": "bad_data",
+				"error":     err.Error(),
+			})
+			return
+		}
+		type result struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		}
+		now := float64(time.Now().UnixNano()) / 1e9
+		results := []result{}
+		for _, s := range ss {
+			m := map[string]string{}
+			if s.Name != "" {
+				m["__name__"] = s.Name
+			}
+			for k, v := range s.Labels {
+				m[k] = v
+			}
+			results = append(results, result{
+				Metric: m,
+				Value:  [2]interface{}{now, strconv.FormatFloat(s.Value, 'g', -1, 64)},
+			})
+		}
+		sort.Slice(results, func(i, j int) bool { return fmt.Sprint(results[i].Metric) < fmt.Sprint(results[j].Metric) })
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     results,
+			},
+		})
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}